@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// codec is a compression format for backend object bodies.
+//
+// Every object is stored with its codec name as its encoding, and GETs decode
+// according to the stored encoding rather than the local -compression setting.
+// That lets instances with different settings share a backend. Objects written
+// before encodings were recorded have an empty encoding; for those the codec
+// is detected from the body itself, since every LZ4 and zstd frame starts with
+// a magic number.
+type codec int
+
+const (
+	codecNone codec = iota
+	codecLZ4
+	codecZstd
+)
+
+var (
+	lz4FrameMagic  = []byte{0x04, 0x22, 0x4d, 0x18}
+	zstdFrameMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// String returns the codec name as used by -compression.
+func (c codec) String() string {
+	switch c {
+	case codecLZ4:
+		return "lz4"
+	case codecZstd:
+		return "zstd"
+	default:
+		return "none"
+	}
+}
+
+// errUnknownEncoding is returned for objects stored with an encoding this
+// version doesn't know, e.g. one written by a newer version.
+var errUnknownEncoding = errors.New("unknown encoding")
+
+// parseEncoding returns the codec named by a stored object encoding.
+func parseEncoding(encoding string) (codec, error) {
+	switch encoding {
+	case "none":
+		return codecNone, nil
+	case "lz4":
+		return codecLZ4, nil
+	case "zstd":
+		return codecZstd, nil
+	default:
+		return codecNone, fmt.Errorf("%w %q", errUnknownEncoding, encoding)
+	}
+}
+
+// sniffCodec detects the codec of a body from its first bytes.
+func sniffCodec(head []byte) codec {
+	magic := head[:min(len(head), len(lz4FrameMagic))]
+	switch {
+	case bytes.Equal(magic, lz4FrameMagic):
+		return codecLZ4
+	case bytes.Equal(magic, zstdFrameMagic):
+		return codecZstd
+	default:
+		return codecNone
+	}
+}
+
+// autoMinSavings is the fraction of a payload that auto compression has to
+// save for the compressed body to be stored. Anything less isn't worth the
+// decompression cost on every GET.
+const autoMinSavings = 0.1
+
+// compressionConfig is the parsed -compression setting used for PUTs.
+type compressionConfig struct {
+	codec codec
+	// auto stores payloads that don't compress by at least autoMinSavings
+	// uncompressed.
+	auto bool
+	// level is the zstd compression level (1-22); 0 uses the default.
+	level int
+}
+
+// parseCompression parses a -compression mode and -compression-level. The mode
+// is one of lz4, zstd, auto (zstd, skipping incompressible payloads) or none.
+// The old boolean values are still accepted: true, 1 and yes mean lz4, and
+// false, 0 and no mean none.
+func parseCompression(mode string, level int) (compressionConfig, error) {
+	if level < 0 || level > 22 {
+		return compressionConfig{}, fmt.Errorf("invalid compression level %d: must be between 1 and 22, or 0 for the default", level)
+	}
+
+	config := compressionConfig{level: level}
+	switch strings.ToLower(mode) {
+	case "lz4", "true", "1", "yes":
+		config.codec = codecLZ4
+	case "zstd":
+		config.codec = codecZstd
+	case "auto":
+		config.codec = codecZstd
+		config.auto = true
+	case "none", "false", "0", "no", "":
+		config.codec = codecNone
+	default:
+		return compressionConfig{}, fmt.Errorf("invalid compression %q: must be lz4, zstd, auto or none", mode)
+	}
+	return config, nil
+}
+
+// enabled reports whether PUTs compress at all.
+func (c compressionConfig) enabled() bool {
+	return c.codec != codecNone
+}
+
+// String returns the setting as it would be passed to -compression.
+func (c compressionConfig) String() string {
+	name := c.codec.String()
+	if c.auto {
+		name = "auto"
+	}
+	if c.level != 0 && c.codec == codecZstd {
+		name += fmt.Sprintf(" (level %d)", c.level)
+	}
+	return name
+}
+
+// worthCompressing reports whether a payload of size bytes that compressed to
+// compressedSize bytes should be stored compressed in auto mode.
+func worthCompressing(size, compressedSize int64) bool {
+	return float64(compressedSize) <= float64(size)*(1-autoMinSavings)
+}
+
+// hasFrameMagic reports whether r starts with the magic number of a compressed
+// frame. Stored uncompressed, such a body would be mistaken for a compressed
+// one by versions that detect the codec from the body.
+func hasFrameMagic(r io.ReaderAt) bool {
+	magic := make([]byte, len(lz4FrameMagic))
+	if _, err := r.ReadAt(magic, 0); err != nil {
+		return false
+	}
+	return bytes.Equal(magic, lz4FrameMagic) || bytes.Equal(magic, zstdFrameMagic)
+}
+
+// compressTo compresses everything read from src into dst with c. level and
+// zstdDict (a dictionary trained by train-dict, or nil) only apply to zstd.
+func compressTo(dst io.Writer, src io.Reader, c codec, level int, zstdDict []byte) error {
+	var writer io.WriteCloser
+	switch c {
+	case codecLZ4:
+		writer = lz4.NewWriter(dst)
+	case codecZstd:
+		encoderLevel := zstd.SpeedDefault
+		if level != 0 {
+			encoderLevel = zstd.EncoderLevelFromZstd(level)
+		}
+		opts := []zstd.EOption{zstd.WithEncoderLevel(encoderLevel), zstd.WithEncoderConcurrency(1)}
+		if zstdDict != nil {
+			opts = append(opts, zstd.WithEncoderDict(zstdDict))
+		}
+		zw, err := zstd.NewWriter(dst, opts...)
+		if err != nil {
+			return fmt.Errorf("failed to create zstd compressor: %w", err)
+		}
+		writer = zw
+	default:
+		return fmt.Errorf("codec %s does not compress", c)
+	}
+
+	if _, err := io.Copy(writer, src); err != nil {
+		writer.Close()
+		return fmt.Errorf("failed to write to %s compressor: %w", c, err)
+	}
+
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to close %s compressor: %w", c, err)
+	}
+
+	return nil
+}
+
+// newDecodingReader returns a reader of the decompressed data of a backend
+// object body stored with encoding. If encoding is empty, the codec is
+// detected from the body's first bytes, and bodies that don't start with a
+// known frame magic number are returned as they are. zstd frames that were
+// compressed with a dictionary look it up by ID with getDict, which may be nil
+// if no dictionaries are available. Closing the returned reader releases the
+// decompressor; it doesn't close body.
+func newDecodingReader(body io.Reader, encoding string, getDict func(id uint32) ([]byte, error)) (io.ReadCloser, codec, error) {
+	br := bufio.NewReader(body)
+	// A read error here is returned again by the next read, so it isn't lost.
+	head, _ := br.Peek(zstd.HeaderMaxSize)
+
+	c := sniffCodec(head)
+	if encoding != "" {
+		var err error
+		if c, err = parseEncoding(encoding); err != nil {
+			return nil, codecNone, err
+		}
+	}
+
+	switch c {
+	case codecLZ4:
+		return io.NopCloser(&drainAfter{r: lz4.NewReader(br), src: br}), codecLZ4, nil
+	case codecZstd:
+		opts := []zstd.DOption{zstd.WithDecoderConcurrency(1)}
+		var header zstd.Header
+		if err := header.Decode(head); err == nil && header.DictionaryID != 0 {
+			if getDict == nil {
+				return nil, codecZstd, fmt.Errorf("%w %08x", errUnknownDict, header.DictionaryID)
+			}
+			zstdDict, err := getDict(header.DictionaryID)
+			if err != nil {
+				return nil, codecZstd, err
+			}
+			opts = append(opts, zstd.WithDecoderDicts(zstdDict))
+		}
+		decoder, err := zstd.NewReader(br, opts...)
+		if err != nil {
+			return nil, codecZstd, fmt.Errorf("failed to create zstd decompressor: %w", err)
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{&drainAfter{r: decoder, src: br}, decoder.IOReadCloser()}, codecZstd, nil
+	default:
+		return io.NopCloser(br), codecNone, nil
+	}
+}
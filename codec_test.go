@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"testing"
+)
+
+func TestParseCompression(t *testing.T) {
+	tests := []struct {
+		mode  string
+		level int
+		want  compressionConfig
+	}{
+		{"lz4", 0, compressionConfig{codec: codecLZ4}},
+		{"true", 0, compressionConfig{codec: codecLZ4}},
+		{"1", 0, compressionConfig{codec: codecLZ4}},
+		{"yes", 0, compressionConfig{codec: codecLZ4}},
+		{"ZSTD", 19, compressionConfig{codec: codecZstd, level: 19}},
+		{"auto", 0, compressionConfig{codec: codecZstd, auto: true}},
+		{"none", 0, compressionConfig{codec: codecNone}},
+		{"false", 0, compressionConfig{codec: codecNone}},
+		{"0", 0, compressionConfig{codec: codecNone}},
+		{"no", 0, compressionConfig{codec: codecNone}},
+		{"", 0, compressionConfig{codec: codecNone}},
+	}
+	for _, tt := range tests {
+		got, err := parseCompression(tt.mode, tt.level)
+		if err != nil {
+			t.Fatalf("parseCompression(%q, %d) failed: %v", tt.mode, tt.level, err)
+		}
+		if got != tt.want {
+			t.Fatalf("parseCompression(%q, %d) = %+v, want %+v", tt.mode, tt.level, got, tt.want)
+		}
+	}
+
+	for _, mode := range []string{"gzip", "2"} {
+		if _, err := parseCompression(mode, 0); err == nil {
+			t.Fatalf("expected error for compression %q", mode)
+		}
+	}
+	if _, err := parseCompression("zstd", 23); err == nil {
+		t.Fatal("expected error for compression level 23")
+	}
+}
+
+func TestCompressionFlag(t *testing.T) {
+	tests := []struct {
+		args []string
+		want codec
+	}{
+		{nil, codecZstd},
+		{[]string{"-compression"}, codecLZ4},
+		{[]string{"-compression=false"}, codecNone},
+		{[]string{"-compression=auto"}, codecZstd},
+	}
+	for _, tt := range tests {
+		flags := flag.NewFlagSet("test", flag.ContinueOnError)
+		mode := compressionFlag("zstd")
+		flags.Var(&mode, "compression", "")
+		if err := flags.Parse(tt.args); err != nil {
+			t.Fatalf("%v: unexpected parse error: %v", tt.args, err)
+		}
+		config, err := parseCompression(string(mode), 0)
+		if err != nil || config.codec != tt.want {
+			t.Fatalf("%v: got %+v (err=%v), want codec %v", tt.args, config, err, tt.want)
+		}
+	}
+
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	var mode compressionFlag
+	flags.Var(&mode, "compression", "")
+	if err := flags.Parse([]string{"-compression=gzip"}); err == nil {
+		t.Fatal("expected error for -compression=gzip")
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	expected := bytes.Repeat([]byte("round trip "), 50000)
+	for _, c := range []codec{codecLZ4, codecZstd} {
+		for _, level := range []int{0, 1, 19} {
+			var compressed bytes.Buffer
+			if err := compressTo(&compressed, bytes.NewReader(expected), c, level, nil); err != nil {
+				t.Fatalf("%s: failed to compress: %v", c, err)
+			}
+			if compressed.Len() >= len(expected) {
+				t.Fatalf("%s: expected compression, got %d bytes", c, compressed.Len())
+			}
+
+			reader, detected, err := newDecodingReader(&compressed, c.String(), nil)
+			if err != nil {
+				t.Fatalf("%s: failed to create reader: %v", c, err)
+			}
+			got, err := io.ReadAll(reader)
+			reader.Close()
+			if err != nil {
+				t.Fatalf("%s: failed to decompress: %v", c, err)
+			}
+			if detected != c || !bytes.Equal(got, expected) {
+				t.Fatalf("%s level %d: detected %s, body matches=%v", c, level, detected, bytes.Equal(got, expected))
+			}
+		}
+	}
+}
+
+func TestNewDecodingReaderPassesThroughRawBodies(t *testing.T) {
+	for _, body := range []string{"", "ab", "plain build output"} {
+		reader, detected, err := newDecodingReader(bytes.NewReader([]byte(body)), "", nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		got, err := io.ReadAll(reader)
+		if err != nil || detected != codecNone || string(got) != body {
+			t.Fatalf("expected raw %q, got %q (codec %s, err %v)", body, got, detected, err)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+	"github.com/richardartoul/gobuildcache/pkg/backends"
+)
+
+// Trained zstd dictionaries are stored in the backend next to the objects they
+// compress: every dictionary under its own ID, and the one new PUTs should use
+// under dictCurrentKey as well. zstd frames record the ID of the dictionary
+// they were compressed with, so objects written with an older dictionary stay
+// decodable for as long as that dictionary is kept. Trim never deletes them.
+const (
+	dictKeyPrefix  = "dict/"
+	dictCurrentKey = dictKeyPrefix + "current"
+
+	// dictSampleSize is how much of each entry train-dict samples. Only the
+	// start of each sample matters to the dictionary builder.
+	dictSampleSize = 64 << 10
+	// defaultDictSize is the zstd command line's default dictionary size.
+	defaultDictSize = 110 << 10
+	// dictMissTTL is how long a dictionary the backend didn't have is taken
+	// to be missing, so that a burst of objects compressed with it costs a
+	// single fetch but a dictionary stored later is still found.
+	dictMissTTL = time.Minute
+)
+
+// errUnknownDict is returned when decoding an object compressed with a
+// dictionary that isn't in the backend any more.
+var errUnknownDict = errors.New("unknown compression dictionary")
+
+// dictKey returns the backend key of the dictionary with the given ID.
+func dictKey(id uint32) []byte {
+	return []byte(fmt.Sprintf("%s%08x", dictKeyPrefix, id))
+}
+
+// dictID returns the ID of a zstd dictionary.
+func dictID(d []byte) (uint32, error) {
+	info, err := zstd.InspectDictionary(d)
+	if err != nil {
+		return 0, fmt.Errorf("invalid zstd dictionary: %w", err)
+	}
+	return info.ID(), nil
+}
+
+// dictionaries holds the zstd dictionaries loaded from the backend. The
+// current dictionary is loaded once in the background at startup; older ones
+// are fetched the first time an object needs them.
+type dictionaries struct {
+	backend backends.Backend
+	logger  *slog.Logger
+	loaded  chan struct{} // Closed once loadCurrent has finished
+
+	mu      sync.Mutex
+	current []byte
+	byID    map[uint32][]byte
+	missed  map[uint32]time.Time // When the backend last didn't have a dictionary
+}
+
+func newDictionaries(backend backends.Backend, logger *slog.Logger) *dictionaries {
+	return &dictionaries{
+		backend: backend,
+		logger:  logger,
+		loaded:  make(chan struct{}),
+		byID:    make(map[uint32][]byte),
+		missed:  make(map[uint32]time.Time),
+	}
+}
+
+// loadCurrent loads the current dictionary, if train-dict has stored one. If
+// touch is true, the dictionary objects are touched so that lifecycle policies
+// don't expire them while they're in use.
+func (d *dictionaries) loadCurrent(ctx context.Context, touch bool) {
+	defer close(d.loaded)
+
+	current, err := d.fetch(ctx, []byte(dictCurrentKey))
+	if err != nil {
+		d.logger.Warn("failed to load compression dictionary, compressing without one", "error", err)
+		return
+	}
+	if current == nil {
+		return
+	}
+	id, err := dictID(current)
+	if err != nil {
+		d.logger.Warn("failed to load compression dictionary, compressing without one", "error", err)
+		return
+	}
+
+	d.mu.Lock()
+	d.current = current
+	d.byID[id] = current
+	d.mu.Unlock()
+	d.logger.Debug("loaded compression dictionary", "id", id, "size", len(current))
+
+	if touch {
+		for _, key := range [][]byte{[]byte(dictCurrentKey), dictKey(id)} {
+			if err := d.backend.Touch(ctx, key); err != nil && !errors.Is(err, backends.ErrTouchSkipped) {
+				d.logger.Warn("failed to touch compression dictionary", "error", err)
+			}
+		}
+	}
+}
+
+// forPut returns the dictionary new objects should be compressed with, or nil
+// if there is none (yet).
+func (d *dictionaries) forPut() []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.current
+}
+
+// currentID returns the ID of the current dictionary, or 0 if there is none.
+func (d *dictionaries) currentID() uint32 {
+	current := d.forPut()
+	if current == nil {
+		return 0
+	}
+	id, _ := dictID(current)
+	return id
+}
+
+// get returns the dictionary with the given ID, fetching it from the backend
+// if it hasn't been loaded yet. A dictionary the backend didn't have isn't
+// fetched again for dictMissTTL.
+func (d *dictionaries) get(ctx context.Context, id uint32) ([]byte, error) {
+	d.mu.Lock()
+	cached, ok := d.byID[id]
+	missedAt, missed := d.missed[id]
+	d.mu.Unlock()
+	if ok {
+		return cached, nil
+	}
+	if missed && time.Since(missedAt) < dictMissTTL {
+		return nil, fmt.Errorf("%w %08x", errUnknownDict, id)
+	}
+
+	fetched, err := d.fetch(ctx, dictKey(id))
+	if err != nil {
+		// Not cached, so the next object that needs it tries again.
+		return nil, err
+	}
+	if fetched != nil {
+		if fetchedID, err := dictID(fetched); err != nil || fetchedID != id {
+			return nil, fmt.Errorf("dictionary %08x is invalid or has the wrong ID", id)
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if fetched == nil {
+		d.missed[id] = time.Now()
+		return nil, fmt.Errorf("%w %08x", errUnknownDict, id)
+	}
+	d.byID[id] = fetched
+	delete(d.missed, id)
+	return fetched, nil
+}
+
+// fetch reads a dictionary object from the backend, returning nil if it
+// doesn't exist.
+func (d *dictionaries) fetch(ctx context.Context, key []byte) ([]byte, error) {
+	_, body, _, _, _, miss, err := d.backend.Get(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %w", key, err)
+	}
+	if miss {
+		return nil, nil
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	return data, nil
+}
+
+// storeDict uploads a trained dictionary under its ID and then makes it the
+// current dictionary, in that order, so that every object compressed with it
+// can find it. It returns the dictionary's ID.
+func storeDict(ctx context.Context, backend backends.Backend, d []byte) (uint32, error) {
+	id, err := dictID(d)
+	if err != nil {
+		return 0, err
+	}
+	sum := sha256.Sum256(d)
+	for _, key := range [][]byte{dictKey(id), []byte(dictCurrentKey)} {
+		if err := backend.Put(ctx, key, sum[:], codecNone.String(), bytes.NewReader(d), int64(len(d))); err != nil {
+			return 0, fmt.Errorf("failed to store %s: %w", key, err)
+		}
+	}
+	return id, nil
+}
+
+// trainDict trains a zstd dictionary of at most maxSize bytes on the start of
+// up to samples randomly chosen local cache entries. It returns the dictionary
+// and the samples it was trained on.
+func trainDict(lc *localCache, samples, maxSize int) ([]byte, [][]byte, error) {
+	entries, _, err := lc.scanEntries()
+	if err != nil {
+		return nil, nil, err
+	}
+	rand.Shuffle(len(entries), func(i, j int) {
+		entries[i], entries[j] = entries[j], entries[i]
+	})
+
+	var (
+		inputs [][]byte
+		seen   = make(map[[sha256.Size]byte]bool)
+	)
+	for _, entry := range entries {
+		if len(inputs) >= samples {
+			break
+		}
+		if entry.actionID == nil || entry.blob {
+			continue
+		}
+		sample, err := readSample(entry.dataPath)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue // Evicted since the scan.
+			}
+			return nil, nil, err
+		}
+		// Identical outputs would skew the dictionary towards them.
+		sum := sha256.Sum256(sample)
+		if len(sample) < 8 || seen[sum] {
+			continue
+		}
+		seen[sum] = true
+		inputs = append(inputs, sample)
+	}
+	if len(inputs) == 0 {
+		return nil, nil, fmt.Errorf("no local cache entries to sample in %s", lc.cacheDir)
+	}
+
+	d, err := dict.BuildZstdDict(inputs, dict.Options{
+		MaxDictSize: maxSize,
+		HashBytes:   6,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to build dictionary from %d samples: %w", len(inputs), err)
+	}
+	return d, inputs, nil
+}
+
+// readSample reads up to dictSampleSize bytes from the start of path.
+func readSample(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(io.LimitReader(file, dictSampleSize))
+}
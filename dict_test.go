@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/richardartoul/gobuildcache/pkg/backends"
+	"github.com/richardartoul/gobuildcache/pkg/locking"
+)
+
+// writeDictTrainingEntries fills lc with entries that share a lot of structure,
+// like compile outputs of related packages do.
+func writeDictTrainingEntries(t *testing.T, lc *localCache, n int) {
+	t.Helper()
+	rng := rand.New(rand.NewSource(1))
+	for i := range n {
+		var body bytes.Buffer
+		for j := range 200 {
+			fmt.Fprintf(&body, "go object linux amd64 go1.25 X:%d\npackage pkg%d\nfunc Func%d(ctx context.Context, req *Request) (*Response, error)\n",
+				rng.Intn(1000), i, j)
+		}
+		meta := localCacheMetadata{OutputID: []byte("out"), Size: int64(body.Len()), PutTime: time.Now()}
+		if _, _, err := lc.writeWithMetadata([]byte{byte(i), 0xdd}, &body, meta); err != nil {
+			t.Fatalf("failed to write entry: %v", err)
+		}
+	}
+}
+
+func trainTestDict(t *testing.T, backend backends.Backend) []byte {
+	t.Helper()
+	lc, err := newLocalCache(t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("failed to create local cache: %v", err)
+	}
+	writeDictTrainingEntries(t, lc, 50)
+	trained, samples, err := trainDict(lc, 1000, defaultDictSize)
+	if err != nil {
+		t.Fatalf("failed to train dictionary: %v", err)
+	}
+	if len(samples) != 50 {
+		t.Fatalf("expected 50 samples, got %d", len(samples))
+	}
+	if _, err := storeDict(t.Context(), backend, trained); err != nil {
+		t.Fatalf("failed to store dictionary: %v", err)
+	}
+	return trained
+}
+
+func TestTrainDictRoundTrip(t *testing.T) {
+	fs, err := backends.NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	trained := trainTestDict(t, fs)
+	id, err := dictID(trained)
+	if err != nil {
+		t.Fatalf("invalid dictionary: %v", err)
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	writerDicts := newDictionaries(fs, logger)
+	writerDicts.loadCurrent(t.Context(), false)
+	if writerDicts.currentID() != id {
+		t.Fatalf("expected current dictionary %08x, got %08x", id, writerDicts.currentID())
+	}
+
+	expected := []byte("go object linux amd64 go1.25 X:42\npackage main\nfunc Func1(ctx context.Context, req *Request) (*Response, error)\n")
+	var plain, compressed bytes.Buffer
+	if err := compressTo(&plain, bytes.NewReader(expected), codecZstd, 0, nil); err != nil {
+		t.Fatalf("failed to compress: %v", err)
+	}
+	if err := compressTo(&compressed, bytes.NewReader(expected), codecZstd, 0, writerDicts.forPut()); err != nil {
+		t.Fatalf("failed to compress: %v", err)
+	}
+	if compressed.Len() >= plain.Len() {
+		t.Fatalf("expected the dictionary to help: %d bytes with it, %d without", compressed.Len(), plain.Len())
+	}
+
+	// A reader that hasn't loaded the dictionary fetches it by ID.
+	readerDicts := newDictionaries(fs, logger)
+	getDict := func(id uint32) ([]byte, error) { return readerDicts.get(t.Context(), id) }
+	reader, _, err := newDecodingReader(bytes.NewReader(compressed.Bytes()), "zstd", getDict)
+	if err != nil {
+		t.Fatalf("failed to create reader: %v", err)
+	}
+	got, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil || !bytes.Equal(got, expected) {
+		t.Fatalf("round trip failed: err=%v body=%q", err, got)
+	}
+
+	// Without dictionaries, the frame can't be decoded.
+	if _, _, err := newDecodingReader(bytes.NewReader(compressed.Bytes()), "zstd", nil); err == nil {
+		t.Fatal("expected error decoding without dictionaries")
+	}
+}
+
+func TestHandleGetUnknownDictionaryIsMiss(t *testing.T) {
+	fs, err := backends.NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	trained := trainTestDict(t, fs)
+	id, _ := dictID(trained)
+
+	writer, err := NewCacheProg(fs, locking.NewMemLock(), t.TempDir(),
+		CacheProgOptions{Compression: "zstd", CompressionDict: true})
+	if err != nil {
+		t.Fatalf("failed to create cache prog: %v", err)
+	}
+	writer.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	<-writer.dicts.loaded
+	body := bytes.Repeat([]byte("package pkg1\nfunc Func1(ctx context.Context, req *Request) (*Response, error)\n"), 100)
+	if _, err := writer.handlePut(&Request{
+		ID:       1,
+		Command:  CmdPut,
+		ActionID: []byte{0x01, 0x02},
+		OutputID: []byte{0x03},
+		Body:     bytes.NewReader(body),
+		BodySize: int64(len(body)),
+	}); err != nil {
+		t.Fatalf("handlePut failed: %v", err)
+	}
+
+	_, stored, _, _, _, _, err := fs.Get(t.Context(), writer.generateBackendKey([]byte{0x01, 0x02}))
+	if err != nil {
+		t.Fatalf("failed to get stored object: %v", err)
+	}
+	var header zstd.Header
+	storedData, _ := io.ReadAll(stored)
+	stored.Close()
+	if err := header.Decode(storedData); err != nil || header.DictionaryID != id {
+		t.Fatalf("expected object compressed with dictionary %08x, got %08x (err %v)", id, header.DictionaryID, err)
+	}
+
+	// Readers fetch the dictionary whatever their own compression setting.
+	reader, err := NewCacheProg(fs, locking.NewMemLock(), t.TempDir(), CacheProgOptions{Compression: "lz4"})
+	if err != nil {
+		t.Fatalf("failed to create cache prog: %v", err)
+	}
+	reader.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	resp, err := reader.handleGet(&Request{ID: 2, Command: CmdGet, ActionID: []byte{0x01, 0x02}})
+	if err != nil || resp.Miss {
+		t.Fatalf("expected backend hit, miss=%v err=%v", resp.Miss, err)
+	}
+	if got, _ := os.ReadFile(resp.DiskPath); !bytes.Equal(got, body) {
+		t.Fatal("backend round trip does not match body")
+	}
+
+	// Once the dictionary is gone, objects compressed with it are misses.
+	if err := fs.Clear(t.Context()); err != nil {
+		t.Fatalf("failed to clear: %v", err)
+	}
+	var compressed bytes.Buffer
+	if err := compressTo(&compressed, bytes.NewReader(body), codecZstd, 0, trained); err != nil {
+		t.Fatalf("failed to compress: %v", err)
+	}
+	if err := fs.Put(t.Context(), writer.generateBackendKey([]byte{0x01, 0x02}), []byte{0x03}, "zstd", bytes.NewReader(compressed.Bytes()), int64(compressed.Len())); err != nil {
+		t.Fatalf("failed to put: %v", err)
+	}
+	reader, err = NewCacheProg(fs, locking.NewMemLock(), t.TempDir(), CacheProgOptions{})
+	if err != nil {
+		t.Fatalf("failed to create cache prog: %v", err)
+	}
+	reader.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	resp, err = reader.handleGet(&Request{ID: 3, Command: CmdGet, ActionID: []byte{0x01, 0x02}})
+	if err != nil || !resp.Miss {
+		t.Fatalf("expected miss for unknown dictionary %08x, miss=%v err=%v", id, resp.Miss, err)
+	}
+	if reader.unknownDictMisses.Load() != 1 {
+		t.Fatalf("expected 1 unknown dictionary miss, got %d", reader.unknownDictMisses.Load())
+	}
+}
+
+func TestDictionariesRetryMisses(t *testing.T) {
+	fs, err := backends.NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dicts := newDictionaries(fs, logger)
+
+	// The dictionary isn't there yet, and the miss is remembered for a while.
+	trained := trainTestDict(t, backends.NewNoop())
+	id, _ := dictID(trained)
+	if _, err := dicts.get(t.Context(), id); !errors.Is(err, errUnknownDict) {
+		t.Fatalf("expected errUnknownDict, got %v", err)
+	}
+	if _, err := storeDict(t.Context(), fs, trained); err != nil {
+		t.Fatalf("failed to store dictionary: %v", err)
+	}
+	if _, err := dicts.get(t.Context(), id); !errors.Is(err, errUnknownDict) {
+		t.Fatalf("expected the miss to be remembered, got %v", err)
+	}
+
+	// Once the miss has expired, the dictionary is fetched again.
+	dicts.missed[id] = time.Now().Add(-dictMissTTL)
+	got, err := dicts.get(t.Context(), id)
+	if err != nil || !bytes.Equal(got, trained) {
+		t.Fatalf("expected dictionary %08x after the miss expired, err=%v", id, err)
+	}
+}
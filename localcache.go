@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -10,7 +11,10 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/richardartoul/gobuildcache/pkg/locking"
 )
 
 // localCache manages the local disk cache where Go build tools access cached files.
@@ -18,6 +22,25 @@ import (
 type localCache struct {
 	cacheDir string // Absolute path to cache directory
 	logger   *slog.Logger
+
+	// Size-limit eviction state, see localcache_eviction.go.
+	// Only active when maxBytes > 0.
+	maxBytes     int64
+	locker       locking.Group
+	approxBytes  atomic.Int64 // Estimated bytes on disk, refreshed by each eviction pass
+	evictSignal  chan struct{}
+	evictorStop  chan struct{}
+	evictorDone  chan struct{}
+	evictPasses  atomic.Int64 // Eviction passes run, i.e. directory scans
+	evictions    atomic.Int64
+	evictedBytes atomic.Int64
+
+	// Output ID dedup state, see localcache_dedup.go.
+	dedup      bool
+	dedupLinks atomic.Int64 // Entries linked to an existing blob
+	dedupBytes atomic.Int64 // Bytes not stored thanks to those links
+
+	quarantined atomic.Int64 // Corrupt entries moved aside, see localcache_integrity.go
 }
 
 // localCacheMetadata holds metadata for a cached entry.
@@ -25,6 +48,8 @@ type localCacheMetadata struct {
 	OutputID []byte
 	Size     int64
 	PutTime  time.Time
+	Blob     string // Blob the data file is linked to (relative to cacheDir), if any
+	SHA256   []byte // Checksum of the data file; empty for entries written before checksums were recorded
 }
 
 // newLocalCache creates a new local cache instance.
@@ -80,11 +105,15 @@ func newLocalCache(cacheDir string, logger *slog.Logger) (*localCache, error) {
 func (lc *localCache) writeMetadata(actionID []byte, meta localCacheMetadata) error {
 	metaPath := lc.metadataPath(actionID)
 
-	// Format: outputID:hex\nsize:num\ntime:unix\n
-	content := fmt.Sprintf("outputID:%s\nsize:%d\ntime:%d\n",
+	// Format: outputID:hex\nsize:num\ntime:unix\nsha256:hex\n[blob:path\n]
+	content := fmt.Sprintf("outputID:%s\nsize:%d\ntime:%d\nsha256:%s\n",
 		hex.EncodeToString(meta.OutputID),
 		meta.Size,
-		meta.PutTime.Unix())
+		meta.PutTime.Unix(),
+		hex.EncodeToString(meta.SHA256))
+	if meta.Blob != "" {
+		content += fmt.Sprintf("blob:%s\n", filepath.ToSlash(meta.Blob))
+	}
 
 	// Write to temp file first for atomic operation.
 	tmpPath := metaPath + ".tmp"
@@ -116,6 +145,8 @@ func (lc *localCache) readMetadata(actionID []byte) (*localCacheMetadata, error)
 	var outputIDHex string
 	var size int64
 	var putTimeUnix int64
+	var blob string
+	var checksumHex string
 
 	// Parse each line
 	for _, line := range strings.Split(string(data), "\n") {
@@ -126,6 +157,10 @@ func (lc *localCache) readMetadata(actionID []byte) (*localCacheMetadata, error)
 			_, _ = fmt.Sscanf(line, "size:%d", &size)
 		} else if strings.HasPrefix(line, "time:") {
 			_, _ = fmt.Sscanf(line, "time:%d", &putTimeUnix)
+		} else if strings.HasPrefix(line, "sha256:") {
+			checksumHex = strings.TrimPrefix(line, "sha256:")
+		} else if strings.HasPrefix(line, "blob:") {
+			blob = filepath.FromSlash(strings.TrimPrefix(line, "blob:"))
 		}
 	}
 
@@ -138,16 +173,24 @@ func (lc *localCache) readMetadata(actionID []byte) (*localCacheMetadata, error)
 		return nil, fmt.Errorf("failed to decode outputID: %w", err)
 	}
 
+	checksum, err := hex.DecodeString(checksumHex)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode sha256: %w", err)
+	}
+
 	return &localCacheMetadata{
 		OutputID: outputID,
 		Size:     size,
 		PutTime:  time.Unix(putTimeUnix, 0),
+		Blob:     blob,
+		SHA256:   checksum,
 	}, nil
 }
 
-// Write atomically writes data from a reader to the local cache.
-// Returns the absolute path to the cached file.
-func (lc *localCache) write(actionID []byte, body io.Reader) (string, error) {
+// Write atomically writes data from a reader to the local cache and returns the
+// absolute path to the cached file. meta.Size, meta.SHA256 and meta.Blob are
+// set from the bytes actually written (see publish for the latter).
+func (lc *localCache) write(actionID []byte, meta *localCacheMetadata, body io.Reader) (string, error) {
 	diskPath := lc.actionIDToPath(actionID)
 
 	// Write to temp file first for atomic operation.
@@ -159,7 +202,8 @@ func (lc *localCache) write(actionID []byte, body io.Reader) (string, error) {
 	defer os.Remove(tmpPath) // Clean up if something goes wrong
 
 	// Copy data to temp file.
-	_, err = io.Copy(tmpFile, body)
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmpFile, hash), body)
 	closeErr := tmpFile.Close()
 	if err != nil {
 		return "", fmt.Errorf("failed to write to temp file: %w", err)
@@ -178,21 +222,27 @@ func (lc *localCache) write(actionID []byte, body io.Reader) (string, error) {
 	// localcache.go is running with mutual exclusion over a given action ID
 	// as implemented in server.go. That said, I'm leaving this in for now
 	// because I think it's safer and probably doesn't hurt performance much.
-	if err := os.Rename(tmpPath, diskPath); err != nil {
+	blob, err := lc.publish(tmpPath, diskPath, meta.OutputID, n)
+	if err != nil {
 		return "", fmt.Errorf("failed to rename cache file: %w", err)
 	}
+	meta.Size = n
+	meta.SHA256 = hash.Sum(nil)
+	meta.Blob = blob
 
 	// diskPath is already absolute (cacheDir is absolute)
 	return diskPath, nil
 }
 
-// WriteWithMetadata writes data and metadata to the local cache.
-// Returns the absolute path to the cached file.
-func (lc *localCache) writeWithMetadata(actionID []byte, body io.Reader, meta localCacheMetadata) (string, error) {
+// WriteWithMetadata writes data and metadata to the local cache. meta.Size is
+// ignored and replaced with the number of bytes actually written, which lets
+// callers stream bodies whose size isn't known up front (e.g. while decompressing).
+// Returns the absolute path to the cached file and the number of bytes written.
+func (lc *localCache) writeWithMetadata(actionID []byte, body io.Reader, meta localCacheMetadata) (string, int64, error) {
 	// Write data
-	diskPath, err := lc.write(actionID, body)
+	diskPath, err := lc.write(actionID, &meta, body)
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
 
 	// Write metadata
@@ -203,7 +253,9 @@ func (lc *localCache) writeWithMetadata(actionID []byte, body io.Reader, meta lo
 		// Continue - data is cached, just missing metadata
 	}
 
-	return diskPath, nil
+	lc.noteWrite(meta.Size)
+
+	return diskPath, meta.Size, nil
 }
 
 // Check checks if a file exists in the local cache and returns its metadata.
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// blobDirName is the subdirectory of the cache directory that holds blobs
+// addressed by output ID. It's laid out like the action ID directories, with
+// 256 shards based on the first byte of the output ID.
+const blobDirName = "blobs"
+
+// enableDedup makes the local cache store each output once. Entries whose
+// output ID matches an existing blob are hardlinked to it instead of keeping
+// their own copy, and new entries are published as blobs for later entries to
+// link to. Hardlinks share an inode, so the go command sees an ordinary,
+// immutable file at every DiskPath.
+//
+// This is a no-op on platforms where link counts can't be observed, since
+// eviction relies on them to find blobs that are no longer referenced.
+func (lc *localCache) enableDedup() error {
+	if !hardlinkDedupSupported {
+		lc.logger.Warn("local cache dedup is not supported on this platform")
+		return nil
+	}
+	for i := range 256 {
+		if err := os.MkdirAll(filepath.Join(lc.cacheDir, blobDirName, fmt.Sprintf("%02x", i)), 0755); err != nil {
+			return fmt.Errorf("failed to create blob directory: %w", err)
+		}
+	}
+	lc.dedup = true
+	return nil
+}
+
+// blobPath returns the path of the blob for outputID, relative to the cache
+// directory. The relative path is what the metadata file records.
+func (lc *localCache) blobPath(outputID []byte) string {
+	hexOutputID := hex.EncodeToString(outputID)
+	return filepath.Join(blobDirName, hexOutputID[:2], fileFormatVersion+hexOutputID)
+}
+
+// publish moves a fully written temp file into place at diskPath. With dedup
+// enabled, diskPath is linked to the existing blob for outputID if there is
+// one (and the temp file discarded); otherwise the new file becomes the blob.
+// Returns the relative blob path if diskPath ended up linked to a blob.
+//
+// Linking is best-effort: if anything goes wrong, the entry keeps its own copy.
+func (lc *localCache) publish(tmpPath, diskPath string, outputID []byte, size int64) (string, error) {
+	if !lc.dedup || len(outputID) == 0 {
+		return "", os.Rename(tmpPath, diskPath)
+	}
+
+	blob := lc.blobPath(outputID)
+	blobPath := filepath.Join(lc.cacheDir, blob)
+
+	// Same output ID means same content, but check the size as a sanity check.
+	if info, err := os.Stat(blobPath); err == nil && info.Size() == size {
+		// Link under a temp name first so diskPath is replaced atomically.
+		linkPath := diskPath + ".link.tmp"
+		_ = os.Remove(linkPath)
+		if err := os.Link(blobPath, linkPath); err == nil {
+			if err := os.Rename(linkPath, diskPath); err != nil {
+				_ = os.Remove(linkPath)
+				return "", err
+			}
+			lc.dedupLinks.Add(1)
+			lc.dedupBytes.Add(size)
+			return blob, nil
+		}
+		// The blob was evicted in the meantime, fall back to our own copy.
+	}
+
+	if err := os.Rename(tmpPath, diskPath); err != nil {
+		return "", err
+	}
+	if err := os.Link(diskPath, blobPath); err != nil {
+		// Most likely another entry with the same output ID published its
+		// blob first, which is harmless.
+		if !errors.Is(err, os.ErrExist) {
+			lc.logger.Debug("failed to publish local cache blob", "path", blobPath, "error", err)
+		}
+		return "", nil
+	}
+	return blob, nil
+}
+
+// removeOrphanBlobs removes the blobs among entries (as returned by scanEntries)
+// that are no longer linked from any entry, and returns the number of bytes
+// freed. A blob's size in entries is the share attributed to the blob itself,
+// the rest having been freed along with the entries that linked to it.
+//
+// Removing a blob never affects entries, which keep their own link to the data.
+// A concurrent publish that loses the race simply keeps its own copy.
+func (lc *localCache) removeOrphanBlobs(entries []localCacheEntry) int64 {
+	var freed int64
+	for _, blob := range entries {
+		if !blob.blob {
+			continue
+		}
+		info, err := os.Stat(blob.dataPath)
+		if err != nil || linkCount(info) > 1 {
+			continue
+		}
+		if err := os.Remove(blob.dataPath); err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				lc.logger.Debug("failed to remove local cache blob", "path", blob.dataPath, "error", err)
+			}
+			continue
+		}
+		freed += blob.size
+	}
+	return freed
+}
+
+// scanBlobs returns every blob in the blob directory. Each blob's size is its
+// share of the data (size divided by link count), so that summed with the
+// entries linking to it the data is counted exactly once.
+func (lc *localCache) scanBlobs() ([]localCacheEntry, int64, error) {
+	var (
+		blobs []localCacheEntry
+		total int64
+	)
+	for i := range 256 {
+		subdirPath := filepath.Join(lc.cacheDir, blobDirName, fmt.Sprintf("%02x", i))
+		dirEntries, err := os.ReadDir(subdirPath)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, 0, fmt.Errorf("failed to read %s: %w", subdirPath, err)
+		}
+		for _, dirEntry := range dirEntries {
+			if dirEntry.IsDir() {
+				continue
+			}
+			info, err := dirEntry.Info()
+			if err != nil {
+				continue
+			}
+			blob := localCacheEntry{
+				dataPath: filepath.Join(subdirPath, dirEntry.Name()),
+				size:     info.Size() / int64(linkCount(info)),
+				modTime:  info.ModTime(),
+				blob:     true,
+			}
+			blobs = append(blobs, blob)
+			total += blob.size
+		}
+	}
+	return blobs, total, nil
+}
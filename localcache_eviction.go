@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/richardartoul/gobuildcache/pkg/locking"
+)
+
+const (
+	// evictionInterval is how often the evictor rescans the cache directory even
+	// if this process hasn't written anything. Other processes sharing the same
+	// directory may have grown it in the meantime.
+	evictionInterval = time.Minute
+
+	// evictionMinAge protects recently used entries from eviction. The go command
+	// opens DiskPath some time after we return it, so an entry we just served or
+	// wrote must not disappear underneath it.
+	evictionMinAge = 5 * time.Minute
+
+	// evictionLowWatermark is the fraction of maxBytes the evictor trims down to,
+	// so that we don't rescan the directory after every single write.
+	evictionLowWatermark = 0.9
+)
+
+// localCacheEntry describes a single data+.meta pair on disk.
+type localCacheEntry struct {
+	actionID []byte // nil for entries from an older fileFormatVersion
+	dataPath string
+	metaPath string
+	size     int64 // Combined size of the data and metadata files
+	modTime  time.Time
+	blob     bool // A dedup blob rather than an entry, see localcache_dedup.go
+}
+
+// startEvictor starts a background goroutine that keeps the cache directory
+// under maxBytes by evicting the least recently used entries. Entry recency is
+// tracked via the data file's mtime, which markUsed bumps on local hits.
+//
+// Entries are deleted while holding the same per-action-ID lock used by
+// server.go, so eviction never races with a GET or PUT for the same entry,
+// including ones running in other processes when locker is an FSLockGroup.
+func (lc *localCache) startEvictor(maxBytes int64, locker locking.Group) {
+	if maxBytes <= 0 {
+		return
+	}
+
+	lc.maxBytes = maxBytes
+	lc.locker = locker
+	lc.evictSignal = make(chan struct{}, 1)
+	lc.evictorStop = make(chan struct{})
+	lc.evictorDone = make(chan struct{})
+
+	go func() {
+		defer close(lc.evictorDone)
+
+		ticker := time.NewTicker(evictionInterval)
+		defer ticker.Stop()
+
+		// Run once at startup to pick up whatever is already on disk.
+		stalled := lc.runEviction()
+		for {
+			select {
+			case <-lc.evictorStop:
+				return
+			case <-ticker.C:
+				stalled = lc.runEviction()
+			case <-lc.evictSignal:
+				// If the last pass couldn't free anything because every entry
+				// was too young, rescanning after every write won't either.
+				// Wait for the ticker instead.
+				if stalled {
+					continue
+				}
+				stalled = lc.runEviction()
+			}
+		}
+	}()
+}
+
+// stopEvictor stops the background evictor (if running) and waits for it to exit.
+func (lc *localCache) stopEvictor() {
+	if lc.evictorStop == nil {
+		return
+	}
+	close(lc.evictorStop)
+	<-lc.evictorDone
+	lc.evictorStop = nil
+}
+
+// noteWrite records that size bytes were added to the cache and wakes the
+// evictor if the estimated cache size is over the limit.
+func (lc *localCache) noteWrite(size int64) {
+	if lc.maxBytes <= 0 {
+		return
+	}
+	if lc.approxBytes.Add(size) > lc.maxBytes {
+		select {
+		case lc.evictSignal <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// markUsed bumps the data file's mtime so LRU eviction treats it as recently used.
+// It's a no-op unless eviction is enabled to avoid an extra syscall per hit.
+func (lc *localCache) markUsed(actionID []byte) {
+	if lc.maxBytes <= 0 {
+		return
+	}
+	now := time.Now()
+	if err := os.Chtimes(lc.actionIDToPath(actionID), now, now); err != nil {
+		lc.logger.Debug("failed to bump local cache entry mtime",
+			"actionID", hex.EncodeToString(actionID),
+			"error", err)
+	}
+}
+
+// runEviction performs a single eviction pass and logs any failure. It returns
+// true if the cache is still over the limit but the pass freed nothing.
+func (lc *localCache) runEviction() bool {
+	lc.evictPasses.Add(1)
+	target := int64(float64(lc.maxBytes) * evictionLowWatermark)
+	evicted, freed, remaining, err := lc.evictToSize(lc.maxBytes, target, evictionMinAge)
+	if err != nil {
+		lc.logger.Warn("local cache eviction failed", "error", err)
+		return false
+	}
+	lc.approxBytes.Store(remaining)
+	if evicted > 0 {
+		lc.logger.Debug("local cache eviction completed",
+			"evicted", evicted,
+			"freedBytes", freed,
+			"remainingBytes", remaining)
+	}
+	return freed == 0 && remaining > lc.maxBytes
+}
+
+// evictToSize evicts least recently used entries until the cache is at most
+// target bytes, but only if it's currently over limit bytes. Entries modified
+// within minAge are never evicted. Returns the number of entries evicted, the
+// bytes freed, and the remaining cache size.
+func (lc *localCache) evictToSize(limit, target int64, minAge time.Duration) (int, int64, int64, error) {
+	entries, total, err := lc.scanEntries()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if total <= limit {
+		return 0, 0, total, nil
+	}
+
+	// Oldest first.
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].modTime.Before(entries[j].modTime)
+	})
+
+	var (
+		evicted int
+		freed   int64
+		cutoff  = time.Now().Add(-minAge)
+	)
+	for _, entry := range entries {
+		if total-freed <= target {
+			break
+		}
+		if entry.blob {
+			continue
+		}
+		if entry.modTime.After(cutoff) {
+			// Everything from here on is newer still.
+			break
+		}
+
+		removed, err := lc.removeEntry(entry)
+		if err != nil {
+			lc.logger.Debug("failed to evict local cache entry", "path", entry.dataPath, "error", err)
+			continue
+		}
+		if removed {
+			evicted++
+			freed += entry.size
+		}
+	}
+	// Blobs whose last entry was just evicted (or that lost their entries
+	// some other way) are no longer needed.
+	freed += lc.removeOrphanBlobs(entries)
+
+	lc.evictions.Add(int64(evicted))
+	lc.evictedBytes.Add(freed)
+	return evicted, freed, total - freed, nil
+}
+
+// trimOlderThan evicts every entry whose data file was last written or used
+// before cutoff. Returns the number of entries evicted and the bytes freed.
+func (lc *localCache) trimOlderThan(cutoff time.Time) (int, int64, error) {
+	entries, _, err := lc.scanEntries()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var (
+		evicted int
+		freed   int64
+	)
+	for _, entry := range entries {
+		if entry.blob || !entry.modTime.Before(cutoff) {
+			continue
+		}
+		removed, err := lc.removeEntry(entry)
+		if err != nil {
+			lc.logger.Debug("failed to trim local cache entry", "path", entry.dataPath, "error", err)
+			continue
+		}
+		if removed {
+			evicted++
+			freed += entry.size
+		}
+	}
+	// Clean up blobs that are no longer linked from any entry.
+	freed += lc.removeOrphanBlobs(entries)
+
+	lc.evictions.Add(int64(evicted))
+	lc.evictedBytes.Add(freed)
+	return evicted, freed, nil
+}
+
+// removeEntry deletes an entry's metadata and then its data file. The metadata
+// goes first so that check() stops reporting the entry before its data
+// disappears. Returns false if the entry was refreshed or removed by someone
+// else in the meantime.
+func (lc *localCache) removeEntry(entry localCacheEntry) (bool, error) {
+	remove := func() (interface{}, error) {
+		// Re-check under the lock: a concurrent GET may have just marked the
+		// entry as used, or a PUT may have rewritten it.
+		info, err := os.Stat(entry.dataPath)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				_ = os.Remove(entry.metaPath)
+				return false, nil
+			}
+			return false, err
+		}
+		if info.ModTime().After(entry.modTime) {
+			return false, nil
+		}
+
+		if err := os.Remove(entry.metaPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return false, fmt.Errorf("failed to remove metadata: %w", err)
+		}
+		if err := os.Remove(entry.dataPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return false, fmt.Errorf("failed to remove data: %w", err)
+		}
+		return true, nil
+	}
+
+	// Entries from older file format versions are never accessed by anyone,
+	// so they don't need a lock.
+	if entry.actionID == nil || lc.locker == nil {
+		v, err := remove()
+		return v.(bool), err
+	}
+
+	v, err := lc.locker.DoWithLock(hex.EncodeToString(entry.actionID), remove)
+	if err != nil {
+		return false, err
+	}
+	return v.(bool), nil
+}
+
+// scanEntries walks all 256 shard directories and returns every cache entry
+// and dedup blob along with the total number of bytes used by the cache. Data
+// shared through hardlinks is split evenly between its links, so that it's
+// counted once in the total and evicting an entry frees its share.
+func (lc *localCache) scanEntries() ([]localCacheEntry, int64, error) {
+	var (
+		entries []localCacheEntry
+		total   int64
+	)
+	for i := range 256 {
+		subdirPath := filepath.Join(lc.cacheDir, fmt.Sprintf("%02x", i))
+		dirEntries, err := os.ReadDir(subdirPath)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, 0, fmt.Errorf("failed to read %s: %w", subdirPath, err)
+		}
+
+		metaSizes := make(map[string]int64)
+		for _, dirEntry := range dirEntries {
+			name := dirEntry.Name()
+			if !strings.HasSuffix(name, ".meta") {
+				continue
+			}
+			if info, err := dirEntry.Info(); err == nil {
+				metaSizes[strings.TrimSuffix(name, ".meta")] = info.Size()
+			}
+		}
+
+		for _, dirEntry := range dirEntries {
+			name := dirEntry.Name()
+			if dirEntry.IsDir() || strings.HasSuffix(name, ".meta") || strings.HasSuffix(name, ".tmp") {
+				continue
+			}
+			info, err := dirEntry.Info()
+			if err != nil {
+				// Removed between ReadDir and Info.
+				continue
+			}
+
+			entry := localCacheEntry{
+				dataPath: filepath.Join(subdirPath, name),
+				metaPath: filepath.Join(subdirPath, name+".meta"),
+				size:     info.Size()/int64(linkCount(info)) + metaSizes[name],
+				modTime:  info.ModTime(),
+			}
+			if hexID, ok := strings.CutPrefix(name, fileFormatVersion); ok {
+				if actionID, err := hex.DecodeString(hexID); err == nil {
+					entry.actionID = actionID
+				}
+			}
+
+			entries = append(entries, entry)
+			total += entry.size
+		}
+	}
+
+	blobs, blobBytes, err := lc.scanBlobs()
+	if err != nil {
+		return nil, 0, err
+	}
+	return append(entries, blobs...), total + blobBytes, nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// fsckTempMinAge is how old a temp file must be before fsck considers it
+// orphaned. Temp files are normally renamed or removed within seconds, but
+// spooled PUT bodies can live for as long as a large upload takes.
+const fsckTempMinAge = time.Hour
+
+// fsckIssue is a single problem found by fsck.
+type fsckIssue struct {
+	path     string
+	problem  string
+	repaired bool
+}
+
+// fsckReport summarizes an fsck run.
+type fsckReport struct {
+	entries int // Current-format entries examined
+	issues  []fsckIssue
+}
+
+// fsck walks the cache directory looking for files that the server would never
+// serve or clean up correctly:
+//
+//   - orphaned temp files left behind by crashed writes,
+//   - data files without metadata, and metadata files without data,
+//   - metadata that can't be parsed or doesn't match the size of its data,
+//   - entries from older fileFormatVersions and quarantined corrupt entries,
+//   - dedup blobs that no entry links to any more.
+//
+// If verify is true, the checksum of every entry is verified as well. If
+// repair is true, every problem is fixed by deleting the offending files.
+// Entries are repaired under the same per-action-ID locks the server uses.
+func (lc *localCache) fsck(verify, repair bool) (fsckReport, error) {
+	var report fsckReport
+	addIssue := func(path, problem string, fix func() error) {
+		issue := fsckIssue{path: path, problem: problem}
+		if repair {
+			if err := fix(); err != nil && !errors.Is(err, os.ErrNotExist) {
+				issue.problem += fmt.Sprintf(" (repair failed: %v)", err)
+			} else {
+				issue.repaired = true
+			}
+		}
+		report.issues = append(report.issues, issue)
+	}
+
+	// Spooled PUT bodies live directly in the cache directory.
+	if err := lc.fsckTempFiles(lc.cacheDir, addIssue); err != nil {
+		return report, err
+	}
+
+	for i := range 256 {
+		subdirPath := filepath.Join(lc.cacheDir, fmt.Sprintf("%02x", i))
+		if err := lc.fsckTempFiles(subdirPath, addIssue); err != nil {
+			return report, err
+		}
+		dirEntries, err := os.ReadDir(subdirPath)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return report, fmt.Errorf("failed to read %s: %w", subdirPath, err)
+		}
+
+		names := make(map[string]bool, len(dirEntries))
+		for _, dirEntry := range dirEntries {
+			names[dirEntry.Name()] = true
+		}
+
+		for _, dirEntry := range dirEntries {
+			name := dirEntry.Name()
+			if dirEntry.IsDir() || strings.HasSuffix(name, ".tmp") {
+				continue
+			}
+			var (
+				path       = filepath.Join(subdirPath, name)
+				isMeta     = strings.HasSuffix(name, ".meta")
+				dataName   = strings.TrimSuffix(name, ".meta")
+				dataPath   = filepath.Join(subdirPath, dataName)
+				metaPath   = dataPath + ".meta"
+				removeBoth = func() error {
+					return errors.Join(removeIfExists(metaPath), removeIfExists(dataPath))
+				}
+			)
+
+			if strings.HasSuffix(dataName, quarantineSuffix) {
+				if !isMeta || !names[dataName] {
+					addIssue(path, "quarantined corrupt entry", removeBoth)
+				}
+				continue
+			}
+
+			actionID := lc.parseDataName(dataName)
+			if actionID == nil {
+				// Data and metadata are reported together, via the data file if it exists.
+				if !isMeta || !names[dataName] {
+					addIssue(dataPath, "entry from an older cache format", removeBoth)
+				}
+				continue
+			}
+			// Each fix re-checks the problem under the lock, since a concurrent
+			// write may have been halfway through creating the entry.
+			if isMeta {
+				if !names[dataName] {
+					addIssue(path, "metadata without data file", lc.fixLocked(actionID, func() error {
+						if fileExists(dataPath) {
+							return nil
+						}
+						return os.Remove(metaPath)
+					}))
+				}
+				continue
+			}
+
+			report.entries++
+			if !names[name+".meta"] {
+				addIssue(path, "data file without metadata", lc.fixLocked(actionID, func() error {
+					if fileExists(metaPath) {
+						return nil
+					}
+					return removeBoth()
+				}))
+				continue
+			}
+			if problem := lc.fsckEntry(actionID, verify); problem != "" {
+				addIssue(path, problem, lc.fixLocked(actionID, func() error {
+					if lc.fsckEntry(actionID, verify) == "" {
+						return nil
+					}
+					return removeBoth()
+				}))
+			}
+		}
+	}
+
+	blobs, _, err := lc.scanBlobs()
+	if err != nil {
+		return report, err
+	}
+	for _, blob := range blobs {
+		info, err := os.Stat(blob.dataPath)
+		if err == nil && linkCount(info) <= 1 {
+			addIssue(blob.dataPath, "blob not linked from any entry", func() error { return os.Remove(blob.dataPath) })
+		}
+	}
+
+	return report, nil
+}
+
+// fsckTempFiles reports temp files in dir older than fsckTempMinAge.
+func (lc *localCache) fsckTempFiles(dir string, addIssue func(path, problem string, fix func() error)) error {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("failed to read %s: %w", dir, err)
+	}
+	cutoff := time.Now().Add(-fsckTempMinAge)
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() || !strings.HasSuffix(dirEntry.Name(), ".tmp") {
+			continue
+		}
+		info, err := dirEntry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		path := filepath.Join(dir, dirEntry.Name())
+		addIssue(path, "orphaned temp file", func() error { return os.Remove(path) })
+	}
+	return nil
+}
+
+// fsckEntry returns what's wrong with a current-format entry whose data and
+// metadata files both exist, or "" if nothing is.
+func (lc *localCache) fsckEntry(actionID []byte, verify bool) string {
+	meta, err := lc.readMetadata(actionID)
+	if err != nil {
+		return fmt.Sprintf("unreadable metadata: %v", err)
+	}
+	if verify {
+		if err := lc.verify(actionID, meta); err != nil {
+			return err.Error()
+		}
+		return ""
+	}
+	info, err := os.Stat(lc.actionIDToPath(actionID))
+	if err != nil {
+		return fmt.Sprintf("unreadable data file: %v", err)
+	}
+	if info.Size() != meta.Size {
+		return fmt.Sprintf("size mismatch: metadata says %d, data file has %d", meta.Size, info.Size())
+	}
+	return ""
+}
+
+// fixLocked returns fix wrapped to run under the lock for actionID, if the
+// cache has a locker.
+func (lc *localCache) fixLocked(actionID []byte, fix func() error) func() error {
+	if lc.locker == nil {
+		return fix
+	}
+	return func() error {
+		_, err := lc.locker.DoWithLock(hex.EncodeToString(actionID), func() (interface{}, error) {
+			return nil, fix()
+		})
+		return err
+	}
+}
+
+// parseDataName returns the action ID of a data file name in the current
+// fileFormatVersion, or nil if it isn't one.
+func (lc *localCache) parseDataName(name string) []byte {
+	hexID, ok := strings.CutPrefix(name, fileFormatVersion)
+	if !ok {
+		return nil
+	}
+	actionID, err := hex.DecodeString(hexID)
+	if err != nil || len(actionID) == 0 {
+		return nil
+	}
+	return actionID
+}
+
+// fileExists reports whether path exists.
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// removeIfExists removes path, ignoring it not existing.
+func removeIfExists(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// quarantineSuffix is appended to the data and metadata file names of corrupt
+// entries. Quarantined files no longer resolve to an action ID, so they're
+// never served again, but they stay around for inspection until eviction or
+// trim-local removes them like any other stale entry.
+const quarantineSuffix = ".corrupt"
+
+// verify re-reads an entry's data file and checks it against the size and
+// SHA-256 recorded in meta. Entries written before checksums were recorded are
+// only checked for size.
+func (lc *localCache) verify(actionID []byte, meta *localCacheMetadata) error {
+	file, err := os.Open(lc.actionIDToPath(actionID))
+	if err != nil {
+		return fmt.Errorf("failed to open data file: %w", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	n, err := io.Copy(hash, file)
+	if err != nil {
+		return fmt.Errorf("failed to read data file: %w", err)
+	}
+	if n != meta.Size {
+		return fmt.Errorf("size mismatch: expected %d, got %d", meta.Size, n)
+	}
+	if sum := hash.Sum(nil); len(meta.SHA256) > 0 && !bytes.Equal(sum, meta.SHA256) {
+		return fmt.Errorf("checksum mismatch: expected sha256 %s, got %s",
+			hex.EncodeToString(meta.SHA256), hex.EncodeToString(sum))
+	}
+	return nil
+}
+
+// quarantine moves a corrupt entry's data and metadata files aside so that the
+// entry becomes a miss. If the entry is linked to a dedup blob, the blob shares
+// the corrupt data, so it's removed too to stop new entries linking to it.
+// The caller must hold the lock for actionID.
+func (lc *localCache) quarantine(actionID []byte, meta *localCacheMetadata) error {
+	var (
+		dataPath = lc.actionIDToPath(actionID)
+		metaPath = lc.metadataPath(actionID)
+	)
+	// Metadata first, so the entry stops being reported before its data moves.
+	if err := os.Rename(metaPath, dataPath+quarantineSuffix+".meta"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to quarantine metadata: %w", err)
+	}
+	if err := os.Rename(dataPath, dataPath+quarantineSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to quarantine data: %w", err)
+	}
+	if meta != nil && meta.Blob != "" {
+		if err := os.Remove(filepath.Join(lc.cacheDir, meta.Blob)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove corrupt blob: %w", err)
+		}
+	}
+	lc.quarantined.Add(1)
+	return nil
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/gobuildcache/pkg/locking"
+)
+
+// writeAgedEntry writes a cache entry and backdates its data file by age.
+func writeAgedEntry(t *testing.T, lc *localCache, actionID []byte, size int, age time.Duration) {
+	t.Helper()
+	meta := localCacheMetadata{OutputID: []byte("out"), Size: int64(size), PutTime: time.Now()}
+	if _, _, err := lc.writeWithMetadata(actionID, bytes.NewReader(make([]byte, size)), meta); err != nil {
+		t.Fatalf("failed to write entry: %v", err)
+	}
+	modTime := time.Now().Add(-age)
+	if err := os.Chtimes(lc.actionIDToPath(actionID), modTime, modTime); err != nil {
+		t.Fatalf("failed to set mtime: %v", err)
+	}
+}
+
+func TestLocalCacheEvictToSize_EvictsLeastRecentlyUsed(t *testing.T) {
+	lc, err := newLocalCache(t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("failed to create local cache: %v", err)
+	}
+	lc.locker = locking.NewMemLock()
+
+	// Ten 1000-byte entries, entry i is (10-i) hours old.
+	for i := range 10 {
+		writeAgedEntry(t, lc, []byte{byte(i), 0xaa}, 1000, time.Duration(10-i)*time.Hour)
+	}
+
+	_, total, err := lc.scanEntries()
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+
+	// Trim to roughly half.
+	evicted, freed, remaining, err := lc.evictToSize(total/2, total/2, time.Minute)
+	if err != nil {
+		t.Fatalf("eviction failed: %v", err)
+	}
+	if evicted != 5 {
+		t.Fatalf("expected 5 entries evicted, got %d", evicted)
+	}
+	if remaining != total-freed || remaining > total/2 {
+		t.Fatalf("unexpected remaining size %d (total %d, freed %d)", remaining, total, freed)
+	}
+
+	// The oldest entries are gone and the newest remain.
+	for i := range 10 {
+		meta := lc.check([]byte{byte(i), 0xaa})
+		if i < 5 && meta != nil {
+			t.Errorf("expected entry %d to be evicted", i)
+		}
+		if i >= 5 && meta == nil {
+			t.Errorf("expected entry %d to be kept", i)
+		}
+	}
+}
+
+func TestLocalCacheEvictToSize_SparesRecentEntries(t *testing.T) {
+	lc, err := newLocalCache(t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("failed to create local cache: %v", err)
+	}
+	lc.locker = locking.NewMemLock()
+
+	writeAgedEntry(t, lc, []byte{0x01}, 1000, time.Hour)
+	writeAgedEntry(t, lc, []byte{0x02}, 1000, time.Second)
+
+	evicted, _, _, err := lc.evictToSize(0, 0, time.Minute)
+	if err != nil {
+		t.Fatalf("eviction failed: %v", err)
+	}
+	if evicted != 1 {
+		t.Fatalf("expected only the old entry to be evicted, got %d", evicted)
+	}
+	if lc.check([]byte{0x02}) == nil {
+		t.Fatal("expected recently used entry to survive eviction")
+	}
+}
+
+func TestLocalCacheEvictToSize_UnderLimitIsNoOp(t *testing.T) {
+	lc, err := newLocalCache(t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("failed to create local cache: %v", err)
+	}
+	writeAgedEntry(t, lc, []byte{0x01}, 1000, time.Hour)
+
+	evicted, _, remaining, err := lc.evictToSize(1<<20, 0, 0)
+	if err != nil {
+		t.Fatalf("eviction failed: %v", err)
+	}
+	if evicted != 0 || remaining == 0 {
+		t.Fatalf("expected no eviction, evicted=%d remaining=%d", evicted, remaining)
+	}
+}
+
+func TestLocalCacheEvictor_StalledPassSkipsSignals(t *testing.T) {
+	lc, err := newLocalCache(t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("failed to create local cache: %v", err)
+	}
+
+	// Over the limit, but too recent to evict.
+	writeAgedEntry(t, lc, []byte{0x01}, 1000, time.Second)
+	lc.startEvictor(100, locking.NewMemLock())
+
+	// Every write is over the limit, but none should trigger another scan
+	// until the ticker.
+	for range 5 {
+		lc.noteWrite(1000)
+		time.Sleep(10 * time.Millisecond)
+	}
+	lc.stopEvictor()
+
+	if passes := lc.evictPasses.Load(); passes != 1 {
+		t.Fatalf("expected only the startup eviction pass, got %d", passes)
+	}
+	if lc.check([]byte{0x01}) == nil {
+		t.Fatal("expected recent entry to survive eviction")
+	}
+}
+
+func TestLocalCacheMarkUsed(t *testing.T) {
+	lc, err := newLocalCache(t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("failed to create local cache: %v", err)
+	}
+	lc.maxBytes = 1 << 20
+	writeAgedEntry(t, lc, []byte{0x01}, 10, time.Hour)
+
+	lc.markUsed([]byte{0x01})
+
+	info, err := os.Stat(lc.actionIDToPath([]byte{0x01}))
+	if err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+	if time.Since(info.ModTime()) > time.Minute {
+		t.Fatalf("expected mtime to be bumped, got %v", info.ModTime())
+	}
+}
+
+func TestLocalCacheTrimOlderThan(t *testing.T) {
+	lc, err := newLocalCache(t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("failed to create local cache: %v", err)
+	}
+	lc.locker = locking.NewMemLock()
+
+	writeAgedEntry(t, lc, []byte{0x01}, 100, 96*time.Hour)
+	writeAgedEntry(t, lc, []byte{0x02}, 100, 80*time.Hour)
+	writeAgedEntry(t, lc, []byte{0x03}, 100, time.Hour)
+
+	evicted, freed, err := lc.trimOlderThan(time.Now().Add(-72 * time.Hour))
+	if err != nil {
+		t.Fatalf("trim failed: %v", err)
+	}
+	if evicted != 2 || freed == 0 {
+		t.Fatalf("expected 2 entries trimmed, got %d (%d bytes)", evicted, freed)
+	}
+	if lc.check([]byte{0x01}) != nil || lc.check([]byte{0x02}) != nil {
+		t.Fatal("expected stale entries to be trimmed")
+	}
+	if lc.check([]byte{0x03}) == nil {
+		t.Fatal("expected recent entry to be kept")
+	}
+}
+
+func TestLocalCacheDedup_LinksIdenticalOutputs(t *testing.T) {
+	if !hardlinkDedupSupported {
+		t.Skip("local cache dedup is not supported on this platform")
+	}
+	lc, err := newLocalCache(t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("failed to create local cache: %v", err)
+	}
+	if err := lc.enableDedup(); err != nil {
+		t.Fatalf("failed to enable dedup: %v", err)
+	}
+
+	body := bytes.Repeat([]byte("x"), 10000)
+	for _, actionID := range [][]byte{{0x01}, {0x02}} {
+		meta := localCacheMetadata{OutputID: []byte{0xaa, 0xbb}, PutTime: time.Now()}
+		if _, _, err := lc.writeWithMetadata(actionID, bytes.NewReader(body), meta); err != nil {
+			t.Fatalf("failed to write entry: %v", err)
+		}
+	}
+
+	first, err := os.Stat(lc.actionIDToPath([]byte{0x01}))
+	if err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+	second, err := os.Stat(lc.actionIDToPath([]byte{0x02}))
+	if err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+	if !os.SameFile(first, second) {
+		t.Fatal("expected entries with the same output ID to share a file")
+	}
+	if got := lc.dedupLinks.Load(); got != 1 {
+		t.Fatalf("expected 1 dedup link, got %d", got)
+	}
+	for _, actionID := range [][]byte{{0x01}, {0x02}} {
+		if meta := lc.check(actionID); meta == nil || meta.Blob != lc.blobPath([]byte{0xaa, 0xbb}) {
+			t.Fatalf("expected metadata to record the blob, got %+v", meta)
+		}
+	}
+
+	// The shared data is only counted once.
+	_, total, err := lc.scanEntries()
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+	if total < int64(len(body)) || total >= 2*int64(len(body)) {
+		t.Fatalf("expected shared data to be counted once, got total %d", total)
+	}
+}
+
+func TestLocalCacheDedup_SizeMismatchKeepsCopy(t *testing.T) {
+	if !hardlinkDedupSupported {
+		t.Skip("local cache dedup is not supported on this platform")
+	}
+	lc, err := newLocalCache(t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("failed to create local cache: %v", err)
+	}
+	if err := lc.enableDedup(); err != nil {
+		t.Fatalf("failed to enable dedup: %v", err)
+	}
+
+	for i, actionID := range [][]byte{{0x01}, {0x02}} {
+		meta := localCacheMetadata{OutputID: []byte{0xaa}, PutTime: time.Now()}
+		if _, _, err := lc.writeWithMetadata(actionID, bytes.NewReader(make([]byte, 100+i)), meta); err != nil {
+			t.Fatalf("failed to write entry: %v", err)
+		}
+	}
+	if got := lc.dedupLinks.Load(); got != 0 {
+		t.Fatalf("expected no dedup links, got %d", got)
+	}
+	if meta := lc.check([]byte{0x02}); meta == nil || meta.Blob != "" || meta.Size != 101 {
+		t.Fatalf("expected unlinked entry, got %+v", meta)
+	}
+}
+
+func TestLocalCacheDedup_TrimRemovesOrphanBlobs(t *testing.T) {
+	if !hardlinkDedupSupported {
+		t.Skip("local cache dedup is not supported on this platform")
+	}
+	lc, err := newLocalCache(t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("failed to create local cache: %v", err)
+	}
+	if err := lc.enableDedup(); err != nil {
+		t.Fatalf("failed to enable dedup: %v", err)
+	}
+	lc.locker = locking.NewMemLock()
+
+	// Both entries share an inode, so backdating one backdates both.
+	writeAgedEntry(t, lc, []byte{0x01}, 1000, 0)
+	writeAgedEntry(t, lc, []byte{0x02}, 1000, 96*time.Hour)
+
+	evicted, freed, err := lc.trimOlderThan(time.Now().Add(-72 * time.Hour))
+	if err != nil {
+		t.Fatalf("trim failed: %v", err)
+	}
+	if evicted != 2 || freed < 1000 {
+		t.Fatalf("expected 2 entries and the shared data trimmed, got %d (%d bytes)", evicted, freed)
+	}
+
+	blobs, total, err := lc.scanBlobs()
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+	if len(blobs) != 0 || total != 0 {
+		t.Fatalf("expected orphaned blob to be removed, got %d blobs", len(blobs))
+	}
+}
+
+func TestLocalCacheFsck(t *testing.T) {
+	lc, err := newLocalCache(t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("failed to create local cache: %v", err)
+	}
+	lc.locker = locking.NewMemLock()
+
+	for i := range 5 {
+		writeAgedEntry(t, lc, []byte{byte(i), 0xbb}, 100, 0)
+	}
+	var (
+		noMeta   = []byte{0, 0xbb}
+		noData   = []byte{1, 0xbb}
+		wrongLen = []byte{2, 0xbb}
+		corrupt  = []byte{3, 0xbb}
+	)
+	if err := os.Remove(lc.metadataPath(noMeta)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(lc.actionIDToPath(noData)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(lc.actionIDToPath(wrongLen), 50); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(lc.actionIDToPath(corrupt), bytes.Repeat([]byte{1}, 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// An old temp file is orphaned; a fresh one may belong to a running write.
+	oldTmp := filepath.Join(lc.cacheDir, ".spool-old.tmp")
+	newTmp := filepath.Join(lc.cacheDir, ".spool-new.tmp")
+	for _, path := range []string{oldTmp, newTmp} {
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	modTime := time.Now().Add(-2 * fsckTempMinAge)
+	if err := os.Chtimes(oldTmp, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without -verify, the corrupt entry of the right size goes unnoticed.
+	report, err := lc.fsck(false, false)
+	if err != nil {
+		t.Fatalf("fsck failed: %v", err)
+	}
+	if len(report.issues) != 4 {
+		t.Fatalf("expected 4 issues, got %+v", report.issues)
+	}
+
+	report, err = lc.fsck(true, true)
+	if err != nil {
+		t.Fatalf("fsck failed: %v", err)
+	}
+	if len(report.issues) != 5 {
+		t.Fatalf("expected 5 issues, got %+v", report.issues)
+	}
+	for _, issue := range report.issues {
+		if !issue.repaired {
+			t.Fatalf("expected %s to be repaired: %s", issue.path, issue.problem)
+		}
+	}
+
+	report, err = lc.fsck(true, false)
+	if err != nil {
+		t.Fatalf("fsck failed: %v", err)
+	}
+	if len(report.issues) != 0 || report.entries != 1 {
+		t.Fatalf("expected one clean entry after repair, got %d entries and %+v", report.entries, report.issues)
+	}
+	if !fileExists(newTmp) {
+		t.Fatal("expected recent temp file to be left alone")
+	}
+}
@@ -0,0 +1,20 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// hardlinkDedupSupported reports whether link counts can be observed, which
+// local cache dedup needs to find unreferenced blobs.
+const hardlinkDedupSupported = true
+
+// linkCount returns the number of hardlinks to the file described by info.
+func linkCount(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Nlink > 0 {
+		return uint64(stat.Nlink)
+	}
+	return 1
+}
@@ -1,12 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/richardartoul/gobuildcache/pkg/backends"
@@ -24,14 +31,58 @@ var (
 	cacheDir          string
 	s3Bucket          string
 	s3Prefix          string
+	s3ReadPrefixes    string
 	errorRate         float64
-	compression       bool
+	compression       compressionFlag
+	compressionLevel  int
+	compressionDict   bool
 	asyncBackend      bool
 	touchOnGet        bool
 	touchAgeThreshold time.Duration
 	conditionalPut    bool
 	s3PathStyle       bool
 	readOnly          bool
+	fsRoot            string
+	httpURL           string
+	httpToken         string
+	httpUsername      string
+	httpPassword      string
+	httpTimeout       time.Duration
+	listenAddr        string
+	serveToken        string
+	tierSpecs         string
+	localCacheMax     byteSize
+	localDedup        bool
+	verifyLocalHits   bool
+	errorPolicy       string
+	trimOlderThan     age
+	trimMaxSize       byteSize
+	fsckRepair        bool
+	fsckVerify        bool
+	fsckSample        int
+	dictSamples       int
+	dictSize          byteSize
+	dictDryRun        bool
+	s3MultipartMin    byteSize
+	s3PartSize        byteSize
+	s3Concurrency     int
+	dedup             bool
+	encryptionKeyFile string
+	signingKeyFile    string
+	retryMaxAttempts  int
+	retryBaseDelay    time.Duration
+	retryMaxDelay     time.Duration
+	retryJitter       float64
+	retryTimeout      time.Duration
+	breakerFailures   int
+	breakerLatency    time.Duration
+	breakerCoolDown   time.Duration
+	getTimeout        time.Duration
+	putTimeout        time.Duration
+	hedgeGets         bool
+	hedgeMinDelay     time.Duration
+	prefetchManifest  string
+	prefetchWorkers   int
 )
 
 func main() {
@@ -49,6 +100,24 @@ func main() {
 		case "clear-remote":
 			runClearRemoteCommand()
 			return
+		case "trim-local":
+			runTrimLocalCommand()
+			return
+		case "trim-remote":
+			runTrimRemoteCommand()
+			return
+		case "fsck-local":
+			runFsckLocalCommand()
+			return
+		case "fsck-remote":
+			runFsckRemoteCommand()
+			return
+		case "train-dict":
+			runTrainDictCommand()
+			return
+		case "serve":
+			runServeCommand()
+			return
 		case "help", "-h", "--help":
 			printHelp()
 			return
@@ -77,25 +146,84 @@ func runServerCommand() {
 		s3BucketDefault          = getEnvWithPrefix("S3_BUCKET", "")
 		s3PrefixDefault          = getEnvWithPrefix("S3_PREFIX", "gobuildcache/")
 		errorRateDefault         = getEnvFloatWithPrefix("ERROR_RATE", 0.0)
-		compressionDefault       = getEnvBoolWithPrefix("COMPRESSION", true)
+		compressionDefault       = getEnvWithPrefix("COMPRESSION", "lz4")
 		asyncBackendDefault      = getEnvBoolWithPrefix("ASYNC_BACKEND", true)
 		touchOnGetDefault        = getEnvBoolWithPrefix("TOUCH_ON_GET", false)
 		conditionalPutDefault    = getEnvBoolWithPrefix("CONDITIONAL_PUT", false)
 		printStatsMachineDefault = getEnvBoolWithPrefix("STATS_MACHINE", false)
 		s3PathStyleDefault       = getEnvBoolWithPrefix("S3_PATH_STYLE", false)
 		readOnlyDefault          = getEnvBoolWithPrefix("READONLY", false)
+		fsRootDefault            = getEnvWithPrefix("FS_ROOT", "")
+		httpURLDefault           = getEnvWithPrefix("HTTP_URL", "")
+		httpTokenDefault         = getEnvWithPrefix("HTTP_TOKEN", "")
+		httpUsernameDefault      = getEnvWithPrefix("HTTP_USERNAME", "")
+		httpPasswordDefault      = getEnvWithPrefix("HTTP_PASSWORD", "")
+		httpTimeoutDefault       = getEnvDurationWithPrefix("HTTP_TIMEOUT", 30*time.Second)
+		tiersDefault             = getEnvWithPrefix("TIERS", "")
+		dedupDefault             = getEnvBoolWithPrefix("DEDUP", false)
+		localDedupDefault        = getEnvBoolWithPrefix("LOCAL_DEDUP", false)
+		verifyLocalHitsDefault   = getEnvBoolWithPrefix("VERIFY_LOCAL_HITS", false)
+		encryptionKeyFileDefault = getEnvWithPrefix("ENCRYPTION_KEY_FILE", "")
+		signingKeyFileDefault    = getEnvWithPrefix("SIGNING_KEY_FILE", "")
 	)
+	localCacheMax = byteSize(getEnvByteSizeWithPrefix("LOCAL_CACHE_MAX_BYTES", 0))
+	s3MultipartMin = byteSize(getEnvByteSizeWithPrefix("S3_MULTIPART_THRESHOLD", 16<<20))
+	s3PartSize = byteSize(getEnvByteSizeWithPrefix("S3_PART_SIZE", backends.DefaultS3PartSize))
 	serverFlags.BoolVar(&debug, "debug", debugDefault, "Enable debug logging to stderr (env: DEBUG)")
 	serverFlags.BoolVar(&printStats, "stats", printStatsDefault, "Print cache statistics on exit (env: PRINT_STATS)")
 	serverFlags.BoolVar(&printStatsMachine, "stats-machine", printStatsMachineDefault, "Print one-line machine-readable stats on exit (env: STATS_MACHINE)")
-	serverFlags.StringVar(&backendType, "backend", backendDefault, "Backend type: disk (local only), s3 (env: BACKEND_TYPE)")
+	serverFlags.StringVar(&backendType, "backend", backendDefault, "Backend type: disk (local only), s3, fs, http, tiered (env: BACKEND_TYPE)")
 	serverFlags.StringVar(&lockingType, "lock-type", lockTypeDefault, "Locking type: memory (in-memory), fslock (filesystem) (env: LOCK_TYPE)")
 	serverFlags.StringVar(&lockDir, "lock-dir", lockDirDefault, "Lock directory for fslock (env: LOCK_DIR)")
 	serverFlags.StringVar(&cacheDir, "cache-dir", cacheDirDefault, "Local cache directory (env: CACHE_DIR)")
+	serverFlags.Var(&localCacheMax, "local-cache-max-bytes",
+		"Evict least recently used local cache entries above this size, e.g. 50GiB; 0 disables (env: LOCAL_CACHE_MAX_BYTES)")
+	serverFlags.BoolVar(&localDedup, "local-dedup", localDedupDefault,
+		"Store identical outputs once in the local cache, hardlinked from each action (env: LOCAL_DEDUP)")
+	serverFlags.BoolVar(&verifyLocalHits, "verify-local-hits", verifyLocalHitsDefault,
+		"Verify the checksum of local cache entries before serving them (env: VERIFY_LOCAL_HITS)")
+	serverFlags.StringVar(&errorPolicy, "backend-error-policy", getEnvWithPrefix("BACKEND_ERROR_POLICY", "miss"),
+		"What a GET returns when the backend fails, its body can't be decompressed or it can't be written to the local cache: miss or fail (env: BACKEND_ERROR_POLICY)")
 	serverFlags.StringVar(&s3Bucket, "s3-bucket", s3BucketDefault, "S3 bucket name (required for s3 backend) (env: S3_BUCKET)")
 	serverFlags.StringVar(&s3Prefix, "s3-prefix", s3PrefixDefault, "S3 key prefix (optional) (env: S3_PREFIX)")
+	serverFlags.StringVar(&s3ReadPrefixes, "s3-read-prefixes", getEnvWithPrefix("S3_READ_PREFIXES", ""),
+		"Comma-separated S3 key prefixes to read from, in order, before -s3-prefix; writes still only go to -s3-prefix (env: S3_READ_PREFIXES)")
 	serverFlags.Float64Var(&errorRate, "error-rate", errorRateDefault, "Error injection rate (0.0-1.0) for testing error handling (env: ERROR_RATE)")
-	serverFlags.BoolVar(&compression, "compression", compressionDefault, "Enable LZ4 compression for backend storage (env: COMPRESSION)")
+	serverFlags.IntVar(&retryMaxAttempts, "retry-max-attempts", getEnvIntWithPrefix("RETRY_MAX_ATTEMPTS", 3),
+		"Attempts per backend operation that fails with a transient error (throttling, 5xx, timeouts); 1 disables retries (env: RETRY_MAX_ATTEMPTS)")
+	serverFlags.DurationVar(&retryBaseDelay, "retry-base-delay", getEnvDurationWithPrefix("RETRY_BASE_DELAY", 100*time.Millisecond),
+		"Delay before the first backend retry, doubling for each further retry (env: RETRY_BASE_DELAY)")
+	serverFlags.DurationVar(&retryMaxDelay, "retry-max-delay", getEnvDurationWithPrefix("RETRY_MAX_DELAY", 2*time.Second),
+		"Maximum delay between backend retries (env: RETRY_MAX_DELAY)")
+	serverFlags.Float64Var(&retryJitter, "retry-jitter", getEnvFloatWithPrefix("RETRY_JITTER", 0.5),
+		"Fraction (0.0-1.0) of each retry delay that's randomized (env: RETRY_JITTER)")
+	serverFlags.DurationVar(&retryTimeout, "retry-timeout", getEnvDurationWithPrefix("RETRY_TIMEOUT", 0),
+		"Abandon and retry a backend operation attempt after this long, e.g. 30s; 0 disables (env: RETRY_TIMEOUT)")
+	serverFlags.IntVar(&breakerFailures, "circuit-breaker-failures", getEnvIntWithPrefix("CIRCUIT_BREAKER_FAILURES", 5),
+		"Consecutive failed backend operations that open the circuit breaker, serving misses for a cool-down; 0 disables (env: CIRCUIT_BREAKER_FAILURES)")
+	serverFlags.DurationVar(&breakerLatency, "circuit-breaker-latency", getEnvDurationWithPrefix("CIRCUIT_BREAKER_LATENCY", 0),
+		"Count backend GETs, HEADs and touches slower than this as failures for the circuit breaker, e.g. 5s; 0 disables (env: CIRCUIT_BREAKER_LATENCY)")
+	serverFlags.DurationVar(&breakerCoolDown, "circuit-breaker-cool-down", getEnvDurationWithPrefix("CIRCUIT_BREAKER_COOL_DOWN", 30*time.Second),
+		"How long the circuit breaker stays open before probing the backend again (env: CIRCUIT_BREAKER_COOL_DOWN)")
+	serverFlags.DurationVar(&getTimeout, "get-timeout", getEnvDurationWithPrefix("GET_TIMEOUT", 0),
+		"Give up on a backend GET, including reading its body, after this long, e.g. 2m; 0 disables (env: GET_TIMEOUT)")
+	serverFlags.DurationVar(&putTimeout, "put-timeout", getEnvDurationWithPrefix("PUT_TIMEOUT", 0),
+		"Give up on a backend PUT after this long, e.g. 10m; 0 disables (env: PUT_TIMEOUT)")
+	serverFlags.BoolVar(&hedgeGets, "hedge-gets", getEnvBoolWithPrefix("HEDGE_GETS", false),
+		"Issue a second backend GET when the first takes longer than the p95 GET latency, using whichever returns first (env: HEDGE_GETS)")
+	serverFlags.DurationVar(&hedgeMinDelay, "hedge-min-delay", getEnvDurationWithPrefix("HEDGE_MIN_DELAY", 20*time.Millisecond),
+		"Never hedge a backend GET sooner than this (env: HEDGE_MIN_DELAY)")
+	serverFlags.StringVar(&prefetchManifest, "prefetch-manifest", getEnvWithPrefix("PREFETCH_MANIFEST", ""),
+		"Record the outputs this build uses under this name (e.g. repo/branch) and prefetch the previous build's at startup; empty disables (env: PREFETCH_MANIFEST)")
+	serverFlags.IntVar(&prefetchWorkers, "prefetch-concurrency", getEnvIntWithPrefix("PREFETCH_CONCURRENCY", defaultPrefetchConcurrency),
+		"How many outputs are prefetched at once (env: PREFETCH_CONCURRENCY)")
+	compression = compressionFlag(compressionDefault)
+	serverFlags.Var(&compression, "compression",
+		"Compression for backend storage: lz4, zstd, auto (zstd, skipping incompressible outputs), none (env: COMPRESSION)")
+	serverFlags.IntVar(&compressionLevel, "compression-level", getEnvIntWithPrefix("COMPRESSION_LEVEL", 0),
+		"zstd compression level (1-22); 0 uses the default (env: COMPRESSION_LEVEL)")
+	serverFlags.BoolVar(&compressionDict, "compression-dict", getEnvBoolWithPrefix("COMPRESSION_DICT", true),
+		"Compress zstd PUTs with the dictionary stored by train-dict, if any (env: COMPRESSION_DICT)")
 	serverFlags.BoolVar(&asyncBackend, "async-backend", asyncBackendDefault, "Enable async backend writer for non-blocking PUT operations (env: ASYNC_BACKEND)")
 	serverFlags.BoolVar(&touchOnGet, "touch-on-get", touchOnGetDefault, "Touch S3 objects on GET to reset lifecycle expiry (env: TOUCH_ON_GET)")
 	touchAgeDefault := getEnvDurationWithPrefix("TOUCH_AGE_THRESHOLD", 0)
@@ -103,7 +231,26 @@ func runServerCommand() {
 		"Only touch objects older than this duration, e.g. 84h (env: TOUCH_AGE_THRESHOLD)")
 	serverFlags.BoolVar(&conditionalPut, "conditional-put", conditionalPutDefault, "Skip backend PUT if object already exists (env: CONDITIONAL_PUT)")
 	serverFlags.BoolVar(&s3PathStyle, "s3-path-style", s3PathStyleDefault, "Use path-style S3 addressing (required for MinIO) (env: S3_PATH_STYLE)")
+	serverFlags.Var(&s3MultipartMin, "s3-multipart-threshold",
+		"Use multipart uploads and parallel ranged GETs for S3 objects above this size; 0 disables (env: S3_MULTIPART_THRESHOLD)")
+	serverFlags.Var(&s3PartSize, "s3-part-size", "Part size for S3 multipart uploads and ranged GETs (env: S3_PART_SIZE)")
+	serverFlags.IntVar(&s3Concurrency, "s3-transfer-concurrency", getEnvIntWithPrefix("S3_TRANSFER_CONCURRENCY", backends.DefaultS3TransferConcurrency),
+		"Parts transferred concurrently per large S3 object (env: S3_TRANSFER_CONCURRENCY)")
+	serverFlags.StringVar(&fsRoot, "fs-root", fsRootDefault, "Shared directory for fs backend, e.g. an NFS mount (required for fs backend) (env: FS_ROOT)")
+	serverFlags.StringVar(&httpURL, "http-url", httpURLDefault, "Base URL of HTTP cache (required for http backend) (env: HTTP_URL)")
+	serverFlags.StringVar(&httpToken, "http-token", httpTokenDefault, "Bearer token for HTTP backend (env: HTTP_TOKEN)")
+	serverFlags.StringVar(&httpUsername, "http-username", httpUsernameDefault, "Basic auth username for HTTP backend (env: HTTP_USERNAME)")
+	serverFlags.StringVar(&httpPassword, "http-password", httpPasswordDefault, "Basic auth password for HTTP backend (env: HTTP_PASSWORD)")
+	serverFlags.DurationVar(&httpTimeout, "http-timeout", httpTimeoutDefault, "Per-request timeout for HTTP backend (env: HTTP_TIMEOUT)")
+	serverFlags.StringVar(&tierSpecs, "tiers", tiersDefault,
+		"Comma-separated tiers for tiered backend, fastest first: type[=location][:through|:back] (env: TIERS)")
 	serverFlags.BoolVar(&readOnly, "readonly", readOnlyDefault, "Suppress backend writes (Put/Touch); reads still pass through (env: READONLY)")
+	serverFlags.BoolVar(&dedup, "dedup", dedupDefault,
+		"Store backend bodies once per output ID, with small per-action index records (env: DEDUP)")
+	serverFlags.StringVar(&encryptionKeyFile, "encryption-key-file", encryptionKeyFileDefault,
+		"File of AES keys (<key ID>:<base64 key> per line, current key first) to encrypt backend objects with (env: ENCRYPTION_KEY_FILE)")
+	serverFlags.StringVar(&signingKeyFile, "signing-key-file", signingKeyFileDefault,
+		"File of HMAC keys (<key ID>:<base64 key> per line, current key first) to sign backend objects with; unsigned objects become misses (env: SIGNING_KEY_FILE)")
 
 	serverFlags.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [flags]\n\n", os.Args[0])
@@ -115,19 +262,55 @@ func runServerCommand() {
 		fmt.Fprintf(os.Stderr, "  The prefixed version takes precedence if both are set.\n\n")
 		fmt.Fprintf(os.Stderr, "  DEBUG            Enable debug logging (true/false)\n")
 		fmt.Fprintf(os.Stderr, "  PRINT_STATS      Print cache statistics on exit (true/false)\n")
-		fmt.Fprintf(os.Stderr, "  BACKEND_TYPE     Backend type (disk, s3)\n")
+		fmt.Fprintf(os.Stderr, "  BACKEND_TYPE     Backend type (disk, s3, fs, http, tiered)\n")
 		fmt.Fprintf(os.Stderr, "  LOCK_TYPE        Deduplication type (memory, fslock)\n")
 		fmt.Fprintf(os.Stderr, "  LOCK_DIR         Lock directory for fslock\n")
 		fmt.Fprintf(os.Stderr, "  CACHE_DIR        Local cache directory\n")
+		fmt.Fprintf(os.Stderr, "  LOCAL_CACHE_MAX_BYTES Local cache size limit (e.g. 50GiB, 0 disables)\n")
+		fmt.Fprintf(os.Stderr, "  LOCAL_DEDUP      Hardlink identical outputs in the local cache (true/false)\n")
+		fmt.Fprintf(os.Stderr, "  VERIFY_LOCAL_HITS Verify local cache entry checksums before serving them (true/false)\n")
+		fmt.Fprintf(os.Stderr, "  BACKEND_ERROR_POLICY What a GET returns when the backend fails (miss, fail)\n")
 		fmt.Fprintf(os.Stderr, "  S3_BUCKET        S3 bucket name\n")
 		fmt.Fprintf(os.Stderr, "  S3_PREFIX        S3 key prefix\n")
+		fmt.Fprintf(os.Stderr, "  S3_READ_PREFIXES S3 key prefixes to also read from (e.g. gobuildcache/main/)\n")
 		fmt.Fprintf(os.Stderr, "  S3_PATH_STYLE    Use path-style S3 addressing (true/false)\n")
-		fmt.Fprintf(os.Stderr, "  COMPRESSION      Enable LZ4 compression (true/false)\n")
+		fmt.Fprintf(os.Stderr, "  S3_MULTIPART_THRESHOLD Multipart/ranged transfer threshold (e.g. 16MiB, 0 disables)\n")
+		fmt.Fprintf(os.Stderr, "  S3_PART_SIZE     Part size for multipart/ranged transfers (e.g. 8MiB)\n")
+		fmt.Fprintf(os.Stderr, "  S3_TRANSFER_CONCURRENCY Parts transferred concurrently per object\n")
+		fmt.Fprintf(os.Stderr, "  FS_ROOT          Shared directory for fs backend\n")
+		fmt.Fprintf(os.Stderr, "  HTTP_URL         Base URL of HTTP cache\n")
+		fmt.Fprintf(os.Stderr, "  HTTP_TOKEN       Bearer token for HTTP backend\n")
+		fmt.Fprintf(os.Stderr, "  HTTP_USERNAME    Basic auth username for HTTP backend\n")
+		fmt.Fprintf(os.Stderr, "  HTTP_PASSWORD    Basic auth password for HTTP backend\n")
+		fmt.Fprintf(os.Stderr, "  HTTP_TIMEOUT     Per-request timeout for HTTP backend (e.g. 30s)\n")
+		fmt.Fprintf(os.Stderr, "  TIERS            Tiers for tiered backend (e.g. fs=/mnt/cache,s3:back)\n")
+		fmt.Fprintf(os.Stderr, "  RETRY_MAX_ATTEMPTS Attempts per failing backend operation (1 disables retries)\n")
+		fmt.Fprintf(os.Stderr, "  RETRY_BASE_DELAY Delay before the first backend retry (e.g. 100ms)\n")
+		fmt.Fprintf(os.Stderr, "  RETRY_MAX_DELAY  Maximum delay between backend retries (e.g. 2s)\n")
+		fmt.Fprintf(os.Stderr, "  RETRY_JITTER     Randomized fraction of each retry delay (0.0-1.0)\n")
+		fmt.Fprintf(os.Stderr, "  RETRY_TIMEOUT    Per-attempt backend timeout (e.g. 30s, 0 disables)\n")
+		fmt.Fprintf(os.Stderr, "  CIRCUIT_BREAKER_FAILURES Consecutive backend failures that open the circuit breaker (0 disables)\n")
+		fmt.Fprintf(os.Stderr, "  CIRCUIT_BREAKER_LATENCY Backend latency that counts as a failure (e.g. 5s, 0 disables)\n")
+		fmt.Fprintf(os.Stderr, "  CIRCUIT_BREAKER_COOL_DOWN How long the circuit breaker stays open (e.g. 30s)\n")
+		fmt.Fprintf(os.Stderr, "  GET_TIMEOUT      Deadline for a backend GET (e.g. 2m, 0 disables)\n")
+		fmt.Fprintf(os.Stderr, "  PUT_TIMEOUT      Deadline for a backend PUT (e.g. 10m, 0 disables)\n")
+		fmt.Fprintf(os.Stderr, "  HEDGE_GETS       Hedge backend GETs slower than the p95 (true/false)\n")
+		fmt.Fprintf(os.Stderr, "  HEDGE_MIN_DELAY  Minimum delay before hedging a backend GET (e.g. 20ms)\n")
+		fmt.Fprintf(os.Stderr, "  PREFETCH_MANIFEST Name of the manifest to record and prefetch (e.g. repo/branch)\n")
+		fmt.Fprintf(os.Stderr, "  PREFETCH_CONCURRENCY Outputs prefetched at once\n")
+		fmt.Fprintf(os.Stderr, "  COMPRESSION      Backend compression (lz4, zstd, auto, none)\n")
+		fmt.Fprintf(os.Stderr, "  COMPRESSION_LEVEL zstd compression level (1-22, 0 for the default)\n")
+		fmt.Fprintf(os.Stderr, "  COMPRESSION_DICT Use the dictionary stored by train-dict for zstd (true/false)\n")
 		fmt.Fprintf(os.Stderr, "  ASYNC_BACKEND    Enable async backend writer (true/false)\n")
 		fmt.Fprintf(os.Stderr, "  TOUCH_ON_GET     Touch S3 objects on GET to reset lifecycle expiry (true/false)\n")
 		fmt.Fprintf(os.Stderr, "  TOUCH_AGE_THRESHOLD Only touch objects older than this duration (e.g. 84h)\n")
 		fmt.Fprintf(os.Stderr, "  CONDITIONAL_PUT  Skip backend PUT if object already exists (true/false)\n")
 		fmt.Fprintf(os.Stderr, "  READONLY         Suppress backend writes; reads still pass through (true/false)\n")
+		fmt.Fprintf(os.Stderr, "  DEDUP            Deduplicate backend bodies by output ID (true/false)\n")
+		fmt.Fprintf(os.Stderr, "  ENCRYPTION_KEY_FILE File of keys to encrypt backend objects with\n")
+		fmt.Fprintf(os.Stderr, "  ENCRYPTION_KEY   Keys to encrypt backend objects with, instead of a file\n")
+		fmt.Fprintf(os.Stderr, "  SIGNING_KEY_FILE File of keys to sign and verify backend objects with\n")
+		fmt.Fprintf(os.Stderr, "  SIGNING_KEY      Keys to sign and verify backend objects with, instead of a file\n")
 		fmt.Fprintf(os.Stderr, "  STATS_MACHINE    Print one-line machine-readable stats on exit (true/false)\n")
 		fmt.Fprintf(os.Stderr, "\nNote: Command-line flags take precedence over environment variables.\n")
 		fmt.Fprintf(os.Stderr, "\nExamples:\n")
@@ -135,6 +318,8 @@ func runServerCommand() {
 		fmt.Fprintf(os.Stderr, "  %s -cache-dir=/var/cache/go\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  # Run with S3 backend using flags:\n")
 		fmt.Fprintf(os.Stderr, "  %s -backend=s3 -s3-bucket=my-cache-bucket\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  # Run with a shared filesystem backend (e.g. NFS):\n")
+		fmt.Fprintf(os.Stderr, "  %s -backend=fs -fs-root=/mnt/cache\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  # Run with environment variables (prefixed form):\n")
 		fmt.Fprintf(os.Stderr, "  GOBUILDCACHE_BACKEND_TYPE=s3 GOBUILDCACHE_S3_BUCKET=my-cache-bucket %s\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  # Run with environment variables (unprefixed form, also supported):\n")
@@ -151,20 +336,22 @@ func runClearCommand() {
 	// Get defaults from environment variables.
 	// All variables support both GOBUILDCACHE_<KEY> and <KEY> forms, with prefixed taking precedence.
 	var (
-		clearFlags      = flag.NewFlagSet("clear", flag.ExitOnError)
-		debugDefault    = getEnvBoolWithPrefix("DEBUG", false)
-		backendDefault  = getEnvWithPrefix("BACKEND_TYPE", getEnv("BACKEND", "disk"))
-		cacheDirDefault = getEnvWithPrefix("CACHE_DIR", filepath.Join(os.TempDir(), "gobuildcache", "cache"))
-		s3BucketDefault = getEnvWithPrefix("S3_BUCKET", "")
+		clearFlags         = flag.NewFlagSet("clear", flag.ExitOnError)
+		debugDefault       = getEnvBoolWithPrefix("DEBUG", false)
+		backendDefault     = getEnvWithPrefix("BACKEND_TYPE", getEnv("BACKEND", "disk"))
+		cacheDirDefault    = getEnvWithPrefix("CACHE_DIR", filepath.Join(os.TempDir(), "gobuildcache", "cache"))
+		s3BucketDefault    = getEnvWithPrefix("S3_BUCKET", "")
 		s3PrefixDefault    = getEnvWithPrefix("S3_PREFIX", "")
 		s3PathStyleDefault = getEnvBoolWithPrefix("S3_PATH_STYLE", false)
+		fsRootDefault      = getEnvWithPrefix("FS_ROOT", "")
 	)
 	clearFlags.BoolVar(&debug, "debug", debugDefault, "Enable debug logging to stderr (env: DEBUG)")
-	clearFlags.StringVar(&backendType, "backend", backendDefault, "Backend type: disk (local only), s3 (env: BACKEND_TYPE)")
+	clearFlags.StringVar(&backendType, "backend", backendDefault, "Backend type: disk (local only), s3, fs (env: BACKEND_TYPE)")
 	clearFlags.StringVar(&cacheDir, "cache-dir", cacheDirDefault, "Local cache directory (env: CACHE_DIR)")
 	clearFlags.StringVar(&s3Bucket, "s3-bucket", s3BucketDefault, "S3 bucket name (required for s3 backend) (env: S3_BUCKET)")
 	clearFlags.StringVar(&s3Prefix, "s3-prefix", s3PrefixDefault, "S3 key prefix (optional) (env: S3_PREFIX)")
 	clearFlags.BoolVar(&s3PathStyle, "s3-path-style", s3PathStyleDefault, "Use path-style S3 addressing (required for MinIO) (env: S3_PATH_STYLE)")
+	clearFlags.StringVar(&fsRoot, "fs-root", fsRootDefault, "Shared directory for fs backend (required for fs backend) (env: FS_ROOT)")
 
 	clearFlags.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s clear [flags]\n\n", os.Args[0])
@@ -176,10 +363,11 @@ func runClearCommand() {
 		fmt.Fprintf(os.Stderr, "  The prefixed version takes precedence if both are set.\n\n")
 		fmt.Fprintf(os.Stderr, "  DEBUG          Enable debug logging (true/false)\n")
 		fmt.Fprintf(os.Stderr, "  PRINT_STATS    Print cache statistics on exit (true/false)\n")
-		fmt.Fprintf(os.Stderr, "  BACKEND_TYPE   Backend type (disk, s3)\n")
+		fmt.Fprintf(os.Stderr, "  BACKEND_TYPE   Backend type (disk, s3, fs)\n")
 		fmt.Fprintf(os.Stderr, "  CACHE_DIR      Local cache directory\n")
 		fmt.Fprintf(os.Stderr, "  S3_BUCKET      S3 bucket name\n")
 		fmt.Fprintf(os.Stderr, "  S3_PREFIX      S3 key prefix\n")
+		fmt.Fprintf(os.Stderr, "  FS_ROOT        Shared directory for fs backend\n")
 		fmt.Fprintf(os.Stderr, "  S3_TMP_DIR     Local temp directory for S3 backend\n")
 		fmt.Fprintf(os.Stderr, "\nNote: Command-line flags take precedence over environment variables.\n")
 		fmt.Fprintf(os.Stderr, "\nExamples:\n")
@@ -241,18 +429,20 @@ func runClearRemoteCommand() {
 	// Get defaults from environment variables.
 	// All variables support both GOBUILDCACHE_<KEY> and <KEY> forms, with prefixed taking precedence.
 	var (
-		clearRemoteFlags = flag.NewFlagSet("clear-remote", flag.ExitOnError)
-		debugDefault     = getEnvBoolWithPrefix("DEBUG", false)
-		backendDefault   = getEnvWithPrefix("BACKEND_TYPE", getEnv("BACKEND", "disk"))
-		s3BucketDefault  = getEnvWithPrefix("S3_BUCKET", "")
+		clearRemoteFlags   = flag.NewFlagSet("clear-remote", flag.ExitOnError)
+		debugDefault       = getEnvBoolWithPrefix("DEBUG", false)
+		backendDefault     = getEnvWithPrefix("BACKEND_TYPE", getEnv("BACKEND", "disk"))
+		s3BucketDefault    = getEnvWithPrefix("S3_BUCKET", "")
 		s3PrefixDefault    = getEnvWithPrefix("S3_PREFIX", "")
 		s3PathStyleDefault = getEnvBoolWithPrefix("S3_PATH_STYLE", false)
+		fsRootDefault      = getEnvWithPrefix("FS_ROOT", "")
 	)
 	clearRemoteFlags.BoolVar(&debug, "debug", debugDefault, "Enable debug logging to stderr (env: DEBUG)")
-	clearRemoteFlags.StringVar(&backendType, "backend", backendDefault, "Backend type: disk, s3 (env: BACKEND_TYPE)")
+	clearRemoteFlags.StringVar(&backendType, "backend", backendDefault, "Backend type: disk, s3, fs (env: BACKEND_TYPE)")
 	clearRemoteFlags.StringVar(&s3Bucket, "s3-bucket", s3BucketDefault, "S3 bucket name (required for s3 backend) (env: S3_BUCKET)")
 	clearRemoteFlags.StringVar(&s3Prefix, "s3-prefix", s3PrefixDefault, "S3 key prefix (optional) (env: S3_PREFIX)")
 	clearRemoteFlags.BoolVar(&s3PathStyle, "s3-path-style", s3PathStyleDefault, "Use path-style S3 addressing (required for MinIO) (env: S3_PATH_STYLE)")
+	clearRemoteFlags.StringVar(&fsRoot, "fs-root", fsRootDefault, "Shared directory for fs backend (required for fs backend) (env: FS_ROOT)")
 
 	clearRemoteFlags.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s clear-remote [flags]\n\n", os.Args[0])
@@ -263,9 +453,10 @@ func runClearRemoteCommand() {
 		fmt.Fprintf(os.Stderr, "  All variables support both GOBUILDCACHE_<KEY> and <KEY> forms.\n")
 		fmt.Fprintf(os.Stderr, "  The prefixed version takes precedence if both are set.\n\n")
 		fmt.Fprintf(os.Stderr, "  DEBUG          Enable debug logging (true/false)\n")
-		fmt.Fprintf(os.Stderr, "  BACKEND_TYPE   Backend type (disk, s3)\n")
+		fmt.Fprintf(os.Stderr, "  BACKEND_TYPE   Backend type (disk, s3, fs)\n")
 		fmt.Fprintf(os.Stderr, "  S3_BUCKET      S3 bucket name\n")
 		fmt.Fprintf(os.Stderr, "  S3_PREFIX      S3 key prefix\n")
+		fmt.Fprintf(os.Stderr, "  FS_ROOT        Shared directory for fs backend\n")
 		fmt.Fprintf(os.Stderr, "\nNote: Command-line flags take precedence over environment variables.\n")
 		fmt.Fprintf(os.Stderr, "\nExamples:\n")
 		fmt.Fprintf(os.Stderr, "  # Clear S3 cache using flags:\n")
@@ -287,7 +478,7 @@ func runClearRemoteCommand() {
 	defer backend.Close()
 
 	// Clear the backend (remote storage)
-	if err := backend.Clear(); err != nil {
+	if err := backend.Clear(context.Background()); err != nil {
 		fmt.Fprintf(os.Stderr, "Error clearing backend cache: %v\n", err)
 		os.Exit(1)
 	}
@@ -295,6 +486,475 @@ func runClearRemoteCommand() {
 	fmt.Fprintf(os.Stdout, "Remote cache cleared successfully\n")
 }
 
+func runTrimLocalCommand() {
+	// Get defaults from environment variables.
+	// All variables support both GOBUILDCACHE_<KEY> and <KEY> forms, with prefixed taking precedence.
+	var (
+		trimLocalFlags  = flag.NewFlagSet("trim-local", flag.ExitOnError)
+		debugDefault    = getEnvBoolWithPrefix("DEBUG", false)
+		cacheDirDefault = getEnvWithPrefix("CACHE_DIR", filepath.Join(os.TempDir(), "gobuildcache", "cache"))
+		lockDirDefault  = getEnvWithPrefix("LOCK_DIR", filepath.Join(os.TempDir(), "gobuildcache", "locks"))
+	)
+	trimLocalFlags.BoolVar(&debug, "debug", debugDefault, "Enable debug logging to stderr (env: DEBUG)")
+	trimLocalFlags.StringVar(&cacheDir, "cache-dir", cacheDirDefault, "Local cache directory (env: CACHE_DIR)")
+	trimLocalFlags.StringVar(&lockDir, "lock-dir", lockDirDefault, "Lock directory shared with running servers (env: LOCK_DIR)")
+	trimLocalFlags.Var(&trimOlderThan, "older-than", "Delete entries not written or used within this duration, e.g. 72h or 7d")
+	trimLocalFlags.Var(&trimMaxSize, "max-size", "Then delete least recently used entries until the cache is at most this size, e.g. 50GiB")
+
+	trimLocalFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s trim-local [flags]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Delete stale entries from the local filesystem cache directory.\n")
+		fmt.Fprintf(os.Stderr, "At least one of -older-than or -max-size is required.\n\n")
+		fmt.Fprintf(os.Stderr, "Flags (can also be set via environment variables):\n")
+		trimLocalFlags.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nEnvironment Variables:\n")
+		fmt.Fprintf(os.Stderr, "  All variables support both GOBUILDCACHE_<KEY> and <KEY> forms.\n")
+		fmt.Fprintf(os.Stderr, "  The prefixed version takes precedence if both are set.\n\n")
+		fmt.Fprintf(os.Stderr, "  DEBUG          Enable debug logging (true/false)\n")
+		fmt.Fprintf(os.Stderr, "  CACHE_DIR      Local cache directory\n")
+		fmt.Fprintf(os.Stderr, "  LOCK_DIR       Filesystem lock directory\n")
+		fmt.Fprintf(os.Stderr, "\nNote: Command-line flags take precedence over environment variables.\n")
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  # Delete entries unused for 3 days, then cap the cache at 50GiB:\n")
+		fmt.Fprintf(os.Stderr, "  %s trim-local -older-than=72h -max-size=50GiB\n", os.Args[0])
+	}
+
+	_ = trimLocalFlags.Parse(os.Args[2:])
+
+	if trimOlderThan <= 0 && trimMaxSize <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: at least one of -older-than or -max-size is required\n\n")
+		trimLocalFlags.Usage()
+		os.Exit(1)
+	}
+
+	if err := trimLocalCache(cacheDir, time.Duration(trimOlderThan), int64(trimMaxSize)); err != nil {
+		fmt.Fprintf(os.Stderr, "Error trimming local cache: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func runTrimRemoteCommand() {
+	// Get defaults from environment variables.
+	// All variables support both GOBUILDCACHE_<KEY> and <KEY> forms, with prefixed taking precedence.
+	var (
+		trimRemoteFlags    = flag.NewFlagSet("trim-remote", flag.ExitOnError)
+		debugDefault       = getEnvBoolWithPrefix("DEBUG", false)
+		backendDefault     = getEnvWithPrefix("BACKEND_TYPE", getEnv("BACKEND", "disk"))
+		s3BucketDefault    = getEnvWithPrefix("S3_BUCKET", "")
+		s3PrefixDefault    = getEnvWithPrefix("S3_PREFIX", "gobuildcache/")
+		s3PathStyleDefault = getEnvBoolWithPrefix("S3_PATH_STYLE", false)
+		fsRootDefault      = getEnvWithPrefix("FS_ROOT", "")
+		tiersDefault       = getEnvWithPrefix("TIERS", "")
+	)
+	trimRemoteFlags.BoolVar(&debug, "debug", debugDefault, "Enable debug logging to stderr (env: DEBUG)")
+	trimRemoteFlags.StringVar(&backendType, "backend", backendDefault, "Backend type: disk, s3, fs, tiered (env: BACKEND_TYPE)")
+	trimRemoteFlags.StringVar(&s3Bucket, "s3-bucket", s3BucketDefault, "S3 bucket name (required for s3 backend) (env: S3_BUCKET)")
+	trimRemoteFlags.StringVar(&s3Prefix, "s3-prefix", s3PrefixDefault, "S3 key prefix (optional) (env: S3_PREFIX)")
+	trimRemoteFlags.BoolVar(&s3PathStyle, "s3-path-style", s3PathStyleDefault, "Use path-style S3 addressing (required for MinIO) (env: S3_PATH_STYLE)")
+	trimRemoteFlags.StringVar(&fsRoot, "fs-root", fsRootDefault, "Shared directory for fs backend (required for fs backend) (env: FS_ROOT)")
+	trimRemoteFlags.StringVar(&tierSpecs, "tiers", tiersDefault,
+		"Comma-separated tiers for tiered backend, fastest first: type[=location][:through|:back] (env: TIERS)")
+	trimRemoteFlags.Var(&trimOlderThan, "older-than", "Delete entries not written or touched within this duration, e.g. 7d (required)")
+
+	trimRemoteFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s trim-remote [flags]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Delete stale entries from the remote backend cache. Useful for storage\n")
+		fmt.Fprintf(os.Stderr, "without a lifecycle policy, such as MinIO or NFS.\n\n")
+		fmt.Fprintf(os.Stderr, "Flags (can also be set via environment variables):\n")
+		trimRemoteFlags.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nEnvironment Variables:\n")
+		fmt.Fprintf(os.Stderr, "  All variables support both GOBUILDCACHE_<KEY> and <KEY> forms.\n")
+		fmt.Fprintf(os.Stderr, "  The prefixed version takes precedence if both are set.\n\n")
+		fmt.Fprintf(os.Stderr, "  DEBUG          Enable debug logging (true/false)\n")
+		fmt.Fprintf(os.Stderr, "  BACKEND_TYPE   Backend type (disk, s3, fs, tiered)\n")
+		fmt.Fprintf(os.Stderr, "  S3_BUCKET      S3 bucket name\n")
+		fmt.Fprintf(os.Stderr, "  S3_PREFIX      S3 key prefix\n")
+		fmt.Fprintf(os.Stderr, "  FS_ROOT        Shared directory for fs backend\n")
+		fmt.Fprintf(os.Stderr, "  TIERS          Tiers for tiered backend\n")
+		fmt.Fprintf(os.Stderr, "\nNote: Command-line flags take precedence over environment variables.\n")
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  # Delete MinIO objects not used for a week:\n")
+		fmt.Fprintf(os.Stderr, "  %s trim-remote -backend=s3 -s3-bucket=my-cache-bucket -s3-path-style -older-than=7d\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  # Trim a shared NFS cache:\n")
+		fmt.Fprintf(os.Stderr, "  %s trim-remote -backend=fs -fs-root=/mnt/gobuildcache -older-than=7d\n", os.Args[0])
+	}
+
+	_ = trimRemoteFlags.Parse(os.Args[2:])
+
+	if trimOlderThan <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: -older-than is required\n\n")
+		trimRemoteFlags.Usage()
+		os.Exit(1)
+	}
+
+	// Trim operates on the storage backend directly; none of the runtime
+	// wrappers (async, read-only, ...) apply here.
+	backend, err := createStorageBackend()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating backend: %v\n", err)
+		os.Exit(1)
+	}
+	defer backend.Close()
+
+	trimmer, ok := backend.(backends.Trimmer)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error: backend %q does not support trimming\n", backendType)
+		os.Exit(1)
+	}
+
+	stats, err := trimmer.Trim(context.Background(), time.Now().Add(-time.Duration(trimOlderThan)))
+	fmt.Fprintf(os.Stdout, "Remote cache trimmed: %d of %d entries deleted (%s freed)\n",
+		stats.Deleted, stats.Scanned, formatBytes(stats.DeletedBytes))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error trimming backend cache: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func runFsckLocalCommand() {
+	// Get defaults from environment variables.
+	// All variables support both GOBUILDCACHE_<KEY> and <KEY> forms, with prefixed taking precedence.
+	var (
+		fsckLocalFlags  = flag.NewFlagSet("fsck-local", flag.ExitOnError)
+		debugDefault    = getEnvBoolWithPrefix("DEBUG", false)
+		cacheDirDefault = getEnvWithPrefix("CACHE_DIR", filepath.Join(os.TempDir(), "gobuildcache", "cache"))
+		lockDirDefault  = getEnvWithPrefix("LOCK_DIR", filepath.Join(os.TempDir(), "gobuildcache", "locks"))
+	)
+	fsckLocalFlags.BoolVar(&debug, "debug", debugDefault, "Enable debug logging to stderr (env: DEBUG)")
+	fsckLocalFlags.StringVar(&cacheDir, "cache-dir", cacheDirDefault, "Local cache directory (env: CACHE_DIR)")
+	fsckLocalFlags.StringVar(&lockDir, "lock-dir", lockDirDefault, "Lock directory shared with running servers (env: LOCK_DIR)")
+	fsckLocalFlags.BoolVar(&fsckRepair, "repair", false, "Delete every broken file found")
+	fsckLocalFlags.BoolVar(&fsckVerify, "verify", false, "Also verify the checksum of every entry (reads every file)")
+
+	fsckLocalFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s fsck-local [flags]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Check the local filesystem cache directory for orphaned temp files, data\n")
+		fmt.Fprintf(os.Stderr, "files without metadata (and vice versa), metadata that doesn't match its\n")
+		fmt.Fprintf(os.Stderr, "data, entries from older cache formats and unreferenced dedup blobs.\n")
+		fmt.Fprintf(os.Stderr, "Exits with status 1 if any problem is left unrepaired.\n\n")
+		fmt.Fprintf(os.Stderr, "Flags (can also be set via environment variables):\n")
+		fsckLocalFlags.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nEnvironment Variables:\n")
+		fmt.Fprintf(os.Stderr, "  All variables support both GOBUILDCACHE_<KEY> and <KEY> forms.\n")
+		fmt.Fprintf(os.Stderr, "  The prefixed version takes precedence if both are set.\n\n")
+		fmt.Fprintf(os.Stderr, "  DEBUG          Enable debug logging (true/false)\n")
+		fmt.Fprintf(os.Stderr, "  CACHE_DIR      Local cache directory\n")
+		fmt.Fprintf(os.Stderr, "  LOCK_DIR       Filesystem lock directory\n")
+		fmt.Fprintf(os.Stderr, "\nNote: Command-line flags take precedence over environment variables.\n")
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  # Report problems, verifying checksums:\n")
+		fmt.Fprintf(os.Stderr, "  %s fsck-local -verify\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  # Delete everything broken:\n")
+		fmt.Fprintf(os.Stderr, "  %s fsck-local -repair\n", os.Args[0])
+	}
+
+	_ = fsckLocalFlags.Parse(os.Args[2:])
+
+	unrepaired, err := fsckLocalCache(cacheDir, fsckVerify, fsckRepair)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error checking local cache: %v\n", err)
+		os.Exit(1)
+	}
+	if unrepaired > 0 {
+		os.Exit(1)
+	}
+}
+
+func runFsckRemoteCommand() {
+	// Get defaults from environment variables.
+	// All variables support both GOBUILDCACHE_<KEY> and <KEY> forms, with prefixed taking precedence.
+	var (
+		fsckRemoteFlags    = flag.NewFlagSet("fsck-remote", flag.ExitOnError)
+		debugDefault       = getEnvBoolWithPrefix("DEBUG", false)
+		backendDefault     = getEnvWithPrefix("BACKEND_TYPE", getEnv("BACKEND", "disk"))
+		s3BucketDefault    = getEnvWithPrefix("S3_BUCKET", "")
+		s3PrefixDefault    = getEnvWithPrefix("S3_PREFIX", "gobuildcache/")
+		s3PathStyleDefault = getEnvBoolWithPrefix("S3_PATH_STYLE", false)
+		fsRootDefault      = getEnvWithPrefix("FS_ROOT", "")
+		tiersDefault       = getEnvWithPrefix("TIERS", "")
+	)
+	fsckRemoteFlags.BoolVar(&debug, "debug", debugDefault, "Enable debug logging to stderr (env: DEBUG)")
+	fsckRemoteFlags.StringVar(&backendType, "backend", backendDefault, "Backend type: disk, s3, fs, tiered (env: BACKEND_TYPE)")
+	fsckRemoteFlags.StringVar(&s3Bucket, "s3-bucket", s3BucketDefault, "S3 bucket name (required for s3 backend) (env: S3_BUCKET)")
+	fsckRemoteFlags.StringVar(&s3Prefix, "s3-prefix", s3PrefixDefault, "S3 key prefix (optional) (env: S3_PREFIX)")
+	fsckRemoteFlags.BoolVar(&s3PathStyle, "s3-path-style", s3PathStyleDefault, "Use path-style S3 addressing (required for MinIO) (env: S3_PATH_STYLE)")
+	fsckRemoteFlags.StringVar(&fsRoot, "fs-root", fsRootDefault, "Shared directory for fs backend (required for fs backend) (env: FS_ROOT)")
+	fsckRemoteFlags.StringVar(&tierSpecs, "tiers", tiersDefault,
+		"Comma-separated tiers for tiered backend, fastest first: type[=location][:through|:back] (env: TIERS)")
+	fsckRemoteFlags.IntVar(&fsckSample, "sample", 0, "Only check a random sample of this many objects; 0 checks everything")
+	fsckRemoteFlags.BoolVar(&fsckRepair, "repair", false, "Delete every invalid object found")
+
+	fsckRemoteFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s fsck-remote [flags]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Check the remote backend cache for objects with missing or unparseable\n")
+		fmt.Fprintf(os.Stderr, "metadata, or whose size doesn't match their metadata. GETs of these\n")
+		fmt.Fprintf(os.Stderr, "objects fail instead of missing. Exits with status 1 if any invalid\n")
+		fmt.Fprintf(os.Stderr, "object is left unrepaired.\n\n")
+		fmt.Fprintf(os.Stderr, "Flags (can also be set via environment variables):\n")
+		fsckRemoteFlags.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nEnvironment Variables:\n")
+		fmt.Fprintf(os.Stderr, "  All variables support both GOBUILDCACHE_<KEY> and <KEY> forms.\n")
+		fmt.Fprintf(os.Stderr, "  The prefixed version takes precedence if both are set.\n\n")
+		fmt.Fprintf(os.Stderr, "  DEBUG          Enable debug logging (true/false)\n")
+		fmt.Fprintf(os.Stderr, "  BACKEND_TYPE   Backend type (disk, s3, fs, tiered)\n")
+		fmt.Fprintf(os.Stderr, "  S3_BUCKET      S3 bucket name\n")
+		fmt.Fprintf(os.Stderr, "  S3_PREFIX      S3 key prefix\n")
+		fmt.Fprintf(os.Stderr, "  FS_ROOT        Shared directory for fs backend\n")
+		fmt.Fprintf(os.Stderr, "  TIERS          Tiers for tiered backend\n")
+		fmt.Fprintf(os.Stderr, "\nNote: Command-line flags take precedence over environment variables.\n")
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  # Spot-check 1000 random objects:\n")
+		fmt.Fprintf(os.Stderr, "  %s fsck-remote -backend=s3 -s3-bucket=my-cache-bucket -sample=1000\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  # Check and repair a shared NFS cache:\n")
+		fmt.Fprintf(os.Stderr, "  %s fsck-remote -backend=fs -fs-root=/mnt/gobuildcache -repair\n", os.Args[0])
+	}
+
+	_ = fsckRemoteFlags.Parse(os.Args[2:])
+
+	// Like trim-remote, this operates on the storage backend directly.
+	backend, err := createStorageBackend()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating backend: %v\n", err)
+		os.Exit(1)
+	}
+	defer backend.Close()
+
+	checker, ok := backend.(backends.Checker)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error: backend %q does not support checking\n", backendType)
+		os.Exit(1)
+	}
+
+	opts := backends.CheckOptions{Sample: fsckSample, Repair: fsckRepair}
+	stats, err := checker.Check(context.Background(), opts, func(key, problem string) {
+		fmt.Fprintf(os.Stdout, "%s: %s\n", key, problem)
+	})
+	fmt.Fprintf(os.Stdout, "Remote cache checked: %d objects, %d invalid, %d repaired\n",
+		stats.Scanned, stats.Invalid, stats.Repaired)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error checking backend cache: %v\n", err)
+		os.Exit(1)
+	}
+	if stats.Invalid > stats.Repaired {
+		os.Exit(1)
+	}
+}
+
+func runTrainDictCommand() {
+	// Get defaults from environment variables.
+	// All variables support both GOBUILDCACHE_<KEY> and <KEY> forms, with prefixed taking precedence.
+	var (
+		trainDictFlags     = flag.NewFlagSet("train-dict", flag.ExitOnError)
+		debugDefault       = getEnvBoolWithPrefix("DEBUG", false)
+		cacheDirDefault    = getEnvWithPrefix("CACHE_DIR", filepath.Join(os.TempDir(), "gobuildcache", "cache"))
+		backendDefault     = getEnvWithPrefix("BACKEND_TYPE", getEnv("BACKEND", "disk"))
+		s3BucketDefault    = getEnvWithPrefix("S3_BUCKET", "")
+		s3PrefixDefault    = getEnvWithPrefix("S3_PREFIX", "gobuildcache/")
+		s3PathStyleDefault = getEnvBoolWithPrefix("S3_PATH_STYLE", false)
+		fsRootDefault      = getEnvWithPrefix("FS_ROOT", "")
+		httpURLDefault     = getEnvWithPrefix("HTTP_URL", "")
+		httpTokenDefault   = getEnvWithPrefix("HTTP_TOKEN", "")
+		tiersDefault       = getEnvWithPrefix("TIERS", "")
+		encryptionDefault  = getEnvWithPrefix("ENCRYPTION_KEY_FILE", "")
+		signingDefault     = getEnvWithPrefix("SIGNING_KEY_FILE", "")
+	)
+	dictSize = defaultDictSize
+	trainDictFlags.BoolVar(&debug, "debug", debugDefault, "Enable debug logging to stderr (env: DEBUG)")
+	trainDictFlags.StringVar(&cacheDir, "cache-dir", cacheDirDefault, "Local cache directory to sample (env: CACHE_DIR)")
+	trainDictFlags.StringVar(&backendType, "backend", backendDefault, "Backend type: s3, fs, http, tiered (env: BACKEND_TYPE)")
+	trainDictFlags.StringVar(&s3Bucket, "s3-bucket", s3BucketDefault, "S3 bucket name (required for s3 backend) (env: S3_BUCKET)")
+	trainDictFlags.StringVar(&s3Prefix, "s3-prefix", s3PrefixDefault, "S3 key prefix (optional) (env: S3_PREFIX)")
+	trainDictFlags.BoolVar(&s3PathStyle, "s3-path-style", s3PathStyleDefault, "Use path-style S3 addressing (required for MinIO) (env: S3_PATH_STYLE)")
+	trainDictFlags.StringVar(&fsRoot, "fs-root", fsRootDefault, "Shared directory for fs backend (required for fs backend) (env: FS_ROOT)")
+	trainDictFlags.StringVar(&httpURL, "http-url", httpURLDefault, "Base URL of HTTP cache (required for http backend) (env: HTTP_URL)")
+	trainDictFlags.StringVar(&httpToken, "http-token", httpTokenDefault, "Bearer token for HTTP backend (env: HTTP_TOKEN)")
+	trainDictFlags.StringVar(&tierSpecs, "tiers", tiersDefault,
+		"Comma-separated tiers for tiered backend, fastest first: type[=location][:through|:back] (env: TIERS)")
+	trainDictFlags.StringVar(&encryptionKeyFile, "encryption-key-file", encryptionDefault,
+		"File of AES keys to encrypt the dictionary with, as used by the server (env: ENCRYPTION_KEY_FILE)")
+	trainDictFlags.StringVar(&signingKeyFile, "signing-key-file", signingDefault,
+		"File of HMAC keys to sign the dictionary with, as used by the server (env: SIGNING_KEY_FILE)")
+	trainDictFlags.IntVar(&dictSamples, "samples", 1000, "Maximum number of local cache entries to train on")
+	trainDictFlags.Var(&dictSize, "dict-size", "Maximum dictionary size")
+	trainDictFlags.BoolVar(&dictDryRun, "dry-run", false, "Train and report the dictionary's effect without storing it")
+
+	trainDictFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s train-dict [flags]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Train a zstd dictionary on a sample of the local cache entries and store it\n")
+		fmt.Fprintf(os.Stderr, "in the backend. Instances running with -compression=zstd or auto load it at\n")
+		fmt.Fprintf(os.Stderr, "startup and compress new objects with it.\n\n")
+		fmt.Fprintf(os.Stderr, "Flags (can also be set via environment variables):\n")
+		trainDictFlags.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nEnvironment Variables:\n")
+		fmt.Fprintf(os.Stderr, "  All variables support both GOBUILDCACHE_<KEY> and <KEY> forms.\n")
+		fmt.Fprintf(os.Stderr, "  The prefixed version takes precedence if both are set.\n\n")
+		fmt.Fprintf(os.Stderr, "  DEBUG          Enable debug logging (true/false)\n")
+		fmt.Fprintf(os.Stderr, "  CACHE_DIR      Local cache directory\n")
+		fmt.Fprintf(os.Stderr, "  BACKEND_TYPE   Backend type (s3, fs, http, tiered)\n")
+		fmt.Fprintf(os.Stderr, "  S3_BUCKET      S3 bucket name\n")
+		fmt.Fprintf(os.Stderr, "  S3_PREFIX      S3 key prefix\n")
+		fmt.Fprintf(os.Stderr, "  FS_ROOT        Shared directory for fs backend\n")
+		fmt.Fprintf(os.Stderr, "  HTTP_URL       Base URL of HTTP cache\n")
+		fmt.Fprintf(os.Stderr, "  TIERS          Tiers for tiered backend\n")
+		fmt.Fprintf(os.Stderr, "  ENCRYPTION_KEY_FILE File of keys to encrypt the dictionary with\n")
+		fmt.Fprintf(os.Stderr, "  ENCRYPTION_KEY Keys to encrypt the dictionary with, instead of a file\n")
+		fmt.Fprintf(os.Stderr, "  SIGNING_KEY_FILE File of keys to sign the dictionary with\n")
+		fmt.Fprintf(os.Stderr, "  SIGNING_KEY    Keys to sign the dictionary with, instead of a file\n")
+		fmt.Fprintf(os.Stderr, "\nNote: Command-line flags take precedence over environment variables.\n")
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  # See how much a dictionary would help:\n")
+		fmt.Fprintf(os.Stderr, "  %s train-dict -dry-run\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  # Train a dictionary and store it in S3:\n")
+		fmt.Fprintf(os.Stderr, "  %s train-dict -backend=s3 -s3-bucket=my-cache-bucket\n", os.Args[0])
+	}
+
+	_ = trainDictFlags.Parse(os.Args[2:])
+
+	if strings.ToLower(backendType) == "disk" && !dictDryRun {
+		fmt.Fprintf(os.Stderr, "Error: the disk backend can't store dictionaries; use -dry-run or a remote backend\n")
+		os.Exit(1)
+	}
+
+	lc, err := newLocalCache(cacheDir, newLogger())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening local cache: %v\n", err)
+		os.Exit(1)
+	}
+	trained, samples, err := trainDict(lc, dictSamples, int(dictSize))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error training dictionary: %v\n", err)
+		os.Exit(1)
+	}
+	id, err := dictID(trained)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error training dictionary: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stdout, "Trained dictionary %08x (%s) on %d samples\n", id, formatBytes(int64(len(trained))), len(samples))
+	if err := printDictSavings(samples, trained); err != nil {
+		fmt.Fprintf(os.Stderr, "Error evaluating dictionary: %v\n", err)
+		os.Exit(1)
+	}
+	if dictDryRun {
+		return
+	}
+
+	// The dictionary is written straight to the storage backend, so it isn't
+	// affected by -dedup or -readonly. It's encrypted like any other object,
+	// since it's made of build outputs, and signed so that servers that verify
+	// signatures will load it.
+	backend, err := createStorageBackend()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating backend: %v\n", err)
+		os.Exit(1)
+	}
+	if backend, _, err = wrapEncrypt(backend); err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating backend: %v\n", err)
+		os.Exit(1)
+	}
+	if backend, err = wrapSign(backend); err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating backend: %v\n", err)
+		os.Exit(1)
+	}
+	defer backend.Close()
+
+	if _, err := storeDict(context.Background(), backend, trained); err != nil {
+		fmt.Fprintf(os.Stderr, "Error storing dictionary: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stdout, "Stored dictionary %08x as the current dictionary\n", id)
+}
+
+// printDictSavings prints how well samples compress with zstd, with and
+// without the trained dictionary d.
+func printDictSavings(samples [][]byte, d []byte) error {
+	var raw, plain, withDict int64
+	for _, sample := range samples {
+		for _, c := range []struct {
+			dict []byte
+			size *int64
+		}{{nil, &plain}, {d, &withDict}} {
+			var compressed bytes.Buffer
+			if err := compressTo(&compressed, bytes.NewReader(sample), codecZstd, 0, c.dict); err != nil {
+				return err
+			}
+			*c.size += int64(compressed.Len())
+		}
+		raw += int64(len(sample))
+	}
+	fmt.Fprintf(os.Stdout, "Samples compress from %s to %s without the dictionary, %s with it\n",
+		formatBytes(raw), formatBytes(plain), formatBytes(withDict))
+	return nil
+}
+
+func runServeCommand() {
+	// Get defaults from environment variables.
+	// All variables support both GOBUILDCACHE_<KEY> and <KEY> forms, with prefixed taking precedence.
+	var (
+		serveFlags         = flag.NewFlagSet("serve", flag.ExitOnError)
+		debugDefault       = getEnvBoolWithPrefix("DEBUG", false)
+		backendDefault     = getEnvWithPrefix("SERVE_BACKEND_TYPE", "fs")
+		fsRootDefault      = getEnvWithPrefix("FS_ROOT", filepath.Join(os.TempDir(), "gobuildcache", "serve"))
+		s3BucketDefault    = getEnvWithPrefix("S3_BUCKET", "")
+		s3PrefixDefault    = getEnvWithPrefix("S3_PREFIX", "gobuildcache/")
+		s3PathStyleDefault = getEnvBoolWithPrefix("S3_PATH_STYLE", false)
+		listenDefault      = getEnvWithPrefix("LISTEN_ADDR", ":8080")
+		serveTokenDefault  = getEnvWithPrefix("SERVE_TOKEN", "")
+		tiersDefault       = getEnvWithPrefix("TIERS", "")
+	)
+	serveFlags.BoolVar(&debug, "debug", debugDefault, "Enable debug logging to stderr (env: DEBUG)")
+	serveFlags.StringVar(&backendType, "backend", backendDefault, "Backend to expose: fs, s3, tiered (env: SERVE_BACKEND_TYPE)")
+	serveFlags.StringVar(&fsRoot, "fs-root", fsRootDefault, "Directory to serve for fs backend (env: FS_ROOT)")
+	serveFlags.StringVar(&s3Bucket, "s3-bucket", s3BucketDefault, "S3 bucket name (required for s3 backend) (env: S3_BUCKET)")
+	serveFlags.StringVar(&s3Prefix, "s3-prefix", s3PrefixDefault, "S3 key prefix (optional) (env: S3_PREFIX)")
+	serveFlags.BoolVar(&s3PathStyle, "s3-path-style", s3PathStyleDefault, "Use path-style S3 addressing (required for MinIO) (env: S3_PATH_STYLE)")
+	s3MultipartMin = byteSize(getEnvByteSizeWithPrefix("S3_MULTIPART_THRESHOLD", 16<<20))
+	s3PartSize = byteSize(getEnvByteSizeWithPrefix("S3_PART_SIZE", backends.DefaultS3PartSize))
+	serveFlags.Var(&s3MultipartMin, "s3-multipart-threshold",
+		"Use multipart uploads and parallel ranged GETs for S3 objects above this size; 0 disables (env: S3_MULTIPART_THRESHOLD)")
+	serveFlags.Var(&s3PartSize, "s3-part-size", "Part size for S3 multipart uploads and ranged GETs (env: S3_PART_SIZE)")
+	serveFlags.IntVar(&s3Concurrency, "s3-transfer-concurrency", getEnvIntWithPrefix("S3_TRANSFER_CONCURRENCY", backends.DefaultS3TransferConcurrency),
+		"Parts transferred concurrently per large S3 object (env: S3_TRANSFER_CONCURRENCY)")
+	serveFlags.StringVar(&listenAddr, "listen", listenDefault, "Address to listen on (env: LISTEN_ADDR)")
+	serveFlags.StringVar(&serveToken, "token", serveTokenDefault, "Require this bearer token on every request (env: SERVE_TOKEN)")
+	serveFlags.StringVar(&tierSpecs, "tiers", tiersDefault,
+		"Comma-separated tiers for tiered backend, fastest first: type[=location][:through|:back] (env: TIERS)")
+
+	serveFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s serve [flags]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Run a shared cache server that other gobuildcache instances can use\n")
+		fmt.Fprintf(os.Stderr, "as a backend via -backend=http.\n\n")
+		fmt.Fprintf(os.Stderr, "Flags (can also be set via environment variables):\n")
+		serveFlags.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nEnvironment Variables:\n")
+		fmt.Fprintf(os.Stderr, "  All variables support both GOBUILDCACHE_<KEY> and <KEY> forms.\n")
+		fmt.Fprintf(os.Stderr, "  The prefixed version takes precedence if both are set.\n\n")
+		fmt.Fprintf(os.Stderr, "  DEBUG               Enable debug logging (true/false)\n")
+		fmt.Fprintf(os.Stderr, "  SERVE_BACKEND_TYPE  Backend to expose (fs, s3, tiered)\n")
+		fmt.Fprintf(os.Stderr, "  FS_ROOT             Directory to serve for fs backend\n")
+		fmt.Fprintf(os.Stderr, "  S3_BUCKET           S3 bucket name\n")
+		fmt.Fprintf(os.Stderr, "  S3_PREFIX           S3 key prefix\n")
+		fmt.Fprintf(os.Stderr, "  S3_PATH_STYLE       Use path-style S3 addressing (true/false)\n")
+		fmt.Fprintf(os.Stderr, "  S3_MULTIPART_THRESHOLD  Multipart/ranged transfer threshold (e.g. 16MiB)\n")
+		fmt.Fprintf(os.Stderr, "  S3_PART_SIZE        Part size for multipart/ranged transfers\n")
+		fmt.Fprintf(os.Stderr, "  S3_TRANSFER_CONCURRENCY Parts transferred concurrently per object\n")
+		fmt.Fprintf(os.Stderr, "  LISTEN_ADDR         Address to listen on\n")
+		fmt.Fprintf(os.Stderr, "  SERVE_TOKEN         Required bearer token\n")
+		fmt.Fprintf(os.Stderr, "  TIERS               Tiers for tiered backend\n")
+		fmt.Fprintf(os.Stderr, "\nNote: Command-line flags take precedence over environment variables.\n")
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  # Serve a local directory on port 8080:\n")
+		fmt.Fprintf(os.Stderr, "  %s serve -fs-root=/var/cache/gobuildcache -listen=:8080\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  # Serve a local directory in front of S3:\n")
+		fmt.Fprintf(os.Stderr, "  %s serve -backend=tiered -tiers=fs=/var/cache/gobuildcache,s3=my-cache-bucket:back\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  # Point runners at the server:\n")
+		fmt.Fprintf(os.Stderr, "  GOBUILDCACHE_BACKEND_TYPE=http GOBUILDCACHE_HTTP_URL=http://cache-box:8080 %s\n", os.Args[0])
+	}
+
+	_ = serveFlags.Parse(os.Args[2:])
+	runServe()
+}
+
 func printHelp() {
 	fmt.Fprintf(os.Stderr, "Usage: %s [command] [flags]\n\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "A remote caching server for Go builds.\n\n")
@@ -303,6 +963,12 @@ func printHelp() {
 	fmt.Fprintf(os.Stderr, "  clear         Clear both local and remote cache entries\n")
 	fmt.Fprintf(os.Stderr, "  clear-local   Clear only local cache directory\n")
 	fmt.Fprintf(os.Stderr, "  clear-remote  Clear only remote backend cache\n")
+	fmt.Fprintf(os.Stderr, "  trim-local    Delete stale entries from the local cache directory\n")
+	fmt.Fprintf(os.Stderr, "  trim-remote   Delete stale entries from the remote backend cache\n")
+	fmt.Fprintf(os.Stderr, "  fsck-local    Check the local cache directory for broken entries\n")
+	fmt.Fprintf(os.Stderr, "  fsck-remote   Check the remote backend cache for invalid objects\n")
+	fmt.Fprintf(os.Stderr, "  train-dict    Train a zstd compression dictionary and store it in the backend\n")
+	fmt.Fprintf(os.Stderr, "  serve         Run a shared HTTP cache server for other instances\n")
 	fmt.Fprintf(os.Stderr, "  help          Show this help message\n\n")
 	fmt.Fprintf(os.Stderr, "Configuration:\n")
 	fmt.Fprintf(os.Stderr, "  Flags can be set via command-line arguments or environment variables.\n")
@@ -329,9 +995,22 @@ func runServer() {
 		Debug:             debug,
 		PrintStats:        printStats,
 		PrintStatsMachine: printStatsMachine,
-		Compression:       compression,
 		TouchOnGet:        touchOnGet,
 		ConditionalPut:    conditionalPut,
+
+		Compression:      string(compression),
+		CompressionLevel: compressionLevel,
+		CompressionDict:  compressionDict,
+
+		LocalCacheMaxBytes: int64(localCacheMax),
+		LocalDedup:         localDedup,
+		VerifyLocalHits:    verifyLocalHits,
+		BackendErrorPolicy: errorPolicy,
+		GetTimeout:         getTimeout,
+		PutTimeout:         putTimeout,
+
+		PrefetchManifest:    prefetchManifest,
+		PrefetchConcurrency: prefetchWorkers,
 	})
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error creating cache program: %v\n", err)
@@ -353,7 +1032,7 @@ func runClear() {
 	defer backend.Close()
 
 	// Clear the backend (remote storage)
-	if err := backend.Clear(); err != nil {
+	if err := backend.Clear(context.Background()); err != nil {
 		fmt.Fprintf(os.Stderr, "Error clearing backend cache: %v\n", err)
 		os.Exit(1)
 	}
@@ -367,6 +1046,50 @@ func runClear() {
 	fmt.Fprintf(os.Stdout, "Cache cleared successfully\n")
 }
 
+func runServe() {
+	// Serve the storage backend alone. Runners encrypt, sign and dedup their
+	// objects themselves, and the server stores them as they arrive, so it
+	// never needs their keys.
+	backend, err := createStorageBackend()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating cache backend: %v\n", err)
+		os.Exit(1)
+	}
+	defer backend.Close()
+
+	logger := newLogger()
+	server := &http.Server{
+		Addr:              listenAddr,
+		Handler:           backends.NewHTTPHandler(backend, serveToken, logger),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- server.ListenAndServe()
+	}()
+	logger.Info("cache server listening", "addr", listenAddr, "backend", backendType)
+
+	select {
+	case err := <-errChan:
+		if !errors.Is(err, http.ErrServerClosed) {
+			fmt.Fprintf(os.Stderr, "Error running cache server: %v\n", err)
+			os.Exit(1)
+		}
+	case <-ctx.Done():
+		logger.Info("shutting down cache server")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			fmt.Fprintf(os.Stderr, "Error shutting down cache server: %v\n", err)
+			os.Exit(1)
+		}
+	}
+}
+
 // clearLocalCache removes all entries from the local cache directory.
 func clearLocalCache(cacheDir string) error {
 	// Remove the entire directory and recreate it
@@ -383,49 +1106,204 @@ func clearLocalCache(cacheDir string) error {
 	return nil
 }
 
-func createBackend() (backends.Backend, error) {
-	backendType = strings.ToLower(backendType)
+// trimLocalCache deletes local cache entries not used within olderThan and then,
+// if maxSize > 0, evicts least recently used entries until the cache fits.
+// Entries are removed under the same filesystem locks the server uses, so it's
+// safe to run while builds are using the cache.
+func trimLocalCache(cacheDir string, olderThan time.Duration, maxSize int64) error {
+	lc, err := newLocalCache(cacheDir, newLogger())
+	if err != nil {
+		return err
+	}
+	lc.locker, err = locking.NewFlockGroup(lockDir)
+	if err != nil {
+		return fmt.Errorf("failed to create fslock group: %w", err)
+	}
 
-	var backend backends.Backend
-	var err error
+	if olderThan > 0 {
+		evicted, freed, err := lc.trimOlderThan(time.Now().Add(-olderThan))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stdout, "Deleted %d entries older than %s (%s freed)\n", evicted, olderThan, formatBytes(freed))
+	}
 
-	switch backendType {
-	case "disk":
-		// Use no-op backend - local caching is handled by server.go
-		backend = backends.NewNoop()
+	if maxSize > 0 {
+		evicted, freed, remaining, err := lc.evictToSize(maxSize, maxSize, evictionMinAge)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stdout, "Deleted %d least recently used entries (%s freed), cache is now %s\n",
+			evicted, formatBytes(freed), formatBytes(remaining))
+	}
 
-	case "s3":
-		if s3Bucket == "" {
-			return nil, fmt.Errorf("S3 bucket is required for S3 backend (set via -s3-bucket flag or S3_BUCKET env var)")
+	return nil
+}
+
+// fsckLocalCache checks the local cache directory, printing every problem
+// found, and returns the number of problems left unrepaired. Repairs take the
+// same filesystem locks the server uses, so it's safe to run while builds are
+// using the cache.
+func fsckLocalCache(cacheDir string, verify, repair bool) (int, error) {
+	lc, err := newLocalCache(cacheDir, newLogger())
+	if err != nil {
+		return 0, err
+	}
+	lc.locker, err = locking.NewFlockGroup(lockDir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create fslock group: %w", err)
+	}
+
+	report, err := lc.fsck(verify, repair)
+	if err != nil {
+		return 0, err
+	}
+
+	unrepaired := 0
+	for _, issue := range report.issues {
+		status := ""
+		if issue.repaired {
+			status = " (repaired)"
+		} else {
+			unrepaired++
 		}
+		fmt.Fprintf(os.Stdout, "%s: %s%s\n", issue.path, issue.problem, status)
+	}
+	fmt.Fprintf(os.Stdout, "Local cache checked: %d entries, %d problems, %d repaired\n",
+		report.entries, len(report.issues), len(report.issues)-unrepaired)
+	return unrepaired, nil
+}
 
-		backend, err = backends.NewS3(s3Bucket, s3Prefix, touchAgeThreshold, s3PathStyle)
+// createStorageBackend creates the configured storage backend without any of
+// the runtime wrappers applied by createBackend.
+func createStorageBackend() (backends.Backend, error) {
+	backendType = strings.ToLower(backendType)
+	if backendType == "tiered" {
+		return createTieredBackend(tierSpecs)
+	}
+	if s3ReadPrefixes != "" {
+		if backendType != "s3" {
+			return nil, fmt.Errorf("-s3-read-prefixes requires the s3 backend")
+		}
+		return createOverlayBackend(s3ReadPrefixes)
+	}
+	return createBaseBackend(backendType, "")
+}
 
-	default:
-		return nil, fmt.Errorf("unknown backend type: %s (supported: disk, s3)", backendType)
+// createOverlayBackend creates an S3 backend that reads from each of the
+// comma-separated prefixes in order and then from -s3-prefix, but only writes
+// to -s3-prefix. Listing -s3-prefix itself moves it to that position.
+func createOverlayBackend(readPrefixes string) (backends.Backend, error) {
+	var layers []backends.OverlayLayer
+	write := -1
+	closeAll := func() {
+		for _, layer := range layers {
+			_ = layer.Backend.Close()
+		}
+	}
+	addLayer := func(prefix string) error {
+		backend, err := newS3Backend(s3Bucket, prefix)
+		if err != nil {
+			return fmt.Errorf("failed to create S3 backend for prefix %q: %w", prefix, err)
+		}
+		if prefix == s3Prefix {
+			write = len(layers)
+		}
+		layers = append(layers, backends.OverlayLayer{Name: prefix, Backend: backend})
+		return nil
 	}
 
+	seen := make(map[string]bool)
+	for _, prefix := range strings.Split(readPrefixes, ",") {
+		prefix = strings.TrimSpace(prefix)
+		if prefix == "" || seen[prefix] {
+			continue
+		}
+		seen[prefix] = true
+		if err := addLayer(prefix); err != nil {
+			closeAll()
+			return nil, err
+		}
+	}
+	if write < 0 {
+		if err := addLayer(s3Prefix); err != nil {
+			closeAll()
+			return nil, err
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "[INFO] Reading from %d S3 prefixes, writing to %q\n", len(layers), s3Prefix)
+	return backends.NewOverlay(layers, write, newLogger())
+}
+
+func createBackend() (backends.Backend, error) {
+	backend, err := createStorageBackend()
+	if err != nil {
+		return nil, err
+	}
+
+	// Encrypt right above storage, so every other wrapper sees plaintext.
+	backend, keys, err := wrapEncrypt(backend)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sign below dedup, so that index records and blobs are each signed and
+	// a planted index record can't point an action at someone else's blob.
+	backend, err = wrapSign(backend)
 	if err != nil {
 		return nil, err
 	}
 
+	// Wrap with dedup backend if enabled. This sits below the async writer so
+	// the blob existence check happens off the critical path. With encryption,
+	// blob keys are hashed under the encryption keys so they don't reveal
+	// output IDs.
+	if dedup {
+		backend = backends.NewDedup(backend, fileFormatVersion, backends.DedupOptions{EncryptionKeys: keys})
+		fmt.Fprintf(os.Stderr, "[INFO] Output ID dedup enabled\n")
+	}
+
 	// Wrap with error backend if error rate is configured
 	if errorRate > 0 {
 		backend = backends.NewError(backend, errorRate)
 		fmt.Fprintf(os.Stderr, "[INFO] Error injection enabled with rate: %.2f%%\n", errorRate*100)
 	}
 
+	// Wrap with hedging backend if enabled. This sits below retries, so every
+	// attempt is hedged on its own and a hedge never waits out a backoff.
+	if hedgeGets {
+		backend = backends.NewHedge(backend, backends.HedgeOptions{MinDelay: hedgeMinDelay}, newLogger())
+	}
+
+	// Wrap with retry backend if enabled. This sits above error injection so
+	// injected errors are retried like real ones, and below the async writer
+	// so background PUTs are retried off the critical path.
+	if retryMaxAttempts > 1 || retryTimeout > 0 {
+		backend = backends.NewRetry(backend, backends.RetryOptions{
+			MaxAttempts: retryMaxAttempts,
+			BaseDelay:   retryBaseDelay,
+			MaxDelay:    retryMaxDelay,
+			Jitter:      retryJitter,
+			Timeout:     retryTimeout,
+			SpoolDir:    cacheDir,
+		}, newLogger())
+	}
+
+	// Wrap with circuit breaker if enabled. This sits above retries, so an
+	// operation only counts as failed once its retries are used up, and below
+	// the async writer so queued PUTs are dropped while the circuit is open.
+	if breakerFailures > 0 {
+		backend = backends.NewCircuitBreaker(backend, backends.CircuitBreakerOptions{
+			Failures:   breakerFailures,
+			LatencySLO: breakerLatency,
+			CoolDown:   breakerCoolDown,
+		}, newLogger())
+	}
+
 	// Wrap with async backend if enabled
 	if asyncBackend {
-		// Create logger for async backend
-		logLevel := slog.LevelInfo
-		if debug {
-			logLevel = slog.LevelDebug
-		}
-		logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
-			Level: logLevel,
-		}))
-		backend = backends.NewAsyncBackendWriter(backend, logger)
+		backend = backends.NewAsyncBackendWriter(backend, cacheDir, newLogger())
 		fmt.Fprintf(os.Stderr, "[INFO] Async backend writer enabled\n")
 	}
 
@@ -443,6 +1321,224 @@ func createBackend() (backends.Backend, error) {
 	return backend, nil
 }
 
+// wrapEncrypt wraps backend with encryption if keys are configured, either in
+// -encryption-key-file or directly in the ENCRYPTION_KEY environment variable.
+// It also returns the keys, which are nil if encryption isn't configured.
+func wrapEncrypt(backend backends.Backend) (backends.Backend, []backends.EncryptionKey, error) {
+	keyring, err := readKeyring("encryption-key-file", encryptionKeyFile, "ENCRYPTION_KEY")
+	if err != nil || keyring == "" {
+		return backend, nil, err
+	}
+
+	keys, err := backends.ParseEncryptionKeys(keyring)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse encryption keys: %w", err)
+	}
+	encrypted, err := backends.NewEncrypt(backend, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	fmt.Fprintf(os.Stderr, "[INFO] Backend encryption enabled with key %s\n", keys[0].ID)
+	return encrypted, keys, nil
+}
+
+// wrapSign wraps backend with signing if keys are configured, either in
+// -signing-key-file or directly in the SIGNING_KEY environment variable.
+func wrapSign(backend backends.Backend) (backends.Backend, error) {
+	keyring, err := readKeyring("signing-key-file", signingKeyFile, "SIGNING_KEY")
+	if err != nil || keyring == "" {
+		return backend, err
+	}
+
+	keys, err := backends.ParseSigningKeys(keyring)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing keys: %w", err)
+	}
+	signed, err := backends.NewSign(backend, keys)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(os.Stderr, "[INFO] Backend signing enabled with key %s\n", keys[0].ID)
+	return signed, nil
+}
+
+// readKeyring returns the keyring in file, or in the env environment variable
+// if no file is set. It's empty if neither is set.
+func readKeyring(flagName, file, env string) (string, error) {
+	keyring := getEnvWithPrefix(env, "")
+	if file == "" {
+		return keyring, nil
+	}
+	if keyring != "" {
+		return "", fmt.Errorf("set either -%s or %s, not both", flagName, env)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read keys from %s: %w", file, err)
+	}
+	return string(data), nil
+}
+
+// createBaseBackend creates a single storage backend of the given type.
+// arg optionally overrides the type's location flag (S3 bucket, fs root or
+// HTTP URL) so tiers can point the same backend type at different locations.
+func createBaseBackend(kind, arg string) (backends.Backend, error) {
+	switch kind {
+	case "disk":
+		// Use no-op backend - local caching is handled by server.go
+		return backends.NewNoop(), nil
+
+	case "s3":
+		bucket := s3Bucket
+		if arg != "" {
+			bucket = arg
+		}
+		return newS3Backend(bucket, s3Prefix)
+
+	case "fs":
+		root := fsRoot
+		if arg != "" {
+			root = arg
+		}
+		if root == "" {
+			return nil, fmt.Errorf("filesystem root is required for fs backend (set via -fs-root flag or FS_ROOT env var)")
+		}
+
+		return backends.NewFS(root)
+
+	case "http":
+		url := httpURL
+		if arg != "" {
+			url = arg
+		}
+		if url == "" {
+			return nil, fmt.Errorf("HTTP URL is required for http backend (set via -http-url flag or HTTP_URL env var)")
+		}
+
+		return backends.NewHTTP(url, backends.HTTPOptions{
+			BearerToken: httpToken,
+			Username:    httpUsername,
+			Password:    httpPassword,
+			Timeout:     httpTimeout,
+			SpoolDir:    cacheDir,
+		})
+
+	default:
+		return nil, fmt.Errorf("unknown backend type: %s (supported: disk, s3, fs, http, tiered)", kind)
+	}
+}
+
+// newS3Backend creates an S3 backend for bucket and prefix, configured by the
+// other S3 flags.
+func newS3Backend(bucket, prefix string) (backends.Backend, error) {
+	if bucket == "" {
+		return nil, fmt.Errorf("S3 bucket is required for S3 backend (set via -s3-bucket flag or S3_BUCKET env var)")
+	}
+
+	// With -retry-max-attempts, the Retry wrapper retries S3 requests, so
+	// the SDK's own retries are turned off rather than multiplying them.
+	sdkAttempts := 0
+	if retryMaxAttempts > 1 {
+		sdkAttempts = 1
+	}
+	return backends.NewS3(bucket, prefix, touchAgeThreshold, s3PathStyle, backends.S3TransferOptions{
+		Threshold:   int64(s3MultipartMin),
+		PartSize:    int64(s3PartSize),
+		Concurrency: s3Concurrency,
+		SpoolDir:    cacheDir,
+		MaxAttempts: sdkAttempts,
+	})
+}
+
+// tierSpec is a parsed element of the -tiers flag.
+type tierSpec struct {
+	kind   string
+	arg    string
+	policy backends.TierWritePolicy
+}
+
+// parseTierSpecs parses a comma-separated list of tiers, fastest first.
+// Each tier has the form type[=location][:through|:back], for example
+// "fs=/mnt/cache,s3=hot--x-s3,s3=cold:back". The location defaults to the
+// corresponding -fs-root, -s3-bucket or -http-url flag and the write policy
+// defaults to through.
+func parseTierSpecs(specs string) ([]tierSpec, error) {
+	var tiers []tierSpec
+	for _, raw := range strings.Split(specs, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+
+		spec := tierSpec{policy: backends.WriteThrough}
+		if rest, ok := strings.CutSuffix(raw, ":back"); ok {
+			raw = rest
+			spec.policy = backends.WriteBack
+		} else if rest, ok := strings.CutSuffix(raw, ":through"); ok {
+			raw = rest
+		}
+
+		kind, arg, _ := strings.Cut(raw, "=")
+		spec.kind = strings.ToLower(kind)
+		spec.arg = arg
+		switch spec.kind {
+		case "s3", "fs", "http":
+		default:
+			return nil, fmt.Errorf("unsupported tier type: %q (supported: s3, fs, http)", kind)
+		}
+
+		tiers = append(tiers, spec)
+	}
+
+	if len(tiers) == 0 {
+		return nil, fmt.Errorf("at least one tier is required for tiered backend (set via -tiers flag or TIERS env var)")
+	}
+	return tiers, nil
+}
+
+// createTieredBackend creates a tiered backend from a -tiers specification.
+func createTieredBackend(specs string) (backends.Backend, error) {
+	parsed, err := parseTierSpecs(specs)
+	if err != nil {
+		return nil, err
+	}
+
+	tiers := make([]backends.Tier, 0, len(parsed))
+	for _, spec := range parsed {
+		backend, err := createBaseBackend(spec.kind, spec.arg)
+		if err != nil {
+			for _, tier := range tiers {
+				_ = tier.Backend.Close()
+			}
+			return nil, fmt.Errorf("failed to create %s tier: %w", spec.kind, err)
+		}
+
+		name := spec.kind
+		if spec.arg != "" {
+			name += "=" + spec.arg
+		}
+		tiers = append(tiers, backends.Tier{
+			Name:    name,
+			Backend: backend,
+			Policy:  spec.policy,
+		})
+	}
+
+	fmt.Fprintf(os.Stderr, "[INFO] Tiered backend enabled with %d tiers\n", len(tiers))
+	return backends.NewTiered(tiers, cacheDir, newLogger())
+}
+
+// newLogger creates a stderr logger honoring the -debug flag.
+func newLogger() *slog.Logger {
+	logLevel := slog.LevelInfo
+	if debug {
+		logLevel = slog.LevelDebug
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: logLevel,
+	}))
+}
+
 func createLockingGroup() (locking.Group, error) {
 	lockingType = strings.ToLower(lockingType)
 
@@ -543,6 +1639,18 @@ func getEnvFloatWithPrefix(key string, defaultValue float64) float64 {
 	return getEnvFloat(key, defaultValue)
 }
 
+// getEnvIntWithPrefix gets an int environment variable, checking for GOBUILDCACHE_ prefix first.
+func getEnvIntWithPrefix(key string, defaultValue int) int {
+	for _, k := range []string{"GOBUILDCACHE_" + key, key} {
+		if value := os.Getenv(k); value != "" {
+			if n, err := strconv.Atoi(value); err == nil {
+				return n
+			}
+		}
+	}
+	return defaultValue
+}
+
 // getEnvDurationWithPrefix gets a time.Duration environment variable, checking for GOBUILDCACHE_ prefix first.
 func getEnvDurationWithPrefix(key string, defaultValue time.Duration) time.Duration {
 	for _, k := range []string{"GOBUILDCACHE_" + key, key} {
@@ -554,3 +1662,125 @@ func getEnvDurationWithPrefix(key string, defaultValue time.Duration) time.Durat
 	}
 	return defaultValue
 }
+
+// age is a duration flag that additionally accepts a day suffix, e.g. "7d".
+type age time.Duration
+
+// String implements flag.Value.
+func (a *age) String() string {
+	return time.Duration(*a).String()
+}
+
+// Set implements flag.Value.
+func (a *age) Set(value string) error {
+	d, err := parseAge(value)
+	if err != nil {
+		return err
+	}
+	*a = age(d)
+	return nil
+}
+
+// parseAge parses a duration as accepted by time.ParseDuration, or a (possibly
+// fractional) number of days such as "7d" or "1.5d".
+func parseAge(value string) (time.Duration, error) {
+	s := strings.TrimSpace(value)
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid age: %q", value)
+		}
+		return time.Duration(n * float64(24*time.Hour)), nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid age: %q", value)
+	}
+	return d, nil
+}
+
+// compressionFlag is the -compression mode. It's a boolean flag too, as it
+// was before it took a mode: a bare -compression means lz4.
+type compressionFlag string
+
+// String implements flag.Value.
+func (c *compressionFlag) String() string {
+	return string(*c)
+}
+
+// Set implements flag.Value.
+func (c *compressionFlag) Set(value string) error {
+	if _, err := parseCompression(value, 0); err != nil {
+		return err
+	}
+	*c = compressionFlag(value)
+	return nil
+}
+
+// IsBoolFlag lets -compression be passed without a value.
+func (c *compressionFlag) IsBoolFlag() bool {
+	return true
+}
+
+// byteSize is an int64 byte count flag that accepts human-readable sizes.
+type byteSize int64
+
+// String implements flag.Value.
+func (b *byteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+// Set implements flag.Value.
+func (b *byteSize) Set(value string) error {
+	n, err := parseByteSize(value)
+	if err != nil {
+		return err
+	}
+	*b = byteSize(n)
+	return nil
+}
+
+// parseByteSize parses a byte count with an optional unit suffix.
+// Accepts plain integers and decimal (KB, MB, GB, TB) or binary (KiB, MiB,
+// GiB, TiB) suffixes, case insensitive, e.g. "1073741824", "50GiB", "1.5GB".
+func parseByteSize(value string) (int64, error) {
+	s := strings.TrimSpace(value)
+	units := []struct {
+		suffix     string
+		multiplier float64
+	}{
+		{"kib", 1 << 10}, {"mib", 1 << 20}, {"gib", 1 << 30}, {"tib", 1 << 40},
+		{"kb", 1e3}, {"mb", 1e6}, {"gb", 1e9}, {"tb", 1e12},
+		{"k", 1 << 10}, {"m", 1 << 20}, {"g", 1 << 30}, {"t", 1 << 40},
+		{"b", 1},
+	}
+
+	lower := strings.ToLower(s)
+	multiplier := 1.0
+	for _, unit := range units {
+		if rest, ok := strings.CutSuffix(lower, unit.suffix); ok {
+			lower = strings.TrimSpace(rest)
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(lower, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid byte size: %q", value)
+	}
+	return int64(n * multiplier), nil
+}
+
+// getEnvByteSizeWithPrefix gets a byte size environment variable, checking for GOBUILDCACHE_ prefix first.
+func getEnvByteSizeWithPrefix(key string, defaultValue int64) int64 {
+	for _, k := range []string{"GOBUILDCACHE_" + key, key} {
+		if value := os.Getenv(k); value != "" {
+			if n, err := parseByteSize(value); err == nil {
+				return n
+			}
+		}
+	}
+	return defaultValue
+}
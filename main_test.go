@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/richardartoul/gobuildcache/pkg/backends"
+)
+
+func TestParseTierSpecs(t *testing.T) {
+	tiers, err := parseTierSpecs("fs=/mnt/cache, s3=hot--x-s3 ,s3=cold:back,http=http://cache:8080:through")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []tierSpec{
+		{kind: "fs", arg: "/mnt/cache", policy: backends.WriteThrough},
+		{kind: "s3", arg: "hot--x-s3", policy: backends.WriteThrough},
+		{kind: "s3", arg: "cold", policy: backends.WriteBack},
+		{kind: "http", arg: "http://cache:8080", policy: backends.WriteThrough},
+	}
+	if len(tiers) != len(expected) {
+		t.Fatalf("expected %d tiers, got %d", len(expected), len(tiers))
+	}
+	for i := range expected {
+		if tiers[i] != expected[i] {
+			t.Errorf("tier %d: expected %+v, got %+v", i, expected[i], tiers[i])
+		}
+	}
+}
+
+func TestParseTierSpecsErrors(t *testing.T) {
+	for _, specs := range []string{"", " , ", "disk", "gcs=bucket"} {
+		if _, err := parseTierSpecs(specs); err == nil {
+			t.Errorf("parseTierSpecs(%q): expected error", specs)
+		}
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected int64
+	}{
+		{"0", 0},
+		{"1024", 1024},
+		{"1KiB", 1024},
+		{"50GiB", 50 << 30},
+		{"50gib", 50 << 30},
+		{"1.5GB", 1500000000},
+		{"10M", 10 << 20},
+		{"512B", 512},
+		{" 2 TiB ", 2 << 40},
+	}
+
+	for _, tt := range tests {
+		got, err := parseByteSize(tt.value)
+		if err != nil {
+			t.Errorf("parseByteSize(%q) returned error: %v", tt.value, err)
+			continue
+		}
+		if got != tt.expected {
+			t.Errorf("parseByteSize(%q) = %d, expected %d", tt.value, got, tt.expected)
+		}
+	}
+
+	for _, value := range []string{"", "abc", "-1GiB", "GiB"} {
+		if _, err := parseByteSize(value); err == nil {
+			t.Errorf("parseByteSize(%q): expected error", value)
+		}
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"72h", 72 * time.Hour},
+		{"90m", 90 * time.Minute},
+		{"7d", 7 * 24 * time.Hour},
+		{"1.5d", 36 * time.Hour},
+		{" 0d ", 0},
+	}
+
+	for _, tt := range tests {
+		got, err := parseAge(tt.value)
+		if err != nil {
+			t.Errorf("parseAge(%q) returned error: %v", tt.value, err)
+			continue
+		}
+		if got != tt.expected {
+			t.Errorf("parseAge(%q) = %s, expected %s", tt.value, got, tt.expected)
+		}
+	}
+
+	for _, value := range []string{"", "d", "7", "-1d", "-5h", "seven days"} {
+		if _, err := parseAge(value); err == nil {
+			t.Errorf("parseAge(%q): expected error", value)
+		}
+	}
+}
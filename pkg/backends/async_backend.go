@@ -1,7 +1,7 @@
 package backends
 
 import (
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -17,6 +17,7 @@ import (
 // PUT operations spawn a goroutine on demand.
 type AsyncBackendWriter struct {
 	backend   Backend
+	spoolDir  string
 	logger    *slog.Logger
 	semaphore chan struct{}
 	wg        sync.WaitGroup
@@ -29,20 +30,27 @@ type AsyncBackendWriter struct {
 	touchSkippedFresh atomic.Int64 // Touches skipped because object was fresh
 }
 
+// NewAsyncBackendWriter creates a new asynchronous writer around backend.
+// Bodies are spooled to temporary files in spoolDir (or the default temp
+// directory if it's empty) once they're too large to hold in memory.
 func NewAsyncBackendWriter(
 	backend Backend,
+	spoolDir string,
 	logger *slog.Logger,
 ) *AsyncBackendWriter {
 	return &AsyncBackendWriter{
 		backend:   backend,
+		spoolDir:  spoolDir,
 		logger:    logger,
 		semaphore: make(chan struct{}, 128*runtime.GOMAXPROCS(0)),
 	}
 }
 
 // Put spawns a goroutine to execute the PUT operation asynchronously.
-// The body is copied to avoid holding references to the original data.
-func (abw *AsyncBackendWriter) Put(actionID, outputID []byte, body io.Reader, bodySize int64) error {
+// The body is copied into a Spool since the caller may reuse or release it as
+// soon as Put returns; large bodies are spilled to disk rather than held in memory.
+// A *SpoolBody isn't copied: Put takes its spool over instead.
+func (abw *AsyncBackendWriter) Put(ctx context.Context, actionID, outputID []byte, encoding string, body io.Reader, bodySize int64) error {
 	// Try to acquire semaphore slot
 	select {
 	case abw.semaphore <- struct{}{}:
@@ -51,21 +59,36 @@ func (abw *AsyncBackendWriter) Put(actionID, outputID []byte, body io.Reader, bo
 		return fmt.Errorf("too many concurrent PUT operations")
 	}
 
-	// Copy the body data since we're processing asynchronously
-	bodyData, err := io.ReadAll(body)
-	if err != nil {
-		<-abw.semaphore // Release semaphore on error
-		return fmt.Errorf("failed to read body: %w", err)
+	// Copy the body data since we're processing asynchronously, unless the
+	// caller handed over a spool.
+	var spool *Spool
+	if owned, ok := body.(*SpoolBody); ok {
+		spool = owned.Take()
+	} else {
+		spool = NewSpool(abw.spoolDir, DefaultSpoolThreshold)
+		if body != nil {
+			if _, err := io.Copy(spool, body); err != nil {
+				spool.Close()
+				<-abw.semaphore // Release semaphore on error
+				return fmt.Errorf("failed to read body: %w", err)
+			}
+		}
 	}
 
+	// The PUT outlives the request, so it gets a context that isn't canceled
+	// when the request finishes but keeps its deadline.
+	ctx, cancel := detach(ctx)
+
 	abw.wg.Add(1)
 	abw.startedPuts.Add(1)
 	go func() {
 		defer abw.wg.Done()
 		defer func() { <-abw.semaphore }() // Release semaphore when done
+		defer spool.Close()
+		defer cancel()
 
 		start := time.Now()
-		err := abw.backend.Put(actionID, outputID, bytes.NewReader(bodyData), bodySize)
+		err := abw.backend.Put(ctx, actionID, outputID, encoding, spool.Reader(), bodySize)
 		duration := time.Since(start)
 
 		abw.totalPutTime.Add(duration.Microseconds())
@@ -90,18 +113,18 @@ func (abw *AsyncBackendWriter) Put(actionID, outputID []byte, body io.Reader, bo
 }
 
 // Has passes through to the underlying backend (synchronous).
-func (abw *AsyncBackendWriter) Has(actionID []byte) (bool, error) {
-	return abw.backend.Has(actionID)
+func (abw *AsyncBackendWriter) Has(ctx context.Context, actionID []byte) (bool, error) {
+	return abw.backend.Has(ctx, actionID)
 }
 
 // Get passes through to the underlying backend (synchronous).
 // GET operations remain synchronous as they're in the critical path.
-func (abw *AsyncBackendWriter) Get(actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, bool, error) {
-	return abw.backend.Get(actionID)
+func (abw *AsyncBackendWriter) Get(ctx context.Context, actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, string, bool, error) {
+	return abw.backend.Get(ctx, actionID)
 }
 
 // Touch asynchronously refreshes the backend timestamp for the given actionID.
-func (abw *AsyncBackendWriter) Touch(actionID []byte) error {
+func (abw *AsyncBackendWriter) Touch(ctx context.Context, actionID []byte) error {
 	select {
 	case abw.semaphore <- struct{}{}:
 	default:
@@ -112,12 +135,15 @@ func (abw *AsyncBackendWriter) Touch(actionID []byte) error {
 	id := make([]byte, len(actionID))
 	copy(id, actionID)
 
+	ctx, cancel := detach(ctx)
+
 	abw.wg.Add(1)
 	go func() {
 		defer abw.wg.Done()
 		defer func() { <-abw.semaphore }()
+		defer cancel()
 
-		if err := abw.backend.Touch(id); err != nil {
+		if err := abw.backend.Touch(ctx, id); err != nil {
 			if errors.Is(err, ErrTouchSkipped) {
 				abw.touchSkippedFresh.Add(1)
 			} else {
@@ -160,8 +186,8 @@ func (abw *AsyncBackendWriter) Unwrap() Backend {
 }
 
 // Clear passes through to the underlying backend
-func (abw *AsyncBackendWriter) Clear() error {
-	return abw.backend.Clear()
+func (abw *AsyncBackendWriter) Clear(ctx context.Context) error {
+	return abw.backend.Clear(ctx)
 }
 
 // Stats returns current statistics about the async writer
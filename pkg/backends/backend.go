@@ -1,8 +1,13 @@
 package backends
 
 import (
+	"bytes"
+	"context"
+	"encoding/hex"
 	"errors"
 	"io"
+	"math/rand/v2"
+	"strings"
 	"time"
 )
 
@@ -21,23 +26,32 @@ var ErrTouchSkipped = errors.New("touch skipped: object is fresh")
 // inflight operations of the same type for the same actionID (singleflight)
 // which makes implementing the backends simpler (no need to worry about
 // locking at the filesystem layer).
+//
+// Every operation except Close takes a context. Implementations that talk to
+// remote storage give up and return the context's error once it's done. For
+// Get, the context also bounds reading the returned body, so callers must keep
+// it alive until they've read it.
 type Backend interface {
 	// Put stores an object in the backend storage.
-	// actionID is the cache key, outputID is stored with the body,
+	// actionID is the cache key, outputID and encoding are stored with the body,
 	// body is the content to store, and bodySize is the size in bytes.
+	// encoding names how the body is compressed (e.g. "zstd"); backends persist
+	// it verbatim without interpreting it.
 	// The backend stores the data in its storage system and returns nil on success.
-	Put(actionID, outputID []byte, body io.Reader, bodySize int64) error
+	Put(ctx context.Context, actionID, outputID []byte, encoding string, body io.Reader, bodySize int64) error
 
 	// Has checks whether an object exists in the backend storage without retrieving it.
 	// Returns true if the object exists, false otherwise.
-	Has(actionID []byte) (bool, error)
+	Has(ctx context.Context, actionID []byte) (bool, error)
 
 	// Get retrieves an object from the backend storage.
 	// actionID is the cache key to look up.
-	// Returns outputID, body (as io.ReadCloser), size, putTime, and whether it was a miss.
+	// Returns outputID, body (as io.ReadCloser), size, putTime, the encoding
+	// passed to Put, and whether it was a miss. Objects written before encodings
+	// were recorded return an empty encoding.
 	// The caller is responsible for closing the returned ReadCloser.
 	// On a cache miss, returns miss=true and body=nil.
-	Get(actionID []byte) (outputID []byte, body io.ReadCloser, size int64, putTime *time.Time, miss bool, err error)
+	Get(ctx context.Context, actionID []byte) (outputID []byte, body io.ReadCloser, size int64, putTime *time.Time, encoding string, miss bool, err error)
 
 	// Close performs any cleanup operations needed by the backend.
 	Close() error
@@ -45,8 +59,120 @@ type Backend interface {
 	// Touch refreshes the backend storage timestamp for the given actionID,
 	// preventing lifecycle expiration policies from deleting frequently-accessed entries.
 	// Backends that don't support lifecycle policies can no-op this method.
-	Touch(actionID []byte) error
+	Touch(ctx context.Context, actionID []byte) error
 
 	// Clear removes all entries from the cache backend storage.
-	Clear() error
+	Clear(ctx context.Context) error
+}
+
+// Trimmer is implemented by backends that can delete stale entries themselves.
+// This provides garbage collection for storage that has no lifecycle policy of
+// its own (e.g. MinIO or NFS).
+type Trimmer interface {
+	// Trim deletes every entry that was last written or touched before cutoff.
+	// Compression dictionaries, prefetch manifests and objects that aren't
+	// cache entries are kept.
+	Trim(ctx context.Context, cutoff time.Time) (TrimStats, error)
+}
+
+// objectKey decodes name, the hex-encoded key that FS and S3 name objects by.
+// It reports false for anything else sharing the bucket or directory.
+func objectKey(name string) ([]byte, bool) {
+	key, err := hex.DecodeString(name)
+	if err != nil || len(key) == 0 {
+		return nil, false
+	}
+	return key, true
+}
+
+// trimKeepPrefixes are the key prefixes Trim never deletes: compression
+// dictionaries and prefetch manifests. They're only touched when a server
+// loads them with touch-on-GET, and objects compressed with a dictionary
+// can't be read without it.
+var trimKeepPrefixes = []string{"dict/", "manifest/"}
+
+// trimmable reports whether Trim may delete the object named name,
+// quarantined ones included. Anything that isn't an object is kept.
+func trimmable(name string) bool {
+	key, ok := objectKey(strings.TrimPrefix(name, "quarantine/"))
+	if !ok {
+		return false
+	}
+	for _, prefix := range trimKeepPrefixes {
+		if bytes.HasPrefix(key, []byte(prefix)) {
+			return false
+		}
+	}
+	return true
+}
+
+// TrimStats reports the outcome of a Trim.
+type TrimStats struct {
+	Scanned      int64 // Entries examined
+	Deleted      int64 // Entries deleted
+	DeletedBytes int64 // Bytes freed by deleted entries
+}
+
+// Add accumulates other into s.
+func (s *TrimStats) Add(other TrimStats) {
+	s.Scanned += other.Scanned
+	s.Deleted += other.Deleted
+	s.DeletedBytes += other.DeletedBytes
+}
+
+// Checker is implemented by backends that can scan their storage for objects
+// that Get would reject, such as objects with missing or unparseable metadata.
+type Checker interface {
+	// Check examines stored objects and calls report for each invalid one.
+	Check(ctx context.Context, opts CheckOptions, report func(key, problem string)) (CheckStats, error)
+}
+
+// CheckOptions controls a Check.
+type CheckOptions struct {
+	Sample int  // If >0, only examine a random sample of this many objects
+	Repair bool // Delete invalid objects
+}
+
+// CheckStats reports the outcome of a Check.
+type CheckStats struct {
+	Scanned  int64 // Objects examined
+	Invalid  int64 // Objects that Get would reject
+	Repaired int64 // Invalid objects deleted
+}
+
+// Add accumulates other into s.
+func (s *CheckStats) Add(other CheckStats) {
+	s.Scanned += other.Scanned
+	s.Invalid += other.Invalid
+	s.Repaired += other.Repaired
+}
+
+// detach returns a context for work that outlives the request ctx belongs to,
+// such as a background write. It isn't canceled along with ctx, but it keeps
+// ctx's deadline.
+func detach(ctx context.Context) (context.Context, context.CancelFunc) {
+	detached := context.WithoutCancel(ctx)
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(detached, deadline)
+	}
+	return context.WithCancel(detached)
+}
+
+// sampler keeps a uniformly random sample of up to size items from a stream of
+// unknown length (reservoir sampling). A size of 0 keeps every item.
+type sampler[T any] struct {
+	size  int
+	seen  int
+	items []T
+}
+
+func (s *sampler[T]) add(item T) {
+	s.seen++
+	if s.size <= 0 || len(s.items) < s.size {
+		s.items = append(s.items, item)
+		return
+	}
+	if i := rand.IntN(s.seen); i < s.size {
+		s.items[i] = item
+	}
 }
@@ -0,0 +1,106 @@
+package backends
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// Backends checksum the body they store, i.e. after compression and
+// encryption, rather than the uncompressed output. That way a backend can
+// verify an object without knowing its codec, dictionary or keys: fsck-remote
+// and "gobuildcache serve" check objects they can't decode. Decoding is still
+// covered end to end: zstd and lz4 frames carry a checksum of their content,
+// encrypted bodies are authenticated, and an uncompressed, unencrypted body
+// is the output itself.
+
+// ErrChecksumMismatch is returned from reading an object body that doesn't
+// match the SHA-256 recorded when the object was stored, e.g. because the
+// object was truncated or corrupted at rest. It's only reported once the whole
+// body has been read, so callers must read to EOF before trusting a body.
+// Callers should treat it as a cache miss.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// hashSection returns the SHA-256 of the bytes in r. r is read through a
+// fresh section, so it can still be read from the start afterwards.
+func hashSection(r *io.SectionReader) ([]byte, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(r, 0, r.Size())); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// checksumReader wraps an object body and verifies its SHA-256 once the body
+// has been read to EOF. On a mismatch, onMismatch (if set) is called once,
+// e.g. to quarantine the object, and every further read fails.
+type checksumReader struct {
+	io.ReadCloser
+	hash       hash.Hash
+	expected   []byte
+	onMismatch func()
+	remaining  int64 // Bytes left before the body ends, or -1 to wait for EOF
+	err        error
+}
+
+// newChecksumReader returns body wrapped to verify it against expected. If
+// expected is empty (objects stored before checksums were recorded), body is
+// returned unchanged.
+func newChecksumReader(body io.ReadCloser, expected []byte, onMismatch func()) io.ReadCloser {
+	if len(expected) == 0 {
+		return body
+	}
+	return &checksumReader{
+		ReadCloser: body,
+		hash:       sha256.New(),
+		expected:   expected,
+		onMismatch: onMismatch,
+		remaining:  -1,
+	}
+}
+
+// newSizedChecksumReader returns the first size bytes of body, verified
+// against expected. The checksum is checked as soon as the last byte is read
+// rather than at EOF, so it's also checked for consumers that stop reading
+// once they have size bytes (e.g. through io.CopyN).
+func newSizedChecksumReader(body io.Reader, size int64, expected []byte) io.ReadCloser {
+	limited := io.NopCloser(io.LimitReader(body, size))
+	if len(expected) == 0 {
+		return limited
+	}
+	return &checksumReader{
+		ReadCloser: limited,
+		hash:       sha256.New(),
+		expected:   expected,
+		remaining:  size,
+	}
+}
+
+func (r *checksumReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	if r.remaining >= 0 {
+		r.remaining -= int64(n)
+		if r.remaining == 0 && err == nil {
+			err = io.EOF
+		}
+	}
+	if errors.Is(err, io.EOF) {
+		if sum := r.hash.Sum(nil); !bytes.Equal(sum, r.expected) {
+			r.err = fmt.Errorf("%w: expected sha256 %s, got %s",
+				ErrChecksumMismatch, hex.EncodeToString(r.expected), hex.EncodeToString(sum))
+			if r.onMismatch != nil {
+				r.onMismatch()
+			}
+			return n, r.err
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,256 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CircuitState is the state of a CircuitBreaker.
+type CircuitState int32
+
+const (
+	// CircuitClosed passes every call through to the backend.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen short-circuits every call until the cool-down has passed.
+	CircuitOpen
+	// CircuitHalfOpen lets a single probe call through to decide whether to
+	// close the circuit again.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// CircuitBreakerOptions configures a CircuitBreaker.
+type CircuitBreakerOptions struct {
+	// Failures is the number of consecutive failed calls that trips the
+	// circuit.
+	Failures int
+	// LatencySLO, if set, counts a Get, Has or Touch that takes longer than
+	// this as failed, even if it succeeded. Puts are exempt, since their
+	// latency depends on the size of the object.
+	LatencySLO time.Duration
+	// CoolDown is how long the circuit stays open before a probe is let
+	// through.
+	CoolDown time.Duration
+}
+
+// CircuitBreaker wraps a Backend and stops calling it while it's unhealthy.
+// After Failures consecutive errors (or latency SLO breaches) the circuit
+// opens: for the next CoolDown, Get and Has return misses, Put and Touch are
+// dropped, and none of them reach the backend. Once the cool-down has passed,
+// a single probe call is let through. If it succeeds the circuit closes,
+// otherwise it opens again for another cool-down.
+//
+// This way a backend that's down or throttling makes builds slower, since
+// they fall back to the local cache, instead of failing them. Errors that are
+// about an object rather than the backend, such as a checksum mismatch, don't
+// count as failures. Clear and Close are always passed through.
+type CircuitBreaker struct {
+	backend Backend
+	opts    CircuitBreakerOptions
+	logger  *slog.Logger
+
+	mu        sync.Mutex
+	state     CircuitState
+	failures  int       // Consecutive failures while closed
+	openUntil time.Time // End of the current cool-down while open
+
+	// Stats.
+	trips          atomic.Int64 // Times the circuit opened
+	shortCircuited atomic.Int64 // Calls that didn't reach the backend
+}
+
+// NewCircuitBreaker creates a new circuit breaker around backend.
+func NewCircuitBreaker(backend Backend, opts CircuitBreakerOptions, logger *slog.Logger) *CircuitBreaker {
+	opts.Failures = max(opts.Failures, 1)
+	return &CircuitBreaker{
+		backend: backend,
+		opts:    opts,
+		logger:  logger,
+	}
+}
+
+// Unwrap returns the underlying backend.
+func (cb *CircuitBreaker) Unwrap() Backend {
+	return cb.backend
+}
+
+// Put stores the object, or drains and drops it while the circuit is open.
+func (cb *CircuitBreaker) Put(ctx context.Context, actionID, outputID []byte, encoding string, body io.Reader, bodySize int64) error {
+	probe, ok := cb.allow()
+	if !ok {
+		// Drain the body so callers that expect it to be consumed don't hang.
+		if body != nil {
+			_, _ = io.Copy(io.Discard, body)
+		}
+		return nil
+	}
+	err := cb.backend.Put(ctx, actionID, outputID, encoding, body, bodySize)
+	cb.record(probe, err, 0)
+	return err
+}
+
+// Has checks whether the object exists. It reports false while the circuit is
+// open.
+func (cb *CircuitBreaker) Has(ctx context.Context, actionID []byte) (bool, error) {
+	probe, ok := cb.allow()
+	if !ok {
+		return false, nil
+	}
+	start := time.Now()
+	exists, err := cb.backend.Has(ctx, actionID)
+	cb.record(probe, err, time.Since(start))
+	return exists, err
+}
+
+// Get retrieves the object. It returns a miss while the circuit is open.
+func (cb *CircuitBreaker) Get(ctx context.Context, actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, string, bool, error) {
+	probe, ok := cb.allow()
+	if !ok {
+		return nil, nil, 0, nil, "", true, nil
+	}
+	start := time.Now()
+	outputID, body, size, putTime, encoding, miss, err := cb.backend.Get(ctx, actionID)
+	cb.record(probe, err, time.Since(start))
+	return outputID, body, size, putTime, encoding, miss, err
+}
+
+// Touch refreshes the object's timestamp. It returns ErrTouchSkipped while the
+// circuit is open.
+func (cb *CircuitBreaker) Touch(ctx context.Context, actionID []byte) error {
+	probe, ok := cb.allow()
+	if !ok {
+		return ErrTouchSkipped
+	}
+	start := time.Now()
+	err := cb.backend.Touch(ctx, actionID)
+	cb.record(probe, err, time.Since(start))
+	return err
+}
+
+// Close closes the underlying backend.
+func (cb *CircuitBreaker) Close() error {
+	return cb.backend.Close()
+}
+
+// Clear clears the underlying backend.
+func (cb *CircuitBreaker) Clear(ctx context.Context) error {
+	return cb.backend.Clear(ctx)
+}
+
+// allow reports whether a call may go through to the backend, and whether it's
+// the half-open probe.
+func (cb *CircuitBreaker) allow() (probe, ok bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case CircuitClosed:
+		return false, true
+	case CircuitOpen:
+		if time.Now().After(cb.openUntil) {
+			cb.state = CircuitHalfOpen
+			return true, true
+		}
+	case CircuitHalfOpen:
+		// The probe is in flight.
+	}
+	cb.shortCircuited.Add(1)
+	return false, false
+}
+
+// record updates the circuit with the outcome of a call that allow let
+// through. A latency of 0 skips the SLO check.
+func (cb *CircuitBreaker) record(probe bool, err error, latency time.Duration) {
+	failed := isBackendFailure(err)
+	slow := cb.opts.LatencySLO > 0 && latency > cb.opts.LatencySLO
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if probe {
+		if failed || slow {
+			cb.trip(err, latency)
+			return
+		}
+		cb.state = CircuitClosed
+		cb.failures = 0
+		cb.logger.Info("backend recovered, circuit breaker closed")
+		return
+	}
+
+	// Calls that were let through before the circuit opened don't affect it
+	// any more, only the probe does.
+	if cb.state != CircuitClosed {
+		return
+	}
+	if !failed && !slow {
+		cb.failures = 0
+		return
+	}
+	cb.failures++
+	if cb.failures >= cb.opts.Failures {
+		cb.trip(err, latency)
+	}
+}
+
+// trip opens the circuit for a cool-down. cb.mu must be held.
+func (cb *CircuitBreaker) trip(err error, latency time.Duration) {
+	cb.state = CircuitOpen
+	cb.failures = 0
+	cb.openUntil = time.Now().Add(cb.opts.CoolDown)
+	cb.trips.Add(1)
+	cb.logger.Warn("backend unhealthy, circuit breaker open: serving misses until it recovers",
+		"cool_down", cb.opts.CoolDown,
+		"latency", latency,
+		"error", err)
+}
+
+// isBackendFailure reports whether err says the backend is unhealthy, as
+// opposed to something about the object that was requested or a caller that
+// gave up. Deadlines do count: they're how a hung backend shows up.
+func isBackendFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	return !errors.Is(err, ErrTouchSkipped) &&
+		!errors.Is(err, context.Canceled) &&
+		!errors.Is(err, ErrChecksumMismatch) &&
+		!errors.Is(err, ErrAuthenticationFailed) &&
+		!errors.Is(err, ErrBadSignature)
+}
+
+// Stats returns circuit breaker statistics.
+func (cb *CircuitBreaker) Stats() CircuitBreakerStats {
+	cb.mu.Lock()
+	state := cb.state
+	cb.mu.Unlock()
+	return CircuitBreakerStats{
+		State:          state,
+		Trips:          cb.trips.Load(),
+		ShortCircuited: cb.shortCircuited.Load(),
+	}
+}
+
+// CircuitBreakerStats holds statistics for the circuit breaker.
+type CircuitBreakerStats struct {
+	State          CircuitState
+	Trips          int64
+	ShortCircuited int64
+}
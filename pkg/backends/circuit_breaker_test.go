@@ -0,0 +1,87 @@
+package backends
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker_TripsAfterConsecutiveFailures(t *testing.T) {
+	flaky := &flakyBackend{err: syscall.ECONNRESET, failures: 3}
+	cb := NewCircuitBreaker(flaky, CircuitBreakerOptions{Failures: 3, CoolDown: time.Hour},
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	for i := 0; i < 3; i++ {
+		if _, _, _, _, _, _, err := cb.Get(t.Context(), []byte("action")); !errors.Is(err, syscall.ECONNRESET) {
+			t.Fatalf("expected backend error before the circuit opens, got %v", err)
+		}
+	}
+
+	// While open, calls are fast misses and dropped writes.
+	_, _, _, _, _, miss, err := cb.Get(t.Context(), []byte("action"))
+	if err != nil || !miss {
+		t.Fatalf("expected short-circuited miss, miss=%v err=%v", miss, err)
+	}
+	if err := cb.Put(t.Context(), []byte("action"), []byte("output"), "", strings.NewReader("data"), 4); err != nil {
+		t.Fatalf("expected dropped Put to succeed, got %v", err)
+	}
+	if err := cb.Touch(t.Context(), []byte("action")); !errors.Is(err, ErrTouchSkipped) {
+		t.Fatalf("expected ErrTouchSkipped, got %v", err)
+	}
+	if flaky.getCalled.Load() != 3 || flaky.putCalled.Load() != 0 {
+		t.Fatalf("expected open circuit not to reach the backend, got gets=%d puts=%d", flaky.getCalled.Load(), flaky.putCalled.Load())
+	}
+
+	stats := cb.Stats()
+	if stats.State != CircuitOpen || stats.Trips != 1 || stats.ShortCircuited != 3 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestCircuitBreaker_HalfOpenProbe(t *testing.T) {
+	flaky := &flakyBackend{mockBackend: mockBackend{getMiss: true}, err: syscall.ECONNRESET, failures: 4}
+	cb := NewCircuitBreaker(flaky, CircuitBreakerOptions{Failures: 3, CoolDown: 10 * time.Millisecond},
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	for i := 0; i < 3; i++ {
+		_, _, _, _, _, _, _ = cb.Get(t.Context(), []byte("action"))
+	}
+
+	// The first probe fails, which opens the circuit again.
+	time.Sleep(20 * time.Millisecond)
+	if _, _, _, _, _, _, err := cb.Get(t.Context(), []byte("action")); err == nil {
+		t.Fatal("expected failed probe to return the backend error")
+	}
+	if stats := cb.Stats(); stats.State != CircuitOpen || stats.Trips != 2 {
+		t.Fatalf("expected failed probe to reopen the circuit, got %+v", stats)
+	}
+
+	// The next one succeeds, which closes it.
+	time.Sleep(20 * time.Millisecond)
+	_, _, _, _, _, miss, err := cb.Get(t.Context(), []byte("action"))
+	if err != nil || !miss {
+		t.Fatalf("expected probe to reach the backend, miss=%v err=%v", miss, err)
+	}
+	if stats := cb.Stats(); stats.State != CircuitClosed || flaky.getCalled.Load() != 5 {
+		t.Fatalf("expected successful probe to close the circuit, got %+v gets=%d", stats, flaky.getCalled.Load())
+	}
+}
+
+func TestCircuitBreaker_LatencySLO(t *testing.T) {
+	slow := &slowBackend{delay: 20 * time.Millisecond}
+	cb := NewCircuitBreaker(slow, CircuitBreakerOptions{Failures: 2, LatencySLO: 5 * time.Millisecond, CoolDown: time.Hour},
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	for i := 0; i < 3; i++ {
+		if _, _, _, _, _, _, err := cb.Get(t.Context(), []byte("action")); err != nil {
+			t.Fatalf("unexpected Get error: %v", err)
+		}
+	}
+	if stats := cb.Stats(); stats.State != CircuitOpen || slow.getCalled.Load() != 2 {
+		t.Fatalf("expected slow calls to trip the circuit, got %+v gets=%d", stats, slow.getCalled.Load())
+	}
+}
@@ -1,6 +1,7 @@
 package backends
 
 import (
+	"context"
 	"encoding/hex"
 	"fmt"
 	"io"
@@ -28,12 +29,12 @@ func (d *Debug) Unwrap() Backend {
 }
 
 // Put stores an object in the backend storage with debug logging.
-func (d *Debug) Put(actionID, outputID []byte, body io.Reader, bodySize int64) error {
-	fmt.Fprintf(os.Stderr, "[DEBUG] Put: actionID=%s, outputID=%s, size=%d\n",
-		hex.EncodeToString(actionID), hex.EncodeToString(outputID), bodySize)
+func (d *Debug) Put(ctx context.Context, actionID, outputID []byte, encoding string, body io.Reader, bodySize int64) error {
+	fmt.Fprintf(os.Stderr, "[DEBUG] Put: actionID=%s, outputID=%s, encoding=%s, size=%d\n",
+		hex.EncodeToString(actionID), hex.EncodeToString(outputID), encoding, bodySize)
 
 	start := time.Now()
-	err := d.backend.Put(actionID, outputID, body, bodySize)
+	err := d.backend.Put(ctx, actionID, outputID, encoding, body, bodySize)
 	duration := time.Since(start)
 
 	if err != nil {
@@ -46,11 +47,11 @@ func (d *Debug) Put(actionID, outputID []byte, body io.Reader, bodySize int64) e
 }
 
 // Has checks object existence with debug logging.
-func (d *Debug) Has(actionID []byte) (bool, error) {
+func (d *Debug) Has(ctx context.Context, actionID []byte) (bool, error) {
 	fmt.Fprintf(os.Stderr, "[DEBUG] Has: actionID=%s\n", hex.EncodeToString(actionID))
 
 	start := time.Now()
-	exists, err := d.backend.Has(actionID)
+	exists, err := d.backend.Has(ctx, actionID)
 	duration := time.Since(start)
 
 	if err != nil {
@@ -63,16 +64,16 @@ func (d *Debug) Has(actionID []byte) (bool, error) {
 }
 
 // Get retrieves an object from the backend storage with debug logging.
-func (d *Debug) Get(actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, bool, error) {
+func (d *Debug) Get(ctx context.Context, actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, string, bool, error) {
 	fmt.Fprintf(os.Stderr, "[DEBUG] Get: actionID=%s\n", hex.EncodeToString(actionID))
 
 	start := time.Now()
-	outputID, body, size, putTime, miss, err := d.backend.Get(actionID)
+	outputID, body, size, putTime, encoding, miss, err := d.backend.Get(ctx, actionID)
 	duration := time.Since(start)
 
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "[DEBUG] Get: ERROR: %v (duration: %v)\n", err, duration)
-		return outputID, body, size, putTime, miss, err
+		return outputID, body, size, putTime, encoding, miss, err
 	}
 
 	if miss {
@@ -82,15 +83,15 @@ func (d *Debug) Get(actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time,
 			hex.EncodeToString(outputID), size, duration)
 	}
 
-	return outputID, body, size, putTime, miss, err
+	return outputID, body, size, putTime, encoding, miss, err
 }
 
 // Touch refreshes the backend timestamp with debug logging.
-func (d *Debug) Touch(actionID []byte) error {
+func (d *Debug) Touch(ctx context.Context, actionID []byte) error {
 	fmt.Fprintf(os.Stderr, "[DEBUG] Touch: actionID=%s\n", hex.EncodeToString(actionID))
 
 	start := time.Now()
-	err := d.backend.Touch(actionID)
+	err := d.backend.Touch(ctx, actionID)
 	duration := time.Since(start)
 
 	if err != nil {
@@ -120,11 +121,11 @@ func (d *Debug) Close() error {
 }
 
 // Clear removes all entries from the cache with debug logging.
-func (d *Debug) Clear() error {
+func (d *Debug) Clear(ctx context.Context) error {
 	fmt.Fprintf(os.Stderr, "[DEBUG] Clear: clearing cache\n")
 
 	start := time.Now()
-	err := d.backend.Clear()
+	err := d.backend.Clear(ctx)
 	duration := time.Since(start)
 
 	if err != nil {
@@ -0,0 +1,294 @@
+package backends
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Dedup wraps a Backend with a content-addressed layout. Many different action
+// IDs resolve to the same output ID (identical compile outputs across build
+// configurations), so instead of storing a full copy of the body per action,
+// Dedup stores:
+//
+//   - one blob per output ID, holding the body, and
+//   - one small index record per action ID, holding only the output ID.
+//
+// A Put whose blob already exists only writes the index record (and touches the
+// blob so lifecycle policies see that it's still in use). A Get reads the index
+// record and then the blob it points at; a dangling index record is a miss.
+//
+// Index and blob keys live in their own namespaces, separate from the keys used
+// without Dedup, so instances with and without Dedup can share a backend
+// without ever misreading each other's objects. Both are derived from the
+// caller's key namespace (the file format version), so bumping it invalidates
+// deduplicated entries as well. Keys outside the namespace, such as compression
+// dictionaries, are passed through unchanged so every instance sees them.
+//
+// Blob keys are derived from output IDs, so on an encrypted backend they'd
+// reveal what Encrypt hides. With DedupOptions.EncryptionKeys set, blob keys
+// are instead an HMAC of the output ID under a key derived from the current
+// encryption key. Blobs written under older keys are still found, so rotating
+// keys doesn't turn existing entries into misses.
+type Dedup struct {
+	backend   Backend
+	namespace string
+	blobMACs  []blobMACKey // Newest first; empty if blob keys are plain
+
+	// Stats
+	blobsSkipped    atomic.Int64 // Puts whose blob already existed
+	bytesSkipped    atomic.Int64 // Body bytes not uploaded thanks to dedup
+	danglingIndexes atomic.Int64 // Index records whose blob was missing
+}
+
+// DedupOptions configures a Dedup wrapper.
+type DedupOptions struct {
+	// EncryptionKeys are the keys the underlying backend is encrypted with,
+	// current key first. If set, blob keys are keyed hashes of output IDs
+	// rather than the output IDs themselves.
+	EncryptionKeys []EncryptionKey
+}
+
+// blobMACKey is the key blob keys are hashed with, derived from the
+// encryption key with the same ID.
+type blobMACKey struct {
+	id  string
+	key []byte
+}
+
+// NewDedup creates a new dedup wrapper around backend. namespace is prefixed to
+// every blob key and should change whenever the stored format changes.
+func NewDedup(backend Backend, namespace string, opts DedupOptions) *Dedup {
+	d := &Dedup{
+		backend:   backend,
+		namespace: namespace,
+	}
+	for _, k := range opts.EncryptionKeys {
+		// Derive a separate key rather than reusing the AES key for HMAC.
+		mac := hmac.New(sha256.New, k.Key)
+		mac.Write([]byte("gobuildcache dedup blob key"))
+		d.blobMACs = append(d.blobMACs, blobMACKey{id: k.ID, key: mac.Sum(nil)})
+	}
+	return d
+}
+
+// Unwrap returns the underlying backend.
+func (d *Dedup) Unwrap() Backend {
+	return d.backend
+}
+
+// Put writes the blob for outputID unless it already exists, then writes the
+// index record for actionID. Bodies without an output ID can't be deduplicated
+// and are stored inline in the index record.
+func (d *Dedup) Put(ctx context.Context, actionID, outputID []byte, encoding string, body io.Reader, bodySize int64) error {
+	if !d.inNamespace(actionID) {
+		return d.backend.Put(ctx, actionID, outputID, encoding, body, bodySize)
+	}
+	indexKey := d.indexKey(actionID)
+	if len(outputID) == 0 {
+		return d.backend.Put(ctx, indexKey, outputID, encoding, body, bodySize)
+	}
+
+	blobKey := d.blobKey(outputID)
+	exists, err := d.backend.Has(ctx, blobKey)
+	if err != nil {
+		// Fall through and upload; a redundant write is harmless.
+		exists = false
+	}
+
+	if exists {
+		d.blobsSkipped.Add(1)
+		d.bytesSkipped.Add(bodySize)
+		// Keep shared blobs alive for as long as anything references them.
+		if err := d.backend.Touch(ctx, blobKey); err != nil && !errors.Is(err, ErrTouchSkipped) {
+			return fmt.Errorf("failed to touch blob: %w", err)
+		}
+	} else if err := d.backend.Put(ctx, blobKey, outputID, encoding, body, bodySize); err != nil {
+		return fmt.Errorf("failed to put blob: %w", err)
+	}
+
+	// The index is written last so it never points at a blob that doesn't exist yet.
+	if err := d.backend.Put(ctx, indexKey, outputID, "", bytes.NewReader(nil), 0); err != nil {
+		return fmt.Errorf("failed to put index record: %w", err)
+	}
+	return nil
+}
+
+// Has reports whether both the index record and the blob it points at exist.
+func (d *Dedup) Has(ctx context.Context, actionID []byte) (bool, error) {
+	if !d.inNamespace(actionID) {
+		return d.backend.Has(ctx, actionID)
+	}
+	outputID, body, _, _, _, miss, err := d.backend.Get(ctx, d.indexKey(actionID))
+	if err != nil || miss {
+		return false, err
+	}
+	body.Close()
+
+	if len(outputID) == 0 {
+		return true, nil
+	}
+	blobKey, err := d.findBlob(ctx, outputID)
+	return blobKey != nil, err
+}
+
+// Get reads the index record for actionID and returns the blob it points at.
+// The returned put time is the index record's, i.e. when this action was
+// last stored, while the encoding is the blob's: whichever Put uploaded a
+// shared blob decided how it's compressed.
+func (d *Dedup) Get(ctx context.Context, actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, string, bool, error) {
+	if !d.inNamespace(actionID) {
+		return d.backend.Get(ctx, actionID)
+	}
+	outputID, indexBody, indexSize, putTime, encoding, miss, err := d.backend.Get(ctx, d.indexKey(actionID))
+	if err != nil || miss {
+		return nil, nil, 0, nil, "", true, err
+	}
+
+	// Bodies without an output ID are stored inline.
+	if len(outputID) == 0 || indexSize > 0 {
+		return outputID, indexBody, indexSize, putTime, encoding, false, nil
+	}
+	indexBody.Close()
+
+	for _, blobKey := range d.blobKeys(outputID) {
+		_, body, size, _, encoding, miss, err := d.backend.Get(ctx, blobKey)
+		if err != nil {
+			return nil, nil, 0, nil, "", true, fmt.Errorf("failed to get blob: %w", err)
+		}
+		if !miss {
+			return outputID, body, size, putTime, encoding, false, nil
+		}
+	}
+	// e.g. the blob was expired by a lifecycle policy before the index.
+	d.danglingIndexes.Add(1)
+	return nil, nil, 0, nil, "", true, nil
+}
+
+// Touch touches the index record and the blob it points at.
+func (d *Dedup) Touch(ctx context.Context, actionID []byte) error {
+	if !d.inNamespace(actionID) {
+		return d.backend.Touch(ctx, actionID)
+	}
+	indexKey := d.indexKey(actionID)
+	indexErr := d.backend.Touch(ctx, indexKey)
+	if indexErr != nil && !errors.Is(indexErr, ErrTouchSkipped) {
+		return indexErr
+	}
+
+	outputID, body, _, _, _, miss, err := d.backend.Get(ctx, indexKey)
+	if err != nil {
+		return err
+	}
+	if miss {
+		return indexErr
+	}
+	body.Close()
+	if len(outputID) == 0 {
+		return indexErr
+	}
+
+	blobKey := d.blobKey(outputID)
+	if len(d.blobMACs) > 1 {
+		// The blob may have been written under an older key.
+		if blobKey, err = d.findBlob(ctx, outputID); err != nil || blobKey == nil {
+			return err
+		}
+	}
+
+	// Only report ErrTouchSkipped if both touches were skipped.
+	blobErr := d.backend.Touch(ctx, blobKey)
+	if errors.Is(blobErr, ErrTouchSkipped) {
+		return indexErr
+	}
+	return blobErr
+}
+
+// Close closes the underlying backend.
+func (d *Dedup) Close() error {
+	return d.backend.Close()
+}
+
+// Clear clears the underlying backend.
+func (d *Dedup) Clear(ctx context.Context) error {
+	return d.backend.Clear(ctx)
+}
+
+// inNamespace reports whether key is deduplicated, i.e. it's one of the
+// caller's namespaced action keys.
+func (d *Dedup) inNamespace(key []byte) bool {
+	return bytes.HasPrefix(key, []byte(d.namespace))
+}
+
+// indexKey returns the key of the index record for actionID (the caller's
+// backend key, which already includes the namespace).
+func (d *Dedup) indexKey(actionID []byte) []byte {
+	return append([]byte("index/"), actionID...)
+}
+
+// blobKey returns the key new blobs for outputID are written under.
+func (d *Dedup) blobKey(outputID []byte) []byte {
+	if len(d.blobMACs) == 0 {
+		return []byte(d.namespace + "/blob/" + hex.EncodeToString(outputID))
+	}
+	return d.macBlobKey(d.blobMACs[0], outputID)
+}
+
+// blobKeys returns every key the blob for outputID may be stored under, the
+// one new blobs are written under first.
+func (d *Dedup) blobKeys(outputID []byte) [][]byte {
+	if len(d.blobMACs) <= 1 {
+		return [][]byte{d.blobKey(outputID)}
+	}
+	keys := make([][]byte, len(d.blobMACs))
+	for i, k := range d.blobMACs {
+		keys[i] = d.macBlobKey(k, outputID)
+	}
+	return keys
+}
+
+// macBlobKey returns the key of the blob for outputID hashed under k. The key
+// ID is part of the key, so blobs hashed under different keys never collide.
+func (d *Dedup) macBlobKey(k blobMACKey, outputID []byte) []byte {
+	mac := hmac.New(sha256.New, k.key)
+	mac.Write(outputID)
+	return []byte(d.namespace + "/blob/" + k.id + "/" + hex.EncodeToString(mac.Sum(nil)))
+}
+
+// findBlob returns the key the blob for outputID is stored under, or nil if
+// there isn't one.
+func (d *Dedup) findBlob(ctx context.Context, outputID []byte) ([]byte, error) {
+	for _, blobKey := range d.blobKeys(outputID) {
+		exists, err := d.backend.Has(ctx, blobKey)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			return blobKey, nil
+		}
+	}
+	return nil, nil
+}
+
+// Stats returns dedup statistics.
+func (d *Dedup) Stats() DedupStats {
+	return DedupStats{
+		BlobsSkipped:    d.blobsSkipped.Load(),
+		BytesSkipped:    d.bytesSkipped.Load(),
+		DanglingIndexes: d.danglingIndexes.Load(),
+	}
+}
+
+// DedupStats holds statistics for the dedup wrapper.
+type DedupStats struct {
+	BlobsSkipped    int64
+	BytesSkipped    int64
+	DanglingIndexes int64
+}
@@ -0,0 +1,227 @@
+package backends
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+)
+
+func readDedupEntry(t *testing.T, d *Dedup, actionID string) (string, string) {
+	t.Helper()
+	outputID, body, size, _, _, miss, err := d.Get(t.Context(), []byte(actionID))
+	if err != nil {
+		t.Fatalf("unexpected Get error: %v", err)
+	}
+	if miss {
+		t.Fatalf("expected hit for %s, got miss", actionID)
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("failed to read body: %v", err)
+	}
+	if int64(len(data)) != size {
+		t.Fatalf("expected size=%d, got %d bytes", size, len(data))
+	}
+	return string(outputID), string(data)
+}
+
+func TestDedup_SharedOutputStoredOnce(t *testing.T) {
+	fs, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	d := NewDedup(fs, "v2", DedupOptions{})
+
+	if err := d.Put(t.Context(), []byte("v2action1"), []byte("output"), "", strings.NewReader("hello world"), 11); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+	if err := d.Put(t.Context(), []byte("v2action2"), []byte("output"), "", strings.NewReader("hello world"), 11); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+
+	stats := d.Stats()
+	if stats.BlobsSkipped != 1 || stats.BytesSkipped != 11 {
+		t.Fatalf("expected 1 skipped blob of 11 bytes, got %+v", stats)
+	}
+
+	for _, actionID := range []string{"v2action1", "v2action2"} {
+		outputID, data := readDedupEntry(t, d, actionID)
+		if outputID != "output" || data != "hello world" {
+			t.Fatalf("unexpected entry for %s: outputID=%s body=%q", actionID, outputID, data)
+		}
+	}
+
+	// The raw index record holds no body.
+	_, body, size, _, _, miss, err := fs.Get(t.Context(), d.indexKey([]byte("v2action1")))
+	if err != nil || miss {
+		t.Fatalf("expected index record, miss=%v err=%v", miss, err)
+	}
+	body.Close()
+	if size != 0 {
+		t.Fatalf("expected empty index record, got %d bytes", size)
+	}
+}
+
+func TestDedup_GetReturnsBlobEncoding(t *testing.T) {
+	fs, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	d := NewDedup(fs, "v2", DedupOptions{})
+
+	if err := d.Put(t.Context(), []byte("v2action1"), []byte("output"), "zstd", strings.NewReader("compressed"), 10); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+	// The blob already exists, so this body (and its encoding) isn't stored.
+	if err := d.Put(t.Context(), []byte("v2action2"), []byte("output"), "none", strings.NewReader("plain"), 5); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+
+	_, body, _, _, encoding, miss, err := d.Get(t.Context(), []byte("v2action2"))
+	if err != nil || miss {
+		t.Fatalf("expected hit, miss=%v err=%v", miss, err)
+	}
+	body.Close()
+	if encoding != "zstd" {
+		t.Fatalf("expected the blob's encoding, got %q", encoding)
+	}
+}
+
+func TestDedup_DanglingIndexIsMiss(t *testing.T) {
+	fs, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	d := NewDedup(fs, "v2", DedupOptions{})
+
+	if err := d.Put(t.Context(), []byte("v2action"), []byte("output"), "", strings.NewReader("hello"), 5); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+	// Simulate the blob expiring before the index record.
+	if err := fs.Clear(t.Context()); err != nil {
+		t.Fatalf("failed to clear: %v", err)
+	}
+	if err := fs.Put(t.Context(), d.indexKey([]byte("v2action")), []byte("output"), "", nil, 0); err != nil {
+		t.Fatalf("failed to restore index record: %v", err)
+	}
+
+	_, _, _, _, _, miss, err := d.Get(t.Context(), []byte("v2action"))
+	if err != nil {
+		t.Fatalf("unexpected Get error: %v", err)
+	}
+	if !miss {
+		t.Fatal("expected miss for dangling index record")
+	}
+	if got := d.Stats().DanglingIndexes; got != 1 {
+		t.Fatalf("expected 1 dangling index, got %d", got)
+	}
+
+	has, err := d.Has(t.Context(), []byte("v2action"))
+	if err != nil || has {
+		t.Fatalf("expected Has=false for dangling index, got %v err=%v", has, err)
+	}
+}
+
+func TestDedup_EmptyOutputIDStoredInline(t *testing.T) {
+	fs, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	d := NewDedup(fs, "v2", DedupOptions{})
+
+	if err := d.Put(t.Context(), []byte("v2action"), nil, "", strings.NewReader("inline"), 6); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+	outputID, data := readDedupEntry(t, d, "v2action")
+	if outputID != "" || data != "inline" {
+		t.Fatalf("unexpected entry: outputID=%q body=%q", outputID, data)
+	}
+}
+
+func TestDedup_GetMiss(t *testing.T) {
+	fs, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	d := NewDedup(fs, "v2", DedupOptions{})
+
+	_, body, _, _, _, miss, err := d.Get(t.Context(), []byte("v2missing"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !miss || body != nil {
+		t.Fatalf("expected miss with nil body, got miss=%v body=%v", miss, body)
+	}
+}
+
+func TestDedup_TouchesIndexAndBlob(t *testing.T) {
+	backend := &mockBackend{getOutputID: []byte("output")}
+	d := NewDedup(backend, "v2", DedupOptions{})
+
+	if err := d.Touch(t.Context(), []byte("v2action")); err != nil {
+		t.Fatalf("unexpected Touch error: %v", err)
+	}
+	// Index and blob are both touched.
+	if got := backend.touchCalled.Load(); got != 2 {
+		t.Fatalf("expected 2 touches, got %d", got)
+	}
+}
+
+func TestDedup_PassesThroughKeysOutsideNamespace(t *testing.T) {
+	fs, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	d := NewDedup(fs, "v2", DedupOptions{})
+
+	if err := d.Put(t.Context(), []byte("dict/current"), []byte("output"), "", strings.NewReader("shared"), 6); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+	// Stored under the plain key, so instances without Dedup see it too.
+	_, body, _, _, _, miss, err := fs.Get(t.Context(), []byte("dict/current"))
+	if err != nil || miss {
+		t.Fatalf("expected plain object, miss=%v err=%v", miss, err)
+	}
+	data, _ := io.ReadAll(body)
+	body.Close()
+	if string(data) != "shared" {
+		t.Fatalf("unexpected body %q", data)
+	}
+	if _, data := readDedupEntry(t, d, "dict/current"); data != "shared" {
+		t.Fatalf("unexpected body through dedup %q", data)
+	}
+}
+
+func TestDedup_EncryptionKeysHideOutputIDs(t *testing.T) {
+	fs, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	oldKey := EncryptionKey{ID: "old", Key: make([]byte, 32)}
+	d := NewDedup(fs, "v2", DedupOptions{EncryptionKeys: []EncryptionKey{oldKey}})
+
+	outputID := []byte("output")
+	if err := d.Put(t.Context(), []byte("v2action"), outputID, "", strings.NewReader("hello"), 5); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+	if exists, err := fs.Has(t.Context(), []byte("v2/blob/"+hex.EncodeToString(outputID))); err != nil || exists {
+		t.Fatalf("expected no blob under the plain output ID, exists=%v err=%v", exists, err)
+	}
+
+	// After a rotation, blobs hashed under the old key are still found.
+	newKey := EncryptionKey{ID: "new", Key: bytes.Repeat([]byte{1}, 32)}
+	rotated := NewDedup(fs, "v2", DedupOptions{EncryptionKeys: []EncryptionKey{newKey, oldKey}})
+	if exists, err := rotated.Has(t.Context(), []byte("v2action")); err != nil || !exists {
+		t.Fatalf("expected Has=true after rotation, exists=%v err=%v", exists, err)
+	}
+	if outputID, data := readDedupEntry(t, rotated, "v2action"); outputID != "output" || data != "hello" {
+		t.Fatalf("unexpected entry after rotation: outputID=%s body=%q", outputID, data)
+	}
+	if err := rotated.Touch(t.Context(), []byte("v2action")); err != nil {
+		t.Fatalf("unexpected Touch error: %v", err)
+	}
+}
@@ -0,0 +1,458 @@
+package backends
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ErrAuthenticationFailed is returned from reading an object body that fails
+// authentication, e.g. because it was tampered with or truncated. Like
+// ErrChecksumMismatch, it's reported while the body is read, so callers must
+// read to EOF before trusting a body, and should treat it as a cache miss.
+var ErrAuthenticationFailed = errors.New("authentication failed")
+
+const (
+	// encryptEncodingPrefix starts the encoding of every encrypted object,
+	// followed by the key ID and the encoding of the plaintext body:
+	// "aesgcm:<key ID>:<encoding>".
+	encryptEncodingPrefix = "aesgcm:"
+	// encryptChunkSize is the plaintext size of each separately sealed chunk
+	// of a body, which lets bodies be encrypted and decrypted as streams.
+	encryptChunkSize = 64 << 10
+	// encryptSaltSize is the size of the random per-object salt that the
+	// object's key is derived from. Each object is sealed with its own key,
+	// so nonces only need to be unique within an object: each chunk's nonce
+	// is a 4-byte chunk counter and a final chunk flag, so chunks can't be
+	// reordered, dropped or truncated.
+	encryptSaltSize  = 32
+	encryptNonceSize = 12
+	encryptTagSize   = 16
+	// encryptKeyInfo is the HKDF info string object keys are derived with.
+	encryptKeyInfo = "gobuildcache aesgcm object key"
+	// encryptOutputIDFlag is the final byte of the nonce that seals the
+	// output ID, distinct from the body chunk flags (0 and 1).
+	encryptOutputIDFlag = 2
+	maxKeyIDLength      = 32
+)
+
+// EncryptionKey is a named AES key. The ID is stored with every object
+// encrypted with the key, so that old keys can still decrypt after rotation.
+type EncryptionKey struct {
+	ID  string
+	Key []byte // 16, 24 or 32 bytes (AES-128, AES-192 or AES-256)
+}
+
+// ParseEncryptionKeys parses a keyring: one "<key ID>:<base64 key>" entry per
+// line or comma-separated. Blank lines and lines starting with # are ignored.
+// The first key encrypts new objects; the rest are only used to decrypt
+// objects written before a rotation.
+func ParseEncryptionKeys(s string) ([]EncryptionKey, error) {
+	entries, err := parseKeyring(s)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]EncryptionKey, len(entries))
+	for i, e := range entries {
+		keys[i] = EncryptionKey{ID: e.id, Key: e.key}
+	}
+	return keys, nil
+}
+
+// keyringEntry is one named key of a keyring.
+type keyringEntry struct {
+	id  string
+	key []byte
+}
+
+// parseKeyring parses the "<key ID>:<base64 key>" keyring format shared by
+// encryption and signing keys.
+func parseKeyring(s string) ([]keyringEntry, error) {
+	var entries []keyringEntry
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, entry := range strings.Split(line, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			id, encoded, ok := strings.Cut(entry, ":")
+			if !ok {
+				// Don't echo the entry: it may be a bare key.
+				return nil, fmt.Errorf("invalid key entry %d: expected <key ID>:<base64 key>", len(entries)+1)
+			}
+			key, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				return nil, fmt.Errorf("invalid key %q: %w", id, err)
+			}
+			entries = append(entries, keyringEntry{id: id, key: key})
+		}
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no keys found")
+	}
+	return entries, nil
+}
+
+// Encrypt wraps a Backend and encrypts object bodies and output IDs with
+// AES-GCM, so that the underlying storage only ever holds ciphertext. Each
+// object is encrypted with its own key, derived with HKDF-SHA256 from the
+// configured key and a random salt stored with the object, so the number of
+// objects a key can encrypt isn't limited by GCM's nonce size.
+//
+// Objects record the ID of the key they were encrypted with in their encoding,
+// so keys can be rotated by adding a new key in front of the old ones. Object
+// keys (action IDs), sizes and put times are stored in the clear, but are
+// authenticated along with the encoding: an object can't be moved to another
+// key or served with a different encoding.
+//
+// Encrypt fails closed. Objects that aren't encrypted, were encrypted with an
+// unknown key, or whose output ID fails authentication are misses. A body that
+// fails authentication returns ErrAuthenticationFailed once it's read.
+type Encrypt struct {
+	backend Backend
+	current string
+	keys    map[string][]byte
+
+	// Stats
+	authFailures atomic.Int64 // Objects rejected because they failed authentication
+	unknownKeys  atomic.Int64 // Objects rejected because their key isn't configured
+}
+
+// NewEncrypt creates a new encryption wrapper around backend. keys[0]
+// encrypts new objects; every key decrypts.
+func NewEncrypt(backend Backend, keys []EncryptionKey) (*Encrypt, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("at least one encryption key is required")
+	}
+	e := &Encrypt{
+		backend: backend,
+		current: keys[0].ID,
+		keys:    make(map[string][]byte, len(keys)),
+	}
+	for _, k := range keys {
+		if err := validateKeyID(k.ID); err != nil {
+			return nil, err
+		}
+		if _, ok := e.keys[k.ID]; ok {
+			return nil, fmt.Errorf("duplicate encryption key ID %q", k.ID)
+		}
+		if _, err := aes.NewCipher(k.Key); err != nil {
+			return nil, fmt.Errorf("invalid encryption key %q: %w", k.ID, err)
+		}
+		e.keys[k.ID] = k.Key
+	}
+	return e, nil
+}
+
+// validateKeyID checks that a key ID can be stored in every backend's metadata.
+func validateKeyID(id string) error {
+	if id == "" || len(id) > maxKeyIDLength {
+		return fmt.Errorf("invalid key ID %q: must be 1-%d characters", id, maxKeyIDLength)
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return fmt.Errorf("invalid key ID %q: only letters, digits, '-', '_' and '.' are allowed", id)
+		}
+	}
+	return nil
+}
+
+// Unwrap returns the underlying backend.
+func (e *Encrypt) Unwrap() Backend {
+	return e.backend
+}
+
+// Put encrypts outputID and body with the current key and stores them.
+func (e *Encrypt) Put(ctx context.Context, actionID, outputID []byte, encoding string, body io.Reader, bodySize int64) error {
+	storedEncoding := encryptEncodingPrefix + e.current + ":" + encoding
+
+	salt := make([]byte, encryptSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return fmt.Errorf("failed to generate salt: %w", err)
+	}
+	aead, err := objectAEAD(e.keys[e.current], salt)
+	if err != nil {
+		return err
+	}
+	aad := encryptAAD(actionID, storedEncoding)
+
+	// The stored output ID carries the salt, which ties the body to it.
+	sealedOutputID := aead.Seal(bytes.Clone(salt), encryptNonce(0, encryptOutputIDFlag), outputID, aad)
+
+	if body == nil {
+		body = bytes.NewReader(nil)
+	}
+	encrypted := &encryptingReader{
+		src:       body,
+		aead:      aead,
+		aad:       aad,
+		remaining: bodySize,
+		chunks:    encryptChunks(bodySize),
+	}
+	return e.backend.Put(ctx, actionID, sealedOutputID, storedEncoding, encrypted, encryptedSize(bodySize))
+}
+
+// Has passes through to the underlying backend. It can't authenticate the
+// object, so a later Get may still be a miss.
+func (e *Encrypt) Has(ctx context.Context, actionID []byte) (bool, error) {
+	return e.backend.Has(ctx, actionID)
+}
+
+// Get retrieves and decrypts an object. The body is decrypted as it's read.
+func (e *Encrypt) Get(ctx context.Context, actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, string, bool, error) {
+	sealedOutputID, body, size, putTime, storedEncoding, miss, err := e.backend.Get(ctx, actionID)
+	if err != nil || miss {
+		return nil, nil, 0, nil, "", true, err
+	}
+
+	reject := func(counter *atomic.Int64) ([]byte, io.ReadCloser, int64, *time.Time, string, bool, error) {
+		body.Close()
+		counter.Add(1)
+		return nil, nil, 0, nil, "", true, nil
+	}
+
+	rest, ok := strings.CutPrefix(storedEncoding, encryptEncodingPrefix)
+	if !ok {
+		return reject(&e.authFailures)
+	}
+	keyID, encoding, ok := strings.Cut(rest, ":")
+	if !ok {
+		return reject(&e.authFailures)
+	}
+	key, ok := e.keys[keyID]
+	if !ok {
+		return reject(&e.unknownKeys)
+	}
+
+	plaintextSize, ok := decryptedSize(size)
+	if !ok || len(sealedOutputID) < encryptSaltSize {
+		return reject(&e.authFailures)
+	}
+	aead, err := objectAEAD(key, sealedOutputID[:encryptSaltSize])
+	if err != nil {
+		body.Close()
+		return nil, nil, 0, nil, "", true, err
+	}
+	aad := encryptAAD(actionID, storedEncoding)
+	outputID, err := aead.Open(nil, encryptNonce(0, encryptOutputIDFlag), sealedOutputID[encryptSaltSize:], aad)
+	if err != nil {
+		return reject(&e.authFailures)
+	}
+
+	decrypted := &decryptingReader{
+		src:          body,
+		aead:         aead,
+		aad:          aad,
+		remaining:    size,
+		chunks:       encryptChunks(plaintextSize),
+		authFailures: &e.authFailures,
+	}
+	return outputID, decrypted, plaintextSize, putTime, encoding, false, nil
+}
+
+// Touch passes through to the underlying backend.
+func (e *Encrypt) Touch(ctx context.Context, actionID []byte) error {
+	return e.backend.Touch(ctx, actionID)
+}
+
+// Close closes the underlying backend.
+func (e *Encrypt) Close() error {
+	return e.backend.Close()
+}
+
+// Clear clears the underlying backend.
+func (e *Encrypt) Clear(ctx context.Context) error {
+	return e.backend.Clear(ctx)
+}
+
+// Stats returns encryption statistics.
+func (e *Encrypt) Stats() EncryptStats {
+	return EncryptStats{
+		CurrentKeyID: e.current,
+		AuthFailures: e.authFailures.Load(),
+		UnknownKeys:  e.unknownKeys.Load(),
+	}
+}
+
+// EncryptStats holds statistics for the encryption wrapper.
+type EncryptStats struct {
+	CurrentKeyID string
+	AuthFailures int64
+	UnknownKeys  int64
+}
+
+// encryptAAD returns the additional data authenticated with every part of an
+// object: its key and stored encoding.
+func encryptAAD(actionID []byte, storedEncoding string) []byte {
+	aad := make([]byte, 0, len(actionID)+1+len(storedEncoding))
+	aad = append(aad, actionID...)
+	aad = append(aad, 0)
+	return append(aad, storedEncoding...)
+}
+
+// objectAEAD returns the AEAD an object with the given salt is sealed with,
+// keyed with a subkey of key the same size as key.
+func objectAEAD(key, salt []byte) (cipher.AEAD, error) {
+	subkey, err := hkdf.Key(sha256.New, key, salt, encryptKeyInfo, len(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive object key: %w", err)
+	}
+	block, err := aes.NewCipher(subkey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create object cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptNonce returns the nonce for chunk counter of an object.
+func encryptNonce(counter uint32, flag byte) []byte {
+	nonce := make([]byte, encryptNonceSize)
+	binary.BigEndian.PutUint32(nonce[encryptNonceSize-5:], counter)
+	nonce[encryptNonceSize-1] = flag
+	return nonce
+}
+
+// encryptChunks returns the number of chunks a body of size bytes is sealed
+// in. Empty bodies are a single empty chunk, so they're authenticated too.
+func encryptChunks(size int64) int64 {
+	return max(1, (size+encryptChunkSize-1)/encryptChunkSize)
+}
+
+// encryptedSize returns the size of a body of size bytes once encrypted.
+func encryptedSize(size int64) int64 {
+	return size + encryptChunks(size)*encryptTagSize
+}
+
+// decryptedSize returns the plaintext size of an encrypted body of size bytes,
+// and whether size is a valid encrypted size at all.
+func decryptedSize(size int64) (int64, bool) {
+	chunks := (size + encryptChunkSize + encryptTagSize - 1) / (encryptChunkSize + encryptTagSize)
+	plaintext := size - chunks*encryptTagSize
+	if chunks < 1 || plaintext < 0 || encryptChunks(plaintext) != chunks {
+		return 0, false
+	}
+	return plaintext, true
+}
+
+// encryptingReader seals src chunk by chunk as it's read.
+type encryptingReader struct {
+	src       io.Reader
+	aead      cipher.AEAD
+	aad       []byte
+	remaining int64 // Plaintext bytes not yet read from src
+	chunks    int64
+	counter   int64
+	buf       []byte
+	out       []byte // Sealed bytes not yet returned
+}
+
+func (r *encryptingReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.counter == r.chunks {
+			return 0, io.EOF
+		}
+		n := min(r.remaining, encryptChunkSize)
+		if r.buf == nil {
+			r.buf = make([]byte, 0, encryptChunkSize+encryptTagSize)
+		}
+		chunk := r.buf[:n]
+		if _, err := io.ReadFull(r.src, chunk); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return 0, fmt.Errorf("body shorter than its size")
+			}
+			return 0, err
+		}
+		r.remaining -= n
+
+		var flag byte
+		if r.counter == r.chunks-1 {
+			flag = 1
+		}
+		r.out = r.aead.Seal(chunk[:0], encryptNonce(uint32(r.counter), flag), chunk, r.aad)
+		r.counter++
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// decryptingReader opens src chunk by chunk as it's read. Any chunk that fails
+// authentication, or a body that ends early, fails every further read with
+// ErrAuthenticationFailed.
+type decryptingReader struct {
+	src          io.ReadCloser
+	aead         cipher.AEAD
+	aad          []byte
+	remaining    int64 // Sealed bytes not yet read from src
+	chunks       int64
+	counter      int64
+	buf          []byte
+	out          []byte // Opened bytes not yet returned
+	err          error
+	authFailures *atomic.Int64
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.counter == r.chunks {
+			return 0, io.EOF
+		}
+		n := min(r.remaining, encryptChunkSize+encryptTagSize)
+		if r.buf == nil {
+			r.buf = make([]byte, encryptChunkSize+encryptTagSize)
+		}
+		chunk := r.buf[:n]
+		if _, err := io.ReadFull(r.src, chunk); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return 0, r.fail(fmt.Errorf("%w: body ended early", ErrAuthenticationFailed))
+			}
+			return 0, err
+		}
+		r.remaining -= n
+
+		var flag byte
+		if r.counter == r.chunks-1 {
+			flag = 1
+		}
+		out, err := r.aead.Open(chunk[:0], encryptNonce(uint32(r.counter), flag), chunk, r.aad)
+		if err != nil {
+			return 0, r.fail(fmt.Errorf("%w: chunk %d: %v", ErrAuthenticationFailed, r.counter, err))
+		}
+		r.out = out
+		r.counter++
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// fail records err as the reader's permanent error.
+func (r *decryptingReader) fail(err error) error {
+	r.err = err
+	r.authFailures.Add(1)
+	return err
+}
+
+// Close closes the underlying body.
+func (r *decryptingReader) Close() error {
+	return r.src.Close()
+}
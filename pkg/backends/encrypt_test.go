@@ -0,0 +1,231 @@
+package backends
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func testEncryptionKey(id string, b byte) EncryptionKey {
+	return EncryptionKey{ID: id, Key: bytes.Repeat([]byte{b}, 32)}
+}
+
+func TestEncrypt_RoundTrip(t *testing.T) {
+	fs, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	e, err := NewEncrypt(fs, []EncryptionKey{testEncryptionKey("k1", 1)})
+	if err != nil {
+		t.Fatalf("failed to create encrypt backend: %v", err)
+	}
+
+	// Empty, single chunk, exactly one chunk and several chunks.
+	for _, size := range []int{0, 11, encryptChunkSize, 3*encryptChunkSize + 5} {
+		body := bytes.Repeat([]byte("s"), size)
+		if err := e.Put(t.Context(), []byte("action"), []byte("output"), "zstd", bytes.NewReader(body), int64(size)); err != nil {
+			t.Fatalf("size %d: unexpected Put error: %v", size, err)
+		}
+
+		// Neither the body nor the output ID are stored in the clear.
+		storedOutputID, stored, storedSize, _, storedEncoding, _, err := fs.Get(t.Context(), []byte("action"))
+		if err != nil {
+			t.Fatalf("size %d: unexpected Get error: %v", size, err)
+		}
+		storedData, _ := io.ReadAll(stored)
+		stored.Close()
+		if storedSize != encryptedSize(int64(size)) || bytes.Contains(storedOutputID, []byte("output")) ||
+			(size > 0 && bytes.Contains(storedData, body[:min(size, 11)])) || storedEncoding != "aesgcm:k1:zstd" {
+			t.Fatalf("size %d: unexpected stored object: size=%d encoding=%q", size, storedSize, storedEncoding)
+		}
+
+		outputID, got, gotSize, _, encoding, miss, err := e.Get(t.Context(), []byte("action"))
+		if err != nil || miss {
+			t.Fatalf("size %d: expected hit, miss=%v err=%v", size, miss, err)
+		}
+		data, err := io.ReadAll(got)
+		got.Close()
+		if err != nil {
+			t.Fatalf("size %d: failed to read body: %v", size, err)
+		}
+		if string(outputID) != "output" || gotSize != int64(size) || encoding != "zstd" || !bytes.Equal(data, body) {
+			t.Fatalf("size %d: unexpected object: outputID=%q size=%d encoding=%q", size, outputID, gotSize, encoding)
+		}
+	}
+}
+
+func TestEncrypt_PerObjectKeys(t *testing.T) {
+	fs, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	e, err := NewEncrypt(fs, []EncryptionKey{testEncryptionKey("k1", 1)})
+	if err != nil {
+		t.Fatalf("failed to create encrypt backend: %v", err)
+	}
+
+	// The same object stored twice is sealed under different salts, so
+	// neither the output ID nor the body ciphertext repeat.
+	var outputIDs, bodies [][]byte
+	for _, actionID := range []string{"a", "b"} {
+		if err := e.Put(t.Context(), []byte(actionID), []byte("output"), "", strings.NewReader("hello"), 5); err != nil {
+			t.Fatalf("unexpected Put error: %v", err)
+		}
+		outputID, body, _, _, _, _, err := fs.Get(t.Context(), []byte(actionID))
+		if err != nil {
+			t.Fatalf("unexpected Get error: %v", err)
+		}
+		data, _ := io.ReadAll(body)
+		body.Close()
+		if len(outputID) < encryptSaltSize {
+			t.Fatalf("stored output ID too short: %d bytes", len(outputID))
+		}
+		outputIDs = append(outputIDs, outputID)
+		bodies = append(bodies, data)
+	}
+	if bytes.Equal(outputIDs[0][:encryptSaltSize], outputIDs[1][:encryptSaltSize]) ||
+		bytes.Equal(outputIDs[0], outputIDs[1]) || bytes.Equal(bodies[0], bodies[1]) {
+		t.Fatalf("expected objects sealed under different keys")
+	}
+}
+
+func TestEncrypt_KeyRotation(t *testing.T) {
+	fs, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	old, err := NewEncrypt(fs, []EncryptionKey{testEncryptionKey("k1", 1)})
+	if err != nil {
+		t.Fatalf("failed to create encrypt backend: %v", err)
+	}
+	if err := old.Put(t.Context(), []byte("action"), []byte("output"), "", strings.NewReader("hello"), 5); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+
+	// The new key encrypts, while the old one still decrypts.
+	rotated, err := NewEncrypt(fs, []EncryptionKey{testEncryptionKey("k2", 2), testEncryptionKey("k1", 1)})
+	if err != nil {
+		t.Fatalf("failed to create encrypt backend: %v", err)
+	}
+	_, body, _, _, _, miss, err := rotated.Get(t.Context(), []byte("action"))
+	if err != nil || miss {
+		t.Fatalf("expected hit with the old key, miss=%v err=%v", miss, err)
+	}
+	body.Close()
+
+	if err := rotated.Put(t.Context(), []byte("action"), []byte("output"), "", strings.NewReader("hello"), 5); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+	// Instances without the new key fail closed.
+	_, _, _, _, _, miss, err = old.Get(t.Context(), []byte("action"))
+	if err != nil || !miss {
+		t.Fatalf("expected miss for an unknown key, miss=%v err=%v", miss, err)
+	}
+	if stats := old.Stats(); stats.UnknownKeys != 1 {
+		t.Fatalf("expected 1 unknown key, got %+v", stats)
+	}
+}
+
+func TestEncrypt_FailsClosed(t *testing.T) {
+	fs, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	e, err := NewEncrypt(fs, []EncryptionKey{testEncryptionKey("k1", 1)})
+	if err != nil {
+		t.Fatalf("failed to create encrypt backend: %v", err)
+	}
+
+	// Plaintext objects are never served.
+	if err := fs.Put(t.Context(), []byte("plain"), []byte("output"), "none", strings.NewReader("hello"), 5); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+	// Nor are objects whose encoding was changed...
+	if err := e.Put(t.Context(), []byte("action"), []byte("output"), "zstd", strings.NewReader("hello"), 5); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+	outputID, body, size, _, _, _, _ := fs.Get(t.Context(), []byte("action"))
+	data, _ := io.ReadAll(body)
+	body.Close()
+	if err := fs.Put(t.Context(), []byte("reencoded"), outputID, "aesgcm:k1:none", bytes.NewReader(data), size); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+	// ...or that were moved to another key.
+	if err := fs.Put(t.Context(), []byte("moved"), outputID, "aesgcm:k1:zstd", bytes.NewReader(data), size); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+
+	for _, key := range []string{"plain", "reencoded", "moved"} {
+		_, _, _, _, _, miss, err := e.Get(t.Context(), []byte(key))
+		if err != nil || !miss {
+			t.Fatalf("%s: expected miss, miss=%v err=%v", key, miss, err)
+		}
+	}
+	if stats := e.Stats(); stats.AuthFailures != 3 {
+		t.Fatalf("expected 3 authentication failures, got %+v", stats)
+	}
+}
+
+func TestEncrypt_TamperedBody(t *testing.T) {
+	fs, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	e, err := NewEncrypt(fs, []EncryptionKey{testEncryptionKey("k1", 1)})
+	if err != nil {
+		t.Fatalf("failed to create encrypt backend: %v", err)
+	}
+
+	body := bytes.Repeat([]byte("x"), 2*encryptChunkSize)
+	if err := e.Put(t.Context(), []byte("action"), []byte("output"), "", bytes.NewReader(body), int64(len(body))); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+	// Rewrite the object with a bit flipped in the final chunk, with a
+	// matching checksum so only authentication catches it.
+	outputID, stored, size, _, encoding, _, err := fs.Get(t.Context(), []byte("action"))
+	if err != nil {
+		t.Fatalf("unexpected Get error: %v", err)
+	}
+	data, _ := io.ReadAll(stored)
+	stored.Close()
+	data[len(data)-1] ^= 1
+	if err := fs.Put(t.Context(), []byte("action"), outputID, encoding, bytes.NewReader(data), size); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+
+	_, got, _, _, _, miss, err := e.Get(t.Context(), []byte("action"))
+	if err != nil || miss {
+		t.Fatalf("expected hit before the body is read, miss=%v err=%v", miss, err)
+	}
+	defer got.Close()
+	if _, err := io.ReadAll(got); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Fatalf("expected ErrAuthenticationFailed, got %v", err)
+	}
+	if stats := e.Stats(); stats.AuthFailures != 1 {
+		t.Fatalf("expected 1 authentication failure, got %+v", stats)
+	}
+}
+
+func TestParseEncryptionKeys(t *testing.T) {
+	keys, err := ParseEncryptionKeys("# rotated 2026-10\nk2:AgICAgICAgICAgICAgICAg==\n\nk1:AQEBAQEBAQEBAQEBAQEBAQ==, k0:AAAAAAAAAAAAAAAAAAAAAA==\n")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(keys) != 3 || keys[0].ID != "k2" || keys[2].ID != "k0" || !bytes.Equal(keys[1].Key, bytes.Repeat([]byte{1}, 16)) {
+		t.Fatalf("unexpected keys: %+v", keys)
+	}
+
+	for _, bad := range []string{"", "AQEBAQEBAQEBAQEBAQEBAQ==", "k1:not base64"} {
+		if _, err := ParseEncryptionKeys(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+	if _, err := NewEncrypt(NewNoop(), []EncryptionKey{{ID: "k 1", Key: make([]byte, 32)}}); err == nil {
+		t.Fatal("expected error for key ID with a space")
+	}
+	if _, err := NewEncrypt(NewNoop(), []EncryptionKey{{ID: "k1", Key: make([]byte, 7)}}); err == nil {
+		t.Fatal("expected error for a 7-byte key")
+	}
+}
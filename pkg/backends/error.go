@@ -1,6 +1,7 @@
 package backends
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"math/rand"
@@ -49,56 +50,72 @@ func (e *Error) shouldError() bool {
 	return e.rng.Float64() < e.errorRate
 }
 
+// simulatedError is an injected error. It's transient, so that injected errors
+// exercise the Retry wrapper like real network failures would.
+type simulatedError struct {
+	op        string
+	errorRate float64
+}
+
+func (e *simulatedError) Error() string {
+	return fmt.Sprintf("error backend: simulated %s error (error rate: %.2f%%)", e.op, e.errorRate*100)
+}
+
+// Temporary reports that the error is transient.
+func (e *simulatedError) Temporary() bool {
+	return true
+}
+
 // Put stores an object in the backend storage, potentially returning an error.
-func (e *Error) Put(actionID, outputID []byte, body io.Reader, bodySize int64) error {
+func (e *Error) Put(ctx context.Context, actionID, outputID []byte, encoding string, body io.Reader, bodySize int64) error {
 	if e.shouldError() {
 		e.putErrors.Add(1)
-		return fmt.Errorf("error backend: simulated Put error (error rate: %.2f%%)", e.errorRate*100)
+		return &simulatedError{op: "Put", errorRate: e.errorRate}
 	}
-	return e.backend.Put(actionID, outputID, body, bodySize)
+	return e.backend.Put(ctx, actionID, outputID, encoding, body, bodySize)
 }
 
 // Has checks object existence, potentially returning an error.
-func (e *Error) Has(actionID []byte) (bool, error) {
+func (e *Error) Has(ctx context.Context, actionID []byte) (bool, error) {
 	if e.shouldError() {
-		return false, fmt.Errorf("error backend: simulated Has error (error rate: %.2f%%)", e.errorRate*100)
+		return false, &simulatedError{op: "Has", errorRate: e.errorRate}
 	}
-	return e.backend.Has(actionID)
+	return e.backend.Has(ctx, actionID)
 }
 
 // Get retrieves an object from the backend storage, potentially returning an error.
-func (e *Error) Get(actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, bool, error) {
+func (e *Error) Get(ctx context.Context, actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, string, bool, error) {
 	if e.shouldError() {
 		e.getErrors.Add(1)
-		return nil, nil, 0, nil, false, fmt.Errorf("error backend: simulated Get error (error rate: %.2f%%)", e.errorRate*100)
+		return nil, nil, 0, nil, "", false, &simulatedError{op: "Get", errorRate: e.errorRate}
 	}
-	return e.backend.Get(actionID)
+	return e.backend.Get(ctx, actionID)
 }
 
 // Touch refreshes the backend timestamp, potentially returning an error.
-func (e *Error) Touch(actionID []byte) error {
+func (e *Error) Touch(ctx context.Context, actionID []byte) error {
 	if e.shouldError() {
-		return fmt.Errorf("error backend: simulated Touch error (error rate: %.2f%%)", e.errorRate*100)
+		return &simulatedError{op: "Touch", errorRate: e.errorRate}
 	}
-	return e.backend.Touch(actionID)
+	return e.backend.Touch(ctx, actionID)
 }
 
 // Close performs cleanup operations, potentially returning an error.
 func (e *Error) Close() error {
 	if e.shouldError() {
 		e.closeErrors.Add(1)
-		return fmt.Errorf("error backend: simulated Close error (error rate: %.2f%%)", e.errorRate*100)
+		return &simulatedError{op: "Close", errorRate: e.errorRate}
 	}
 	return e.backend.Close()
 }
 
 // Clear removes all entries from the cache, potentially returning an error.
-func (e *Error) Clear() error {
+func (e *Error) Clear(ctx context.Context) error {
 	if e.shouldError() {
 		e.clearErrors.Add(1)
-		return fmt.Errorf("error backend: simulated Clear error (error rate: %.2f%%)", e.errorRate*100)
+		return &simulatedError{op: "Clear", errorRate: e.errorRate}
 	}
-	return e.backend.Clear()
+	return e.backend.Clear(ctx)
 }
 
 // Unwrap returns the underlying backend.
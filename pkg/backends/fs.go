@@ -0,0 +1,436 @@
+package backends
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FS implements Backend using a (possibly shared) filesystem directory, such as
+// an NFS or EFS mount. Many hosts can point at the same root to share a cache
+// without S3.
+//
+// Each object is stored as a single file consisting of a one-line metadata
+// header (outputID, size, put time and SHA-256 of the body) followed by the body. Objects are written
+// to a uniquely named temp file in the destination directory and then renamed
+// into place, so readers on any host only ever observe complete objects.
+type FS struct {
+	root string
+}
+
+// NewFS creates a new filesystem-backed cache backend rooted at root.
+// The directory is created if it does not already exist.
+func NewFS(root string) (*FS, error) {
+	if root == "" {
+		return nil, fmt.Errorf("filesystem backend root is required")
+	}
+
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get absolute path: %w", err)
+	}
+
+	if err := os.MkdirAll(absRoot, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create filesystem backend root: %w", err)
+	}
+
+	return &FS{
+		root: absRoot,
+	}, nil
+}
+
+// Put stores an object in the filesystem backend.
+func (f *FS) Put(ctx context.Context, actionID, outputID []byte, encoding string, body io.Reader, bodySize int64) error {
+	path := f.actionIDToPath(actionID)
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	// The temp file lives in the destination directory so the final rename is
+	// atomic, and its name is unique so concurrent writers on other hosts
+	// never clobber each other's partial writes.
+	tmpFile, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	tmpPath := tmpFile.Name()
+	defer os.Remove(tmpPath) // Clean up if something goes wrong
+
+	// The checksum is only known once the body has been written, so write a
+	// placeholder header of the same length first and fill it in afterwards.
+	putTime := time.Now()
+	header := formatFSHeader(outputID, bodySize, putTime, make([]byte, sha256.Size), encoding)
+	if _, err := tmpFile.WriteString(header); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to write header: %w", err)
+	}
+
+	var (
+		n    int64
+		hash = sha256.New()
+	)
+	if body != nil {
+		n, err = io.Copy(io.MultiWriter(tmpFile, hash), body)
+		if err != nil {
+			tmpFile.Close()
+			return fmt.Errorf("failed to write body: %w", err)
+		}
+	}
+	if n != bodySize {
+		tmpFile.Close()
+		return fmt.Errorf("size mismatch: expected %d, read %d", bodySize, n)
+	}
+
+	header = formatFSHeader(outputID, bodySize, putTime, hash.Sum(nil), encoding)
+	if _, err := tmpFile.WriteAt([]byte(header), 0); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to write header: %w", err)
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("failed to close temp file: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to rename object: %w", err)
+	}
+
+	return nil
+}
+
+// Has checks whether an object exists in the filesystem backend.
+func (f *FS) Has(ctx context.Context, actionID []byte) (bool, error) {
+	_, err := os.Stat(f.actionIDToPath(actionID))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to stat object: %w", err)
+	}
+	return true, nil
+}
+
+// Get retrieves an object from the filesystem backend.
+// Returns the object body as an io.ReadCloser that must be closed by the caller.
+func (f *FS) Get(ctx context.Context, actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, string, bool, error) {
+	file, err := os.Open(f.actionIDToPath(actionID))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil, 0, nil, "", true, nil
+		}
+		return nil, nil, 0, nil, "", true, fmt.Errorf("failed to open object: %w", err)
+	}
+
+	reader := bufio.NewReader(file)
+	headerLine, err := reader.ReadString('\n')
+	if err != nil {
+		file.Close()
+		return nil, nil, 0, nil, "", true, fmt.Errorf("failed to read header: %w", err)
+	}
+
+	outputID, size, putTime, checksum, encoding, err := parseFSHeader(headerLine)
+	if err != nil {
+		file.Close()
+		return nil, nil, 0, nil, "", true, err
+	}
+
+	body := newChecksumReader(&fsObjectReader{
+		Reader: io.LimitReader(reader, size),
+		file:   file,
+	}, checksum, func() { f.quarantine(actionID, file) })
+	return outputID, body, size, &putTime, encoding, false, nil
+}
+
+// Touch bumps the object's modification time so age-based cleanup treats it
+// as recently used. The put time recorded in the header is left unchanged.
+func (f *FS) Touch(ctx context.Context, actionID []byte) error {
+	now := time.Now()
+	if err := os.Chtimes(f.actionIDToPath(actionID), now, now); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil // object gone, nothing to touch
+		}
+		return fmt.Errorf("failed to touch object: %w", err)
+	}
+	return nil
+}
+
+// Close performs cleanup operations.
+func (f *FS) Close() error {
+	return nil
+}
+
+// Clear removes all entries from the filesystem backend.
+// The root directory itself is preserved.
+func (f *FS) Clear(ctx context.Context) error {
+	entries, err := os.ReadDir(f.root)
+	if err != nil {
+		return fmt.Errorf("failed to read filesystem backend root: %w", err)
+	}
+
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(f.root, entry.Name())); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", entry.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+// Trim deletes every object (and abandoned temp file) whose mtime is before
+// cutoff. Put and Touch both set the mtime, so this removes entries that have
+// neither been written nor used since cutoff. Dictionaries, manifests and
+// files that aren't objects are kept.
+func (f *FS) Trim(ctx context.Context, cutoff time.Time) (TrimStats, error) {
+	var stats TrimStats
+
+	subdirs, err := os.ReadDir(f.root)
+	if err != nil {
+		return stats, fmt.Errorf("failed to read filesystem backend root: %w", err)
+	}
+
+	for _, subdir := range subdirs {
+		if !subdir.IsDir() {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		subdirPath := filepath.Join(f.root, subdir.Name())
+		entries, err := os.ReadDir(subdirPath)
+		if err != nil {
+			return stats, fmt.Errorf("failed to read %s: %w", subdirPath, err)
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				// Removed between ReadDir and Info.
+				continue
+			}
+			if !strings.HasPrefix(entry.Name(), ".tmp-") && !trimmable(entry.Name()) {
+				continue
+			}
+			stats.Scanned++
+			if !info.ModTime().Before(cutoff) {
+				continue
+			}
+			if err := os.Remove(filepath.Join(subdirPath, entry.Name())); err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					continue
+				}
+				return stats, fmt.Errorf("failed to remove %s: %w", entry.Name(), err)
+			}
+			stats.Deleted++
+			stats.DeletedBytes += info.Size()
+		}
+	}
+
+	return stats, nil
+}
+
+// Check examines every object (or a random sample of them) and reports any
+// whose header Get would reject, or whose body is shorter or longer than its
+// header says. Temp files, quarantined objects and anything else that isn't
+// an object are skipped.
+func (f *FS) Check(ctx context.Context, opts CheckOptions, report func(key, problem string)) (CheckStats, error) {
+	var (
+		stats CheckStats
+		paths = sampler[string]{size: opts.Sample}
+	)
+	subdirs, err := os.ReadDir(f.root)
+	if err != nil {
+		return stats, fmt.Errorf("failed to read filesystem backend root: %w", err)
+	}
+	for _, subdir := range subdirs {
+		if !subdir.IsDir() || subdir.Name() == "quarantine" {
+			continue
+		}
+		subdirPath := filepath.Join(f.root, subdir.Name())
+		entries, err := os.ReadDir(subdirPath)
+		if err != nil {
+			return stats, fmt.Errorf("failed to read %s: %w", subdirPath, err)
+		}
+		for _, entry := range entries {
+			if _, ok := objectKey(entry.Name()); ok && !entry.IsDir() {
+				paths.add(filepath.Join(subdirPath, entry.Name()))
+			}
+		}
+	}
+
+	for _, path := range paths.items {
+		problem, err := checkFSObject(path)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue // Removed since it was listed.
+			}
+			return stats, err
+		}
+		stats.Scanned++
+		if problem == "" {
+			continue
+		}
+
+		stats.Invalid++
+		key, _ := filepath.Rel(f.root, path)
+		report(key, problem)
+		if opts.Repair {
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return stats, fmt.Errorf("failed to remove %s: %w", path, err)
+			}
+			stats.Repaired++
+		}
+	}
+
+	return stats, nil
+}
+
+// checkFSObject returns why Get would reject the object at path, or "" if
+// it's valid.
+func checkFSObject(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	headerLine, err := bufio.NewReader(file).ReadString('\n')
+	if err != nil {
+		return "missing or truncated header", nil
+	}
+	_, size, _, _, _, err := parseFSHeader(headerLine)
+	if err != nil {
+		return err.Error(), nil
+	}
+	if bodySize := info.Size() - int64(len(headerLine)); bodySize != size {
+		return fmt.Sprintf("header size %d does not match body size %d", size, bodySize), nil
+	}
+	return "", nil
+}
+
+// quarantine moves a corrupt object into the "quarantine" directory under the
+// root so it stops being served, while remaining available for inspection
+// until it's trimmed. file is the open corrupt object; if the path has been
+// replaced by a new object in the meantime, nothing is moved.
+func (f *FS) quarantine(actionID []byte, file *os.File) {
+	path := f.actionIDToPath(actionID)
+	openInfo, err := file.Stat()
+	if err != nil {
+		return
+	}
+	pathInfo, err := os.Stat(path)
+	if err != nil || !os.SameFile(openInfo, pathInfo) {
+		return
+	}
+
+	dir := filepath.Join(f.root, "quarantine")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	_ = os.Rename(path, filepath.Join(dir, filepath.Base(path)))
+}
+
+// actionIDToPath converts an actionID to an object path. Objects are spread
+// across 256 subdirectories keyed by the last byte of the action ID so that no
+// single directory grows too large on filesystems like NFS.
+func (f *FS) actionIDToPath(actionID []byte) string {
+	hexID := hex.EncodeToString(actionID)
+	subdir := "00"
+	if len(hexID) >= 2 {
+		subdir = hexID[len(hexID)-2:]
+	}
+	return filepath.Join(f.root, subdir, hexID)
+}
+
+// fsObjectReader reads an object body while keeping the underlying file open
+// until the caller closes it.
+type fsObjectReader struct {
+	io.Reader
+	file *os.File
+}
+
+// Close closes the underlying file.
+func (r *fsObjectReader) Close() error {
+	return r.file.Close()
+}
+
+// formatFSHeader formats the metadata header line stored before each object body.
+// Format: outputid:hex size:num time:unix sha256:hex[ encoding:name]\n
+// The encoding field is omitted when empty.
+func formatFSHeader(outputID []byte, size int64, putTime time.Time, checksum []byte, encoding string) string {
+	header := fmt.Sprintf("outputid:%s size:%d time:%d sha256:%s",
+		hex.EncodeToString(outputID), size, putTime.Unix(), hex.EncodeToString(checksum))
+	if encoding != "" {
+		header += " encoding:" + encoding
+	}
+	return header + "\n"
+}
+
+// parseFSHeader parses a metadata header line written by formatFSHeader.
+// The checksum is empty for objects written before checksums were recorded,
+// and the encoding for objects written before encodings were.
+func parseFSHeader(line string) ([]byte, int64, time.Time, []byte, string, error) {
+	var (
+		outputIDHex string
+		sizeStr     string
+		timeStr     string
+		checksumHex string
+		encoding    string
+	)
+	for _, field := range strings.Fields(line) {
+		key, value, ok := strings.Cut(field, ":")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "outputid":
+			outputIDHex = value
+		case "size":
+			sizeStr = value
+		case "time":
+			timeStr = value
+		case "sha256":
+			checksumHex = value
+		case "encoding":
+			encoding = value
+		}
+	}
+
+	outputID, err := hex.DecodeString(outputIDHex)
+	if err != nil {
+		return nil, 0, time.Time{}, nil, "", fmt.Errorf("failed to decode outputID: %w", err)
+	}
+
+	size, err := strconv.ParseInt(sizeStr, 10, 64)
+	if err != nil {
+		return nil, 0, time.Time{}, nil, "", fmt.Errorf("failed to parse size: %w", err)
+	}
+
+	putTimeUnix, err := strconv.ParseInt(timeStr, 10, 64)
+	if err != nil {
+		return nil, 0, time.Time{}, nil, "", fmt.Errorf("failed to parse time: %w", err)
+	}
+
+	checksum, err := hex.DecodeString(checksumHex)
+	if err != nil {
+		return nil, 0, time.Time{}, nil, "", fmt.Errorf("failed to decode sha256: %w", err)
+	}
+
+	return outputID, size, time.Unix(putTimeUnix, 0), checksum, encoding, nil
+}
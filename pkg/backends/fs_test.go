@@ -0,0 +1,405 @@
+package backends
+
+import (
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFS_PutGetRoundTrip(t *testing.T) {
+	fs, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+
+	before := time.Now().Add(-time.Second)
+	err = fs.Put(t.Context(), []byte("action"), []byte("output"), "lz4", strings.NewReader("hello world"), 11)
+	if err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+
+	outputID, body, size, putTime, encoding, miss, err := fs.Get(t.Context(), []byte("action"))
+	if err != nil {
+		t.Fatalf("unexpected Get error: %v", err)
+	}
+	if miss {
+		t.Fatal("expected hit, got miss")
+	}
+	defer body.Close()
+
+	if string(outputID) != "output" {
+		t.Fatalf("expected outputID=output, got %s", outputID)
+	}
+	if size != 11 {
+		t.Fatalf("expected size=11, got %d", size)
+	}
+	if encoding != "lz4" {
+		t.Fatalf("expected encoding=lz4, got %q", encoding)
+	}
+	if putTime == nil || putTime.Before(before.Truncate(time.Second)) {
+		t.Fatalf("unexpected putTime %v", putTime)
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("failed to read body: %v", err)
+	}
+	if string(data) != "hello world" {
+		t.Fatalf("expected body='hello world', got '%s'", data)
+	}
+}
+
+func TestFS_GetMiss(t *testing.T) {
+	fs, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+
+	_, body, _, _, _, miss, err := fs.Get(t.Context(), []byte("missing"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !miss || body != nil {
+		t.Fatal("expected miss with nil body")
+	}
+
+	exists, err := fs.Has(t.Context(), []byte("missing"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if exists {
+		t.Fatal("expected exists=false")
+	}
+}
+
+func TestFS_PutSizeMismatch(t *testing.T) {
+	fs, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+
+	err = fs.Put(t.Context(), []byte("action"), []byte("output"), "", strings.NewReader("short"), 100)
+	if err == nil {
+		t.Fatal("expected size mismatch error")
+	}
+
+	exists, _ := fs.Has(t.Context(), []byte("action"))
+	if exists {
+		t.Fatal("expected partial object not to be visible")
+	}
+}
+
+func TestFS_TouchBumpsModTime(t *testing.T) {
+	fs, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+
+	if err := fs.Put(t.Context(), []byte("action"), []byte("output"), "", strings.NewReader("x"), 1); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+
+	path := fs.actionIDToPath([]byte("action"))
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatalf("failed to set times: %v", err)
+	}
+
+	if err := fs.Touch(t.Context(), []byte("action")); err != nil {
+		t.Fatalf("unexpected Touch error: %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("failed to stat: %v", err)
+	}
+	if time.Since(info.ModTime()) > time.Hour {
+		t.Fatalf("expected mtime to be bumped, got %v", info.ModTime())
+	}
+
+	if err := fs.Touch(t.Context(), []byte("missing")); err != nil {
+		t.Fatalf("expected Touch of missing object to succeed, got %v", err)
+	}
+}
+
+func TestFS_Clear(t *testing.T) {
+	root := t.TempDir()
+	fs, err := NewFS(root)
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+
+	for _, id := range []string{"a", "b", "c"} {
+		if err := fs.Put(t.Context(), []byte(id), []byte("out"), "", strings.NewReader("data"), 4); err != nil {
+			t.Fatalf("unexpected Put error: %v", err)
+		}
+	}
+
+	if err := fs.Clear(t.Context()); err != nil {
+		t.Fatalf("unexpected Clear error: %v", err)
+	}
+
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatalf("failed to read root: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected empty root, found %d entries", len(entries))
+	}
+
+	if _, err := os.Stat(filepath.Clean(root)); err != nil {
+		t.Fatalf("expected root to be preserved: %v", err)
+	}
+}
+
+func TestFS_Trim(t *testing.T) {
+	fs, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+
+	for _, id := range []string{"stale", "fresh"} {
+		if err := fs.Put(t.Context(), []byte(id), []byte("out"), "", strings.NewReader("data"), 4); err != nil {
+			t.Fatalf("unexpected Put error: %v", err)
+		}
+	}
+	old := time.Now().Add(-8 * 24 * time.Hour)
+	if err := os.Chtimes(fs.actionIDToPath([]byte("stale")), old, old); err != nil {
+		t.Fatalf("failed to set times: %v", err)
+	}
+
+	stats, err := fs.Trim(t.Context(), time.Now().Add(-7*24*time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected Trim error: %v", err)
+	}
+	if stats.Scanned != 2 || stats.Deleted != 1 || stats.DeletedBytes == 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	if exists, _ := fs.Has(t.Context(), []byte("stale")); exists {
+		t.Fatal("expected stale object to be trimmed")
+	}
+	if exists, _ := fs.Has(t.Context(), []byte("fresh")); !exists {
+		t.Fatal("expected fresh object to be kept")
+	}
+}
+
+func TestFS_TrimKeepsNonEntries(t *testing.T) {
+	fs, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+
+	keys := []string{"dict/current", "dict/00000001", "manifest/abcd", "stale"}
+	old := time.Now().Add(-8 * 24 * time.Hour)
+	for _, key := range keys {
+		if err := fs.Put(t.Context(), []byte(key), []byte("out"), "", strings.NewReader("data"), 4); err != nil {
+			t.Fatalf("unexpected Put error: %v", err)
+		}
+		if err := os.Chtimes(fs.actionIDToPath([]byte(key)), old, old); err != nil {
+			t.Fatalf("failed to set times: %v", err)
+		}
+	}
+
+	// Something else's file in the same directory.
+	foreign := filepath.Join(filepath.Dir(fs.actionIDToPath([]byte("stale"))), "notes.txt")
+	if err := os.WriteFile(foreign, []byte("keep me"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if err := os.Chtimes(foreign, old, old); err != nil {
+		t.Fatalf("failed to set times: %v", err)
+	}
+
+	stats, err := fs.Trim(t.Context(), time.Now().Add(-7*24*time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected Trim error: %v", err)
+	}
+	if stats.Deleted != 1 {
+		t.Fatalf("expected only the stale object to be trimmed, got %+v", stats)
+	}
+	for _, key := range keys[:3] {
+		if exists, _ := fs.Has(t.Context(), []byte(key)); !exists {
+			t.Fatalf("expected %s to be kept", key)
+		}
+	}
+	if _, err := os.Stat(foreign); err != nil {
+		t.Fatalf("expected a file that isn't an object to be kept: %v", err)
+	}
+}
+
+func TestTrimmable(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: hex.EncodeToString([]byte("v2abcd")), want: true},
+		{name: "quarantine/" + hex.EncodeToString([]byte("v2abcd")), want: true},
+		{name: hex.EncodeToString([]byte("dict/current")), want: false},
+		{name: hex.EncodeToString([]byte("manifest/abcd")), want: false},
+		// e.g. a server's objects, listed by trim-remote with an empty prefix.
+		{name: "gobuildcache/" + hex.EncodeToString([]byte("v2abcd")), want: false},
+		{name: "", want: false},
+	}
+	for _, tt := range tests {
+		if got := trimmable(tt.name); got != tt.want {
+			t.Errorf("trimmable(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// corruptFSObject flips the last byte of an object's body.
+func corruptFSObject(t *testing.T, fs *FS, actionID []byte) {
+	t.Helper()
+	path := fs.actionIDToPath(actionID)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read object: %v", err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("failed to write object: %v", err)
+	}
+}
+
+func TestFS_CorruptObjectIsQuarantined(t *testing.T) {
+	root := t.TempDir()
+	fs, err := NewFS(root)
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+
+	if err := fs.Put(t.Context(), []byte("action"), []byte("output"), "", strings.NewReader("hello world"), 11); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+	corruptFSObject(t, fs, []byte("action"))
+
+	_, body, _, _, _, miss, err := fs.Get(t.Context(), []byte("action"))
+	if err != nil || miss {
+		t.Fatalf("expected hit, miss=%v err=%v", miss, err)
+	}
+	_, err = io.ReadAll(body)
+	body.Close()
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+
+	// The object has been moved aside.
+	if exists, _ := fs.Has(t.Context(), []byte("action")); exists {
+		t.Fatal("expected corrupt object to be quarantined")
+	}
+	quarantined, err := os.ReadDir(filepath.Join(root, "quarantine"))
+	if err != nil || len(quarantined) != 1 {
+		t.Fatalf("expected 1 quarantined object, got %d (err=%v)", len(quarantined), err)
+	}
+}
+
+func TestFS_GetWithoutChecksum(t *testing.T) {
+	fs, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+
+	// Objects written before checksums were recorded are served unverified.
+	path := fs.actionIDToPath([]byte("action"))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+	legacy := "outputid:6f7574707574 size:5 time:1700000000\nhello"
+	if err := os.WriteFile(path, []byte(legacy), 0644); err != nil {
+		t.Fatalf("failed to write object: %v", err)
+	}
+
+	_, body, _, _, encoding, miss, err := fs.Get(t.Context(), []byte("action"))
+	if err != nil || miss {
+		t.Fatalf("expected hit, miss=%v err=%v", miss, err)
+	}
+	defer body.Close()
+	if encoding != "" {
+		t.Fatalf("expected no encoding for legacy object, got %q", encoding)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("unexpected body %q (err=%v)", data, err)
+	}
+}
+
+func TestFS_Check(t *testing.T) {
+	fs, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+
+	for _, actionID := range []string{"good", "truncated", "garbage"} {
+		if err := fs.Put(t.Context(), []byte(actionID), []byte("output"), "", strings.NewReader("hello world"), 11); err != nil {
+			t.Fatalf("unexpected Put error: %v", err)
+		}
+	}
+	truncatedPath := fs.actionIDToPath([]byte("truncated"))
+	info, err := os.Stat(truncatedPath)
+	if err != nil {
+		t.Fatalf("failed to stat object: %v", err)
+	}
+	if err := os.Truncate(truncatedPath, info.Size()-5); err != nil {
+		t.Fatalf("failed to truncate object: %v", err)
+	}
+	if err := os.WriteFile(fs.actionIDToPath([]byte("garbage")), []byte("not a header\n"), 0644); err != nil {
+		t.Fatalf("failed to write object: %v", err)
+	}
+	// Files that aren't objects belong to something else and are left alone.
+	foreign := filepath.Join(filepath.Dir(truncatedPath), "notes.txt")
+	if err := os.WriteFile(foreign, []byte("not an object\n"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	var reported []string
+	stats, err := fs.Check(t.Context(), CheckOptions{}, func(key, problem string) {
+		reported = append(reported, key)
+	})
+	if err != nil {
+		t.Fatalf("unexpected Check error: %v", err)
+	}
+	if stats.Scanned != 3 || stats.Invalid != 2 || stats.Repaired != 0 || len(reported) != 2 {
+		t.Fatalf("unexpected check stats %+v, reported %v", stats, reported)
+	}
+
+	stats, err = fs.Check(t.Context(), CheckOptions{Repair: true}, func(key, problem string) {})
+	if err != nil {
+		t.Fatalf("unexpected Check error: %v", err)
+	}
+	if stats.Invalid != 2 || stats.Repaired != 2 {
+		t.Fatalf("unexpected repair stats %+v", stats)
+	}
+	for actionID, want := range map[string]bool{"good": true, "truncated": false, "garbage": false} {
+		if exists, _ := fs.Has(t.Context(), []byte(actionID)); exists != want {
+			t.Fatalf("expected %s exists=%v after repair", actionID, want)
+		}
+	}
+	if _, err := os.Stat(foreign); err != nil {
+		t.Fatalf("expected foreign file to be kept: %v", err)
+	}
+}
+
+func TestFS_CheckSample(t *testing.T) {
+	fs, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	for i := range 20 {
+		if err := fs.Put(t.Context(), []byte{byte(i)}, []byte("output"), "", strings.NewReader("x"), 1); err != nil {
+			t.Fatalf("unexpected Put error: %v", err)
+		}
+	}
+
+	stats, err := fs.Check(t.Context(), CheckOptions{Sample: 5}, func(key, problem string) {})
+	if err != nil {
+		t.Fatalf("unexpected Check error: %v", err)
+	}
+	if stats.Scanned != 5 {
+		t.Fatalf("expected 5 objects scanned, got %d", stats.Scanned)
+	}
+}
@@ -0,0 +1,189 @@
+package backends
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// HedgeOptions configures a Hedge wrapper.
+type HedgeOptions struct {
+	// MinDelay is the shortest time a Get waits before it's hedged, however
+	// fast the backend usually is. It stops a backend whose GETs are mostly
+	// quick misses from having every slightly slow GET hedged.
+	MinDelay time.Duration
+}
+
+// Hedge wraps a Backend and hedges slow Gets to cut tail latency. If a Get
+// hasn't returned after the backend's usual (e.g. p95) GET latency, a second,
+// identical Get is issued. Whichever returns first is used and the other is
+// canceled. A leg that fails doesn't win while the other is still running.
+//
+// The latency the delay is derived from is registered with LatencyFrom; until
+// it reports one, Gets aren't hedged. Put, Has, Touch, Clear and Close are
+// passed through.
+type Hedge struct {
+	backend Backend
+	opts    HedgeOptions
+	logger  *slog.Logger
+
+	latency atomic.Pointer[func() (time.Duration, bool)]
+
+	// Stats.
+	issued atomic.Int64 // Gets that were hedged
+	won    atomic.Int64 // Hedged Gets answered by the hedge rather than the original
+}
+
+// NewHedge creates a new hedging wrapper around backend.
+func NewHedge(backend Backend, opts HedgeOptions, logger *slog.Logger) *Hedge {
+	return &Hedge{
+		backend: backend,
+		opts:    opts,
+		logger:  logger,
+	}
+}
+
+// LatencyFrom registers fn as the source of the live GET latency that Gets
+// are hedged after. fn reports false while there isn't enough data yet.
+func (h *Hedge) LatencyFrom(fn func() (time.Duration, bool)) {
+	h.latency.Store(&fn)
+}
+
+// Unwrap returns the underlying backend.
+func (h *Hedge) Unwrap() Backend {
+	return h.backend
+}
+
+// Put passes through to the underlying backend.
+func (h *Hedge) Put(ctx context.Context, actionID, outputID []byte, encoding string, body io.Reader, bodySize int64) error {
+	return h.backend.Put(ctx, actionID, outputID, encoding, body, bodySize)
+}
+
+// Has passes through to the underlying backend.
+func (h *Hedge) Has(ctx context.Context, actionID []byte) (bool, error) {
+	return h.backend.Has(ctx, actionID)
+}
+
+// hedgeGetResult holds the result of one leg of a hedged Get.
+type hedgeGetResult struct {
+	retryGetResult
+	err error
+	leg int // 0 for the original Get, 1 for the hedge
+}
+
+// Get retrieves the object, hedging the request if it's slow.
+func (h *Hedge) Get(ctx context.Context, actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, string, bool, error) {
+	delay, ok := h.delay()
+	if !ok {
+		return h.backend.Get(ctx, actionID)
+	}
+
+	var (
+		results = make(chan hedgeGetResult, 2)
+		cancels [2]context.CancelFunc
+		pending int
+	)
+	start := func(leg int) {
+		legCtx, cancel := context.WithCancel(ctx)
+		cancels[leg] = cancel
+		pending++
+		go func() {
+			outputID, body, size, putTime, encoding, miss, err := h.backend.Get(legCtx, actionID)
+			results <- hedgeGetResult{retryGetResult{outputID, body, size, putTime, encoding, miss}, err, leg}
+		}()
+	}
+
+	start(0)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var res hedgeGetResult
+	select {
+	case res = <-results:
+	case <-timer.C:
+		h.issued.Add(1)
+		h.logger.Debug("hedging slow backend GET",
+			"actionID", fmt.Sprintf("%x", actionID[:min(8, len(actionID))]),
+			"delay", delay)
+		start(1)
+		res = <-results
+		if res.err != nil {
+			// The other leg may still succeed.
+			cancels[res.leg]()
+			pending--
+			res = <-results
+		}
+	}
+	pending--
+
+	if pending > 0 {
+		// Cancel the loser and release its body, if it still returns one.
+		cancels[1-res.leg]()
+		go func() {
+			if loser := <-results; loser.body != nil {
+				loser.body.Close()
+			}
+		}()
+	}
+	if res.leg == 1 && res.err == nil {
+		h.won.Add(1)
+	}
+
+	release := cancels[res.leg]
+	if res.err != nil {
+		release()
+		return nil, nil, 0, nil, "", true, res.err
+	}
+	if res.body == nil {
+		release()
+		return res.outputID, nil, res.size, res.putTime, res.encoding, res.miss, nil
+	}
+	// The body is read with the winning leg's context, so keep it until it's closed.
+	return res.outputID, &releasingBody{ReadCloser: res.body, release: release}, res.size, res.putTime, res.encoding, res.miss, nil
+}
+
+// delay returns how long a Get waits before it's hedged, or false if it
+// shouldn't be hedged at all.
+func (h *Hedge) delay() (time.Duration, bool) {
+	fn := h.latency.Load()
+	if fn == nil {
+		return 0, false
+	}
+	latency, ok := (*fn)()
+	if !ok {
+		return 0, false
+	}
+	return max(latency, h.opts.MinDelay), true
+}
+
+// Touch passes through to the underlying backend.
+func (h *Hedge) Touch(ctx context.Context, actionID []byte) error {
+	return h.backend.Touch(ctx, actionID)
+}
+
+// Close closes the underlying backend.
+func (h *Hedge) Close() error {
+	return h.backend.Close()
+}
+
+// Clear passes through to the underlying backend.
+func (h *Hedge) Clear(ctx context.Context) error {
+	return h.backend.Clear(ctx)
+}
+
+// Stats returns hedging counters.
+func (h *Hedge) Stats() HedgeStats {
+	return HedgeStats{
+		Issued: h.issued.Load(),
+		Won:    h.won.Load(),
+	}
+}
+
+// HedgeStats holds statistics for the hedging wrapper.
+type HedgeStats struct {
+	Issued int64
+	Won    int64
+}
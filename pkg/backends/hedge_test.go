@@ -0,0 +1,73 @@
+package backends
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+// stuckFirstBackend blocks the first Get until its context is done, then
+// serves every later Get from the mockBackend.
+type stuckFirstBackend struct {
+	mockBackend
+	canceled chan struct{}
+}
+
+func (s *stuckFirstBackend) Get(ctx context.Context, actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, string, bool, error) {
+	if s.getCalled.Load() == 0 {
+		s.getCalled.Add(1)
+		<-ctx.Done()
+		close(s.canceled)
+		return nil, nil, 0, nil, "", true, ctx.Err()
+	}
+	return s.mockBackend.Get(ctx, actionID)
+}
+
+func TestHedge_HedgesSlowGets(t *testing.T) {
+	stuck := &stuckFirstBackend{
+		mockBackend: mockBackend{getOutputID: []byte("output"), getBody: []byte("hello"), getSize: 5},
+		canceled:    make(chan struct{}),
+	}
+	h := NewHedge(stuck, HedgeOptions{MinDelay: time.Millisecond}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	h.LatencyFrom(func() (time.Duration, bool) { return 10 * time.Millisecond, true })
+
+	outputID, body, _, _, _, miss, err := h.Get(t.Context(), []byte("action"))
+	if err != nil || miss {
+		t.Fatalf("expected hit from the hedge, miss=%v err=%v", miss, err)
+	}
+	data, err := io.ReadAll(body)
+	body.Close()
+	if err != nil || string(data) != "hello" || string(outputID) != "output" {
+		t.Fatalf("unexpected object: outputID=%q body=%q err=%v", outputID, data, err)
+	}
+
+	select {
+	case <-stuck.canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the original GET to be canceled")
+	}
+	if stats := h.Stats(); stats.Issued != 1 || stats.Won != 1 {
+		t.Fatalf("expected 1 hedge issued and won, got %+v", stats)
+	}
+}
+
+func TestHedge_WithoutLatencyPassesThrough(t *testing.T) {
+	stuck := &stuckFirstBackend{
+		mockBackend: mockBackend{getOutputID: []byte("output"), getBody: []byte("hello"), getSize: 5},
+		canceled:    make(chan struct{}),
+	}
+	h := NewHedge(stuck, HedgeOptions{MinDelay: time.Millisecond}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	h.LatencyFrom(func() (time.Duration, bool) { return 0, false })
+	stuck.getCalled.Store(1) // Don't block the first Get.
+
+	if _, body, _, _, _, miss, err := h.Get(t.Context(), []byte("action")); err != nil || miss {
+		t.Fatalf("expected hit, miss=%v err=%v", miss, err)
+	} else {
+		body.Close()
+	}
+	if stats := h.Stats(); stats.Issued != 0 || stuck.getCalled.Load() != 2 {
+		t.Fatalf("expected a single unhedged GET, got %+v after %d GETs", stats, stuck.getCalled.Load()-1)
+	}
+}
@@ -0,0 +1,307 @@
+package backends
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// HTTPHeaderTouch marks a HEAD request as a Touch rather than a Has. Object
+// metadata isn't sent in headers: generic caches don't store them, so it's
+// stored in the object itself (see HTTP).
+const HTTPHeaderTouch = "X-Gobuildcache-Touch"
+
+// HTTPOptions holds configuration for NewHTTP.
+type HTTPOptions struct {
+	// BearerToken, if set, is sent as an "Authorization: Bearer" header.
+	BearerToken string
+	// Username and Password, if set, are sent using HTTP basic auth.
+	// BearerToken takes precedence if both are configured.
+	Username string
+	Password string
+	// Timeout bounds each individual request, including reading the body.
+	// Zero means no timeout.
+	Timeout time.Duration
+	// Client overrides the HTTP client used for requests (useful for tests).
+	Client *http.Client
+	// SpoolDir is where Put bodies that can't be re-read are spooled; empty
+	// uses the default temp directory.
+	SpoolDir string
+}
+
+// HTTP implements Backend on top of a generic HTTP artifact cache that speaks
+// a simple GET/PUT/HEAD protocol (e.g. bazel-remote's /ac layout).
+// Objects are addressed as <baseURL>/<hex key>. Generic caches only store the
+// body, so each object starts with the same one-line metadata header as the FS
+// backend's (outputID, size, put time and encoding), followed by the body.
+// Objects without a valid header, e.g. written by something else, are misses.
+type HTTP struct {
+	client      *http.Client
+	baseURL     string
+	bearerToken string
+	username    string
+	password    string
+	spoolDir    string
+}
+
+// NewHTTP creates a new HTTP-based cache backend.
+// baseURL is the URL prefix under which objects are stored, e.g.
+// "https://cache.example.com/ac".
+func NewHTTP(baseURL string, opts HTTPOptions) (*HTTP, error) {
+	if baseURL == "" {
+		return nil, fmt.Errorf("HTTP backend URL is required")
+	}
+	if !strings.HasPrefix(baseURL, "http://") && !strings.HasPrefix(baseURL, "https://") {
+		return nil, fmt.Errorf("HTTP backend URL must start with http:// or https://: %s", baseURL)
+	}
+
+	client := opts.Client
+	if client == nil {
+		client = &http.Client{Timeout: opts.Timeout}
+	}
+
+	return &HTTP{
+		client:      client,
+		baseURL:     strings.TrimSuffix(baseURL, "/"),
+		bearerToken: opts.BearerToken,
+		username:    opts.Username,
+		password:    opts.Password,
+		spoolDir:    opts.SpoolDir,
+	}, nil
+}
+
+// Put stores an object via an HTTP PUT request. The body is read twice, once
+// to checksum it and once to upload it, so bodies that can't be re-read are
+// spooled first.
+func (h *HTTP) Put(ctx context.Context, actionID, outputID []byte, encoding string, body io.Reader, bodySize int64) error {
+	// The checksum goes in the header line, which is sent before the body, so
+	// it takes a separate pass over the body.
+	src, offset, release, err := replayableBody(body, bodySize, h.spoolDir)
+	if err != nil {
+		return err
+	}
+	defer release()
+	bodyReader := io.NewSectionReader(src, offset, bodySize)
+	checksum, err := hashSection(bodyReader)
+	if err != nil {
+		return fmt.Errorf("failed to read body: %w", err)
+	}
+
+	header := formatFSHeader(outputID, bodySize, time.Now(), checksum, encoding)
+	objectSize := int64(len(header)) + bodySize
+
+	req, err := h.newRequest(ctx, http.MethodPut, actionID, io.MultiReader(strings.NewReader(header), bodyReader))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = objectSize
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to upload to HTTP cache: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return newHTTPStatusError("failed to upload to HTTP cache", resp)
+	}
+
+	return nil
+}
+
+// Has checks whether an object exists via an HTTP HEAD request.
+func (h *HTTP) Has(ctx context.Context, actionID []byte) (bool, error) {
+	req, err := h.newRequest(ctx, http.MethodHead, actionID, nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("failed to check HTTP cache object: %w", err)
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		return true, nil
+	default:
+		return false, newHTTPStatusError("failed to check HTTP cache object", resp)
+	}
+}
+
+// Get retrieves an object via an HTTP GET request.
+// Returns the response body as an io.ReadCloser that must be closed by the caller.
+// The body is verified against the checksum in its header line as it's read,
+// and returns ErrChecksumMismatch at EOF if it doesn't match.
+func (h *HTTP) Get(ctx context.Context, actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, string, bool, error) {
+	req, err := h.newRequest(ctx, http.MethodGet, actionID, nil)
+	if err != nil {
+		return nil, nil, 0, nil, "", true, err
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, nil, 0, nil, "", true, fmt.Errorf("failed to get HTTP cache object: %w", err)
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, nil, 0, nil, "", true, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, nil, 0, nil, "", true, newHTTPStatusError("failed to get HTTP cache object", resp)
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	header, ok, err := readHTTPObjectHeader(reader)
+	if err != nil {
+		resp.Body.Close()
+		return nil, nil, 0, nil, "", true, err
+	}
+	if !ok {
+		// Not an object this backend wrote.
+		resp.Body.Close()
+		return nil, nil, 0, nil, "", true, nil
+	}
+
+	// A generic cache can't be told to quarantine an object, so a corrupt one
+	// is only reported; the go command's rebuild overwrites it.
+	body := newChecksumReader(&httpObjectReader{Reader: io.LimitReader(reader, header.size), body: resp.Body}, header.checksum, nil)
+	return header.outputID, body, header.size, &header.putTime, header.encoding, false, nil
+}
+
+// Touch issues a HEAD request for the object carrying the X-Gobuildcache-Touch
+// header. A "gobuildcache serve" server touches the object in its own backend;
+// other HTTP caches ignore the header, and those that track access times (such
+// as bazel-remote) treat the HEAD itself as a use of the entry.
+func (h *HTTP) Touch(ctx context.Context, actionID []byte) error {
+	req, err := h.newRequest(ctx, http.MethodHead, actionID, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(HTTPHeaderTouch, "1")
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to touch HTTP cache object: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+		return newHTTPStatusError("failed to touch HTTP cache object", resp)
+	}
+	return nil
+}
+
+// Close performs cleanup operations.
+func (h *HTTP) Close() error {
+	h.client.CloseIdleConnections()
+	return nil
+}
+
+// Clear is not supported: the GET/PUT/HEAD protocol has no way to enumerate
+// or bulk-delete objects.
+func (h *HTTP) Clear(ctx context.Context) error {
+	return fmt.Errorf("clear is not supported by the HTTP backend")
+}
+
+// HTTPStatusError is returned when the cache responds with an unexpected
+// status code.
+type HTTPStatusError struct {
+	Op         string
+	StatusCode int
+	Status     string
+}
+
+func newHTTPStatusError(op string, resp *http.Response) *HTTPStatusError {
+	return &HTTPStatusError{Op: op, StatusCode: resp.StatusCode, Status: resp.Status}
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("%s: unexpected status %s", e.Op, e.Status)
+}
+
+// HTTPStatusCode returns the response's status code. AWS SDK errors have the
+// same method, so retry classification treats both alike.
+func (e *HTTPStatusError) HTTPStatusCode() int {
+	return e.StatusCode
+}
+
+// newRequest builds an authenticated request for the object at actionID.
+func (h *HTTP) newRequest(ctx context.Context, method string, actionID []byte, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, h.actionIDToURL(actionID), body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+
+	if h.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+h.bearerToken)
+	} else if h.username != "" || h.password != "" {
+		req.SetBasicAuth(h.username, h.password)
+	}
+
+	return req, nil
+}
+
+// actionIDToURL converts an actionID to an object URL.
+func (h *HTTP) actionIDToURL(actionID []byte) string {
+	return h.baseURL + "/" + hex.EncodeToString(actionID)
+}
+
+// httpObjectHeader is the metadata line at the start of every HTTP object.
+type httpObjectHeader struct {
+	outputID []byte
+	size     int64
+	putTime  time.Time
+	checksum []byte
+	encoding string
+	length   int64 // Length of the line itself, including the newline
+}
+
+// readHTTPObjectHeader reads the metadata line at the start of an object. ok
+// is false if the object doesn't start with a valid one.
+func readHTTPObjectHeader(r *bufio.Reader) (httpObjectHeader, bool, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, bufio.ErrBufferFull) {
+			return httpObjectHeader{}, false, nil
+		}
+		return httpObjectHeader{}, false, fmt.Errorf("failed to read HTTP cache object header: %w", err)
+	}
+	outputID, size, putTime, checksum, encoding, err := parseFSHeader(string(line))
+	if err != nil {
+		return httpObjectHeader{}, false, nil
+	}
+	return httpObjectHeader{
+		outputID: outputID,
+		size:     size,
+		putTime:  putTime,
+		checksum: checksum,
+		encoding: encoding,
+		length:   int64(len(line)),
+	}, true, nil
+}
+
+// httpObjectReader reads an object body while keeping the response body open
+// until the caller closes it.
+type httpObjectReader struct {
+	io.Reader
+	body io.ReadCloser
+}
+
+// Close closes the response body.
+func (r *httpObjectReader) Close() error {
+	return r.body.Close()
+}
@@ -0,0 +1,173 @@
+package backends
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HTTPHandler exposes a Backend over HTTP using the same GET/PUT/HEAD protocol
+// spoken by the HTTP backend, so one gobuildcache instance can act as a shared
+// cache server for others (see "gobuildcache serve").
+//
+// Objects are addressed as /<hex key>, where the key is the hex encoding of the
+// backend key the client passed to its own HTTP backend. On the wire, objects
+// start with the HTTP backend's metadata line. The handler strips it on PUT and
+// stores the object with its real output ID and encoding, so clients reading
+// the served backend directly see the same objects they'd have written
+// themselves, and adds it back on GET.
+type HTTPHandler struct {
+	backend Backend
+	token   string
+	logger  *slog.Logger
+}
+
+// NewHTTPHandler creates a new handler serving the given backend.
+// If token is non-empty, every request must carry "Authorization: Bearer <token>".
+func NewHTTPHandler(backend Backend, token string, logger *slog.Logger) *HTTPHandler {
+	return &HTTPHandler{
+		backend: backend,
+		token:   token,
+		logger:  logger,
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	actionID, err := hex.DecodeString(strings.TrimPrefix(r.URL.Path, "/"))
+	if err != nil || len(actionID) == 0 {
+		http.Error(w, "invalid object key", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		h.handleGet(w, r, actionID)
+	case http.MethodHead:
+		if r.Header.Get(HTTPHeaderTouch) != "" {
+			h.handleTouch(w, r, actionID)
+		} else {
+			h.handleHead(w, r, actionID)
+		}
+	case http.MethodPut:
+		h.handlePut(w, r, actionID)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleGet streams an object from the backend to the client.
+func (h *HTTPHandler) handleGet(w http.ResponseWriter, r *http.Request, actionID []byte) {
+	outputID, body, size, putTime, encoding, miss, err := h.backend.Get(r.Context(), actionID)
+	if err != nil {
+		h.logger.Warn("backend GET failed", "key", hex.EncodeToString(actionID), "error", err)
+		http.Error(w, "backend error", http.StatusBadGateway)
+		return
+	}
+	if miss {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer body.Close()
+
+	// The backend verifies the body as it's streamed, so no checksum is sent.
+	var modTime time.Time
+	if putTime != nil {
+		modTime = *putTime
+	}
+	metadata := formatFSHeader(outputID, size, modTime, nil, encoding)
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(int64(len(metadata))+size, 10))
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := io.Copy(w, io.MultiReader(strings.NewReader(metadata), body)); err != nil {
+		// Headers are already sent, so all we can do is log and let the
+		// client detect the short body via Content-Length.
+		h.logger.Warn("failed to stream object to client", "key", hex.EncodeToString(actionID), "error", err)
+	}
+}
+
+// handleHead reports whether an object exists.
+func (h *HTTPHandler) handleHead(w http.ResponseWriter, r *http.Request, actionID []byte) {
+	exists, err := h.backend.Has(r.Context(), actionID)
+	if err != nil {
+		h.logger.Warn("backend HEAD failed", "key", hex.EncodeToString(actionID), "error", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleTouch touches an object in the backend, so that touch-on-GET on the
+// client resets lifecycle expiry (or trim-remote age) on the real backend. A
+// touch the backend skips is still a success.
+func (h *HTTPHandler) handleTouch(w http.ResponseWriter, r *http.Request, actionID []byte) {
+	if err := h.backend.Touch(r.Context(), actionID); err != nil && !errors.Is(err, ErrTouchSkipped) {
+		h.logger.Warn("backend touch failed", "key", hex.EncodeToString(actionID), "error", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlePut streams an object from the client into the backend, without its
+// metadata line. The body is checked against the line's checksum as it's
+// streamed, so a body corrupted on the way fails the backend's Put.
+func (h *HTTPHandler) handlePut(w http.ResponseWriter, r *http.Request, actionID []byte) {
+	reader := bufio.NewReader(r.Body)
+	metadata, ok, err := readHTTPObjectHeader(reader)
+	if err != nil {
+		http.Error(w, "failed to read object", http.StatusBadRequest)
+		return
+	}
+	if !ok {
+		http.Error(w, "invalid object metadata line", http.StatusBadRequest)
+		return
+	}
+	if r.ContentLength >= 0 && r.ContentLength != metadata.length+metadata.size {
+		http.Error(w, "object size does not match Content-Length", http.StatusBadRequest)
+		return
+	}
+
+	body := newSizedChecksumReader(reader, metadata.size, metadata.checksum)
+	err = h.backend.Put(r.Context(), actionID, metadata.outputID, metadata.encoding, body, metadata.size)
+	if errors.Is(err, ErrChecksumMismatch) {
+		http.Error(w, "object does not match its checksum", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		h.logger.Warn("backend PUT failed", "key", hex.EncodeToString(actionID), "error", err)
+		http.Error(w, "backend error", http.StatusBadGateway)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// authorized reports whether the request carries the configured bearer token.
+func (h *HTTPHandler) authorized(r *http.Request) bool {
+	if h.token == "" {
+		return true
+	}
+	got := r.Header.Get("Authorization")
+	want := "Bearer " + h.token
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
@@ -0,0 +1,175 @@
+package backends
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPHandler_ClientRoundTrip(t *testing.T) {
+	fs, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	server := httptest.NewServer(NewHTTPHandler(fs, "secret", slog.New(slog.NewTextHandler(io.Discard, nil))))
+	defer server.Close()
+
+	client, err := NewHTTP(server.URL, HTTPOptions{BearerToken: "secret"})
+	if err != nil {
+		t.Fatalf("failed to create HTTP backend: %v", err)
+	}
+
+	if err := client.Put(t.Context(), []byte("v2action"), []byte("output"), "zstd", strings.NewReader("hello world"), 11); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+
+	// The object lands in the served backend under the original key, as the
+	// client would have stored it there itself: without the metadata line.
+	storedOutputID, stored, storedSize, _, storedEncoding, miss, err := fs.Get(t.Context(), []byte("v2action"))
+	if err != nil || miss {
+		t.Fatalf("expected object in served backend, miss=%v err=%v", miss, err)
+	}
+	storedData, err := io.ReadAll(stored)
+	stored.Close()
+	if err != nil || string(storedOutputID) != "output" || storedSize != 11 || storedEncoding != "zstd" || string(storedData) != "hello world" {
+		t.Fatalf("unexpected stored object: outputID=%s size=%d encoding=%q body=%q err=%v",
+			storedOutputID, storedSize, storedEncoding, storedData, err)
+	}
+
+	exists, err := client.Has(t.Context(), []byte("v2action"))
+	if err != nil || !exists {
+		t.Fatalf("expected Has=true, exists=%v err=%v", exists, err)
+	}
+
+	outputID, body, size, putTime, encoding, miss, err := client.Get(t.Context(), []byte("v2action"))
+	if err != nil {
+		t.Fatalf("unexpected Get error: %v", err)
+	}
+	if miss {
+		t.Fatal("expected hit, got miss")
+	}
+	defer body.Close()
+
+	if string(outputID) != "output" || size != 11 || putTime == nil || encoding != "zstd" {
+		t.Fatalf("unexpected metadata: outputID=%s size=%d putTime=%v encoding=%q", outputID, size, putTime, encoding)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("failed to read body: %v", err)
+	}
+	if string(data) != "hello world" {
+		t.Fatalf("expected body='hello world', got '%s'", data)
+	}
+
+	_, body, _, _, _, miss, err = client.Get(t.Context(), []byte("v2missing"))
+	if err != nil || !miss || body != nil {
+		t.Fatalf("expected clean miss, miss=%v err=%v", miss, err)
+	}
+}
+
+func TestHTTPHandler_TouchReachesBackend(t *testing.T) {
+	fs, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	server := httptest.NewServer(NewHTTPHandler(fs, "", slog.New(slog.NewTextHandler(io.Discard, nil))))
+	defer server.Close()
+
+	client, err := NewHTTP(server.URL, HTTPOptions{})
+	if err != nil {
+		t.Fatalf("failed to create HTTP backend: %v", err)
+	}
+	if err := client.Put(t.Context(), []byte("action"), []byte("output"), "", strings.NewReader("x"), 1); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+
+	path := fs.actionIDToPath([]byte("action"))
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatalf("failed to age object: %v", err)
+	}
+	modTime := func() time.Time {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("failed to stat object: %v", err)
+		}
+		return info.ModTime()
+	}
+
+	// A plain Has mustn't count as a use of the object.
+	if _, err := client.Has(t.Context(), []byte("action")); err != nil {
+		t.Fatalf("unexpected Has error: %v", err)
+	}
+	if !modTime().Equal(old) {
+		t.Fatal("expected Has to leave the object's mtime alone")
+	}
+
+	if err := client.Touch(t.Context(), []byte("action")); err != nil {
+		t.Fatalf("unexpected Touch error: %v", err)
+	}
+	if !modTime().After(old) {
+		t.Fatal("expected Touch to bump the object's mtime in the served backend")
+	}
+
+	if err := client.Touch(t.Context(), []byte("missing")); err != nil {
+		t.Fatalf("expected Touch of a missing object to succeed, got %v", err)
+	}
+}
+
+func TestHTTPHandler_RejectsBadToken(t *testing.T) {
+	server := httptest.NewServer(NewHTTPHandler(&mockBackend{}, "secret", slog.New(slog.NewTextHandler(io.Discard, nil))))
+	defer server.Close()
+
+	client, err := NewHTTP(server.URL, HTTPOptions{BearerToken: "wrong"})
+	if err != nil {
+		t.Fatalf("failed to create HTTP backend: %v", err)
+	}
+
+	if err := client.Put(t.Context(), []byte("action"), []byte("output"), "", strings.NewReader("x"), 1); err == nil {
+		t.Fatal("expected Put with bad token to fail")
+	}
+}
+
+func TestHTTPHandler_RejectsInvalidRequests(t *testing.T) {
+	fs, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	server := httptest.NewServer(NewHTTPHandler(fs, "", slog.New(slog.NewTextHandler(io.Discard, nil))))
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{name: "non-hex key", method: http.MethodGet, path: "/not-hex", want: http.StatusBadRequest},
+		{name: "unsupported method", method: http.MethodDelete, path: "/abcd", want: http.StatusMethodNotAllowed},
+		{name: "missing metadata line", method: http.MethodPut, path: "/abcd", body: "just a body", want: http.StatusBadRequest},
+		{name: "corrupt body", method: http.MethodPut, path: "/abcd", body: "outputid:ab size:2 time:0 sha256:" + strings.Repeat("00", 32) + "\nhi", want: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, server.URL+tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Fatalf("expected status %d, got %d", tt.want, resp.StatusCode)
+			}
+		})
+	}
+}
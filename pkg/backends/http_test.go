@@ -0,0 +1,265 @@
+package backends
+
+import (
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeHTTPCache is a minimal in-memory stand-in for a generic HTTP artifact
+// cache. Like bazel-remote, it stores bodies only, not request headers.
+type fakeHTTPCache struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	auth    string
+	heads   int
+	touches int
+}
+
+func newFakeHTTPCache(auth string) *fakeHTTPCache {
+	return &fakeHTTPCache{
+		objects: make(map[string][]byte),
+		auth:    auth,
+	}
+}
+
+func (f *fakeHTTPCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if f.auth != "" && r.Header.Get("Authorization") != f.auth {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodPut:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.objects[r.URL.Path] = body
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodHead, http.MethodGet:
+		if r.Method == http.MethodHead {
+			f.heads++
+			if r.Header.Get(HTTPHeaderTouch) != "" {
+				f.touches++
+			}
+		}
+		body, ok := f.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(body)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestHTTP_PutGetRoundTrip(t *testing.T) {
+	cache := newFakeHTTPCache("Bearer secret")
+	server := httptest.NewServer(cache)
+	defer server.Close()
+
+	h, err := NewHTTP(server.URL+"/ac/", HTTPOptions{BearerToken: "secret", Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("failed to create HTTP backend: %v", err)
+	}
+	defer h.Close()
+
+	if err := h.Put(t.Context(), []byte("action"), []byte("output"), "zstd", strings.NewReader("hello world"), 11); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+
+	exists, err := h.Has(t.Context(), []byte("action"))
+	if err != nil {
+		t.Fatalf("unexpected Has error: %v", err)
+	}
+	if !exists {
+		t.Fatal("expected exists=true")
+	}
+
+	outputID, body, size, putTime, encoding, miss, err := h.Get(t.Context(), []byte("action"))
+	if err != nil {
+		t.Fatalf("unexpected Get error: %v", err)
+	}
+	if miss {
+		t.Fatal("expected hit, got miss")
+	}
+	defer body.Close()
+
+	if string(outputID) != "output" {
+		t.Fatalf("expected outputID=output, got %s", outputID)
+	}
+	if size != 11 {
+		t.Fatalf("expected size=11, got %d", size)
+	}
+	if putTime == nil || time.Since(*putTime) > time.Minute {
+		t.Fatalf("unexpected putTime %v", putTime)
+	}
+	if encoding != "zstd" {
+		t.Fatalf("expected encoding=zstd, got %q", encoding)
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("failed to read body: %v", err)
+	}
+	if string(data) != "hello world" {
+		t.Fatalf("expected body='hello world', got '%s'", data)
+	}
+}
+
+func TestHTTP_GetMiss(t *testing.T) {
+	server := httptest.NewServer(newFakeHTTPCache(""))
+	defer server.Close()
+
+	h, err := NewHTTP(server.URL, HTTPOptions{})
+	if err != nil {
+		t.Fatalf("failed to create HTTP backend: %v", err)
+	}
+
+	_, body, _, _, _, miss, err := h.Get(t.Context(), []byte("missing"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !miss || body != nil {
+		t.Fatal("expected miss with nil body")
+	}
+
+	exists, err := h.Has(t.Context(), []byte("missing"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if exists {
+		t.Fatal("expected exists=false")
+	}
+}
+
+func TestHTTP_ForeignObjectIsMiss(t *testing.T) {
+	cache := newFakeHTTPCache("")
+	server := httptest.NewServer(cache)
+	defer server.Close()
+
+	h, err := NewHTTP(server.URL, HTTPOptions{})
+	if err != nil {
+		t.Fatalf("failed to create HTTP backend: %v", err)
+	}
+	// Written by something other than the HTTP backend, so there's no metadata.
+	cache.objects["/"+hex.EncodeToString([]byte("action"))] = []byte("just a body")
+
+	_, body, _, _, _, miss, err := h.Get(t.Context(), []byte("action"))
+	if err != nil || !miss || body != nil {
+		t.Fatalf("expected miss without error, miss=%v err=%v", miss, err)
+	}
+}
+
+func TestHTTP_BasicAuth(t *testing.T) {
+	// "user:pass" base64-encoded
+	server := httptest.NewServer(newFakeHTTPCache("Basic dXNlcjpwYXNz"))
+	defer server.Close()
+
+	h, err := NewHTTP(server.URL, HTTPOptions{Username: "user", Password: "pass"})
+	if err != nil {
+		t.Fatalf("failed to create HTTP backend: %v", err)
+	}
+	if err := h.Put(t.Context(), []byte("action"), []byte("output"), "", strings.NewReader("x"), 1); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+
+	unauthenticated, err := NewHTTP(server.URL, HTTPOptions{})
+	if err != nil {
+		t.Fatalf("failed to create HTTP backend: %v", err)
+	}
+	if _, _, _, _, _, _, err := unauthenticated.Get(t.Context(), []byte("action")); err == nil {
+		t.Fatal("expected error for unauthenticated request")
+	}
+}
+
+func TestHTTP_CorruptBodyFailsChecksum(t *testing.T) {
+	cache := newFakeHTTPCache("")
+	server := httptest.NewServer(cache)
+	defer server.Close()
+
+	h, err := NewHTTP(server.URL, HTTPOptions{})
+	if err != nil {
+		t.Fatalf("failed to create HTTP backend: %v", err)
+	}
+	if err := h.Put(t.Context(), []byte("action"), []byte("output"), "", strings.NewReader("hello world"), 11); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+
+	cache.mu.Lock()
+	object := cache.objects["/"+hex.EncodeToString([]byte("action"))]
+	object[len(object)-1] ^= 0xff
+	cache.mu.Unlock()
+
+	_, body, _, _, _, miss, err := h.Get(t.Context(), []byte("action"))
+	if err != nil || miss {
+		t.Fatalf("expected hit, miss=%v err=%v", miss, err)
+	}
+	defer body.Close()
+	if _, err := io.ReadAll(body); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch, got %v", err)
+	}
+}
+
+func TestHTTP_TouchIssuesHead(t *testing.T) {
+	cache := newFakeHTTPCache("")
+	server := httptest.NewServer(cache)
+	defer server.Close()
+
+	h, err := NewHTTP(server.URL, HTTPOptions{})
+	if err != nil {
+		t.Fatalf("failed to create HTTP backend: %v", err)
+	}
+
+	if err := h.Touch(t.Context(), []byte("action")); err != nil {
+		t.Fatalf("unexpected Touch error: %v", err)
+	}
+
+	cache.mu.Lock()
+	heads, touches := cache.heads, cache.touches
+	cache.mu.Unlock()
+	if heads != 1 || touches != 1 {
+		t.Fatalf("expected 1 HEAD request marked as a touch, got %d HEADs and %d touches", heads, touches)
+	}
+}
+
+func TestHTTP_Timeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	h, err := NewHTTP(server.URL, HTTPOptions{Timeout: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("failed to create HTTP backend: %v", err)
+	}
+
+	if _, _, _, _, _, _, err := h.Get(t.Context(), []byte("action")); err == nil {
+		t.Fatal("expected timeout error")
+	}
+}
+
+func TestNewHTTP_RejectsInvalidURL(t *testing.T) {
+	if _, err := NewHTTP("", HTTPOptions{}); err == nil {
+		t.Fatal("expected error for empty URL")
+	}
+	if _, err := NewHTTP("cache.example.com", HTTPOptions{}); err == nil {
+		t.Fatal("expected error for URL without scheme")
+	}
+}
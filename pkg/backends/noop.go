@@ -1,6 +1,7 @@
 package backends
 
 import (
+	"context"
 	"io"
 	"time"
 )
@@ -17,23 +18,23 @@ func NewNoop() *Noop {
 
 // Put does nothing and always succeeds.
 // The local cache in server.go handles the actual storage.
-func (n *Noop) Put(actionID, outputID []byte, body io.Reader, bodySize int64) error {
+func (n *Noop) Put(ctx context.Context, actionID, outputID []byte, encoding string, body io.Reader, bodySize int64) error {
 	return nil
 }
 
 // Has always returns false (no remote backend).
-func (n *Noop) Has(actionID []byte) (bool, error) {
+func (n *Noop) Has(ctx context.Context, actionID []byte) (bool, error) {
 	return false, nil
 }
 
 // Get always returns a miss.
 // The local cache in server.go handles retrieving cached entries.
-func (n *Noop) Get(actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, bool, error) {
-	return nil, nil, 0, nil, true, nil
+func (n *Noop) Get(ctx context.Context, actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, string, bool, error) {
+	return nil, nil, 0, nil, "", true, nil
 }
 
 // Touch does nothing.
-func (n *Noop) Touch(actionID []byte) error {
+func (n *Noop) Touch(ctx context.Context, actionID []byte) error {
 	return nil
 }
 
@@ -44,6 +45,16 @@ func (n *Noop) Close() error {
 
 // Clear does nothing.
 // The local cache in server.go manages its own clearing if needed.
-func (n *Noop) Clear() error {
+func (n *Noop) Clear(ctx context.Context) error {
 	return nil
 }
+
+// Trim does nothing; there is no remote storage to trim.
+func (n *Noop) Trim(ctx context.Context, cutoff time.Time) (TrimStats, error) {
+	return TrimStats{}, nil
+}
+
+// Check does nothing; there is no remote storage to check.
+func (n *Noop) Check(ctx context.Context, opts CheckOptions, report func(key, problem string)) (CheckStats, error) {
+	return CheckStats{}, nil
+}
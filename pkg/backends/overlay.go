@@ -0,0 +1,172 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// OverlayLayer is a single named backend of an Overlay.
+type OverlayLayer struct {
+	Name    string
+	Backend Backend
+}
+
+// Overlay reads from an ordered list of backends but only ever writes to one
+// of them. It lets untrusted builds (e.g. PRs from forks) keep a cache of their
+// own in a sandbox, such as a separate S3 prefix, while still reading from the
+// trusted cache that only main-branch builds write to.
+//
+// Get tries each layer in order and returns the first hit. Put, Touch, Clear,
+// Trim and Check only act on the write layer, so an Overlay never modifies the
+// other layers, which may be read-only to it.
+type Overlay struct {
+	layers []OverlayLayer
+	write  int
+	logger *slog.Logger
+
+	// Stats
+	hits []atomic.Int64 // Hits per layer
+}
+
+// NewOverlay creates a new overlay backend. layers are read in order, and
+// layers[write] is the only one written to.
+func NewOverlay(layers []OverlayLayer, write int, logger *slog.Logger) (*Overlay, error) {
+	if write < 0 || write >= len(layers) {
+		return nil, fmt.Errorf("overlay write layer %d out of range for %d layers", write, len(layers))
+	}
+	return &Overlay{
+		layers: layers,
+		write:  write,
+		logger: logger,
+		hits:   make([]atomic.Int64, len(layers)),
+	}, nil
+}
+
+// Put writes the object to the write layer only.
+func (o *Overlay) Put(ctx context.Context, actionID, outputID []byte, encoding string, body io.Reader, bodySize int64) error {
+	return o.layers[o.write].Backend.Put(ctx, actionID, outputID, encoding, body, bodySize)
+}
+
+// Has reports whether any layer has the object.
+func (o *Overlay) Has(ctx context.Context, actionID []byte) (bool, error) {
+	var errs []error
+	for i := range o.layers {
+		exists, err := o.layers[i].Backend.Has(ctx, actionID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("layer %s: %w", o.layers[i].Name, err))
+			continue
+		}
+		if exists {
+			return true, nil
+		}
+	}
+	return false, errors.Join(errs...)
+}
+
+// Get tries each layer in order and returns the first hit. An error from one
+// layer is logged and the next layer is tried; the errors are only returned if
+// no layer produced a hit or a clean miss.
+func (o *Overlay) Get(ctx context.Context, actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, string, bool, error) {
+	var (
+		errs    []error
+		anyMiss bool
+	)
+	for i := range o.layers {
+		layer := &o.layers[i]
+		outputID, body, size, putTime, encoding, miss, err := layer.Backend.Get(ctx, actionID)
+		if err != nil {
+			o.logger.Warn("overlay backend GET failed, trying next layer",
+				"layer", layer.Name,
+				"actionID", fmt.Sprintf("%x", actionID[:min(8, len(actionID))]),
+				"error", err)
+			errs = append(errs, fmt.Errorf("layer %s: %w", layer.Name, err))
+			continue
+		}
+		if miss {
+			anyMiss = true
+			continue
+		}
+
+		o.hits[i].Add(1)
+		return outputID, body, size, putTime, encoding, false, nil
+	}
+
+	if anyMiss || len(errs) == 0 {
+		return nil, nil, 0, nil, "", true, nil
+	}
+	return nil, nil, 0, nil, "", true, errors.Join(errs...)
+}
+
+// Touch touches the object in the write layer. Objects that are only in other
+// layers are kept alive by their own writers, so touching them is skipped.
+func (o *Overlay) Touch(ctx context.Context, actionID []byte) error {
+	write := o.layers[o.write].Backend
+	exists, err := write.Has(ctx, actionID)
+	if err != nil {
+		return fmt.Errorf("layer %s: %w", o.layers[o.write].Name, err)
+	}
+	if !exists {
+		return ErrTouchSkipped
+	}
+	return write.Touch(ctx, actionID)
+}
+
+// Close closes every layer.
+func (o *Overlay) Close() error {
+	var errs []error
+	for i := range o.layers {
+		if err := o.layers[i].Backend.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("layer %s: %w", o.layers[i].Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Clear clears the write layer only.
+func (o *Overlay) Clear(ctx context.Context) error {
+	return o.layers[o.write].Backend.Clear(ctx)
+}
+
+// Trim trims the write layer only.
+func (o *Overlay) Trim(ctx context.Context, cutoff time.Time) (TrimStats, error) {
+	trimmer, ok := o.layers[o.write].Backend.(Trimmer)
+	if !ok {
+		return TrimStats{}, fmt.Errorf("layer %s: trim not supported", o.layers[o.write].Name)
+	}
+	return trimmer.Trim(ctx, cutoff)
+}
+
+// Check checks the write layer only.
+func (o *Overlay) Check(ctx context.Context, opts CheckOptions, report func(key, problem string)) (CheckStats, error) {
+	checker, ok := o.layers[o.write].Backend.(Checker)
+	if !ok {
+		return CheckStats{}, fmt.Errorf("layer %s: check not supported", o.layers[o.write].Name)
+	}
+	return checker.Check(ctx, opts, report)
+}
+
+// Stats returns hit counters for the overlay backend.
+func (o *Overlay) Stats() OverlayStats {
+	stats := OverlayStats{
+		LayerNames: make([]string, len(o.layers)),
+		LayerHits:  make([]int64, len(o.layers)),
+		WriteLayer: o.layers[o.write].Name,
+	}
+	for i := range o.layers {
+		stats.LayerNames[i] = o.layers[i].Name
+		stats.LayerHits[i] = o.hits[i].Load()
+	}
+	return stats
+}
+
+// OverlayStats holds statistics for the overlay backend.
+type OverlayStats struct {
+	LayerNames []string
+	LayerHits  []int64
+	WriteLayer string
+}
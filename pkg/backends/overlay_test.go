@@ -0,0 +1,133 @@
+package backends
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOverlay_WritesOnlyToWriteLayer(t *testing.T) {
+	main, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	sandbox, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	overlay, err := NewOverlay([]OverlayLayer{
+		{Name: "main", Backend: main},
+		{Name: "sandbox", Backend: sandbox},
+	}, 1, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("failed to create overlay backend: %v", err)
+	}
+
+	if err := overlay.Put(t.Context(), []byte("action"), []byte("output"), "", strings.NewReader("data"), 4); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+	if exists, _ := main.Has(t.Context(), []byte("action")); exists {
+		t.Fatal("expected main layer to be left alone")
+	}
+	if exists, _ := sandbox.Has(t.Context(), []byte("action")); !exists {
+		t.Fatal("expected sandbox layer to have object")
+	}
+
+	if err := overlay.Clear(t.Context()); err != nil {
+		t.Fatalf("unexpected Clear error: %v", err)
+	}
+	if err := main.Put(t.Context(), []byte("trusted"), []byte("output"), "", strings.NewReader("data"), 4); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+	if _, err := overlay.Trim(t.Context(), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("unexpected Trim error: %v", err)
+	}
+	if exists, _ := main.Has(t.Context(), []byte("trusted")); !exists {
+		t.Fatal("expected Trim to leave the main layer alone")
+	}
+}
+
+func TestOverlay_GetReadsLayersInOrder(t *testing.T) {
+	main, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	sandbox, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	overlay, err := NewOverlay([]OverlayLayer{
+		{Name: "main", Backend: main},
+		{Name: "sandbox", Backend: sandbox},
+	}, 1, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("failed to create overlay backend: %v", err)
+	}
+
+	// The main layer wins over the sandbox for the same key.
+	if err := main.Put(t.Context(), []byte("both"), []byte("trusted"), "", strings.NewReader("main"), 4); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+	if err := sandbox.Put(t.Context(), []byte("both"), []byte("sandboxed"), "", strings.NewReader("fork"), 4); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+	if err := sandbox.Put(t.Context(), []byte("fork"), []byte("sandboxed"), "", strings.NewReader("fork"), 4); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+
+	for key, want := range map[string]string{"both": "trusted", "fork": "sandboxed"} {
+		outputID, body, _, _, _, miss, err := overlay.Get(t.Context(), []byte(key))
+		if err != nil || miss {
+			t.Fatalf("%s: expected hit, miss=%v err=%v", key, miss, err)
+		}
+		body.Close()
+		if string(outputID) != want {
+			t.Fatalf("%s: expected output ID %q, got %q", key, want, outputID)
+		}
+	}
+
+	_, _, _, _, _, miss, err := overlay.Get(t.Context(), []byte("missing"))
+	if err != nil || !miss {
+		t.Fatalf("expected clean miss, miss=%v err=%v", miss, err)
+	}
+
+	stats := overlay.Stats()
+	if stats.LayerHits[0] != 1 || stats.LayerHits[1] != 1 || stats.WriteLayer != "sandbox" {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestOverlay_TouchSkipsReadOnlyLayers(t *testing.T) {
+	main, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	sandbox, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	overlay, err := NewOverlay([]OverlayLayer{
+		{Name: "main", Backend: main},
+		{Name: "sandbox", Backend: sandbox},
+	}, 1, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("failed to create overlay backend: %v", err)
+	}
+
+	if err := main.Put(t.Context(), []byte("trusted"), []byte("output"), "", strings.NewReader("data"), 4); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+	if err := overlay.Touch(t.Context(), []byte("trusted")); !errors.Is(err, ErrTouchSkipped) {
+		t.Fatalf("expected ErrTouchSkipped for an object only in the main layer, got %v", err)
+	}
+
+	if err := sandbox.Put(t.Context(), []byte("fork"), []byte("output"), "", strings.NewReader("data"), 4); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+	if err := overlay.Touch(t.Context(), []byte("fork")); err != nil {
+		t.Fatalf("unexpected Touch error: %v", err)
+	}
+}
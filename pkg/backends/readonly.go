@@ -1,6 +1,7 @@
 package backends
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"sync/atomic"
@@ -32,17 +33,17 @@ func (ro *ReadOnly) Unwrap() Backend {
 }
 
 // Get delegates to the inner backend (reads are allowed).
-func (ro *ReadOnly) Get(actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, bool, error) {
-	return ro.backend.Get(actionID)
+func (ro *ReadOnly) Get(ctx context.Context, actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, string, bool, error) {
+	return ro.backend.Get(ctx, actionID)
 }
 
 // Has delegates to the inner backend (reads are allowed).
-func (ro *ReadOnly) Has(actionID []byte) (bool, error) {
-	return ro.backend.Has(actionID)
+func (ro *ReadOnly) Has(ctx context.Context, actionID []byte) (bool, error) {
+	return ro.backend.Has(ctx, actionID)
 }
 
 // Put is a no-op in read-only mode. It drains the body reader for safety and returns nil.
-func (ro *ReadOnly) Put(actionID, outputID []byte, body io.Reader, bodySize int64) error {
+func (ro *ReadOnly) Put(ctx context.Context, actionID, outputID []byte, encoding string, body io.Reader, bodySize int64) error {
 	ro.putsSkipped.Add(1)
 	// Drain the body so callers that expect it to be consumed don't hang.
 	if body != nil {
@@ -52,7 +53,7 @@ func (ro *ReadOnly) Put(actionID, outputID []byte, body io.Reader, bodySize int6
 }
 
 // Touch is a no-op in read-only mode.
-func (ro *ReadOnly) Touch(actionID []byte) error {
+func (ro *ReadOnly) Touch(ctx context.Context, actionID []byte) error {
 	ro.touchesSkipped.Add(1)
 	return nil
 }
@@ -60,7 +61,7 @@ func (ro *ReadOnly) Touch(actionID []byte) error {
 // Clear returns an error because it is a destructive operation that should not be
 // silently ignored. Unlike Put (called implicitly by the Go compiler), Clear is
 // only invoked by explicit user commands.
-func (ro *ReadOnly) Clear() error {
+func (ro *ReadOnly) Clear(ctx context.Context) error {
 	ro.clearsBlocked.Add(1)
 	return fmt.Errorf("clear blocked: backend is in read-only mode")
 }
@@ -2,6 +2,7 @@ package backends
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"strings"
 	"sync/atomic"
@@ -26,30 +27,30 @@ type mockBackend struct {
 	getMiss     bool
 }
 
-func (m *mockBackend) Put(actionID, outputID []byte, body io.Reader, bodySize int64) error {
+func (m *mockBackend) Put(ctx context.Context, actionID, outputID []byte, encoding string, body io.Reader, bodySize int64) error {
 	m.putCalled.Add(1)
 	return nil
 }
 
-func (m *mockBackend) Has(actionID []byte) (bool, error) {
+func (m *mockBackend) Has(ctx context.Context, actionID []byte) (bool, error) {
 	m.hasCalled.Add(1)
 	return true, nil
 }
 
-func (m *mockBackend) Get(actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, bool, error) {
+func (m *mockBackend) Get(ctx context.Context, actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, string, bool, error) {
 	m.getCalled.Add(1)
 	if m.getMiss {
-		return nil, nil, 0, nil, true, nil
+		return nil, nil, 0, nil, "", true, nil
 	}
-	return m.getOutputID, io.NopCloser(bytes.NewReader(m.getBody)), m.getSize, m.getPutTime, false, nil
+	return m.getOutputID, io.NopCloser(bytes.NewReader(m.getBody)), m.getSize, m.getPutTime, "", false, nil
 }
 
-func (m *mockBackend) Touch(actionID []byte) error {
+func (m *mockBackend) Touch(ctx context.Context, actionID []byte) error {
 	m.touchCalled.Add(1)
 	return nil
 }
 
-func (m *mockBackend) Clear() error {
+func (m *mockBackend) Clear(ctx context.Context) error {
 	m.clearCalled.Add(1)
 	return nil
 }
@@ -64,7 +65,7 @@ func TestReadOnly_PutIsNoOp(t *testing.T) {
 	ro := NewReadOnly(inner)
 
 	body := strings.NewReader("hello world")
-	err := ro.Put([]byte("action"), []byte("output"), body, 11)
+	err := ro.Put(t.Context(), []byte("action"), []byte("output"), "", body, 11)
 	if err != nil {
 		t.Fatalf("expected nil error, got %v", err)
 	}
@@ -95,7 +96,7 @@ func TestReadOnly_PutDrainsBody(t *testing.T) {
 		pw.Close()
 	}()
 
-	err := ro.Put([]byte("action"), []byte("output"), pr, 9)
+	err := ro.Put(t.Context(), []byte("action"), []byte("output"), "", pr, 9)
 	if err != nil {
 		t.Fatalf("expected nil error, got %v", err)
 	}
@@ -107,7 +108,7 @@ func TestReadOnly_PutNilBody(t *testing.T) {
 	inner := &mockBackend{}
 	ro := NewReadOnly(inner)
 
-	err := ro.Put([]byte("action"), []byte("output"), nil, 0)
+	err := ro.Put(t.Context(), []byte("action"), []byte("output"), "", nil, 0)
 	if err != nil {
 		t.Fatalf("expected nil error, got %v", err)
 	}
@@ -117,7 +118,7 @@ func TestReadOnly_TouchIsNoOp(t *testing.T) {
 	inner := &mockBackend{}
 	ro := NewReadOnly(inner)
 
-	err := ro.Touch([]byte("action"))
+	err := ro.Touch(t.Context(), []byte("action"))
 	if err != nil {
 		t.Fatalf("expected nil error, got %v", err)
 	}
@@ -143,7 +144,7 @@ func TestReadOnly_GetPassesThrough(t *testing.T) {
 	}
 	ro := NewReadOnly(inner)
 
-	outputID, body, size, putTime, miss, err := ro.Get([]byte("action"))
+	outputID, body, size, putTime, _, miss, err := ro.Get(t.Context(), []byte("action"))
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -175,7 +176,7 @@ func TestReadOnly_HasPassesThrough(t *testing.T) {
 	inner := &mockBackend{}
 	ro := NewReadOnly(inner)
 
-	exists, err := ro.Has([]byte("action"))
+	exists, err := ro.Has(t.Context(), []byte("action"))
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -191,7 +192,7 @@ func TestReadOnly_ClearReturnsError(t *testing.T) {
 	inner := &mockBackend{}
 	ro := NewReadOnly(inner)
 
-	err := ro.Clear()
+	err := ro.Clear(t.Context())
 	if err == nil {
 		t.Fatal("expected error from Clear in read-only mode")
 	}
@@ -237,13 +238,13 @@ func TestReadOnly_StatsAccumulate(t *testing.T) {
 	ro := NewReadOnly(inner)
 
 	for i := 0; i < 5; i++ {
-		_ = ro.Put([]byte("a"), []byte("b"), nil, 0)
+		_ = ro.Put(t.Context(), []byte("a"), []byte("b"), "", nil, 0)
 	}
 	for i := 0; i < 3; i++ {
-		_ = ro.Touch([]byte("a"))
+		_ = ro.Touch(t.Context(), []byte("a"))
 	}
 	for i := 0; i < 2; i++ {
-		_ = ro.Clear()
+		_ = ro.Clear(t.Context())
 	}
 
 	stats := ro.Stats()
@@ -0,0 +1,355 @@
+package backends
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// errAttemptTimeout is returned for an attempt that took longer than the
+// per-attempt timeout.
+var errAttemptTimeout = fmt.Errorf("backend operation timed out: %w", context.DeadlineExceeded)
+
+// RetryOptions configures a Retry wrapper.
+type RetryOptions struct {
+	// MaxAttempts is the number of times an operation is tried, including the
+	// first. 1 disables retries.
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry. It doubles for every
+	// further retry, up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Jitter is the fraction (0.0 to 1.0) of each delay that's randomized, so
+	// that many clients failing together don't retry in lockstep.
+	Jitter float64
+	// Timeout bounds each attempt of an operation; 0 disables it. A Get only
+	// has to return the start of its body within the timeout.
+	Timeout time.Duration
+	// SpoolDir is where Put bodies that can't be replayed are spooled once
+	// they're too large to hold in memory; empty uses the default temp
+	// directory.
+	SpoolDir string
+}
+
+// Retry wraps a Backend and retries operations that fail with a transient
+// error (see IsRetryable), with exponential backoff and jitter. Permanent
+// errors are returned straight away.
+//
+// An attempt that exceeds the per-attempt timeout is abandoned: its context is
+// canceled and its result is discarded. Operations aren't retried once the
+// caller's context is done. Put bodies are
+// replayed for each attempt, from the body itself if it's an io.ReaderAt and
+// io.Seeker (such as a file) or from a spooled copy otherwise. Clear and Close
+// are never retried.
+type Retry struct {
+	backend Backend
+	opts    RetryOptions
+	logger  *slog.Logger
+
+	onRetried atomic.Pointer[func(retries int)]
+
+	// Stats. Retry counts are reported through OnRetried.
+	exhausted atomic.Int64 // Operations that still failed after MaxAttempts
+	timeouts  atomic.Int64 // Attempts abandoned after Timeout
+}
+
+// NewRetry creates a new retrying wrapper around backend.
+func NewRetry(backend Backend, opts RetryOptions, logger *slog.Logger) *Retry {
+	opts.MaxAttempts = max(opts.MaxAttempts, 1)
+	opts.Jitter = min(max(opts.Jitter, 0), 1)
+	return &Retry{
+		backend: backend,
+		opts:    opts,
+		logger:  logger,
+	}
+}
+
+// OnRetried registers fn to be called once for every operation that needed
+// retries, with the number of retries, whether it eventually succeeded or not.
+func (r *Retry) OnRetried(fn func(retries int)) {
+	r.onRetried.Store(&fn)
+}
+
+// Unwrap returns the underlying backend.
+func (r *Retry) Unwrap() Backend {
+	return r.backend
+}
+
+// IsRetryable reports whether err is transient and the operation that
+// returned it is worth retrying: timeouts, connection resets, throttling and
+// server-side (5xx) errors. Everything else, including client errors such as
+// access denied, is permanent.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	// AWS SDK API errors carry an error code...
+	var apiErr interface{ ErrorCode() string }
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "SlowDown", "Throttling", "ThrottlingException", "RequestLimitExceeded",
+			"TooManyRequestsException", "RequestTimeout", "RequestTimeoutException",
+			"InternalError", "ServiceUnavailable":
+			return true
+		}
+	}
+	// ...and both they and HTTP backend errors carry a status code.
+	var statusErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &statusErr) {
+		code := statusErr.HTTPStatusCode()
+		return code == 429 || code >= 500
+	}
+
+	var temporary interface{ Temporary() bool }
+	if errors.As(err, &temporary) {
+		return temporary.Temporary()
+	}
+	return false
+}
+
+// Put stores the object, replaying the body for each attempt.
+func (r *Retry) Put(ctx context.Context, actionID, outputID []byte, encoding string, body io.Reader, bodySize int64) error {
+	if r.opts.MaxAttempts == 1 && r.opts.Timeout <= 0 {
+		return r.backend.Put(ctx, actionID, outputID, encoding, body, bodySize)
+	}
+
+	src, offset, release, err := replayableBody(body, bodySize, r.opts.SpoolDir)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	_, releaseAttempt, err := retry(ctx, r, "Put", func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, r.backend.Put(ctx, actionID, outputID, encoding, io.NewSectionReader(src, offset, bodySize), bodySize)
+	}, nil)
+	releaseAttempt()
+	return err
+}
+
+// Has checks whether the object exists.
+func (r *Retry) Has(ctx context.Context, actionID []byte) (bool, error) {
+	exists, release, err := retry(ctx, r, "Has", func(ctx context.Context) (bool, error) {
+		return r.backend.Has(ctx, actionID)
+	}, nil)
+	release()
+	return exists, err
+}
+
+// retryGetResult holds the results of a single Get attempt.
+type retryGetResult struct {
+	outputID []byte
+	body     io.ReadCloser
+	size     int64
+	putTime  *time.Time
+	encoding string
+	miss     bool
+}
+
+// Get retrieves the object. Only errors are retried, not misses.
+func (r *Retry) Get(ctx context.Context, actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, string, bool, error) {
+	res, release, err := retry(ctx, r, "Get", func(ctx context.Context) (retryGetResult, error) {
+		outputID, body, size, putTime, encoding, miss, err := r.backend.Get(ctx, actionID)
+		return retryGetResult{outputID, body, size, putTime, encoding, miss}, err
+	}, func(res retryGetResult) {
+		if res.body != nil {
+			res.body.Close()
+		}
+	})
+	if err != nil {
+		release()
+		return nil, nil, 0, nil, "", true, err
+	}
+	if res.body == nil {
+		release()
+		return res.outputID, nil, res.size, res.putTime, res.encoding, res.miss, nil
+	}
+	// The body is read with the attempt's context, so keep it until it's closed.
+	return res.outputID, &releasingBody{ReadCloser: res.body, release: release}, res.size, res.putTime, res.encoding, res.miss, nil
+}
+
+// releasingBody calls release once the body is closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// Touch refreshes the object's timestamp. ErrTouchSkipped isn't retried.
+func (r *Retry) Touch(ctx context.Context, actionID []byte) error {
+	_, release, err := retry(ctx, r, "Touch", func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, r.backend.Touch(ctx, actionID)
+	}, nil)
+	release()
+	return err
+}
+
+// Close closes the underlying backend.
+func (r *Retry) Close() error {
+	return r.backend.Close()
+}
+
+// Clear clears the underlying backend.
+func (r *Retry) Clear(ctx context.Context) error {
+	return r.backend.Clear(ctx)
+}
+
+// Stats returns retry statistics.
+func (r *Retry) Stats() RetryStats {
+	return RetryStats{
+		Exhausted: r.exhausted.Load(),
+		Timeouts:  r.timeouts.Load(),
+	}
+}
+
+// RetryStats holds statistics for the retry wrapper.
+type RetryStats struct {
+	Exhausted int64
+	Timeouts  int64
+}
+
+// retry runs fn until it succeeds, fails with a permanent error, has been
+// tried MaxAttempts times or ctx is done. discard (if set) releases the result
+// of an attempt that succeeded after it was abandoned. The caller must call
+// release once it's done with the result.
+func retry[T any](ctx context.Context, r *Retry, op string, fn func(context.Context) (T, error), discard func(T)) (v T, release func(), err error) {
+	retries := 0
+	defer func() {
+		if onRetried := r.onRetried.Load(); onRetried != nil && retries > 0 {
+			(*onRetried)(retries)
+		}
+	}()
+
+	for attempt := 1; ; attempt++ {
+		v, release, err := runAttempt(ctx, r.opts.Timeout, fn, discard)
+		if errors.Is(err, errAttemptTimeout) {
+			r.timeouts.Add(1)
+		}
+		if err == nil || !IsRetryable(err) || ctx.Err() != nil {
+			return v, release, err
+		}
+		release()
+		if attempt == r.opts.MaxAttempts {
+			if attempt > 1 {
+				r.exhausted.Add(1)
+				err = fmt.Errorf("%s failed after %d attempts: %w", op, attempt, err)
+			}
+			return v, func() {}, err
+		}
+
+		delay := r.delay(attempt)
+		r.logger.Debug("retrying backend operation",
+			"op", op,
+			"attempt", attempt,
+			"delay", delay,
+			"error", err)
+		retries++
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return v, func() {}, fmt.Errorf("%s canceled after %d attempts: %w", op, attempt, ctx.Err())
+		}
+	}
+}
+
+// runAttempt runs fn, abandoning it if it takes longer than timeout. An
+// abandoned call has its context canceled and, if it succeeds anyway, its
+// result is passed to discard. release cancels the context of an attempt that
+// wasn't abandoned.
+func runAttempt[T any](ctx context.Context, timeout time.Duration, fn func(context.Context) (T, error), discard func(T)) (T, func(), error) {
+	if timeout <= 0 {
+		v, err := fn(ctx)
+		return v, func() {}, err
+	}
+
+	type result struct {
+		v   T
+		err error
+	}
+	attemptCtx, cancel := context.WithCancel(ctx)
+	done := make(chan result, 1)
+	go func() {
+		v, err := fn(attemptCtx)
+		done <- result{v, err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		return res.v, cancel, res.err
+	case <-timer.C:
+		cancel()
+		if discard != nil {
+			go func() {
+				if res := <-done; res.err == nil {
+					discard(res.v)
+				}
+			}()
+		}
+		var zero T
+		return zero, func() {}, errAttemptTimeout
+	}
+}
+
+// delay returns the backoff before retry number attempt (starting at 1).
+func (r *Retry) delay(attempt int) time.Duration {
+	d := r.opts.MaxDelay
+	if shift := attempt - 1; shift < 32 {
+		if exp := r.opts.BaseDelay << shift; exp > 0 && (d <= 0 || exp < d) {
+			d = exp
+		}
+	}
+	if r.opts.Jitter > 0 {
+		d -= time.Duration(rand.Float64() * r.opts.Jitter * float64(d))
+	}
+	return d
+}
+
+// replayableBody returns a reader that each attempt of a Put can read body
+// from independently, starting at offset. Bodies that can't be read that way
+// are copied to a spool in spoolDir, which release removes.
+func replayableBody(body io.Reader, bodySize int64, spoolDir string) (io.ReaderAt, int64, func(), error) {
+	if body == nil {
+		return bytes.NewReader(nil), 0, func() {}, nil
+	}
+	if rs, ok := body.(interface {
+		io.ReaderAt
+		io.Seeker
+	}); ok {
+		offset, err := rs.Seek(0, io.SeekCurrent)
+		if err == nil {
+			return rs, offset, func() {}, nil
+		}
+	}
+
+	spool := NewSpool(spoolDir, DefaultSpoolThreshold)
+	if _, err := io.CopyN(spool, body, bodySize); err != nil {
+		spool.Close()
+		return nil, 0, nil, fmt.Errorf("failed to read body: %w", err)
+	}
+	return spool.Reader(), 0, func() { spool.Close() }, nil
+}
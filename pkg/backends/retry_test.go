@@ -0,0 +1,175 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyBackend fails the first failures calls of each operation with err,
+// then stores and returns the last body put.
+type flakyBackend struct {
+	mockBackend
+	err      error
+	failures int64
+}
+
+func (f *flakyBackend) Put(ctx context.Context, actionID, outputID []byte, encoding string, body io.Reader, bodySize int64) error {
+	if f.putCalled.Load() < f.failures {
+		f.putCalled.Add(1)
+		// Consume part of the body, like a connection that dropped mid-upload.
+		_, _ = io.CopyN(io.Discard, body, 2)
+		return f.err
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	f.getOutputID, f.getBody, f.getSize = outputID, data, int64(len(data))
+	return f.mockBackend.Put(ctx, actionID, outputID, encoding, body, bodySize)
+}
+
+func (f *flakyBackend) Get(ctx context.Context, actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, string, bool, error) {
+	if f.getCalled.Load() < f.failures {
+		f.getCalled.Add(1)
+		return nil, nil, 0, nil, "", true, f.err
+	}
+	return f.mockBackend.Get(ctx, actionID)
+}
+
+func TestRetry_RetriesTransientErrors(t *testing.T) {
+	transient := &HTTPStatusError{Op: "get", StatusCode: http.StatusServiceUnavailable, Status: "503 Service Unavailable"}
+	flaky := &flakyBackend{err: transient, failures: 2}
+	r := NewRetry(flaky, RetryOptions{MaxAttempts: 3, BaseDelay: time.Millisecond, Jitter: 0.5},
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	var retries atomic.Int64
+	r.OnRetried(func(n int) { retries.Add(int64(n)) })
+
+	// A body that can't be re-read is replayed from a spool.
+	body := io.MultiReader(strings.NewReader("hello "), strings.NewReader("world"))
+	if err := r.Put(t.Context(), []byte("action"), []byte("output"), "", body, 11); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+	_, got, _, _, _, miss, err := r.Get(t.Context(), []byte("action"))
+	if err != nil || miss {
+		t.Fatalf("expected hit, miss=%v err=%v", miss, err)
+	}
+	data, _ := io.ReadAll(got)
+	got.Close()
+	if string(data) != "hello world" {
+		t.Fatalf("expected replayed body, got %q", data)
+	}
+
+	if flaky.putCalled.Load() != 3 || flaky.getCalled.Load() != 3 || retries.Load() != 4 {
+		t.Fatalf("expected 3 attempts each and 4 retries, got puts=%d gets=%d retries=%d",
+			flaky.putCalled.Load(), flaky.getCalled.Load(), retries.Load())
+	}
+}
+
+func TestRetry_GivesUp(t *testing.T) {
+	throttled := &HTTPStatusError{Op: "get", StatusCode: http.StatusTooManyRequests, Status: "429 Too Many Requests"}
+	flaky := &flakyBackend{err: throttled, failures: 10}
+	r := NewRetry(flaky, RetryOptions{MaxAttempts: 3, BaseDelay: time.Millisecond},
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	var retries atomic.Int64
+	r.OnRetried(func(n int) { retries.Add(int64(n)) })
+
+	_, _, _, _, _, _, err := r.Get(t.Context(), []byte("action"))
+	if !errors.Is(err, throttled) {
+		t.Fatalf("expected the last error to be returned, got %v", err)
+	}
+	if flaky.getCalled.Load() != 3 || retries.Load() != 2 || r.Stats().Exhausted != 1 {
+		t.Fatalf("expected 3 attempts, got gets=%d retries=%d stats=%+v", flaky.getCalled.Load(), retries.Load(), r.Stats())
+	}
+}
+
+func TestRetry_DoesNotRetryPermanentErrors(t *testing.T) {
+	forbidden := &HTTPStatusError{Op: "get", StatusCode: http.StatusForbidden, Status: "403 Forbidden"}
+	flaky := &flakyBackend{err: forbidden, failures: 10}
+	r := NewRetry(flaky, RetryOptions{MaxAttempts: 3, BaseDelay: time.Millisecond},
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	var retries atomic.Int64
+	r.OnRetried(func(n int) { retries.Add(int64(n)) })
+
+	if _, _, _, _, _, _, err := r.Get(t.Context(), []byte("action")); !errors.Is(err, forbidden) {
+		t.Fatalf("expected permanent error, got %v", err)
+	}
+	if flaky.getCalled.Load() != 1 || retries.Load() != 0 {
+		t.Fatalf("expected a single attempt, got gets=%d retries=%d", flaky.getCalled.Load(), retries.Load())
+	}
+}
+
+// slowBackend blocks every Get for delay, or until its context is done.
+type slowBackend struct {
+	mockBackend
+	delay time.Duration
+}
+
+func (s *slowBackend) Get(ctx context.Context, actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, string, bool, error) {
+	s.getCalled.Add(1)
+	select {
+	case <-time.After(s.delay):
+		return nil, nil, 0, nil, "", true, nil
+	case <-ctx.Done():
+		return nil, nil, 0, nil, "", true, ctx.Err()
+	}
+}
+
+func TestRetry_TimesOutAttempts(t *testing.T) {
+	slow := &slowBackend{delay: time.Second}
+	r := NewRetry(slow, RetryOptions{MaxAttempts: 2, BaseDelay: time.Millisecond, Timeout: 10 * time.Millisecond},
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	start := time.Now()
+	_, _, _, _, _, _, err := r.Get(t.Context(), []byte("action"))
+	if !IsRetryable(err) || time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("expected a timeout well before the backend returns, got %v after %v", err, time.Since(start))
+	}
+	if stats := r.Stats(); stats.Timeouts != 2 || slow.getCalled.Load() != 2 {
+		t.Fatalf("expected 2 timed out attempts, got %+v", stats)
+	}
+}
+
+func TestRetry_StopsWhenContextDone(t *testing.T) {
+	transient := &HTTPStatusError{Op: "get", StatusCode: http.StatusServiceUnavailable, Status: "503 Service Unavailable"}
+	flaky := &flakyBackend{err: transient, failures: 10}
+	r := NewRetry(flaky, RetryOptions{MaxAttempts: 10, BaseDelay: time.Second},
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	ctx, cancel := context.WithTimeout(t.Context(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, _, _, _, _, err := r.Get(ctx, []byte("action"))
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("expected the deadline to cut the backoff short, got %v after %v", err, time.Since(start))
+	}
+	if gets := flaky.getCalled.Load(); gets != 1 {
+		t.Fatalf("expected 1 attempt, got %d", gets)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{errors.New("boom"), false},
+		{ErrTouchSkipped, false},
+		{io.ErrUnexpectedEOF, true},
+		{errAttemptTimeout, true},
+		{&simulatedError{op: "Get"}, true},
+		{&HTTPStatusError{StatusCode: http.StatusNotFound}, false},
+		{&HTTPStatusError{StatusCode: http.StatusBadGateway}, true},
+	}
+	for _, tt := range tests {
+		if got := IsRetryable(tt.err); got != tt.want {
+			t.Errorf("IsRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
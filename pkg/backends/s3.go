@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"io"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -22,7 +24,7 @@ type S3 struct {
 	bucket         string
 	prefix         string
 	touchThreshold time.Duration // If >0, Touch skips CopyObject when object is newer than this
-	ctx            context.Context
+	transfer       S3TransferOptions
 	awsConfig      aws.Config
 }
 
@@ -31,7 +33,8 @@ type S3 struct {
 // prefix is an optional prefix for all S3 keys (e.g., "cache/" or "").
 // touchThreshold controls debounced touch: if >0, Touch only issues a CopyObject
 // when the object's LastModified is older than this duration. Use 0 to always touch.
-func NewS3(bucket, prefix string, touchThreshold time.Duration, pathStyle bool) (*S3, error) {
+// transfer controls multipart uploads and parallel ranged downloads of large objects.
+func NewS3(bucket, prefix string, touchThreshold time.Duration, pathStyle bool, transfer S3TransferOptions) (*S3, error) {
 	ctx := context.Background()
 
 	// Load AWS config from environment/credentials
@@ -40,19 +43,19 @@ func NewS3(bucket, prefix string, touchThreshold time.Duration, pathStyle bool)
 		return nil, fmt.Errorf("failed to load AWS config: %w", err)
 	}
 
-	var client *s3.Client
-	if pathStyle {
-		client = s3.NewFromConfig(cfg, func(o *s3.Options) { o.UsePathStyle = true })
-	} else {
-		client = s3.NewFromConfig(cfg)
-	}
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.UsePathStyle = pathStyle
+		if transfer.MaxAttempts > 0 {
+			o.RetryMaxAttempts = transfer.MaxAttempts
+		}
+	})
 
 	backend := &S3{
 		client:         client,
 		bucket:         bucket,
 		prefix:         prefix,
 		touchThreshold: touchThreshold,
-		ctx:            ctx,
+		transfer:       transfer.withDefaults(),
 		awsConfig:      cfg,
 	}
 
@@ -68,20 +71,42 @@ func NewS3(bucket, prefix string, touchThreshold time.Duration, pathStyle bool)
 }
 
 // Put stores an object in S3.
-func (s *S3) Put(actionID, outputID []byte, body io.Reader, bodySize int64) error {
+func (s *S3) Put(ctx context.Context, actionID, outputID []byte, encoding string, body io.Reader, bodySize int64) error {
 	key := s.actionIDToKey(actionID)
 
-	// Read the body into a buffer (needed for S3 SDK)
-	var bodyData []byte
-	if bodySize > 0 && body != nil {
-		bodyData = make([]byte, bodySize)
-		n, err := io.ReadFull(body, bodyData)
-		if err != nil && err != io.EOF {
+	// The S3 SDK needs a seekable body to sign the payload, and multipart
+	// uploads read parts at arbitrary offsets. Bodies that support neither are
+	// spooled, which spills large ones to disk instead of memory.
+	var bodyReader *io.SectionReader
+	switch r := body.(type) {
+	case nil:
+		bodyReader = io.NewSectionReader(bytes.NewReader(nil), 0, 0)
+	case interface {
+		io.Seeker
+		io.ReaderAt
+	}:
+		start, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
 			return fmt.Errorf("failed to read body: %w", err)
 		}
-		if int64(n) != bodySize {
-			return fmt.Errorf("size mismatch: expected %d, read %d", bodySize, n)
+		bodyReader = io.NewSectionReader(r, start, bodySize)
+	default:
+		spool := NewSpool(s.transfer.SpoolDir, DefaultSpoolThreshold)
+		defer spool.Close()
+		if _, err := io.Copy(spool, io.LimitReader(body, bodySize)); err != nil {
+			return fmt.Errorf("failed to read body: %w", err)
+		}
+		if spool.Size() != bodySize {
+			return fmt.Errorf("size mismatch: expected %d, read %d", bodySize, spool.Size())
 		}
+		bodyReader = spool.Reader()
+	}
+
+	// The checksum goes in the metadata, which is sent before the body, so
+	// it takes a separate pass over the body.
+	checksum, err := hashSection(bodyReader)
+	if err != nil {
+		return fmt.Errorf("failed to read body: %w", err)
 	}
 
 	// Prepare metadata
@@ -90,17 +115,27 @@ func (s *S3) Put(actionID, outputID []byte, body io.Reader, bodySize int64) erro
 		"outputid": hex.EncodeToString(outputID),
 		"size":     strconv.FormatInt(bodySize, 10),
 		"time":     strconv.FormatInt(now.Unix(), 10),
+		"sha256":   hex.EncodeToString(checksum),
+	}
+	if encoding != "" {
+		metadata["encoding"] = encoding
+	}
+
+	// Large objects are uploaded in concurrent parts.
+	if s.transfer.Threshold > 0 && bodySize > s.transfer.Threshold {
+		return s.putMultipart(ctx, key, metadata, bodyReader, bodySize)
 	}
 
 	// Upload to S3
 	putInput := &s3.PutObjectInput{
-		Bucket:   aws.String(s.bucket),
-		Key:      aws.String(key),
-		Body:     bytes.NewReader(bodyData),
-		Metadata: metadata,
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(key),
+		Body:          bodyReader,
+		ContentLength: aws.Int64(bodySize),
+		Metadata:      metadata,
 	}
 
-	_, err := s.client.PutObject(s.ctx, putInput)
+	_, err = s.client.PutObject(ctx, putInput)
 	if err != nil {
 		return fmt.Errorf("failed to upload to S3: %w", err)
 	}
@@ -109,10 +144,10 @@ func (s *S3) Put(actionID, outputID []byte, body io.Reader, bodySize int64) erro
 }
 
 // Has checks whether an object exists in S3 via HeadObject.
-func (s *S3) Has(actionID []byte) (bool, error) {
+func (s *S3) Has(ctx context.Context, actionID []byte) (bool, error) {
 	key := s.actionIDToKey(actionID)
 
-	_, err := s.client.HeadObject(s.ctx, &s3.HeadObjectInput{
+	_, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
 		Bucket: aws.String(s.bucket),
 		Key:    aws.String(key),
 	})
@@ -128,7 +163,7 @@ func (s *S3) Has(actionID []byte) (bool, error) {
 
 // Get retrieves an object from S3.
 // Returns the object data as an io.ReadCloser that must be closed by the caller.
-func (s *S3) Get(actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, bool, error) {
+func (s *S3) Get(ctx context.Context, actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, string, bool, error) {
 	key := s.actionIDToKey(actionID)
 
 	// Get object from S3
@@ -137,42 +172,34 @@ func (s *S3) Get(actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, boo
 		Key:    aws.String(key),
 	}
 
-	result, err := s.client.GetObject(s.ctx, getInput)
+	result, err := s.client.GetObject(ctx, getInput)
 	if err != nil {
 		// Check if it's a not found error
 		if s.isNotFoundError(err) {
-			return nil, nil, 0, nil, true, nil
+			return nil, nil, 0, nil, "", true, nil
 		}
-		return nil, nil, 0, nil, true, fmt.Errorf("failed to get S3 object: %w", err)
+		return nil, nil, 0, nil, "", true, fmt.Errorf("failed to get S3 object: %w", err)
 	}
 
 	// Parse metadata from GET response
-	outputIDHex := result.Metadata["outputid"]
-	sizeStr := result.Metadata["size"]
-	timeStr := result.Metadata["time"]
-
-	outputID, err := hex.DecodeString(outputIDHex)
+	outputID, size, putTime, checksum, err := parseS3Metadata(result.Metadata)
 	if err != nil {
 		result.Body.Close()
-		return nil, nil, 0, nil, true, fmt.Errorf("failed to decode outputID: %w", err)
+		return nil, nil, 0, nil, "", true, err
 	}
 
-	size, err := strconv.ParseInt(sizeStr, 10, 64)
-	if err != nil {
-		result.Body.Close()
-		return nil, nil, 0, nil, true, fmt.Errorf("failed to parse size: %w", err)
+	// Large objects are downloaded with parallel ranged GETs. We still issue a
+	// plain GET first so small objects (the vast majority) take a single request.
+	body := result.Body
+	contentLength := aws.ToInt64(result.ContentLength)
+	if s.transfer.Threshold > 0 && contentLength > s.transfer.Threshold && contentLength > s.transfer.PartSize {
+		body = s.rangedBody(ctx, key, result.Body, result.ETag, contentLength)
 	}
-
-	putTimeUnix, err := strconv.ParseInt(timeStr, 10, 64)
-	if err != nil {
-		result.Body.Close()
-		return nil, nil, 0, nil, true, fmt.Errorf("failed to parse time: %w", err)
-	}
-	putTime := time.Unix(putTimeUnix, 0)
+	body = newChecksumReader(body, checksum, func() { s.quarantine(ctx, key, result.ETag) })
 
 	// Return the S3 object body as a ReadCloser
 	// The caller is responsible for closing it
-	return outputID, result.Body, size, &putTime, false, nil
+	return outputID, body, size, &putTime, result.Metadata["encoding"], false, nil
 }
 
 // Touch performs a CopyObject self-to-self to reset the S3 object's LastModified timestamp,
@@ -181,12 +208,12 @@ func (s *S3) Get(actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, boo
 // When touchThreshold is configured, Touch first checks the object's LastModified via
 // HeadObject and skips the CopyObject if the object was modified more recently than the
 // threshold. Returns ErrTouchSkipped when the object is fresh enough.
-func (s *S3) Touch(actionID []byte) error {
+func (s *S3) Touch(ctx context.Context, actionID []byte) error {
 	key := s.actionIDToKey(actionID)
 
 	// If threshold is set, check whether the object is fresh enough to skip
 	if s.touchThreshold > 0 {
-		head, err := s.client.HeadObject(s.ctx, &s3.HeadObjectInput{
+		head, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
 			Bucket: aws.String(s.bucket),
 			Key:    aws.String(key),
 		})
@@ -205,7 +232,7 @@ func (s *S3) Touch(actionID []byte) error {
 	}
 
 	copySource := s.bucket + "/" + key
-	_, err := s.client.CopyObject(s.ctx, &s3.CopyObjectInput{
+	_, err := s.client.CopyObject(ctx, &s3.CopyObjectInput{
 		Bucket:            aws.String(s.bucket),
 		Key:               aws.String(key),
 		CopySource:        aws.String(copySource),
@@ -224,7 +251,7 @@ func (s *S3) Close() error {
 }
 
 // Clear removes all entries from the cache in S3.
-func (s *S3) Clear() error {
+func (s *S3) Clear(ctx context.Context) error {
 	// List all objects with the prefix
 	listInput := &s3.ListObjectsV2Input{
 		Bucket: aws.String(s.bucket),
@@ -235,7 +262,7 @@ func (s *S3) Clear() error {
 
 	var deleteObjects []types.ObjectIdentifier
 	for paginator.HasMorePages() {
-		page, err := paginator.NextPage(s.ctx)
+		page, err := paginator.NextPage(ctx)
 		if err != nil {
 			return fmt.Errorf("failed to list S3 objects: %w", err)
 		}
@@ -267,7 +294,7 @@ func (s *S3) Clear() error {
 			},
 		}
 
-		_, err := s.client.DeleteObjects(s.ctx, deleteInput)
+		_, err := s.client.DeleteObjects(ctx, deleteInput)
 		if err != nil {
 			return fmt.Errorf("failed to delete S3 objects: %w", err)
 		}
@@ -276,6 +303,225 @@ func (s *S3) Clear() error {
 	return nil
 }
 
+// Trim deletes every object under the prefix whose LastModified is before
+// cutoff. LastModified is set by Put and reset by Touch, and is never older than
+// the object's "time" metadata, so this avoids a HeadObject per object while
+// never deleting anything put or touched after cutoff. Dictionaries,
+// manifests and keys that aren't cache objects (e.g. ones outside
+// gobuildcache's own prefix when the prefix is empty) are kept.
+func (s *S3) Trim(ctx context.Context, cutoff time.Time) (TrimStats, error) {
+	var stats TrimStats
+
+	listInput := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.prefix),
+	}
+
+	paginator := s3.NewListObjectsV2Paginator(s.client, listInput)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return stats, fmt.Errorf("failed to list S3 objects: %w", err)
+		}
+
+		var (
+			deleteObjects []types.ObjectIdentifier
+			sizes         = make(map[string]int64)
+		)
+		for _, obj := range page.Contents {
+			if !trimmable(strings.TrimPrefix(aws.ToString(obj.Key), s.prefix)) {
+				continue
+			}
+			stats.Scanned++
+			if obj.LastModified == nil || !obj.LastModified.Before(cutoff) {
+				continue
+			}
+			deleteObjects = append(deleteObjects, types.ObjectIdentifier{Key: obj.Key})
+			sizes[aws.ToString(obj.Key)] = aws.ToInt64(obj.Size)
+		}
+		if len(deleteObjects) == 0 {
+			continue
+		}
+
+		// A list page holds at most 1000 keys, which is also the DeleteObjects limit.
+		result, err := s.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.bucket),
+			Delete: &types.Delete{
+				Objects: deleteObjects,
+				Quiet:   aws.Bool(true),
+			},
+		})
+		if err != nil {
+			return stats, fmt.Errorf("failed to delete S3 objects: %w", err)
+		}
+
+		// In quiet mode only failures are reported back.
+		for _, deleteErr := range result.Errors {
+			delete(sizes, aws.ToString(deleteErr.Key))
+		}
+		for _, size := range sizes {
+			stats.Deleted++
+			stats.DeletedBytes += size
+		}
+		if len(result.Errors) > 0 {
+			first := result.Errors[0]
+			return stats, fmt.Errorf("failed to delete %d S3 objects (first: %s: %s)",
+				len(result.Errors), aws.ToString(first.Key), aws.ToString(first.Message))
+		}
+	}
+
+	return stats, nil
+}
+
+// Check examines objects under the prefix (or a random sample of them) with
+// HeadObject and reports any whose metadata Get would reject, or whose size
+// metadata doesn't match the stored object. Quarantined objects and keys
+// that aren't cache objects are skipped.
+func (s *S3) Check(ctx context.Context, opts CheckOptions, report func(key, problem string)) (CheckStats, error) {
+	var (
+		stats      CheckStats
+		keys       = sampler[string]{size: opts.Sample}
+		quarantine = s.prefix + "quarantine/"
+	)
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return stats, fmt.Errorf("failed to list S3 objects: %w", err)
+		}
+		for _, obj := range page.Contents {
+			key := aws.ToString(obj.Key)
+			if _, ok := objectKey(strings.TrimPrefix(key, s.prefix)); ok && !strings.HasPrefix(key, quarantine) {
+				keys.add(key)
+			}
+		}
+	}
+
+	// HeadObject is one round trip per object, so check several at once.
+	var (
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+		firstErr  error
+		semaphore = make(chan struct{}, s.transfer.Concurrency)
+	)
+	for _, key := range keys.items {
+		semaphore <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			problem, err := s.checkObject(ctx, key)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			stats.Scanned++
+			if problem == "" {
+				return
+			}
+			stats.Invalid++
+			report(key, problem)
+			if !opts.Repair {
+				return
+			}
+			if _, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+				Bucket: aws.String(s.bucket),
+				Key:    aws.String(key),
+			}); err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("failed to delete %s: %w", key, err)
+				}
+				return
+			}
+			stats.Repaired++
+		}()
+	}
+	wg.Wait()
+
+	return stats, firstErr
+}
+
+// checkObject returns why Get would reject the object at key, or "" if it's
+// valid (or has been deleted since it was listed).
+func (s *S3) checkObject(ctx context.Context, key string) (string, error) {
+	head, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if s.isNotFoundError(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to check %s: %w", key, err)
+	}
+
+	_, size, _, _, err := parseS3Metadata(head.Metadata)
+	if err != nil {
+		return err.Error(), nil
+	}
+	if contentLength := aws.ToInt64(head.ContentLength); size != contentLength {
+		return fmt.Sprintf("size metadata %d does not match object size %d", size, contentLength), nil
+	}
+	return "", nil
+}
+
+// parseS3Metadata parses the object metadata written by Put. The checksum is
+// empty for objects stored before checksums were recorded, which are served
+// unverified.
+func parseS3Metadata(metadata map[string]string) ([]byte, int64, time.Time, []byte, error) {
+	outputID, err := hex.DecodeString(metadata["outputid"])
+	if err != nil {
+		return nil, 0, time.Time{}, nil, fmt.Errorf("failed to decode outputID: %w", err)
+	}
+
+	size, err := strconv.ParseInt(metadata["size"], 10, 64)
+	if err != nil {
+		return nil, 0, time.Time{}, nil, fmt.Errorf("failed to parse size: %w", err)
+	}
+
+	putTimeUnix, err := strconv.ParseInt(metadata["time"], 10, 64)
+	if err != nil {
+		return nil, 0, time.Time{}, nil, fmt.Errorf("failed to parse time: %w", err)
+	}
+
+	checksum, err := hex.DecodeString(metadata["sha256"])
+	if err != nil {
+		return nil, 0, time.Time{}, nil, fmt.Errorf("failed to decode sha256: %w", err)
+	}
+
+	return outputID, size, time.Unix(putTimeUnix, 0), checksum, nil
+}
+
+// quarantine moves a corrupt object aside under the "quarantine/" prefix so it
+// stops being served (and reported by Has), while remaining available for
+// inspection until it's trimmed or expired. The copy is pinned to the corrupt
+// object's ETag so that a good object written concurrently isn't moved instead.
+// This is best-effort: on failure the object is simply left in place.
+func (s *S3) quarantine(ctx context.Context, key string, etag *string) {
+	_, err := s.client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:            aws.String(s.bucket),
+		Key:               aws.String(s.prefix + "quarantine/" + strings.TrimPrefix(key, s.prefix)),
+		CopySource:        aws.String(s.bucket + "/" + key),
+		CopySourceIfMatch: etag,
+		MetadataDirective: types.MetadataDirectiveCopy,
+	})
+	if err != nil {
+		return
+	}
+	_, _ = s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+}
+
 // actionIDToKey converts an actionID to an S3 key.
 func (s *S3) actionIDToKey(actionID []byte) string {
 	hexID := hex.EncodeToString(actionID)
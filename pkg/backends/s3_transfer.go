@@ -0,0 +1,307 @@
+package backends
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	// DefaultS3PartSize is the default multipart part size and ranged GET size.
+	DefaultS3PartSize = 8 << 20
+	// DefaultS3TransferConcurrency is the default number of parts transferred at once.
+	DefaultS3TransferConcurrency = 8
+
+	// minS3PartSize is the smallest part size S3 accepts (except for the last part).
+	minS3PartSize = 5 << 20
+)
+
+// S3TransferOptions controls how objects, large ones in particular, are
+// transferred to and from S3.
+type S3TransferOptions struct {
+	// Threshold is the object size above which uploads use multipart and
+	// downloads use parallel ranged GETs. 0 disables both.
+	Threshold int64
+	// PartSize is the size of each uploaded part and downloaded range.
+	// Defaults to DefaultS3PartSize; values below S3's 5 MiB minimum are raised.
+	PartSize int64
+	// Concurrency is the number of parts transferred at once per object.
+	// Defaults to DefaultS3TransferConcurrency.
+	Concurrency int
+	// SpoolDir is where bodies that can't be replayed are spooled before
+	// they're uploaded; empty uses the default temp directory.
+	SpoolDir string
+	// MaxAttempts is the number of attempts the AWS SDK makes per request;
+	// 0 keeps the SDK's default. Set it to 1 when a Retry wrapper retries
+	// instead, so the two don't multiply.
+	MaxAttempts int
+}
+
+// withDefaults returns a copy of o with defaults applied.
+func (o S3TransferOptions) withDefaults() S3TransferOptions {
+	if o.PartSize <= 0 {
+		o.PartSize = DefaultS3PartSize
+	}
+	if o.PartSize < minS3PartSize {
+		o.PartSize = minS3PartSize
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = DefaultS3TransferConcurrency
+	}
+	return o
+}
+
+// byteRange is a half-open [offset, offset+length) range of an object.
+type byteRange struct {
+	offset int64
+	length int64
+}
+
+// planParts splits [start, size) into consecutive ranges of at most partSize bytes.
+func planParts(start, size, partSize int64) []byteRange {
+	var parts []byteRange
+	for offset := start; offset < size; offset += partSize {
+		parts = append(parts, byteRange{offset: offset, length: min(partSize, size-offset)})
+	}
+	return parts
+}
+
+// putMultipart uploads body as a multipart upload with up to Concurrency parts
+// in flight. Parts are read directly from body at their offsets, so nothing is
+// buffered in memory. The upload is aborted if any part fails.
+func (s *S3) putMultipart(ctx context.Context, key string, metadata map[string]string, body io.ReaderAt, bodySize int64) error {
+	create, err := s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(key),
+		Metadata: metadata,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create multipart upload: %w", err)
+	}
+
+	partsCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		ranges    = planParts(0, bodySize, s.transfer.PartSize)
+		completed = make([]types.CompletedPart, len(ranges))
+		semaphore = make(chan struct{}, s.transfer.Concurrency)
+		wg        sync.WaitGroup
+		errOnce   sync.Once
+		firstErr  error
+	)
+	for i, r := range ranges {
+		select {
+		case semaphore <- struct{}{}:
+		case <-partsCtx.Done():
+		}
+		if partsCtx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			partNumber := aws.Int32(int32(i + 1))
+			out, err := s.client.UploadPart(partsCtx, &s3.UploadPartInput{
+				Bucket:        aws.String(s.bucket),
+				Key:           aws.String(key),
+				UploadId:      create.UploadId,
+				PartNumber:    partNumber,
+				Body:          io.NewSectionReader(body, r.offset, r.length),
+				ContentLength: aws.Int64(r.length),
+			})
+			if err != nil {
+				errOnce.Do(func() {
+					firstErr = fmt.Errorf("failed to upload part %d: %w", i+1, err)
+					cancel()
+				})
+				return
+			}
+			completed[i] = types.CompletedPart{ETag: out.ETag, PartNumber: partNumber}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr == nil {
+		_, firstErr = s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(s.bucket),
+			Key:             aws.String(key),
+			UploadId:        create.UploadId,
+			MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+		})
+		if firstErr == nil {
+			return nil
+		}
+		firstErr = fmt.Errorf("failed to complete multipart upload: %w", firstErr)
+	}
+
+	// Don't leave orphaned parts behind (they're billed until aborted), even if
+	// the upload failed because ctx is done.
+	if _, err := s.client.AbortMultipartUpload(context.WithoutCancel(ctx), &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(key),
+		UploadId: create.UploadId,
+	}); err != nil {
+		return errors.Join(firstErr, fmt.Errorf("failed to abort multipart upload: %w", err))
+	}
+	return firstErr
+}
+
+// rangedBody returns a reader over a large object that continues reading the
+// already open GET body for the first part while the remaining parts are
+// fetched concurrently with ranged GETs. The parts are pinned to the original
+// object's ETag so a concurrent overwrite fails the read instead of mixing
+// objects. The ranged GETs are canceled once ctx is done.
+func (s *S3) rangedBody(ctx context.Context, key string, first io.ReadCloser, etag *string, size int64) io.ReadCloser {
+	firstLen := min(s.transfer.PartSize, size)
+	fetch := func(ctx context.Context, r byteRange) ([]byte, error) {
+		out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket:  aws.String(s.bucket),
+			Key:     aws.String(key),
+			Range:   aws.String(fmt.Sprintf("bytes=%d-%d", r.offset, r.offset+r.length-1)),
+			IfMatch: etag,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get range %d-%d: %w", r.offset, r.offset+r.length-1, err)
+		}
+		defer out.Body.Close()
+		return io.ReadAll(out.Body)
+	}
+	return newRangedReader(ctx, first, firstLen, planParts(firstLen, size, s.transfer.PartSize), s.transfer.Concurrency, fetch)
+}
+
+// rangedPart is the outcome of fetching one range.
+type rangedPart struct {
+	data []byte
+	err  error
+}
+
+// rangedReader reassembles an object in order from an initial stream followed
+// by ranges fetched concurrently. At most concurrency ranges are buffered
+// ahead of the reader, which bounds memory to concurrency*partSize.
+type rangedReader struct {
+	first     io.ReadCloser
+	firstLeft int64
+
+	ranges    []byteRange
+	results   []chan rangedPart
+	semaphore chan struct{}
+	ctx       context.Context
+	cancel    context.CancelFunc
+
+	next    int // Index of the range currently being read
+	current *bytes.Reader
+	err     error
+}
+
+func newRangedReader(
+	ctx context.Context,
+	first io.ReadCloser,
+	firstLen int64,
+	ranges []byteRange,
+	concurrency int,
+	fetch func(ctx context.Context, r byteRange) ([]byte, error),
+) *rangedReader {
+	ctx, cancel := context.WithCancel(ctx)
+	rr := &rangedReader{
+		first:     first,
+		firstLeft: firstLen,
+		ranges:    ranges,
+		results:   make([]chan rangedPart, len(ranges)),
+		semaphore: make(chan struct{}, concurrency),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+	for i := range rr.results {
+		rr.results[i] = make(chan rangedPart, 1)
+	}
+
+	// Start fetches in order, never more than concurrency ahead of the reader.
+	// Read releases a slot each time it finishes consuming a range.
+	go func() {
+		for i, r := range ranges {
+			select {
+			case rr.semaphore <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			go func() {
+				data, err := fetch(ctx, r)
+				if err == nil && int64(len(data)) != r.length {
+					err = fmt.Errorf("short range read at offset %d: expected %d bytes, got %d", r.offset, r.length, len(data))
+				}
+				rr.results[i] <- rangedPart{data: data, err: err}
+			}()
+		}
+	}()
+
+	return rr
+}
+
+func (rr *rangedReader) Read(p []byte) (int, error) {
+	if rr.err != nil {
+		return 0, rr.err
+	}
+
+	// Keep streaming the initial body first.
+	if rr.firstLeft > 0 {
+		n, err := rr.first.Read(p[:min(int64(len(p)), rr.firstLeft)])
+		rr.firstLeft -= int64(n)
+		if errors.Is(err, io.EOF) && rr.firstLeft > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			rr.err = err
+			return n, err
+		}
+		if rr.firstLeft == 0 {
+			// We only needed the first part of this body.
+			rr.first.Close()
+		}
+		return n, nil
+	}
+
+	for rr.current == nil || rr.current.Len() == 0 {
+		if rr.current != nil {
+			// Finished a range, let another fetch start.
+			rr.current = nil
+			rr.next++
+			<-rr.semaphore
+		}
+		if rr.next >= len(rr.ranges) {
+			return 0, io.EOF
+		}
+		select {
+		case part := <-rr.results[rr.next]:
+			if part.err != nil {
+				rr.err = part.err
+				return 0, part.err
+			}
+			rr.current = bytes.NewReader(part.data)
+		case <-rr.ctx.Done():
+			rr.err = errors.New("ranged reader closed")
+			return 0, rr.err
+		}
+	}
+
+	return rr.current.Read(p)
+}
+
+// Close stops any in-flight range fetches and closes the initial body.
+func (rr *rangedReader) Close() error {
+	rr.cancel()
+	if rr.firstLeft > 0 {
+		return rr.first.Close()
+	}
+	return nil
+}
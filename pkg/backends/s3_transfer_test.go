@@ -0,0 +1,120 @@
+package backends
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestPlanParts(t *testing.T) {
+	parts := planParts(4, 25, 8)
+	expected := []byteRange{{4, 8}, {12, 8}, {20, 5}}
+	if len(parts) != len(expected) {
+		t.Fatalf("expected %d parts, got %d: %+v", len(expected), len(parts), parts)
+	}
+	for i := range expected {
+		if parts[i] != expected[i] {
+			t.Errorf("part %d: expected %+v, got %+v", i, expected[i], parts[i])
+		}
+	}
+
+	if parts := planParts(10, 10, 8); len(parts) != 0 {
+		t.Fatalf("expected no parts for empty range, got %+v", parts)
+	}
+}
+
+func TestS3TransferOptionsDefaults(t *testing.T) {
+	opts := S3TransferOptions{Threshold: 1, PartSize: 1}.withDefaults()
+	if opts.PartSize != minS3PartSize || opts.Concurrency != DefaultS3TransferConcurrency {
+		t.Fatalf("unexpected defaults: %+v", opts)
+	}
+}
+
+// sliceFetch serves ranges of data with a random delay so parts complete out of order.
+func sliceFetch(data []byte) func(ctx context.Context, r byteRange) ([]byte, error) {
+	return func(ctx context.Context, r byteRange) ([]byte, error) {
+		time.Sleep(time.Duration(rand.Intn(3)) * time.Millisecond)
+		return bytes.Clone(data[r.offset : r.offset+r.length]), nil
+	}
+}
+
+func TestRangedReader_ReassemblesInOrder(t *testing.T) {
+	data := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	const firstLen = 100
+	first := io.NopCloser(bytes.NewReader(data)) // Extra bytes past firstLen are ignored
+	rr := newRangedReader(context.Background(), first, firstLen, planParts(firstLen, int64(len(data)), 64), 3, sliceFetch(data))
+	defer rr.Close()
+
+	got, err := io.ReadAll(rr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("reassembled data does not match")
+	}
+}
+
+func TestRangedReader_PropagatesErrors(t *testing.T) {
+	data := make([]byte, 300)
+	fetch := func(ctx context.Context, r byteRange) ([]byte, error) {
+		if r.offset == 200 {
+			return nil, errors.New("precondition failed")
+		}
+		return data[r.offset : r.offset+r.length], nil
+	}
+
+	rr := newRangedReader(context.Background(), io.NopCloser(bytes.NewReader(data)), 100, planParts(100, 300, 100), 2, fetch)
+	defer rr.Close()
+
+	if _, err := io.ReadAll(rr); err == nil {
+		t.Fatal("expected error from failed range")
+	}
+}
+
+func TestRangedReader_ShortRange(t *testing.T) {
+	data := make([]byte, 300)
+	fetch := func(ctx context.Context, r byteRange) ([]byte, error) {
+		return data[r.offset : r.offset+r.length-1], nil
+	}
+
+	rr := newRangedReader(context.Background(), io.NopCloser(bytes.NewReader(data)), 100, planParts(100, 300, 100), 2, fetch)
+	defer rr.Close()
+
+	if _, err := io.ReadAll(rr); err == nil {
+		t.Fatal("expected error for short range")
+	}
+}
+
+func TestRangedReader_CloseStopsFetching(t *testing.T) {
+	data := make([]byte, 10000)
+	started := make(chan struct{}, 100)
+	fetch := func(ctx context.Context, r byteRange) ([]byte, error) {
+		started <- struct{}{}
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	rr := newRangedReader(context.Background(), io.NopCloser(bytes.NewReader(data)), 100, planParts(100, 10000, 100), 4, fetch)
+	// Only concurrency fetches may start before the reader consumes anything.
+	for range 4 {
+		<-started
+	}
+	select {
+	case <-started:
+		t.Fatal("more fetches started than the concurrency limit")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	if err := rr.Close(); err != nil {
+		t.Fatalf("unexpected Close error: %v", err)
+	}
+	if _, err := io.ReadAll(rr); err == nil {
+		t.Fatal("expected error reading from a closed ranged reader")
+	}
+}
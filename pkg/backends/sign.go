@@ -0,0 +1,316 @@
+package backends
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ErrBadSignature is returned from reading an object body whose signature
+// doesn't match, e.g. because the object was planted or altered by someone
+// without the signing key. It's only reported once the whole body has been
+// read, so callers must read to EOF before trusting a body, and should treat
+// it as a cache miss.
+var ErrBadSignature = errors.New("bad signature")
+
+const (
+	// signEncodingPrefix starts the encoding of every signed object, followed
+	// by the key ID and the encoding of the body: "hmac:<key ID>:<encoding>".
+	signEncodingPrefix = "hmac:"
+	// signatureSize is the size of the HMAC-SHA256 trailer after each body.
+	signatureSize = sha256.Size
+)
+
+// SigningKey is a named HMAC key. The ID is stored with every object signed
+// with the key, so that old keys can still verify after rotation.
+type SigningKey struct {
+	ID  string
+	Key []byte
+}
+
+// ParseSigningKeys parses a keyring in the same format as ParseEncryptionKeys.
+// The first key signs new objects; the rest are only used to verify objects
+// written before a rotation.
+func ParseSigningKeys(s string) ([]SigningKey, error) {
+	entries, err := parseKeyring(s)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]SigningKey, len(entries))
+	for i, e := range entries {
+		keys[i] = SigningKey{ID: e.id, Key: e.key}
+	}
+	return keys, nil
+}
+
+// Sign wraps a Backend and signs every object with HMAC-SHA256, so that only
+// writers holding the key can add entries that readers will accept. The
+// signature covers the action ID, output ID, stored encoding and the SHA-256 of
+// the body, and is stored as a trailer after the body.
+//
+// Sign fails closed. Objects that aren't signed or were signed with an unknown
+// key are misses. A body whose signature doesn't match returns ErrBadSignature
+// once it's read.
+type Sign struct {
+	backend Backend
+	current string
+	keys    map[string][]byte
+
+	// Stats
+	unsigned      atomic.Int64 // Objects rejected because they weren't signed
+	badSignatures atomic.Int64 // Objects rejected because their signature didn't match
+	unknownKeys   atomic.Int64 // Objects rejected because their key isn't configured
+}
+
+// NewSign creates a new signing wrapper around backend. keys[0] signs new
+// objects; every key verifies.
+func NewSign(backend Backend, keys []SigningKey) (*Sign, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("at least one signing key is required")
+	}
+	s := &Sign{
+		backend: backend,
+		current: keys[0].ID,
+		keys:    make(map[string][]byte, len(keys)),
+	}
+	for _, k := range keys {
+		if err := validateKeyID(k.ID); err != nil {
+			return nil, err
+		}
+		if _, ok := s.keys[k.ID]; ok {
+			return nil, fmt.Errorf("duplicate signing key ID %q", k.ID)
+		}
+		// HMAC accepts any key, but a short one is trivially brute-forced.
+		if len(k.Key) < 16 {
+			return nil, fmt.Errorf("signing key %q is too short: need at least 16 bytes, got %d", k.ID, len(k.Key))
+		}
+		s.keys[k.ID] = k.Key
+	}
+	return s, nil
+}
+
+// Unwrap returns the underlying backend.
+func (s *Sign) Unwrap() Backend {
+	return s.backend
+}
+
+// Put stores the object with a signature made with the current key.
+func (s *Sign) Put(ctx context.Context, actionID, outputID []byte, encoding string, body io.Reader, bodySize int64) error {
+	storedEncoding := signEncodingPrefix + s.current + ":" + encoding
+	if body == nil {
+		body = bytes.NewReader(nil)
+	}
+	signed := &signingReader{
+		src:       body,
+		hash:      sha256.New(),
+		remaining: bodySize,
+		sign: func(bodyHash []byte) []byte {
+			return signature(s.keys[s.current], actionID, outputID, storedEncoding, bodyHash)
+		},
+	}
+	return s.backend.Put(ctx, actionID, outputID, storedEncoding, signed, bodySize+signatureSize)
+}
+
+// Has passes through to the underlying backend. It can't verify the object,
+// so a later Get may still be a miss.
+func (s *Sign) Has(ctx context.Context, actionID []byte) (bool, error) {
+	return s.backend.Has(ctx, actionID)
+}
+
+// Get retrieves an object. Its signature is verified once the body has been
+// read to EOF.
+func (s *Sign) Get(ctx context.Context, actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, string, bool, error) {
+	outputID, body, size, putTime, storedEncoding, miss, err := s.backend.Get(ctx, actionID)
+	if err != nil || miss {
+		return nil, nil, 0, nil, "", true, err
+	}
+
+	reject := func(counter *atomic.Int64) ([]byte, io.ReadCloser, int64, *time.Time, string, bool, error) {
+		body.Close()
+		counter.Add(1)
+		return nil, nil, 0, nil, "", true, nil
+	}
+
+	rest, ok := strings.CutPrefix(storedEncoding, signEncodingPrefix)
+	if !ok {
+		return reject(&s.unsigned)
+	}
+	keyID, encoding, ok := strings.Cut(rest, ":")
+	if !ok {
+		return reject(&s.badSignatures)
+	}
+	key, ok := s.keys[keyID]
+	if !ok {
+		return reject(&s.unknownKeys)
+	}
+	if size < signatureSize {
+		return reject(&s.badSignatures)
+	}
+
+	verified := &verifyingReader{
+		src:       body,
+		hash:      sha256.New(),
+		remaining: size - signatureSize,
+		expected: func(bodyHash []byte) []byte {
+			return signature(key, actionID, outputID, storedEncoding, bodyHash)
+		},
+		badSignatures: &s.badSignatures,
+	}
+	return outputID, verified, size - signatureSize, putTime, encoding, false, nil
+}
+
+// Touch passes through to the underlying backend.
+func (s *Sign) Touch(ctx context.Context, actionID []byte) error {
+	return s.backend.Touch(ctx, actionID)
+}
+
+// Close closes the underlying backend.
+func (s *Sign) Close() error {
+	return s.backend.Close()
+}
+
+// Clear clears the underlying backend.
+func (s *Sign) Clear(ctx context.Context) error {
+	return s.backend.Clear(ctx)
+}
+
+// Stats returns signing statistics.
+func (s *Sign) Stats() SignStats {
+	return SignStats{
+		CurrentKeyID:  s.current,
+		Unsigned:      s.unsigned.Load(),
+		BadSignatures: s.badSignatures.Load(),
+		UnknownKeys:   s.unknownKeys.Load(),
+	}
+}
+
+// SignStats holds statistics for the signing wrapper.
+type SignStats struct {
+	CurrentKeyID  string
+	Unsigned      int64
+	BadSignatures int64
+	UnknownKeys   int64
+}
+
+// Rejected returns the total number of objects rejected for any reason.
+func (s SignStats) Rejected() int64 {
+	return s.Unsigned + s.BadSignatures + s.UnknownKeys
+}
+
+// signature returns the HMAC-SHA256 of an object. Each variable-length field
+// is length-prefixed so that no two objects sign the same message.
+func signature(key, actionID, outputID []byte, storedEncoding string, bodyHash []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, field := range [][]byte{actionID, outputID, []byte(storedEncoding)} {
+		mac.Write(binary.BigEndian.AppendUint32(nil, uint32(len(field))))
+		mac.Write(field)
+	}
+	mac.Write(bodyHash)
+	return mac.Sum(nil)
+}
+
+// signingReader passes src through and appends the signature of its contents
+// once remaining bytes have been read.
+type signingReader struct {
+	src       io.Reader
+	hash      hash.Hash
+	remaining int64 // Body bytes not yet read from src
+	sign      func(bodyHash []byte) []byte
+	trailer   []byte // Signature bytes not yet returned
+	signed    bool
+}
+
+func (r *signingReader) Read(p []byte) (int, error) {
+	if r.remaining > 0 {
+		if int64(len(p)) > r.remaining {
+			p = p[:r.remaining]
+		}
+		n, err := r.src.Read(p)
+		r.hash.Write(p[:n])
+		r.remaining -= int64(n)
+		if errors.Is(err, io.EOF) && r.remaining > 0 {
+			return n, fmt.Errorf("body shorter than its size")
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return n, err
+		}
+		return n, nil
+	}
+	if !r.signed {
+		r.trailer = r.sign(r.hash.Sum(nil))
+		r.signed = true
+	}
+	if len(r.trailer) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.trailer)
+	r.trailer = r.trailer[n:]
+	return n, nil
+}
+
+// verifyingReader passes through the first remaining bytes of src, then reads
+// the signature trailer and checks it. A mismatch, or a body that ends early,
+// fails every further read with ErrBadSignature.
+type verifyingReader struct {
+	src           io.ReadCloser
+	hash          hash.Hash
+	remaining     int64 // Body bytes not yet read from src
+	expected      func(bodyHash []byte) []byte
+	err           error
+	badSignatures *atomic.Int64
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.remaining > 0 {
+		if int64(len(p)) > r.remaining {
+			p = p[:r.remaining]
+		}
+		n, err := r.src.Read(p)
+		r.hash.Write(p[:n])
+		r.remaining -= int64(n)
+		if errors.Is(err, io.EOF) && r.remaining > 0 {
+			return n, r.fail(fmt.Errorf("%w: body ended early", ErrBadSignature))
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return n, err
+		}
+		return n, nil
+	}
+
+	trailer := make([]byte, signatureSize)
+	if _, err := io.ReadFull(r.src, trailer); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return 0, r.fail(fmt.Errorf("%w: signature missing", ErrBadSignature))
+		}
+		return 0, err
+	}
+	if !hmac.Equal(trailer, r.expected(r.hash.Sum(nil))) {
+		return 0, r.fail(ErrBadSignature)
+	}
+	r.err = io.EOF
+	return 0, io.EOF
+}
+
+// fail records err as the reader's permanent error.
+func (r *verifyingReader) fail(err error) error {
+	r.err = err
+	r.badSignatures.Add(1)
+	return err
+}
+
+// Close closes the underlying body.
+func (r *verifyingReader) Close() error {
+	return r.src.Close()
+}
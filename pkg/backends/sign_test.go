@@ -0,0 +1,179 @@
+package backends
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func testSigningKey(id string, b byte) SigningKey {
+	return SigningKey{ID: id, Key: bytes.Repeat([]byte{b}, 32)}
+}
+
+func TestSign_RoundTrip(t *testing.T) {
+	fs, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	s, err := NewSign(fs, []SigningKey{testSigningKey("s1", 1)})
+	if err != nil {
+		t.Fatalf("failed to create sign backend: %v", err)
+	}
+
+	for _, size := range []int{0, 11, 100 << 10} {
+		body := bytes.Repeat([]byte("s"), size)
+		if err := s.Put(t.Context(), []byte("action"), []byte("output"), "zstd", bytes.NewReader(body), int64(size)); err != nil {
+			t.Fatalf("size %d: unexpected Put error: %v", size, err)
+		}
+
+		_, _, storedSize, _, storedEncoding, _, err := fs.Get(t.Context(), []byte("action"))
+		if err != nil {
+			t.Fatalf("size %d: unexpected Get error: %v", size, err)
+		}
+		if storedSize != int64(size)+signatureSize || storedEncoding != "hmac:s1:zstd" {
+			t.Fatalf("size %d: unexpected stored object: size=%d encoding=%q", size, storedSize, storedEncoding)
+		}
+
+		outputID, got, gotSize, _, encoding, miss, err := s.Get(t.Context(), []byte("action"))
+		if err != nil || miss {
+			t.Fatalf("size %d: expected hit, miss=%v err=%v", size, miss, err)
+		}
+		data, err := io.ReadAll(got)
+		got.Close()
+		if err != nil {
+			t.Fatalf("size %d: failed to read body: %v", size, err)
+		}
+		if string(outputID) != "output" || gotSize != int64(size) || encoding != "zstd" || !bytes.Equal(data, body) {
+			t.Fatalf("size %d: unexpected object: outputID=%q size=%d encoding=%q", size, outputID, gotSize, encoding)
+		}
+	}
+	if stats := s.Stats(); stats.Rejected() != 0 {
+		t.Fatalf("expected no rejects, got %+v", stats)
+	}
+}
+
+func TestSign_KeyRotation(t *testing.T) {
+	fs, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	old, err := NewSign(fs, []SigningKey{testSigningKey("s1", 1)})
+	if err != nil {
+		t.Fatalf("failed to create sign backend: %v", err)
+	}
+	if err := old.Put(t.Context(), []byte("action"), []byte("output"), "", strings.NewReader("hello"), 5); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+
+	// The new key signs, while the old one still verifies.
+	rotated, err := NewSign(fs, []SigningKey{testSigningKey("s2", 2), testSigningKey("s1", 1)})
+	if err != nil {
+		t.Fatalf("failed to create sign backend: %v", err)
+	}
+	_, body, _, _, _, miss, err := rotated.Get(t.Context(), []byte("action"))
+	if err != nil || miss {
+		t.Fatalf("expected hit with the old key, miss=%v err=%v", miss, err)
+	}
+	if _, err := io.ReadAll(body); err != nil {
+		t.Fatalf("expected valid signature, got %v", err)
+	}
+	body.Close()
+
+	if err := rotated.Put(t.Context(), []byte("action"), []byte("output"), "", strings.NewReader("hello"), 5); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+	_, _, _, _, _, miss, err = old.Get(t.Context(), []byte("action"))
+	if err != nil || !miss {
+		t.Fatalf("expected miss for an unknown key, miss=%v err=%v", miss, err)
+	}
+	if stats := old.Stats(); stats.UnknownKeys != 1 {
+		t.Fatalf("expected 1 unknown key, got %+v", stats)
+	}
+}
+
+func TestSign_RejectsUnsigned(t *testing.T) {
+	fs, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	s, err := NewSign(fs, []SigningKey{testSigningKey("s1", 1)})
+	if err != nil {
+		t.Fatalf("failed to create sign backend: %v", err)
+	}
+
+	if err := fs.Put(t.Context(), []byte("action"), []byte("output"), "none", strings.NewReader("hello"), 5); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+	_, _, _, _, _, miss, err := s.Get(t.Context(), []byte("action"))
+	if err != nil || !miss {
+		t.Fatalf("expected miss for an unsigned object, miss=%v err=%v", miss, err)
+	}
+	if stats := s.Stats(); stats.Unsigned != 1 || stats.Rejected() != 1 {
+		t.Fatalf("expected 1 unsigned object, got %+v", stats)
+	}
+}
+
+func TestSign_RejectsForgeries(t *testing.T) {
+	fs, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	s, err := NewSign(fs, []SigningKey{testSigningKey("s1", 1)})
+	if err != nil {
+		t.Fatalf("failed to create sign backend: %v", err)
+	}
+	if err := s.Put(t.Context(), []byte("action"), []byte("output"), "", strings.NewReader("hello"), 5); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+	outputID, stored, size, _, encoding, _, err := fs.Get(t.Context(), []byte("action"))
+	if err != nil {
+		t.Fatalf("unexpected Get error: %v", err)
+	}
+	data, _ := io.ReadAll(stored)
+	stored.Close()
+
+	// An attacker without the key can plant an object under the same key ID,
+	// copy a signed object to another action, or change its output ID or body.
+	evil := []byte("evil!")
+	evilHash := sha256.Sum256(evil)
+	planted := append(evil, signature(testSigningKey("s1", 9).Key, []byte("planted"), outputID, encoding, evilHash[:])...)
+	tampered := bytes.Clone(data)
+	tampered[0] ^= 1
+
+	for _, obj := range []struct {
+		actionID, outputID string
+		data               []byte
+	}{
+		{"planted", string(outputID), planted},
+		{"copied", string(outputID), data},
+		{"relabelled", "other", data},
+		{"tampered", string(outputID), tampered},
+	} {
+		if err := fs.Put(t.Context(), []byte(obj.actionID), []byte(obj.outputID), encoding, bytes.NewReader(obj.data), size); err != nil {
+			t.Fatalf("%s: unexpected Put error: %v", obj.actionID, err)
+		}
+		_, body, _, _, _, miss, err := s.Get(t.Context(), []byte(obj.actionID))
+		if err != nil || miss {
+			t.Fatalf("%s: expected hit before the body is read, miss=%v err=%v", obj.actionID, miss, err)
+		}
+		if _, err := io.ReadAll(body); !errors.Is(err, ErrBadSignature) {
+			t.Fatalf("%s: expected ErrBadSignature, got %v", obj.actionID, err)
+		}
+		body.Close()
+	}
+	if stats := s.Stats(); stats.BadSignatures != 4 {
+		t.Fatalf("expected 4 bad signatures, got %+v", stats)
+	}
+}
+
+func TestNewSign_RejectsShortKeys(t *testing.T) {
+	if _, err := NewSign(NewNoop(), []SigningKey{{ID: "s1", Key: []byte("short")}}); err == nil {
+		t.Fatal("expected error for a 5-byte key")
+	}
+	if _, err := NewSign(NewNoop(), []SigningKey{testSigningKey("s1", 1), testSigningKey("s1", 2)}); err == nil {
+		t.Fatal("expected error for duplicate key IDs")
+	}
+}
@@ -0,0 +1,116 @@
+package backends
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// DefaultSpoolThreshold is the number of bytes a Spool keeps in memory before
+// spilling to a temporary file.
+const DefaultSpoolThreshold = 1 << 20
+
+// Spool is an io.Writer that buffers data in memory up to a threshold and
+// spills anything larger to a temporary file. It lets the PUT path hold on to
+// arbitrarily large bodies (e.g. to replay them, or to learn their compressed
+// size before uploading) with bounded memory.
+//
+// A Spool is not safe for concurrent writes, but once writing is finished any
+// number of readers returned by Reader may be used concurrently. Close must be
+// called to remove the temporary file.
+type Spool struct {
+	dir       string
+	threshold int
+
+	buf  bytes.Buffer
+	file *os.File
+	size int64
+}
+
+// NewSpool creates a new spool that spills to a temporary file in dir (or the
+// default temp directory if dir is empty) once more than threshold bytes have
+// been written.
+func NewSpool(dir string, threshold int) *Spool {
+	return &Spool{dir: dir, threshold: threshold}
+}
+
+// Write appends p to the spool.
+func (s *Spool) Write(p []byte) (int, error) {
+	if s.file == nil && s.buf.Len()+len(p) > s.threshold {
+		file, err := os.CreateTemp(s.dir, ".spool-*.tmp")
+		if err != nil {
+			return 0, fmt.Errorf("failed to create spool file: %w", err)
+		}
+		s.file = file
+		if _, err := s.file.Write(s.buf.Bytes()); err != nil {
+			return 0, fmt.Errorf("failed to write spool file: %w", err)
+		}
+		s.buf = bytes.Buffer{}
+	}
+
+	var (
+		n   int
+		err error
+	)
+	if s.file != nil {
+		n, err = s.file.Write(p)
+	} else {
+		n, err = s.buf.Write(p)
+	}
+	s.size += int64(n)
+	return n, err
+}
+
+// Size returns the number of bytes written to the spool.
+func (s *Spool) Size() int64 {
+	return s.size
+}
+
+// Reader returns a new reader over everything written to the spool so far.
+// Each call returns an independent reader positioned at the start.
+func (s *Spool) Reader() *io.SectionReader {
+	if s.file != nil {
+		return io.NewSectionReader(s.file, 0, s.size)
+	}
+	return io.NewSectionReader(bytes.NewReader(s.buf.Bytes()), 0, s.size)
+}
+
+// Body returns a reader over everything written to the spool, like Reader,
+// that also lets whoever consumes it take the spool over (see SpoolBody).
+func (s *Spool) Body() *SpoolBody {
+	return &SpoolBody{SectionReader: s.Reader(), spool: s}
+}
+
+// SpoolBody is a Put body backed by a Spool. Backends that need the body after
+// Put returns, such as AsyncBackendWriter, take the spool over with Take
+// rather than copying the body.
+type SpoolBody struct {
+	*io.SectionReader
+	spool *Spool
+}
+
+// Take moves the spool's contents to a new Spool, which the caller must
+// Close. The original spool is left empty, so closing it no longer removes
+// them.
+func (b *SpoolBody) Take() *Spool {
+	taken := &Spool{}
+	*taken = *b.spool
+	*b.spool = Spool{dir: taken.dir, threshold: taken.threshold}
+	return taken
+}
+
+// Close releases the spool's memory and removes its temporary file, if any.
+func (s *Spool) Close() error {
+	s.buf = bytes.Buffer{}
+	if s.file == nil {
+		return nil
+	}
+	name := s.file.Name()
+	closeErr := s.file.Close()
+	s.file = nil
+	if err := os.Remove(name); err != nil {
+		return fmt.Errorf("failed to remove spool file: %w", err)
+	}
+	return closeErr
+}
@@ -0,0 +1,83 @@
+package backends
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestSpool_StaysInMemoryBelowThreshold(t *testing.T) {
+	dir := t.TempDir()
+	spool := NewSpool(dir, 16)
+	defer spool.Close()
+
+	if _, err := spool.Write([]byte("small")); err != nil {
+		t.Fatalf("unexpected Write error: %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("expected no spool file, found %d", len(entries))
+	}
+
+	data, _ := io.ReadAll(spool.Reader())
+	if string(data) != "small" || spool.Size() != 5 {
+		t.Fatalf("unexpected contents %q (size %d)", data, spool.Size())
+	}
+}
+
+func TestSpool_SpillsToFile(t *testing.T) {
+	dir := t.TempDir()
+	spool := NewSpool(dir, 16)
+
+	expected := bytes.Repeat([]byte("0123456789"), 10)
+	for i := 0; i < len(expected); i += 7 {
+		if _, err := spool.Write(expected[i:min(i+7, len(expected))]); err != nil {
+			t.Fatalf("unexpected Write error: %v", err)
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("expected one spool file, found %d", len(entries))
+	}
+
+	// Readers are independent of each other.
+	first, second := spool.Reader(), spool.Reader()
+	for _, r := range []io.Reader{first, second} {
+		data, err := io.ReadAll(r)
+		if err != nil || !bytes.Equal(data, expected) {
+			t.Fatalf("unexpected contents (err=%v)", err)
+		}
+	}
+
+	if err := spool.Close(); err != nil {
+		t.Fatalf("unexpected Close error: %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("expected spool file to be removed, found %d", len(entries))
+	}
+}
+
+func TestSpoolBody_Take(t *testing.T) {
+	dir := t.TempDir()
+	spool := NewSpool(dir, 16)
+	expected := bytes.Repeat([]byte("x"), 100)
+	if _, err := spool.Write(expected); err != nil {
+		t.Fatalf("unexpected Write error: %v", err)
+	}
+
+	taken := spool.Body().Take()
+	// The original owner's Close no longer removes the spooled data.
+	if err := spool.Close(); err != nil {
+		t.Fatalf("unexpected Close error: %v", err)
+	}
+	data, err := io.ReadAll(taken.Reader())
+	if err != nil || !bytes.Equal(data, expected) {
+		t.Fatalf("unexpected contents (err=%v)", err)
+	}
+
+	if err := taken.Close(); err != nil {
+		t.Fatalf("unexpected Close error: %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("expected spool file to be removed, found %d", len(entries))
+	}
+}
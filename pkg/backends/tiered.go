@@ -0,0 +1,399 @@
+package backends
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TierWritePolicy controls how Put and back-fill writes reach a tier.
+type TierWritePolicy int
+
+const (
+	// WriteThrough writes to the tier synchronously; a failure fails the Put.
+	WriteThrough TierWritePolicy = iota
+	// WriteBack writes to the tier in the background; failures are logged and counted.
+	WriteBack
+)
+
+// String returns the policy name as used in tier specs.
+func (p TierWritePolicy) String() string {
+	switch p {
+	case WriteBack:
+		return "back"
+	default:
+		return "through"
+	}
+}
+
+// Tier is a single level of a Tiered backend.
+type Tier struct {
+	Name    string
+	Backend Backend
+	Policy  TierWritePolicy
+}
+
+// Tiered composes an ordered list of backends, fastest first (e.g. shared
+// filesystem -> S3 Express -> regular S3).
+//
+// Get tries each tier in order and, on a hit from a slower tier, back-fills all
+// faster tiers so subsequent reads are served closer to the caller. Put writes
+// to every tier according to that tier's write policy. This allows a small, hot
+// near cache to sit in front of a cheaper long-tail store.
+type Tiered struct {
+	tiers    []Tier
+	spoolDir string
+	logger   *slog.Logger
+	wg       sync.WaitGroup
+
+	// Stats
+	hits            []atomic.Int64 // Hits per tier
+	backfills       atomic.Int64
+	backfillErrors  atomic.Int64
+	writeBackErrors atomic.Int64
+}
+
+// NewTiered creates a new tiered backend. tiers must be ordered fastest first.
+// Bodies replayed to several tiers are spooled to temporary files in spoolDir
+// (or the default temp directory if it's empty) once they're too large to
+// hold in memory.
+func NewTiered(tiers []Tier, spoolDir string, logger *slog.Logger) (*Tiered, error) {
+	if len(tiers) == 0 {
+		return nil, fmt.Errorf("tiered backend requires at least one tier")
+	}
+	return &Tiered{
+		tiers:    tiers,
+		spoolDir: spoolDir,
+		logger:   logger,
+		hits:     make([]atomic.Int64, len(tiers)),
+	}, nil
+}
+
+// Tiers returns the configured tiers, fastest first.
+func (t *Tiered) Tiers() []Tier {
+	return t.tiers
+}
+
+// Put writes the object to every tier. Write-through tiers are written
+// synchronously in order and any failure is returned; write-back tiers are
+// written in the background.
+func (t *Tiered) Put(ctx context.Context, actionID, outputID []byte, encoding string, body io.Reader, bodySize int64) error {
+	// The body has to be replayed once per tier.
+	spool := NewSpool(t.spoolDir, DefaultSpoolThreshold)
+	if body != nil {
+		if _, err := io.Copy(spool, body); err != nil {
+			spool.Close()
+			return fmt.Errorf("failed to read body: %w", err)
+		}
+	}
+
+	var (
+		errs       []error
+		writeBacks sync.WaitGroup
+	)
+	for i := range t.tiers {
+		tier := &t.tiers[i]
+		if tier.Policy == WriteBack {
+			t.writeBack(ctx, tier, actionID, outputID, encoding, spool.Reader(), bodySize, &t.writeBackErrors, &writeBacks)
+			continue
+		}
+		if err := tier.Backend.Put(ctx, actionID, outputID, encoding, spool.Reader(), bodySize); err != nil {
+			errs = append(errs, fmt.Errorf("tier %s: %w", tier.Name, err))
+		}
+	}
+
+	// Release the spool once every background write has finished reading it.
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		writeBacks.Wait()
+		spool.Close()
+	}()
+
+	return errors.Join(errs...)
+}
+
+// Has reports whether any tier has the object.
+func (t *Tiered) Has(ctx context.Context, actionID []byte) (bool, error) {
+	var errs []error
+	for i := range t.tiers {
+		exists, err := t.tiers[i].Backend.Has(ctx, actionID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("tier %s: %w", t.tiers[i].Name, err))
+			continue
+		}
+		if exists {
+			return true, nil
+		}
+	}
+	return false, errors.Join(errs...)
+}
+
+// Get tries each tier in order. An error from one tier is logged and the next
+// tier is tried; the errors are only returned if no tier produced a hit or a
+// clean miss. On a hit from a slower tier, the body is copied into a spool
+// (on disk if it's large) as the caller reads it. Once the caller has read it
+// to EOF, it's back-filled into every faster tier in the background; a body
+// that's closed early or fails isn't back-filled.
+func (t *Tiered) Get(ctx context.Context, actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, string, bool, error) {
+	var (
+		errs    []error
+		anyMiss bool
+	)
+	for i := range t.tiers {
+		tier := &t.tiers[i]
+		outputID, body, size, putTime, encoding, miss, err := tier.Backend.Get(ctx, actionID)
+		if err != nil {
+			t.logger.Warn("tiered backend GET failed, trying next tier",
+				"tier", tier.Name,
+				"actionID", fmt.Sprintf("%x", actionID[:min(8, len(actionID))]),
+				"error", err)
+			errs = append(errs, fmt.Errorf("tier %s: %w", tier.Name, err))
+			continue
+		}
+		if miss {
+			anyMiss = true
+			continue
+		}
+
+		t.hits[i].Add(1)
+		if i == 0 {
+			return outputID, body, size, putTime, encoding, false, nil
+		}
+
+		// The body has to be replayed once per faster tier, so keep a copy of
+		// it as the caller reads it.
+		actionID, outputID := bytes.Clone(actionID), bytes.Clone(outputID)
+		returned := &backfillingBody{
+			body:  body,
+			spool: NewSpool(t.spoolDir, DefaultSpoolThreshold),
+			size:  size,
+			backfill: func(spool *Spool) {
+				t.backfills.Add(1)
+				var backfills sync.WaitGroup
+				for j := range i {
+					t.writeBack(ctx, &t.tiers[j], actionID, outputID, encoding, spool.Reader(), size, &t.backfillErrors, &backfills)
+				}
+				t.wg.Add(1)
+				go func() {
+					defer t.wg.Done()
+					backfills.Wait()
+					spool.Close()
+				}()
+			},
+		}
+		return outputID, returned, size, putTime, encoding, false, nil
+	}
+
+	if anyMiss || len(errs) == 0 {
+		return nil, nil, 0, nil, "", true, nil
+	}
+	return nil, nil, 0, nil, "", true, errors.Join(errs...)
+}
+
+// Touch touches the object in every tier. Returns ErrTouchSkipped only if
+// every tier skipped the touch.
+func (t *Tiered) Touch(ctx context.Context, actionID []byte) error {
+	var (
+		errs    []error
+		skipped int
+	)
+	for i := range t.tiers {
+		err := t.tiers[i].Backend.Touch(ctx, actionID)
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrTouchSkipped):
+			skipped++
+		default:
+			errs = append(errs, fmt.Errorf("tier %s: %w", t.tiers[i].Name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	if skipped == len(t.tiers) {
+		return ErrTouchSkipped
+	}
+	return nil
+}
+
+// Close waits for background writes to finish and then closes every tier.
+func (t *Tiered) Close() error {
+	t.wg.Wait()
+
+	var errs []error
+	for i := range t.tiers {
+		if err := t.tiers[i].Backend.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("tier %s: %w", t.tiers[i].Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Clear clears every tier.
+func (t *Tiered) Clear(ctx context.Context) error {
+	var errs []error
+	for i := range t.tiers {
+		if err := t.tiers[i].Backend.Clear(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("tier %s: %w", t.tiers[i].Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Trim trims every tier that supports trimming. Tiers that don't are reported
+// as errors, but don't stop the remaining tiers from being trimmed.
+func (t *Tiered) Trim(ctx context.Context, cutoff time.Time) (TrimStats, error) {
+	var (
+		stats TrimStats
+		errs  []error
+	)
+	for i := range t.tiers {
+		trimmer, ok := t.tiers[i].Backend.(Trimmer)
+		if !ok {
+			errs = append(errs, fmt.Errorf("tier %s: trim not supported", t.tiers[i].Name))
+			continue
+		}
+		tierStats, err := trimmer.Trim(ctx, cutoff)
+		stats.Add(tierStats)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("tier %s: %w", t.tiers[i].Name, err))
+		}
+	}
+	return stats, errors.Join(errs...)
+}
+
+// Check checks every tier that supports checking, reporting keys prefixed with
+// the tier name. Tiers that don't are reported as errors, but don't stop the
+// remaining tiers from being checked.
+func (t *Tiered) Check(ctx context.Context, opts CheckOptions, report func(key, problem string)) (CheckStats, error) {
+	var (
+		stats CheckStats
+		errs  []error
+	)
+	for i := range t.tiers {
+		tier := &t.tiers[i]
+		checker, ok := tier.Backend.(Checker)
+		if !ok {
+			errs = append(errs, fmt.Errorf("tier %s: check not supported", tier.Name))
+			continue
+		}
+		tierStats, err := checker.Check(ctx, opts, func(key, problem string) {
+			report(tier.Name+":"+key, problem)
+		})
+		stats.Add(tierStats)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("tier %s: %w", tier.Name, err))
+		}
+	}
+	return stats, errors.Join(errs...)
+}
+
+// writeBack writes body to tier in the background, counting failures in
+// errCounter. If pending is non-nil it is marked done once the write finishes.
+// The write outlives the request that started it, so it isn't canceled with
+// ctx, but it keeps ctx's deadline.
+func (t *Tiered) writeBack(ctx context.Context, tier *Tier, actionID, outputID []byte, encoding string, body io.Reader, bodySize int64, errCounter *atomic.Int64, pending *sync.WaitGroup) {
+	// Copy IDs since we're going async
+	actionID = bytes.Clone(actionID)
+	outputID = bytes.Clone(outputID)
+	ctx, cancel := detach(ctx)
+
+	t.wg.Add(1)
+	if pending != nil {
+		pending.Add(1)
+	}
+	go func() {
+		defer t.wg.Done()
+		defer cancel()
+		if pending != nil {
+			defer pending.Done()
+		}
+		if err := tier.Backend.Put(ctx, actionID, outputID, encoding, body, bodySize); err != nil {
+			errCounter.Add(1)
+			t.logger.Warn("tiered backend background write failed",
+				"tier", tier.Name,
+				"actionID", fmt.Sprintf("%x", actionID[:min(8, len(actionID))]),
+				"error", err)
+		}
+	}()
+}
+
+// backfillingBody is a slower tier's body returned to the caller. It copies
+// the body into spool as it's read, and hands the spool to backfill once the
+// whole body has been read without error.
+type backfillingBody struct {
+	body     io.ReadCloser
+	spool    *Spool // nil once handed to backfill or abandoned
+	size     int64
+	backfill func(spool *Spool)
+}
+
+func (b *backfillingBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if b.spool == nil {
+		return n, err
+	}
+	if n > 0 {
+		if _, werr := b.spool.Write(p[:n]); werr != nil {
+			// The caller can still read the body; it just isn't back-filled.
+			b.abandon()
+			return n, err
+		}
+	}
+	switch {
+	case err == io.EOF && b.spool.Size() == b.size:
+		spool := b.spool
+		b.spool = nil
+		b.backfill(spool)
+	case err != nil:
+		b.abandon()
+	}
+	return n, err
+}
+
+// abandon drops the spool without back-filling it.
+func (b *backfillingBody) abandon() {
+	b.spool.Close()
+	b.spool = nil
+}
+
+// Close closes the body. A body closed before it was read to EOF isn't
+// back-filled.
+func (b *backfillingBody) Close() error {
+	if b.spool != nil {
+		b.abandon()
+	}
+	return b.body.Close()
+}
+
+// Stats returns hit and write counters for the tiered backend.
+func (t *Tiered) Stats() TieredStats {
+	stats := TieredStats{
+		TierNames:       make([]string, len(t.tiers)),
+		TierHits:        make([]int64, len(t.tiers)),
+		Backfills:       t.backfills.Load(),
+		BackfillErrors:  t.backfillErrors.Load(),
+		WriteBackErrors: t.writeBackErrors.Load(),
+	}
+	for i := range t.tiers {
+		stats.TierNames[i] = t.tiers[i].Name
+		stats.TierHits[i] = t.hits[i].Load()
+	}
+	return stats
+}
+
+// TieredStats holds statistics for the tiered backend.
+type TieredStats struct {
+	TierNames       []string
+	TierHits        []int64
+	Backfills       int64
+	BackfillErrors  int64
+	WriteBackErrors int64
+}
@@ -0,0 +1,281 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTiered_PutWritesAllTiers(t *testing.T) {
+	fast, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	slow, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	tiered, err := NewTiered([]Tier{
+		{Name: "fast", Backend: fast, Policy: WriteThrough},
+		{Name: "slow", Backend: slow, Policy: WriteBack},
+	}, "", slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("failed to create tiered backend: %v", err)
+	}
+
+	if err := tiered.Put(t.Context(), []byte("action"), []byte("output"), "", strings.NewReader("data"), 4); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+
+	// Write-through tier is populated synchronously.
+	if exists, _ := fast.Has(t.Context(), []byte("action")); !exists {
+		t.Fatal("expected write-through tier to have object immediately")
+	}
+
+	// Close waits for write-back tiers.
+	if err := tiered.Close(); err != nil {
+		t.Fatalf("unexpected Close error: %v", err)
+	}
+	if exists, _ := slow.Has(t.Context(), []byte("action")); !exists {
+		t.Fatal("expected write-back tier to have object after Close")
+	}
+}
+
+func TestTiered_GetBackfillsFasterTiers(t *testing.T) {
+	fast, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	mid, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	slow, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	tiered, err := NewTiered([]Tier{
+		{Name: "fast", Backend: fast, Policy: WriteThrough},
+		{Name: "mid", Backend: mid, Policy: WriteThrough},
+		{Name: "slow", Backend: slow, Policy: WriteThrough},
+	}, "", slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("failed to create tiered backend: %v", err)
+	}
+
+	// Only the slowest tier has the object.
+	if err := slow.Put(t.Context(), []byte("action"), []byte("output"), "", strings.NewReader("data"), 4); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+
+	outputID, body, size, _, _, miss, err := tiered.Get(t.Context(), []byte("action"))
+	if err != nil || miss {
+		t.Fatalf("expected hit, miss=%v err=%v", miss, err)
+	}
+	data, _ := io.ReadAll(body)
+	body.Close()
+	if string(outputID) != "output" || size != 4 || string(data) != "data" {
+		t.Fatalf("unexpected result: outputID=%s size=%d body=%s", outputID, size, data)
+	}
+
+	tiered.wg.Wait()
+	for i, fs := range []*FS{fast, mid} {
+		if exists, _ := fs.Has(t.Context(), []byte("action")); !exists {
+			t.Fatalf("expected tier %d to be back-filled", i)
+		}
+	}
+
+	stats := tiered.Stats()
+	if stats.TierHits[2] != 1 || stats.Backfills != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	// A second Get is served by the fastest tier.
+	_, body, _, _, _, _, _ = tiered.Get(t.Context(), []byte("action"))
+	body.Close()
+	if stats := tiered.Stats(); stats.TierHits[0] != 1 {
+		t.Fatalf("expected hit from fastest tier, got %+v", stats)
+	}
+}
+
+func TestTiered_GetBackfillsLargeBodies(t *testing.T) {
+	fast, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	slow, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	tiered, err := NewTiered([]Tier{
+		{Name: "fast", Backend: fast, Policy: WriteThrough},
+		{Name: "slow", Backend: slow, Policy: WriteThrough},
+	}, "", slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("failed to create tiered backend: %v", err)
+	}
+
+	// Larger than the spool keeps in memory, so it's spooled to disk.
+	want := strings.Repeat("x", 2*DefaultSpoolThreshold)
+	if err := slow.Put(t.Context(), []byte("action"), []byte("output"), "", strings.NewReader(want), int64(len(want))); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+
+	_, body, _, _, _, miss, err := tiered.Get(t.Context(), []byte("action"))
+	if err != nil || miss {
+		t.Fatalf("expected hit, miss=%v err=%v", miss, err)
+	}
+	data, err := io.ReadAll(body)
+	body.Close()
+	if err != nil || string(data) != want {
+		t.Fatalf("unexpected body: %d bytes, err=%v", len(data), err)
+	}
+	tiered.wg.Wait()
+
+	_, body, _, _, _, miss, err = fast.Get(t.Context(), []byte("action"))
+	if err != nil || miss {
+		t.Fatalf("expected fastest tier to be back-filled, miss=%v err=%v", miss, err)
+	}
+	data, _ = io.ReadAll(body)
+	body.Close()
+	if string(data) != want {
+		t.Fatalf("unexpected back-filled body: %d bytes", len(data))
+	}
+}
+
+func TestTiered_GetSkipsBackfillOfUnreadBody(t *testing.T) {
+	fast, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	slow, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	tiered, err := NewTiered([]Tier{
+		{Name: "fast", Backend: fast, Policy: WriteThrough},
+		{Name: "slow", Backend: slow, Policy: WriteThrough},
+	}, "", slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("failed to create tiered backend: %v", err)
+	}
+	if err := slow.Put(t.Context(), []byte("action"), []byte("output"), "", strings.NewReader("data"), 4); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+
+	// Nothing is back-filled until the caller has read the whole body.
+	_, body, _, _, _, miss, err := tiered.Get(t.Context(), []byte("action"))
+	if err != nil || miss {
+		t.Fatalf("expected hit, miss=%v err=%v", miss, err)
+	}
+	if _, err := body.Read(make([]byte, 2)); err != nil {
+		t.Fatalf("unexpected Read error: %v", err)
+	}
+	tiered.wg.Wait()
+	if exists, _ := fast.Has(t.Context(), []byte("action")); exists {
+		t.Fatal("expected no back-fill before EOF")
+	}
+
+	// A body closed early isn't back-filled at all.
+	body.Close()
+	tiered.wg.Wait()
+	if exists, _ := fast.Has(t.Context(), []byte("action")); exists {
+		t.Fatal("expected no back-fill of a body closed early")
+	}
+	if stats := tiered.Stats(); stats.Backfills != 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+// failingBackend fails every Get.
+type failingBackend struct{ mockBackend }
+
+func (f *failingBackend) Get(ctx context.Context, actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, string, bool, error) {
+	return nil, nil, 0, nil, "", true, errors.New("boom")
+}
+
+func TestTiered_GetSkipsFailingTier(t *testing.T) {
+	fs, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	if err := fs.Put(t.Context(), []byte("action"), []byte("output"), "", strings.NewReader("data"), 4); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+
+	tiered, err := NewTiered([]Tier{
+		{Name: "broken", Backend: &failingBackend{}},
+		{Name: "fs", Backend: fs},
+	}, "", slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("failed to create tiered backend: %v", err)
+	}
+
+	_, body, _, _, _, miss, err := tiered.Get(t.Context(), []byte("action"))
+	if err != nil || miss {
+		t.Fatalf("expected hit from second tier, miss=%v err=%v", miss, err)
+	}
+	body.Close()
+
+	// If every tier fails, the error is surfaced.
+	allBroken, _ := NewTiered([]Tier{{Name: "broken", Backend: &failingBackend{}}}, "",
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if _, _, _, _, _, _, err := allBroken.Get(t.Context(), []byte("action")); err == nil {
+		t.Fatal("expected error when every tier fails")
+	}
+}
+
+func TestTiered_TouchSkippedOnlyWhenAllSkip(t *testing.T) {
+	skipper := &mockTouchBackend{err: ErrTouchSkipped}
+	toucher := &mockTouchBackend{}
+
+	tiered, _ := NewTiered([]Tier{{Name: "a", Backend: skipper}, {Name: "b", Backend: toucher}}, "",
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err := tiered.Touch(t.Context(), []byte("action")); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	allSkip, _ := NewTiered([]Tier{{Name: "a", Backend: skipper}}, "",
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err := allSkip.Touch(t.Context(), []byte("action")); !errors.Is(err, ErrTouchSkipped) {
+		t.Fatalf("expected ErrTouchSkipped, got %v", err)
+	}
+}
+
+// mockTouchBackend returns a fixed error from Touch.
+type mockTouchBackend struct {
+	mockBackend
+	err error
+}
+
+func (m *mockTouchBackend) Touch(ctx context.Context, actionID []byte) error {
+	return m.err
+}
+
+func TestTiered_TrimSkipsUnsupportedTiers(t *testing.T) {
+	fs, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	if err := fs.Put(t.Context(), []byte("action"), []byte("output"), "", strings.NewReader("data"), 4); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+
+	tiered, _ := NewTiered([]Tier{
+		// Embedding the interface hides Noop's Trim method.
+		{Name: "untrimmable", Backend: struct{ Backend }{NewNoop()}},
+		{Name: "fs", Backend: fs},
+	}, "", slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	stats, err := tiered.Trim(t.Context(), time.Now().Add(time.Hour))
+	if err == nil {
+		t.Fatal("expected error for tier without trim support")
+	}
+	if stats.Deleted != 1 {
+		t.Fatalf("expected remaining tiers to be trimmed, got %+v", stats)
+	}
+}
@@ -55,10 +55,10 @@ func (g *FSLockGroup) DoWithLock(key string, fn func() (interface{}, error)) (v
 	defer cc()
 	acquired, err := fileLock.TryLockContext(ctx, 10*time.Millisecond)
 	if err != nil {
-		return nil, fmt.Errorf("failed to acquire lock: %w", err)
+		return nil, fmt.Errorf("%w: %w", ErrLockNotAcquired, err)
 	}
 	if !acquired {
-		return nil, fmt.Errorf("failed to acquire lock: timeout")
+		return nil, fmt.Errorf("%w: timeout", ErrLockNotAcquired)
 	}
 	defer func() { _ = fileLock.Unlock() }()
 
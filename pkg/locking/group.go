@@ -1,5 +1,11 @@
 package locking
 
+import "errors"
+
+// ErrLockNotAcquired is returned by DoWithLock when the lock couldn't be
+// acquired in time. The function isn't run.
+var ErrLockNotAcquired = errors.New("failed to acquire lock")
+
 // locking.Group is an abstraction for running functions with mutual exclusion
 // over sets of keys.
 type Group interface {
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// A prefetch manifest lists the action IDs a build got a hit for or stored, in
+// the order it first asked for them. It's stored in the backend under the name
+// given with -prefetch-manifest (e.g. the repository and branch) when the go
+// command closes the cache. The next build with the same name fetches every
+// output the manifest lists into the local cache in the background at startup,
+// so that most of its GETs are local hits rather than backend round trips.
+const manifestKeyPrefix = "manifest/"
+
+// defaultPrefetchConcurrency is how many outputs are prefetched at once if
+// PrefetchConcurrency isn't set.
+const defaultPrefetchConcurrency = 16
+
+// manifestKey returns the backend key of the manifest with the given name.
+// Names are hashed, since they're chosen by users and may contain anything.
+func manifestKey(name string) []byte {
+	sum := sha256.Sum256([]byte(name))
+	return []byte(manifestKeyPrefix + hex.EncodeToString(sum[:]))
+}
+
+// prefetcher records this build's manifest and prefetches the previous one.
+type prefetcher struct {
+	name     string
+	workers  int
+	stopping context.Context // Done once no more prefetches should start
+	stop     context.CancelFunc
+	done     chan struct{} // Closed once the last prefetch has finished
+
+	mu         sync.Mutex
+	seen       map[string]struct{}
+	order      [][]byte
+	prefetched map[string]struct{}      // Prefetched outputs no GET has used yet
+	fetching   map[string]chan struct{} // Prefetches in flight, closed once done
+	getting    map[string]int           // GETs in flight per action ID
+
+	// Stats
+	fetched atomic.Int64 // Outputs fetched into the local cache
+	used    atomic.Int64 // GETs served from a prefetched output
+	failed  atomic.Int64 // Prefetches that returned an error
+}
+
+func newPrefetcher(name string, workers int) *prefetcher {
+	if workers <= 0 {
+		workers = defaultPrefetchConcurrency
+	}
+	stopping, stop := context.WithCancel(context.Background())
+	return &prefetcher{
+		name:       name,
+		workers:    workers,
+		stopping:   stopping,
+		stop:       stop,
+		done:       make(chan struct{}),
+		seen:       make(map[string]struct{}),
+		prefetched: make(map[string]struct{}),
+		fetching:   make(map[string]chan struct{}),
+		getting:    make(map[string]int),
+	}
+}
+
+// record adds actionID to this build's manifest, unless it's already in it.
+func (p *prefetcher) record(actionID []byte) {
+	key := string(actionID)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.seen[key]; ok {
+		return
+	}
+	p.seen[key] = struct{}{}
+	p.order = append(p.order, bytes.Clone(actionID))
+}
+
+// markPrefetched records that actionID's output was prefetched.
+func (p *prefetcher) markPrefetched(actionID []byte) {
+	p.fetched.Add(1)
+	p.mu.Lock()
+	p.prefetched[string(actionID)] = struct{}{}
+	p.mu.Unlock()
+}
+
+// markUsed counts a local cache hit on actionID if its output was prefetched.
+func (p *prefetcher) markUsed(actionID []byte) {
+	key := string(actionID)
+	p.mu.Lock()
+	_, ok := p.prefetched[key]
+	delete(p.prefetched, key)
+	p.mu.Unlock()
+	if ok {
+		p.used.Add(1)
+	}
+}
+
+// startFetch reports whether actionID may be prefetched now. It can't while a
+// GET for it is in flight: the GET fetches it anyway, and the prefetch would
+// only contend with it for the action's lock. Otherwise, GETs of actionID wait
+// for the prefetch until the returned function is called.
+func (p *prefetcher) startFetch(actionID []byte) (func(), bool) {
+	key := string(actionID)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.fetching[key]; ok || p.getting[key] > 0 {
+		return nil, false
+	}
+	done := make(chan struct{})
+	p.fetching[key] = done
+	return func() {
+		p.mu.Lock()
+		delete(p.fetching, key)
+		p.mu.Unlock()
+		close(done)
+	}, true
+}
+
+// startGet waits for any prefetch of actionID in flight, so that the GET
+// doesn't time out waiting for the action's lock while the prefetch downloads
+// the output, and keeps new prefetches of it from starting until the returned
+// function is called.
+func (p *prefetcher) startGet(actionID []byte) func() {
+	key := string(actionID)
+	p.mu.Lock()
+	done, fetching := p.fetching[key]
+	p.getting[key]++
+	p.mu.Unlock()
+	if fetching {
+		<-done
+	}
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.getting[key]--; p.getting[key] == 0 {
+			delete(p.getting, key)
+		}
+	}
+}
+
+// manifest returns this build's manifest: one hex action ID per line.
+func (p *prefetcher) manifest() []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var buf bytes.Buffer
+	for _, actionID := range p.order {
+		buf.WriteString(hex.EncodeToString(actionID))
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// parseManifest returns the action IDs listed in a manifest.
+func parseManifest(data []byte) ([][]byte, error) {
+	var actionIDs [][]byte
+	for line := range strings.Lines(string(data)) {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		actionID, err := hex.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid action ID %q in manifest: %w", line, err)
+		}
+		actionIDs = append(actionIDs, actionID)
+	}
+	return actionIDs, nil
+}
+
+// runPrefetch fetches the previous build's manifest and prefetches the outputs
+// it lists, until they've all been fetched or stopPrefetch is called.
+func (cp *CacheProg) runPrefetch() {
+	p := cp.prefetch
+	defer close(p.done)
+
+	actionIDs, err := cp.fetchManifest()
+	if err != nil {
+		cp.logger.Warn("failed to load prefetch manifest, not prefetching", "manifest", p.name, "error", err)
+		return
+	}
+	cp.logger.Debug("prefetching outputs from manifest", "manifest", p.name, "count", len(actionIDs))
+
+	work := make(chan []byte)
+	var wg sync.WaitGroup
+	for range p.workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for actionID := range work {
+				cp.prefetchOutput(actionID)
+			}
+		}()
+	}
+
+dispatch:
+	for _, actionID := range actionIDs {
+		select {
+		case work <- actionID:
+		case <-p.stopping.Done():
+			break dispatch
+		}
+	}
+	close(work)
+	wg.Wait()
+}
+
+// fetchManifest reads the previous build's manifest from the backend,
+// returning nil if there isn't one.
+func (cp *CacheProg) fetchManifest() ([][]byte, error) {
+	ctx, cancel := cp.requestContext(cp.ctx, cp.getTimeout)
+	defer cancel()
+
+	_, body, _, _, encoding, miss, err := cp.backend.Get(ctx, manifestKey(cp.prefetch.name))
+	if err != nil {
+		return nil, err
+	}
+	if miss {
+		return nil, nil
+	}
+	defer body.Close()
+
+	decoded, _, err := newDecodingReader(body, encoding, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer decoded.Close()
+	data, err := io.ReadAll(decoded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	return parseManifest(data)
+}
+
+// prefetchOutput fetches actionID's output into the local cache, unless it's
+// there already or a GET is fetching it.
+func (cp *CacheProg) prefetchOutput(actionID []byte) {
+	done, ok := cp.prefetch.startFetch(actionID)
+	if !ok {
+		return
+	}
+	defer done()
+
+	v, err := cp.locker.DoWithLock(hex.EncodeToString(actionID), func() (interface{}, error) {
+		if cp.localCache.check(actionID) != nil {
+			return nil, nil
+		}
+		return cp.getFromBackend(cp.ctx, actionID)
+	})
+	if err != nil {
+		cp.prefetch.failed.Add(1)
+		cp.logger.Debug("prefetch failed", "actionID", hex.EncodeToString(actionID), "error", err)
+		return
+	}
+	if result, ok := v.(*getResult); ok && !result.miss {
+		cp.prefetch.markPrefetched(actionID)
+	}
+}
+
+// stopPrefetch stops starting new prefetches and waits for the ones in flight.
+func (cp *CacheProg) stopPrefetch() {
+	cp.prefetch.stop()
+	<-cp.prefetch.done
+}
+
+// storeManifest stops prefetching and stores this build's manifest for the
+// next build. A build that didn't hit or store anything (e.g. "go env") leaves
+// the previous manifest in place.
+func (cp *CacheProg) storeManifest() {
+	cp.stopPrefetch()
+
+	data := cp.prefetch.manifest()
+	if len(data) == 0 {
+		return
+	}
+	var compressed bytes.Buffer
+	if err := compressTo(&compressed, bytes.NewReader(data), codecZstd, 0, nil); err != nil {
+		cp.logger.Warn("failed to compress prefetch manifest", "manifest", cp.prefetch.name, "error", err)
+		return
+	}
+
+	ctx, cancel := cp.requestContext(cp.ctx, cp.putTimeout)
+	defer cancel()
+	sum := sha256.Sum256(data)
+	err := cp.backend.Put(ctx, manifestKey(cp.prefetch.name), sum[:], codecZstd.String(),
+		bytes.NewReader(compressed.Bytes()), int64(compressed.Len()))
+	if err != nil {
+		cp.logger.Warn("failed to store prefetch manifest", "manifest", cp.prefetch.name, "error", err)
+	}
+}
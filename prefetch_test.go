@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/gobuildcache/pkg/backends"
+	"github.com/richardartoul/gobuildcache/pkg/locking"
+)
+
+func TestParseManifest(t *testing.T) {
+	p := newPrefetcher("repo/main", 0)
+	for _, actionID := range [][]byte{{0x01, 0x02}, {0x03}, {0x01, 0x02}} {
+		p.record(actionID)
+	}
+	actionIDs, err := parseManifest(p.manifest())
+	if err != nil {
+		t.Fatalf("failed to parse manifest: %v", err)
+	}
+	if len(actionIDs) != 2 || !bytes.Equal(actionIDs[0], []byte{0x01, 0x02}) || !bytes.Equal(actionIDs[1], []byte{0x03}) {
+		t.Fatalf("expected each action ID once, in order, got %x", actionIDs)
+	}
+
+	if _, err := parseManifest([]byte("0102\nnot hex\n")); err == nil {
+		t.Fatal("expected error for a manifest with an invalid action ID")
+	}
+}
+
+func TestPrefetchPreviousBuild(t *testing.T) {
+	fs, err := backends.NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	opts := CacheProgOptions{Compression: "zstd", PrefetchManifest: "repo/main"}
+
+	// The first build finds no manifest, stores two outputs and records them.
+	first, err := NewCacheProg(fs, locking.NewMemLock(), t.TempDir(), opts)
+	if err != nil {
+		t.Fatalf("failed to create cache prog: %v", err)
+	}
+	for i, actionID := range [][]byte{{0x01}, {0x02}} {
+		body := bytes.Repeat([]byte{byte(i)}, 1000)
+		if _, err := first.handlePut(&Request{ID: int64(i), Command: CmdPut, ActionID: actionID,
+			OutputID: []byte{0x09}, Body: bytes.NewReader(body), BodySize: int64(len(body))}); err != nil {
+			t.Fatalf("handlePut failed: %v", err)
+		}
+	}
+	if _, err := first.handleRequest(&Request{ID: 3, Command: CmdClose}); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	if first.prefetch.fetched.Load() != 0 {
+		t.Fatalf("expected nothing to prefetch without a manifest, got %d", first.prefetch.fetched.Load())
+	}
+
+	// The second build, with an empty local cache, prefetches both.
+	second, err := NewCacheProg(fs, locking.NewMemLock(), t.TempDir(), opts)
+	if err != nil {
+		t.Fatalf("failed to create cache prog: %v", err)
+	}
+	<-second.prefetch.done
+	if got := second.prefetch.fetched.Load(); got != 2 {
+		t.Fatalf("expected 2 prefetched outputs, got %d", got)
+	}
+	resp, err := second.handleGet(&Request{ID: 1, Command: CmdGet, ActionID: []byte{0x02}})
+	if err != nil || resp.Miss {
+		t.Fatalf("expected hit, miss=%v err=%v", resp.Miss, err)
+	}
+	if second.localCacheHits.Load() != 1 || second.prefetch.used.Load() != 1 {
+		t.Fatalf("expected a local hit on a prefetched output, got %d local hits and %d used",
+			second.localCacheHits.Load(), second.prefetch.used.Load())
+	}
+}
+
+func TestPrefetchAndGetDoNotContend(t *testing.T) {
+	p := newPrefetcher("repo/main", 0)
+
+	// A key a GET is fetching isn't prefetched.
+	doneGet := p.startGet([]byte{0x01})
+	if _, ok := p.startFetch([]byte{0x01}); ok {
+		t.Fatal("expected no prefetch while a GET is in flight")
+	}
+	doneGet()
+
+	// A GET waits for the prefetch in flight.
+	doneFetch, ok := p.startFetch([]byte{0x01})
+	if !ok {
+		t.Fatal("expected prefetch to start")
+	}
+	got := make(chan struct{})
+	go func() {
+		p.startGet([]byte{0x01})()
+		close(got)
+	}()
+	select {
+	case <-got:
+		t.Fatal("expected GET to wait for the prefetch")
+	case <-time.After(20 * time.Millisecond):
+	}
+	doneFetch()
+	<-got
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
@@ -19,13 +20,15 @@ import (
 	"github.com/richardartoul/gobuildcache/pkg/backends"
 	"github.com/richardartoul/gobuildcache/pkg/locking"
 	"github.com/richardartoul/gobuildcache/pkg/metrics"
-
-	"github.com/pierrec/lz4/v4"
 )
 
 const (
 	// Bump this string whenever you make backwards-incompatible changes to the file format.
 	fileFormatVersion = "v2"
+
+	// hedgeMinSamples is the number of backend GETs needed before their p95
+	// latency is used to hedge slow ones.
+	hedgeMinSamples = 20
 )
 
 // Cmd represents a cache command type.
@@ -74,7 +77,8 @@ type CacheProg struct {
 	debug             bool
 	printStats        bool
 	printStatsMachine bool
-	compression       bool
+	compression       compressionConfig
+	dicts             *dictionaries
 	logger            *slog.Logger
 
 	// Latency tracking using DDSketch for quantile estimation.
@@ -113,6 +117,8 @@ type CacheProg struct {
 	compressionBytesOut   atomic.Int64 // Compressed bytes after compression
 	decompressionBytesIn  atomic.Int64 // Compressed bytes before decompression
 	decompressionBytesOut atomic.Int64 // Uncompressed bytes after decompression
+	compressionSkipped    atomic.Int64 // PUTs stored uncompressed by auto compression
+	unknownDictMisses     atomic.Int64 // GETs of objects whose dictionary is gone
 
 	// Touch-on-GET state
 	touchOnGet bool
@@ -126,6 +132,29 @@ type CacheProg struct {
 	// Conditional PUT state
 	conditionalPut    bool
 	putSkippedBackend atomic.Int64 // PUTs skipped because backend already has the object
+
+	// Integrity state
+	verifyLocalHits bool
+	corruptBackend  atomic.Int64 // Backend GETs whose body failed its checksum or authentication
+
+	// Degraded GET state. Under the miss policy these GETs are served as
+	// misses; under the fail policy they're returned to the go command as errors.
+	failDegradedGets bool
+	lockErrors       atomic.Int64 // GETs whose action ID couldn't be locked
+	backendGetErrors atomic.Int64 // Backend GETs that returned an error
+	decodeErrors     atomic.Int64 // Backend bodies that couldn't be read or decompressed
+	localWriteErrors atomic.Int64 // Backend hits that couldn't be written to the local cache
+
+	// Deadline state. ctx is canceled once the go command has gone away, which
+	// abandons any backend work still in flight; each GET and PUT additionally
+	// gets its own timeout, if one is configured.
+	ctx        context.Context
+	cancel     context.CancelFunc
+	getTimeout time.Duration
+	putTimeout time.Duration
+
+	// Prefetch state; nil unless a prefetch manifest is configured.
+	prefetch *prefetcher
 }
 
 // CacheProgOptions holds configuration for NewCacheProg.
@@ -133,9 +162,43 @@ type CacheProgOptions struct {
 	Debug             bool
 	PrintStats        bool
 	PrintStatsMachine bool
-	Compression       bool
 	TouchOnGet        bool
 	ConditionalPut    bool
+
+	// Compression is the codec used for backend PUTs: lz4, zstd, auto or
+	// none (the default). GETs decode whatever codec an object was stored with.
+	Compression string
+	// CompressionLevel is the zstd compression level; 0 uses the default.
+	CompressionLevel int
+	// CompressionDict compresses zstd PUTs with the dictionary stored by
+	// train-dict, if there is one. It's loaded in the background at startup.
+	CompressionDict bool
+
+	// LocalCacheMaxBytes caps the size of the local cache directory. When >0,
+	// least recently used entries are evicted in the background.
+	LocalCacheMaxBytes int64
+	// LocalDedup stores each output once in the local cache and hardlinks
+	// every action ID with that output to it.
+	LocalDedup bool
+	// VerifyLocalHits re-hashes local cache entries before serving them.
+	VerifyLocalHits bool
+	// BackendErrorPolicy decides what a GET returns when the backend fails, the
+	// body can't be decompressed or it can't be written to the local cache: a
+	// miss ("miss", the default) or an error ("fail").
+	BackendErrorPolicy string
+	// GetTimeout and PutTimeout bound the backend work of a single GET or PUT
+	// request, including reading the body; 0 means no timeout. A GET that
+	// times out is degraded as per BackendErrorPolicy.
+	GetTimeout time.Duration
+	PutTimeout time.Duration
+
+	// PrefetchManifest names the manifest of action IDs this build records for
+	// the next one, and prefetches from the previous one at startup (e.g. the
+	// repository and branch). Empty disables prefetching.
+	PrefetchManifest string
+	// PrefetchConcurrency is how many outputs are prefetched at once; 0 uses
+	// the default.
+	PrefetchConcurrency int
 }
 
 // NewCacheProg creates a new cache program instance.
@@ -155,6 +218,16 @@ func NewCacheProg(
 		Level: logLevel,
 	}))
 
+	compression, err := parseCompression(opts.Compression, opts.CompressionLevel)
+	if err != nil {
+		return nil, err
+	}
+
+	failDegradedGets, err := parseBackendErrorPolicy(opts.BackendErrorPolicy)
+	if err != nil {
+		return nil, err
+	}
+
 	localCache, err := newLocalCache(cacheDir, logger)
 	if err != nil {
 		return nil, err
@@ -167,21 +240,60 @@ func NewCacheProg(
 		debug:             opts.Debug,
 		printStats:        opts.PrintStats,
 		printStatsMachine: opts.PrintStatsMachine,
-		compression:       opts.Compression,
+		compression:       compression,
+		dicts:             newDictionaries(backend, logger),
 		touchOnGet:        opts.TouchOnGet,
 		conditionalPut:    opts.ConditionalPut,
+		verifyLocalHits:   opts.VerifyLocalHits,
+		failDegradedGets:  failDegradedGets,
+		getTimeout:        opts.GetTimeout,
+		putTimeout:        opts.PutTimeout,
 		logger:            logger,
 		locker:            sfGroup,
 		latencyTracker:    metrics.NewLatencyTracker(0.01), // 1% relative accuracy
 	}
+	cp.ctx, cp.cancel = context.WithCancel(context.Background())
 	cp.writer.w = bufio.NewWriter(os.Stdout)
 	cp.seenActionIDs.ids = make(map[string]int)
 	cp.touched.keys = make(map[string]struct{})
+	if opts.LocalDedup {
+		if err := localCache.enableDedup(); err != nil {
+			return nil, err
+		}
+	}
+	if retry, ok := findBackend[*backends.Retry](cp.backend); ok {
+		retry.OnRetried(func(retries int) {
+			cp.retriedRequests.Add(1)
+			cp.totalRetries.Add(int64(retries))
+		})
+	}
+	if hedge, ok := findBackend[*backends.Hedge](cp.backend); ok {
+		hedge.LatencyFrom(cp.hedgeDelay)
+	}
+	if opts.PrefetchManifest != "" {
+		cp.prefetch = newPrefetcher(opts.PrefetchManifest, opts.PrefetchConcurrency)
+		go cp.runPrefetch()
+	}
+	localCache.startEvictor(opts.LocalCacheMaxBytes, sfGroup)
+	if opts.CompressionDict && compression.codec == codecZstd {
+		go cp.dicts.loadCurrent(cp.ctx, opts.TouchOnGet)
+	} else {
+		close(cp.dicts.loaded)
+	}
 	return cp, nil
 }
 
 // Run starts the cache program and processes requests concurrently.
 func (cp *CacheProg) Run() error {
+	defer cp.localCache.stopEvictor()
+	defer func() { <-cp.dicts.loaded }()
+	defer func() {
+		if cp.prefetch != nil {
+			cp.stopPrefetch()
+		}
+	}()
+	defer cp.cancel()
+
 	// Send initial response with capabilities
 	if err := cp.sendInitialResponse(); err != nil {
 		return fmt.Errorf("failed to send initial response: %w", err)
@@ -195,10 +307,14 @@ func (cp *CacheProg) Run() error {
 	for {
 		req, err := cp.readRequest()
 		if errors.Is(err, io.EOF) {
+			// The go command went away without sending close, so nobody is
+			// waiting for the in-flight requests any more.
+			cp.cancel()
 			break
 		}
 		if err != nil {
-			// Wait for any in-flight requests to complete
+			// Abandon and wait for any in-flight requests
+			cp.cancel()
 			wg.Wait()
 			return fmt.Errorf("failed to read request: %w", err)
 		}
@@ -292,6 +408,8 @@ func (cp *CacheProg) Run() error {
 			compressionBytesOut   = cp.compressionBytesOut.Load()
 			decompressionBytesIn  = cp.decompressionBytesIn.Load()
 			decompressionBytesOut = cp.decompressionBytesOut.Load()
+			compressionSkipped    = cp.compressionSkipped.Load()
+			unknownDictMisses     = cp.unknownDictMisses.Load()
 			missCount             = getCount - hitCount
 			hitRate               = 0.0
 			localHitRate          = 0.0
@@ -331,9 +449,14 @@ func (cp *CacheProg) Run() error {
 		fmt.Fprintf(os.Stderr, "  Unique action IDs: %d\n", uniqueActionIDs)
 		fmt.Fprintf(os.Stderr, "  Total backend bytes transferred: %s\n", formatBytes(backendBytesRead+backendBytesWritten))
 
-		// Print compression statistics if compression is enabled
-		if cp.compression {
-			fmt.Fprintf(os.Stderr, "\nCompression statistics:\n")
+		// Print compression statistics if compression is enabled, or if
+		// compressed objects written by other instances were read.
+		if cp.compression.enabled() || decompressionBytesIn > 0 || unknownDictMisses > 0 {
+			if id := cp.dicts.currentID(); id != 0 {
+				fmt.Fprintf(os.Stderr, "\nCompression statistics (%s, dictionary %08x):\n", cp.compression, id)
+			} else {
+				fmt.Fprintf(os.Stderr, "\nCompression statistics (%s):\n", cp.compression)
+			}
 			if compressionBytesIn > 0 {
 				compressionRatio := float64(compressionBytesOut) / float64(compressionBytesIn) * 100
 				spaceSaved := compressionBytesIn - compressionBytesOut
@@ -341,6 +464,12 @@ func (cp *CacheProg) Run() error {
 					formatBytes(compressionBytesIn), formatBytes(compressionBytesOut),
 					compressionRatio, formatBytes(spaceSaved))
 			}
+			if compressionSkipped > 0 {
+				fmt.Fprintf(os.Stderr, "  Stored uncompressed (incompressible): %d PUTs\n", compressionSkipped)
+			}
+			if unknownDictMisses > 0 {
+				fmt.Fprintf(os.Stderr, "  Misses for objects with an unknown dictionary: %d\n", unknownDictMisses)
+			}
 			if decompressionBytesIn > 0 {
 				decompressionRatio := float64(decompressionBytesOut) / float64(decompressionBytesIn) * 100
 				fmt.Fprintf(os.Stderr, "  Decompression (GET): %s -> %s (%.1f%% expansion)\n",
@@ -358,12 +487,36 @@ func (cp *CacheProg) Run() error {
 			fmt.Fprintf(os.Stderr, "  Total retries: %d (avg %.1f retries per failed request)\n",
 				totalRetries, avgRetries)
 		}
+		if retry, ok := findBackend[*backends.Retry](cp.backend); ok {
+			if retryStats := retry.Stats(); retryStats.Exhausted > 0 || retryStats.Timeouts > 0 {
+				fmt.Fprintf(os.Stderr, "  Backend retries: %d requests still failed after every attempt, %d attempts timed out\n",
+					retryStats.Exhausted, retryStats.Timeouts)
+			}
+		}
+		if breaker, ok := findBackend[*backends.CircuitBreaker](cp.backend); ok {
+			if breakerStats := breaker.Stats(); breakerStats.Trips > 0 {
+				fmt.Fprintf(os.Stderr, "  Circuit breaker: tripped %d times, %d backend operations skipped (now %s)\n",
+					breakerStats.Trips, breakerStats.ShortCircuited, breakerStats.State)
+			}
+		}
+		if hedge, ok := findBackend[*backends.Hedge](cp.backend); ok {
+			hedgeStats := hedge.Stats()
+			fmt.Fprintf(os.Stderr, "  Hedged GETs: %d issued, %d won by the hedge\n",
+				hedgeStats.Issued, hedgeStats.Won)
+		}
+		if cp.prefetch != nil {
+			fmt.Fprintf(os.Stderr, "  Prefetch: %d outputs prefetched, %d used by GETs, %d failed\n",
+				cp.prefetch.fetched.Load(), cp.prefetch.used.Load(), cp.prefetch.failed.Load())
+		}
 
 		// Print touch statistics if touch-on-GET is enabled
 		if cp.touchOnGet {
 			touchCount := cp.touchCount.Load()
 			touchSkipped := cp.touchSkipped.Load()
-			touchSkippedFresh := cp.getAsyncTouchSkippedFresh()
+			var touchSkippedFresh int64
+			if async, ok := findBackend[*backends.AsyncBackendWriter](cp.backend); ok {
+				touchSkippedFresh = async.Stats().TouchSkippedFresh
+			}
 			fmt.Fprintf(os.Stderr, "  Touch-on-GET: %d dispatched, %d skipped (dedup), %d skipped (fresh)\n",
 				touchCount, touchSkipped, touchSkippedFresh)
 		}
@@ -376,11 +529,86 @@ func (cp *CacheProg) Run() error {
 		}
 
 		// Print read-only statistics if read-only wrapper is present
-		if roStats := cp.getReadOnlyStats(); roStats != nil {
+		if ro, ok := findBackend[*backends.ReadOnly](cp.backend); ok {
+			roStats := ro.Stats()
 			fmt.Fprintf(os.Stderr, "  Read-only mode: %d puts skipped, %d touches skipped, %d clears blocked\n",
 				roStats.PutsSkipped, roStats.TouchesSkipped, roStats.ClearsBlocked)
 		}
 
+		// Print local cache eviction statistics if a size limit is configured
+		if cp.localCache.maxBytes > 0 {
+			fmt.Fprintf(os.Stderr, "  Local cache eviction: %d entries evicted (%s), limit %s\n",
+				cp.localCache.evictions.Load(), formatBytes(cp.localCache.evictedBytes.Load()),
+				formatBytes(cp.localCache.maxBytes))
+		}
+
+		// Print integrity statistics if any corrupt entries were found
+		if corruptBackend, corruptLocal := cp.corruptBackend.Load(), cp.localCache.quarantined.Load(); corruptBackend > 0 || corruptLocal > 0 {
+			fmt.Fprintf(os.Stderr, "  Corrupt entries: %d from backend, %d in local cache (treated as misses and quarantined)\n",
+				corruptBackend, corruptLocal)
+		}
+
+		// Print degraded GET statistics if any GETs failed
+		lockErrors, backendGetErrors := cp.lockErrors.Load(), cp.backendGetErrors.Load()
+		decodeErrors, localWriteErrors := cp.decodeErrors.Load(), cp.localWriteErrors.Load()
+		if lockErrors > 0 || backendGetErrors > 0 || decodeErrors > 0 || localWriteErrors > 0 {
+			outcome := "served as misses"
+			if cp.failDegradedGets {
+				outcome = "returned as errors"
+			}
+			fmt.Fprintf(os.Stderr, "  Degraded GETs (%s): %d lock errors, %d backend errors, %d decode errors, %d local write errors\n",
+				outcome, lockErrors, backendGetErrors, decodeErrors, localWriteErrors)
+		}
+
+		// Print local cache dedup statistics if enabled
+		if cp.localCache.dedup {
+			fmt.Fprintf(os.Stderr, "  Local cache dedup: %d entries linked to existing outputs (%s saved)\n",
+				cp.localCache.dedupLinks.Load(), formatBytes(cp.localCache.dedupBytes.Load()))
+		}
+
+		// Print tiered backend statistics if a Tiered backend is in the chain
+		if tiered, ok := findBackend[*backends.Tiered](cp.backend); ok {
+			tieredStats := tiered.Stats()
+			fmt.Fprintf(os.Stderr, "  Tiered backend hits:")
+			for i, name := range tieredStats.TierNames {
+				fmt.Fprintf(os.Stderr, " %s=%d", name, tieredStats.TierHits[i])
+			}
+			fmt.Fprintf(os.Stderr, "\n")
+			fmt.Fprintf(os.Stderr, "  Tiered backend: %d back-fills (%d failed), %d write-back failures\n",
+				tieredStats.Backfills, tieredStats.BackfillErrors, tieredStats.WriteBackErrors)
+		}
+
+		// Print overlay statistics if an Overlay backend is in the chain
+		if overlay, ok := findBackend[*backends.Overlay](cp.backend); ok {
+			overlayStats := overlay.Stats()
+			fmt.Fprintf(os.Stderr, "  Overlay backend hits:")
+			for i, name := range overlayStats.LayerNames {
+				fmt.Fprintf(os.Stderr, " %s=%d", name, overlayStats.LayerHits[i])
+			}
+			fmt.Fprintf(os.Stderr, " (writing to %s)\n", overlayStats.WriteLayer)
+		}
+
+		// Print dedup statistics if a Dedup wrapper is in the chain
+		if dedup, ok := findBackend[*backends.Dedup](cp.backend); ok {
+			dedupStats := dedup.Stats()
+			fmt.Fprintf(os.Stderr, "  Dedup: %d blob uploads skipped (%s saved), %d dangling index records\n",
+				dedupStats.BlobsSkipped, formatBytes(dedupStats.BytesSkipped), dedupStats.DanglingIndexes)
+		}
+
+		// Print encryption statistics if an Encrypt wrapper is in the chain
+		if encrypt, ok := findBackend[*backends.Encrypt](cp.backend); ok {
+			encryptStats := encrypt.Stats()
+			fmt.Fprintf(os.Stderr, "  Encryption: key %s, %d objects failed authentication, %d encrypted with unknown keys (treated as misses)\n",
+				encryptStats.CurrentKeyID, encryptStats.AuthFailures, encryptStats.UnknownKeys)
+		}
+
+		// Print signing statistics if a Sign wrapper is in the chain
+		if sign, ok := findBackend[*backends.Sign](cp.backend); ok {
+			signStats := sign.Stats()
+			fmt.Fprintf(os.Stderr, "  Signing: key %s, rejected %d unsigned, %d badly signed and %d signed with unknown keys (treated as misses)\n",
+				signStats.CurrentKeyID, signStats.Unsigned, signStats.BadSignatures, signStats.UnknownKeys)
+		}
+
 		// Print backend hit entry age distribution (lifecycle health)
 		if ageStats, err := cp.latencyTracker.GetStats("backend_hit_entry_age"); err == nil && ageStats.Count > 0 {
 			msToHours := 1.0 / (1000.0 * 3600.0)
@@ -429,11 +657,32 @@ func (cp *CacheProg) Run() error {
 		}
 
 		putSkippedBackend := cp.putSkippedBackend.Load()
-		touchSkippedFresh := cp.getAsyncTouchSkippedFresh()
+		var touchSkippedFresh int64
+		if async, ok := findBackend[*backends.AsyncBackendWriter](cp.backend); ok {
+			touchSkippedFresh = async.Stats().TouchSkippedFresh
+		}
 
 		var readonlyPutsSkipped int64
-		if roStats := cp.getReadOnlyStats(); roStats != nil {
-			readonlyPutsSkipped = roStats.PutsSkipped
+		if ro, ok := findBackend[*backends.ReadOnly](cp.backend); ok {
+			readonlyPutsSkipped = ro.Stats().PutsSkipped
+		}
+		corruptEntries := cp.corruptBackend.Load() + cp.localCache.quarantined.Load()
+		var rejectedEntries int64
+		if sign, ok := findBackend[*backends.Sign](cp.backend); ok {
+			rejectedEntries = sign.Stats().Rejected()
+		}
+
+		var circuitTrips int64
+		if breaker, ok := findBackend[*backends.CircuitBreaker](cp.backend); ok {
+			circuitTrips = breaker.Stats().Trips
+		}
+		var hedgeStats backends.HedgeStats
+		if hedge, ok := findBackend[*backends.Hedge](cp.backend); ok {
+			hedgeStats = hedge.Stats()
+		}
+		var prefetched, prefetchUsed int64
+		if cp.prefetch != nil {
+			prefetched, prefetchUsed = cp.prefetch.fetched.Load(), cp.prefetch.used.Load()
 		}
 
 		// Get entry age percentiles for machine stats
@@ -449,13 +698,17 @@ func (cp *CacheProg) Run() error {
 				" local_hits=%d backend_hits=%d puts=%d puts_skipped=%d"+
 				" backend_bytes_read=%d backend_bytes_written=%d"+
 				" touches=%d touches_skipped_fresh=%d"+
-				" readonly_puts_skipped=%d"+
+				" readonly_puts_skipped=%d corrupt_entries=%d rejected_entries=%d"+
+				" circuit_trips=%d lock_errors=%d backend_get_errors=%d decode_errors=%d local_write_errors=%d"+
+				" hedges_issued=%d hedges_won=%d prefetched=%d prefetch_used=%d"+
 				" entry_age_p50_hours=%.1f entry_age_max_hours=%.1f\n",
 			getCount, hitCount, missCount, hitRate,
 			localCacheHits, backendCacheHits, putCount, putSkippedBackend,
 			backendBytesRead, backendBytesWritten,
 			touchCount, touchSkippedFresh,
-			readonlyPutsSkipped,
+			readonlyPutsSkipped, corruptEntries, rejectedEntries,
+			circuitTrips, cp.lockErrors.Load(), cp.backendGetErrors.Load(), cp.decodeErrors.Load(), cp.localWriteErrors.Load(),
+			hedgeStats.Issued, hedgeStats.Won, prefetched, prefetchUsed,
 			ageP50Hours, ageMaxHours)
 	}
 
@@ -475,6 +728,9 @@ func (cp *CacheProg) handleRequest(req *Request) (Response, error) {
 		return cp.handleGet(req)
 
 	case CmdClose:
+		if cp.prefetch != nil {
+			cp.storeManifest()
+		}
 		if err := cp.backend.Close(); err != nil {
 			resp.Err = err.Error()
 			return resp, err
@@ -502,6 +758,11 @@ func (cp *CacheProg) handlePut(req *Request) (Response, error) {
 	var resp Response
 	resp.ID = req.ID
 
+	// Bodies read from stdin are spooled and must be released once handled.
+	if closer, ok := req.Body.(io.Closer); ok {
+		defer closer.Close()
+	}
+
 	cp.putCount.Add(1)
 	isDuplicate := cp.trackActionID(req.ActionID)
 	if isDuplicate {
@@ -523,17 +784,11 @@ func (cp *CacheProg) handlePut(req *Request) (Response, error) {
 			return &putResult{diskPath: cp.localCache.getPath(req.ActionID)}, nil
 		}
 
-		// Read body into memory (we need to write it to both local cache and backend)
-		var bodyData []byte
+		// Stream the body straight to the local cache. The backend PUT below
+		// re-reads it from there, so the body is never held in memory.
+		var body io.Reader = bytes.NewReader(nil)
 		if req.BodySize > 0 && req.Body != nil {
-			bodyData = make([]byte, req.BodySize)
-			n, err := io.ReadFull(req.Body, bodyData)
-			if err != nil && err != io.EOF {
-				return nil, fmt.Errorf("failed to read body: %w", err)
-			}
-			if int64(n) != req.BodySize {
-				return nil, fmt.Errorf("size mismatch: expected %d, read %d", req.BodySize, n)
-			}
+			body = &sizedReader{r: req.Body, expected: req.BodySize}
 		}
 
 		// Write to local cache with metadata
@@ -544,7 +799,7 @@ func (cp *CacheProg) handlePut(req *Request) (Response, error) {
 		}
 
 		localCacheWriteStart := time.Now()
-		diskPath, err := cp.localCache.writeWithMetadata(req.ActionID, bytes.NewReader(bodyData), meta)
+		diskPath, _, err := cp.localCache.writeWithMetadata(req.ActionID, body, meta)
 		cp.latencyTracker.Record("put_local_cache_write", time.Since(localCacheWriteStart))
 
 		if err != nil {
@@ -552,11 +807,13 @@ func (cp *CacheProg) handlePut(req *Request) (Response, error) {
 		}
 
 		backendKey := cp.generateBackendKey(req.ActionID)
+		ctx, cancel := cp.requestContext(cp.ctx, cp.putTimeout)
+		defer cancel()
 
 		// Check if backend already has this object to avoid redundant uploads
 		if cp.conditionalPut {
 			hasStart := time.Now()
-			exists, err := cp.backend.Has(backendKey)
+			exists, err := cp.backend.Has(ctx, backendKey)
 			cp.latencyTracker.Record("put_backend_has", time.Since(hasStart))
 
 			if err != nil {
@@ -569,31 +826,26 @@ func (cp *CacheProg) handlePut(req *Request) (Response, error) {
 			}
 		}
 
-		var (
-			backendPutStart = time.Now()
-			dataToStore     []byte
-			dataSize        int64
-		)
-		if cp.compression && req.BodySize > 0 {
-			compressStart := time.Now()
-			compressed, err := compressData(bodyData)
-			cp.latencyTracker.Record("put_compression", time.Since(compressStart))
-
-			if err != nil {
-				return nil, fmt.Errorf("failed to compress data: %w", err)
-			}
-
-			dataToStore = compressed
-			dataSize = int64(len(compressed))
-
-			cp.compressionBytesIn.Add(req.BodySize)
-			cp.compressionBytesOut.Add(dataSize)
-		} else {
-			dataToStore = bodyData
-			dataSize = req.BodySize
+		// We hold the lock for this action ID, so the file can't be evicted or
+		// rewritten underneath us.
+		localFile, err := os.Open(diskPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to reopen local cache file: %w", err)
+		}
+		defer localFile.Close()
+
+		// The compressed size has to be known up front, so compress into a
+		// spool next to the local cache rather than into memory. An async
+		// backend writer takes the spool over instead of copying it.
+		backendPutStart := time.Now()
+		compressed := backends.NewSpool(cp.localCache.cacheDir, backends.DefaultSpoolThreshold)
+		defer compressed.Close()
+		dataToStore, dataSize, bodyCodec, err := cp.encodeForBackend(compressed, localFile, req.BodySize)
+		if err != nil {
+			return nil, err
 		}
 
-		err = cp.backend.Put(backendKey, req.OutputID, bytes.NewReader(dataToStore), dataSize)
+		err = cp.backend.Put(ctx, backendKey, req.OutputID, bodyCodec.String(), dataToStore, dataSize)
 		cp.latencyTracker.Record("put_backend", time.Since(backendPutStart))
 
 		if err != nil {
@@ -616,6 +868,9 @@ func (cp *CacheProg) handlePut(req *Request) (Response, error) {
 
 	result := v.(*putResult)
 	resp.DiskPath = result.diskPath
+	if cp.prefetch != nil {
+		cp.prefetch.record(req.ActionID)
+	}
 	return resp, nil
 }
 
@@ -629,6 +884,43 @@ type getResult struct {
 	fromLocalCache bool // true if hit was from local cache, false if from backend
 }
 
+// corruptBackendEntry records a backend body that failed its checksum or
+// authentication and returns a miss for it. The go command then rebuilds the
+// output and PUTs a good copy over it (checksum failures have already been
+// quarantined by the backend).
+func (cp *CacheProg) corruptBackendEntry(actionID []byte, err error) *getResult {
+	cp.corruptBackend.Add(1)
+	cp.logger.Warn("corrupt backend entry, treating as miss",
+		"actionID", hex.EncodeToString(actionID),
+		"error", err)
+	return &getResult{miss: true}
+}
+
+// rejectedBackendEntry returns a miss for a backend body whose signature didn't
+// match. It's counted by the Sign wrapper rather than as corruption: it may
+// have been planted on purpose, so it's worth telling apart in the stats.
+func (cp *CacheProg) rejectedBackendEntry(actionID []byte, err error) *getResult {
+	cp.logger.Warn("badly signed backend entry, treating as miss",
+		"actionID", hex.EncodeToString(actionID),
+		"error", err)
+	return &getResult{miss: true}
+}
+
+// degradedGet counts a GET that failed for a reason other than the output not
+// being cached, then applies the backend error policy: under the miss policy
+// the failure is logged and the GET becomes a miss, and under the fail policy
+// err is returned to the go command.
+func (cp *CacheProg) degradedGet(actionID []byte, counter *atomic.Int64, msg string, err error) (*getResult, error) {
+	counter.Add(1)
+	if cp.failDegradedGets {
+		return nil, err
+	}
+	cp.logger.Warn(msg+", treating as miss",
+		"actionID", hex.EncodeToString(actionID),
+		"error", err)
+	return &getResult{miss: true}, nil
+}
+
 // handleGet processes a GET request.
 func (cp *CacheProg) handleGet(req *Request) (Response, error) {
 	overallStart := time.Now()
@@ -648,6 +940,10 @@ func (cp *CacheProg) handleGet(req *Request) (Response, error) {
 		}
 	}
 
+	if cp.prefetch != nil {
+		defer cp.prefetch.startGet(req.ActionID)()
+	}
+
 	key := hex.EncodeToString(req.ActionID)
 	v, err := cp.locker.DoWithLock(key, func() (interface{}, error) {
 		// Check local cache first
@@ -655,9 +951,27 @@ func (cp *CacheProg) handleGet(req *Request) (Response, error) {
 		meta := cp.localCache.check(req.ActionID)
 		cp.latencyTracker.Record("get_local_cache_check", time.Since(localCacheCheckStart))
 
+		if meta != nil && cp.verifyLocalHits {
+			verifyStart := time.Now()
+			err := cp.localCache.verify(req.ActionID, meta)
+			cp.latencyTracker.Record("get_local_cache_verify", time.Since(verifyStart))
+
+			if err != nil {
+				// Treat the entry as a miss and fall through to the backend.
+				cp.logger.Warn("corrupt local cache entry, quarantining",
+					"actionID", hex.EncodeToString(req.ActionID),
+					"error", err)
+				if err := cp.localCache.quarantine(req.ActionID, meta); err != nil {
+					return nil, err
+				}
+				meta = nil
+			}
+		}
+
 		if meta != nil {
 			// Local cache hit with metadata
 			diskPath := cp.localCache.getPath(req.ActionID)
+			cp.localCache.markUsed(req.ActionID)
 
 			return &getResult{
 				outputID:       meta.OutputID,
@@ -670,94 +984,11 @@ func (cp *CacheProg) handleGet(req *Request) (Response, error) {
 		}
 
 		// Local cache miss - get from backend
-		backendGetStart := time.Now()
-		backendKey := cp.generateBackendKey(req.ActionID)
-		outputID, body, size, putTime, miss, err := cp.backend.Get(backendKey)
-		cp.latencyTracker.Record("get_backend", time.Since(backendGetStart))
-
-		if err != nil {
-			return nil, err
-		}
-
-		if miss {
-			// Backend miss
-			return &getResult{
-				miss: true,
-			}, nil
-		}
-
-		// Backend hit - track bytes and entry age
-		cp.backendBytesRead.Add(size)
-		if putTime != nil {
-			cp.latencyTracker.Record("backend_hit_entry_age", time.Since(*putTime))
-		}
-
-		// Backend hit - decompress if needed, then write to local cache with metadata
-		defer body.Close()
-
-		var dataToCache io.Reader
-		var actualSize int64
-
-		if cp.compression && size > 0 {
-			// Read compressed data from backend
-			compressedData, err := io.ReadAll(body)
-			if err != nil {
-				return nil, fmt.Errorf("failed to read compressed data from backend: %w", err)
-			}
-
-			// Decompress data
-			decompressStart := time.Now()
-			decompressed, err := decompressData(compressedData)
-			cp.latencyTracker.Record("get_decompression", time.Since(decompressStart))
-
-			if err != nil {
-				return nil, fmt.Errorf("failed to decompress data: %w", err)
-			}
-
-			// Track decompression statistics
-			cp.decompressionBytesIn.Add(size)
-			cp.decompressionBytesOut.Add(int64(len(decompressed)))
-
-			dataToCache = bytes.NewReader(decompressed)
-			actualSize = int64(len(decompressed))
-		} else {
-			dataToCache = body
-			actualSize = size
-		}
-
-		metaForWrite := localCacheMetadata{
-			OutputID: outputID,
-			Size:     actualSize,
-			PutTime:  *putTime,
-		}
-
-		localCacheWriteStart := time.Now()
-		diskPath, err := cp.localCache.writeWithMetadata(req.ActionID, dataToCache, metaForWrite)
-		cp.latencyTracker.Record("get_local_cache_write", time.Since(localCacheWriteStart))
-
-		if err != nil {
-			cp.logger.Warn("failed to write to local cache after backend hit",
-				"actionID", hex.EncodeToString(req.ActionID),
-				"error", err)
-			// We got data from backend but couldn't cache it locally
-			// This is not fatal - we can still serve from backend
-			return nil, fmt.Errorf("failed to cache locally: %w", err)
-		}
-
-		// Touch the S3 object to reset lifecycle timer
-		if cp.touchOnGet {
-			cp.maybeTouch(backendKey)
-		}
-
-		return &getResult{
-			outputID:       outputID,
-			diskPath:       diskPath,
-			size:           actualSize,
-			putTime:        putTime,
-			miss:           false,
-			fromLocalCache: false,
-		}, nil
+		return cp.getFromBackend(cp.ctx, req.ActionID)
 	})
+	if errors.Is(err, locking.ErrLockNotAcquired) {
+		v, err = cp.degradedGet(req.ActionID, &cp.lockErrors, "failed to lock action ID", err)
+	}
 
 	if err != nil {
 		resp.Err = err.Error()
@@ -774,6 +1005,12 @@ func (cp *CacheProg) handleGet(req *Request) (Response, error) {
 		} else {
 			cp.backendCacheHits.Add(1)
 		}
+		if cp.prefetch != nil {
+			if result.fromLocalCache {
+				cp.prefetch.markUsed(req.ActionID)
+			}
+			cp.prefetch.record(req.ActionID)
+		}
 		resp.OutputID = result.outputID
 		resp.DiskPath = result.diskPath
 		resp.Size = result.size
@@ -782,46 +1019,165 @@ func (cp *CacheProg) handleGet(req *Request) (Response, error) {
 	return resp, nil
 }
 
-// getAsyncTouchSkippedFresh extracts the debounced touch skip count from the async backend wrapper.
-func (cp *CacheProg) getAsyncTouchSkippedFresh() int64 {
-	b := cp.backend
-	for b != nil {
-		if abw, ok := b.(*backends.AsyncBackendWriter); ok {
-			return abw.Stats().TouchSkippedFresh
-		}
-		// Try to unwrap known wrapper types
-		switch w := b.(type) {
-		case *backends.Debug:
-			b = w.Unwrap()
-		case *backends.ReadOnly:
-			b = w.Unwrap()
-		default:
-			return 0
-		}
+// getFromBackend fetches an output from the backend into the local cache. The
+// caller must hold the lock for actionID.
+func (cp *CacheProg) getFromBackend(ctx context.Context, actionID []byte) (*getResult, error) {
+	backendGetStart := time.Now()
+	backendKey := cp.generateBackendKey(actionID)
+	// The deadline covers streaming the body into the local cache too.
+	ctx, cancel := cp.requestContext(ctx, cp.getTimeout)
+	defer cancel()
+	outputID, body, size, putTime, encoding, miss, err := cp.backend.Get(ctx, backendKey)
+	cp.latencyTracker.Record("get_backend", time.Since(backendGetStart))
+
+	if errors.Is(err, backends.ErrChecksumMismatch) || errors.Is(err, backends.ErrAuthenticationFailed) {
+		// e.g. a tiered backend that read the whole body to back-fill it.
+		return cp.corruptBackendEntry(actionID, err), nil
 	}
-	return 0
+	if errors.Is(err, backends.ErrBadSignature) {
+		return cp.rejectedBackendEntry(actionID, err), nil
+	}
+	if err != nil {
+		return cp.degradedGet(actionID, &cp.backendGetErrors, "backend GET failed", err)
+	}
+
+	if miss {
+		// Backend miss
+		return &getResult{
+			miss: true,
+		}, nil
+	}
+
+	// Backend hit - track bytes and entry age
+	cp.backendBytesRead.Add(size)
+	if putTime != nil {
+		cp.latencyTracker.Record("backend_hit_entry_age", time.Since(*putTime))
+	}
+
+	// Backend hit - decompress if needed, then write to local cache with metadata.
+	// The body is streamed from the backend through the decompressor straight
+	// into the local cache file, so it's never buffered in memory.
+	defer body.Close()
+
+	dataToCache, bodyCodec, err := newDecodingReader(body, encoding, func(id uint32) ([]byte, error) {
+		return cp.dicts.get(ctx, id)
+	})
+	if errors.Is(err, errUnknownEncoding) {
+		// Written by a newer version; rebuilding the output overwrites it
+		// with an encoding this version understands.
+		cp.logger.Warn("backend entry has an unknown encoding, treating as miss",
+			"actionID", hex.EncodeToString(actionID),
+			"error", err)
+		return &getResult{miss: true}, nil
+	}
+	if errors.Is(err, errUnknownDict) {
+		// Rebuilding the output overwrites the object with one compressed
+		// with the current dictionary.
+		cp.unknownDictMisses.Add(1)
+		cp.logger.Warn("backend entry was compressed with an unknown dictionary, treating as miss",
+			"actionID", hex.EncodeToString(actionID),
+			"error", err)
+		return &getResult{miss: true}, nil
+	}
+	if err != nil {
+		return cp.degradedGet(actionID, &cp.decodeErrors, "failed to decompress backend entry", err)
+	}
+	defer dataToCache.Close()
+
+	metaForWrite := localCacheMetadata{
+		OutputID: outputID,
+		PutTime:  *putTime,
+	}
+
+	localCacheWriteStart := time.Now()
+	diskPath, actualSize, err := cp.localCache.writeWithMetadata(actionID, &bodyReader{r: dataToCache}, metaForWrite)
+	localCacheWriteTime := time.Since(localCacheWriteStart)
+	cp.latencyTracker.Record("get_local_cache_write", localCacheWriteTime)
+	if bodyCodec != codecNone {
+		// The body is decompressed as it's written, so the write is the
+		// decompression.
+		cp.latencyTracker.Record("get_decompression", localCacheWriteTime)
+	}
+
+	if err == nil && bodyCodec != codecNone {
+		// Track decompression statistics
+		cp.decompressionBytesIn.Add(size)
+		cp.decompressionBytesOut.Add(actualSize)
+	}
+
+	if errors.Is(err, backends.ErrChecksumMismatch) || errors.Is(err, backends.ErrAuthenticationFailed) {
+		// Nothing was cached: the local entry is only committed after the
+		// whole body (and so its checksum) has been read.
+		return cp.corruptBackendEntry(actionID, err), nil
+	}
+	if errors.Is(err, backends.ErrBadSignature) {
+		return cp.rejectedBackendEntry(actionID, err), nil
+	}
+	var readErr *bodyReadError
+	if errors.As(err, &readErr) {
+		// The body was cut short or isn't valid for its encoding.
+		return cp.degradedGet(actionID, &cp.decodeErrors, "failed to read or decompress backend entry", err)
+	}
+	if err != nil {
+		// We got data from the backend but couldn't cache it locally, and
+		// the go command can only read outputs from the local cache.
+		return cp.degradedGet(actionID, &cp.localWriteErrors, "failed to write to local cache after backend hit",
+			fmt.Errorf("failed to cache locally: %w", err))
+	}
+
+	// Touch the S3 object to reset lifecycle timer
+	if cp.touchOnGet {
+		cp.maybeTouch(ctx, backendKey)
+	}
+
+	return &getResult{
+		outputID:       outputID,
+		diskPath:       diskPath,
+		size:           actualSize,
+		putTime:        putTime,
+		miss:           false,
+		fromLocalCache: false,
+	}, nil
 }
 
-// getReadOnlyStats returns ReadOnly stats if a ReadOnly wrapper is in the chain.
-func (cp *CacheProg) getReadOnlyStats() *backends.ReadOnlyStats {
-	b := cp.backend
+// findBackend returns the first backend of type T in b's wrapper chain,
+// looking through every wrapper that exposes the backend it wraps.
+func findBackend[T any](b backends.Backend) (T, bool) {
 	for b != nil {
-		if ro, ok := b.(*backends.ReadOnly); ok {
-			stats := ro.Stats()
-			return &stats
+		if found, ok := b.(T); ok {
+			return found, true
 		}
-		switch w := b.(type) {
-		case *backends.Debug:
-			b = w.Unwrap()
-		default:
-			return nil
+		w, ok := b.(interface{ Unwrap() backends.Backend })
+		if !ok {
+			break
 		}
+		b = w.Unwrap()
 	}
-	return nil
+	var zero T
+	return zero, false
+}
+
+// hedgeDelay returns the live p95 of backend GET latency, which slow GETs are
+// hedged after, once there are enough samples for it to be meaningful.
+func (cp *CacheProg) hedgeDelay() (time.Duration, bool) {
+	stats, err := cp.latencyTracker.GetStats("get_backend")
+	if err != nil || stats.Count < hedgeMinSamples {
+		return 0, false
+	}
+	return time.Duration(stats.P95 * float64(time.Millisecond)), true
+}
+
+// requestContext returns the context for a single request's backend work,
+// bounded by timeout if it's set.
+func (cp *CacheProg) requestContext(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(parent, timeout)
+	}
+	return context.WithCancel(parent)
 }
 
 // maybeTouch fires an async backend Touch if we haven't already touched this key in this build.
-func (cp *CacheProg) maybeTouch(backendKey []byte) {
+func (cp *CacheProg) maybeTouch(ctx context.Context, backendKey []byte) {
 	key := string(backendKey)
 
 	cp.touched.Lock()
@@ -838,7 +1194,7 @@ func (cp *CacheProg) maybeTouch(backendKey []byte) {
 
 	cp.touchCount.Add(1)
 	// Fire async — errors are logged by the backend wrapper, not fatal
-	if err := cp.backend.Touch(backendKey); err != nil {
+	if err := cp.backend.Touch(ctx, backendKey); err != nil {
 		cp.logger.Warn("touch-on-GET failed", "key", key, "error", err)
 	}
 }
@@ -908,8 +1264,27 @@ func (cp *CacheProg) readRequest() (*Request, error) {
 
 	// For "put" commands with BodySize > 0, read the base64 body on the next line
 	if req.Command == CmdPut && req.BodySize > 0 {
-		// Read the body line
-		bodyLine, err := cp.readLine()
+		body, err := cp.readBody(req.BodySize)
+		if err != nil {
+			return nil, err
+		}
+		req.Body = body
+	}
+
+	return &req, nil
+}
+
+// readBody streams a PUT body from stdin into a spool. The body is sent on its
+// own line as a base64-encoded JSON string literal. It's decoded on the fly so
+// that large bodies never have to be held in memory in either encoded or
+// decoded form; anything over backends.DefaultSpoolThreshold is spilled to a
+// temporary file in the local cache directory.
+//
+// The caller must Close the returned body.
+func (cp *CacheProg) readBody(size int64) (*spooledBody, error) {
+	// Skip blank lines and whitespace up to the opening quote.
+	for {
+		c, err := cp.reader.ReadByte()
 		if err != nil {
 			if errors.Is(err, io.EOF) {
 				// EOF reached without finding body - connection closed
@@ -917,22 +1292,80 @@ func (cp *CacheProg) readRequest() (*Request, error) {
 			}
 			return nil, fmt.Errorf("error reading body line: %w", err)
 		}
-
-		// The body is sent as a base64-encoded JSON string (a JSON string literal)
-		var base64Str string
-		if err := json.Unmarshal(bodyLine, &base64Str); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal body as JSON string: %w (line: %q)", err, string(bodyLine))
+		if c == '"' {
+			break
 		}
-
-		bodyData, err := base64.StdEncoding.DecodeString(base64Str)
-		if err != nil {
-			return nil, fmt.Errorf("failed to decode base64 body: %w", err)
+		if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			return nil, fmt.Errorf("failed to read body: expected JSON string, found %q", c)
 		}
+	}
 
-		req.Body = strings.NewReader(string(bodyData))
+	spool := backends.NewSpool(cp.localCache.cacheDir, backends.DefaultSpoolThreshold)
+	decoder := base64.NewDecoder(base64.StdEncoding, &quotedBodyReader{r: cp.reader})
+	if _, err := io.Copy(spool, decoder); err != nil {
+		spool.Close()
+		return nil, fmt.Errorf("failed to decode base64 body: %w", err)
+	}
+	if spool.Size() != size {
+		spool.Close()
+		return nil, fmt.Errorf("size mismatch: expected %d, read %d", size, spool.Size())
 	}
 
-	return &req, nil
+	// Discard the rest of the line after the closing quote.
+	if _, err := cp.reader.ReadSlice('\n'); err != nil && !errors.Is(err, io.EOF) {
+		spool.Close()
+		return nil, fmt.Errorf("error reading body line: %w", err)
+	}
+
+	return &spooledBody{ReadSeeker: spool.Reader(), spool: spool}, nil
+}
+
+// quotedBodyReader returns the contents of a JSON string literal from r, up to
+// (but not including) the closing quote. The opening quote must already have
+// been consumed. Base64 never needs escaping, so escape sequences are rejected.
+type quotedBodyReader struct {
+	r    *bufio.Reader
+	buf  []byte
+	done bool
+}
+
+func (q *quotedBodyReader) Read(p []byte) (int, error) {
+	for len(q.buf) == 0 {
+		if q.done {
+			return 0, io.EOF
+		}
+		// ReadSlice returns at most one buffer's worth at a time, which keeps
+		// memory bounded regardless of the body size.
+		chunk, err := q.r.ReadSlice('"')
+		switch {
+		case err == nil:
+			chunk = chunk[:len(chunk)-1]
+			q.done = true
+		case errors.Is(err, bufio.ErrBufferFull):
+		case errors.Is(err, io.EOF):
+			return 0, io.ErrUnexpectedEOF
+		default:
+			return 0, err
+		}
+		if bytes.IndexByte(chunk, '\\') >= 0 {
+			return 0, fmt.Errorf("unsupported escape sequence in body")
+		}
+		q.buf = chunk
+	}
+
+	n := copy(p, q.buf)
+	q.buf = q.buf[n:]
+	return n, nil
+}
+
+// spooledBody is a PUT body backed by a spool. Closing it releases the spool.
+type spooledBody struct {
+	io.ReadSeeker
+	spool *backends.Spool
+}
+
+func (b *spooledBody) Close() error {
+	return b.spool.Close()
 }
 
 // trackActionID records an action ID and returns whether it's a duplicate.
@@ -975,31 +1408,126 @@ func formatBytes(bytes int64) string {
 	return fmt.Sprintf("%.2f TB", float64(bytes)/TB)
 }
 
-// compressData compresses data using LZ4 and returns the compressed bytes.
-func compressData(data []byte) ([]byte, error) {
-	var buf bytes.Buffer
-	writer := lz4.NewWriter(&buf)
+// encodeForBackend returns the body to store in the backend for the local
+// cache file localFile, compressed according to the -compression setting, and
+// the codec it was compressed with, which is stored as the object's encoding.
+// Compressed bodies are written to spool, which the caller must close once the
+// body has been stored.
+func (cp *CacheProg) encodeForBackend(spool *backends.Spool, localFile *os.File, size int64) (io.Reader, int64, codec, error) {
+	c := cp.compression.codec
+	if size == 0 {
+		return localFile, size, codecNone, nil
+	}
+	if c == codecNone {
+		if !hasFrameMagic(localFile) {
+			return localFile, size, codecNone, nil
+		}
+		// The output is itself a compressed frame; stored raw, older versions
+		// that detect the codec from the body would decompress it.
+		c = codecLZ4
+	}
+
+	compressStart := time.Now()
+	err := compressTo(spool, localFile, c, cp.compression.level, cp.dicts.forPut())
+	cp.latencyTracker.Record("put_compression", time.Since(compressStart))
+	if err != nil {
+		return nil, 0, codecNone, fmt.Errorf("failed to compress data: %w", err)
+	}
 
-	if _, err := writer.Write(data); err != nil {
-		writer.Close()
-		return nil, fmt.Errorf("failed to write to LZ4 compressor: %w", err)
+	if cp.compression.auto && !worthCompressing(size, spool.Size()) && !hasFrameMagic(localFile) {
+		cp.compressionSkipped.Add(1)
+		if _, err := localFile.Seek(0, io.SeekStart); err != nil {
+			return nil, 0, codecNone, fmt.Errorf("failed to rewind local cache file: %w", err)
+		}
+		return localFile, size, codecNone, nil
+	}
+
+	cp.compressionBytesIn.Add(size)
+	cp.compressionBytesOut.Add(spool.Size())
+	return spool.Body(), spool.Size(), c, nil
+}
+
+// sizedReader reads exactly expected bytes from r, returning an error if r
+// ends early. Any data beyond expected bytes is ignored.
+type sizedReader struct {
+	r        io.Reader
+	expected int64
+	read     int64
+}
+
+func (s *sizedReader) Read(p []byte) (int, error) {
+	remaining := s.expected - s.read
+	if remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > remaining {
+		p = p[:remaining]
 	}
+	n, err := s.r.Read(p)
+	s.read += int64(n)
+	if errors.Is(err, io.EOF) && s.read < s.expected {
+		return n, fmt.Errorf("size mismatch: expected %d, read %d", s.expected, s.read)
+	}
+	return n, err
+}
 
-	if err := writer.Close(); err != nil {
-		return nil, fmt.Errorf("failed to close LZ4 compressor: %w", err)
+// parseBackendErrorPolicy parses the -backend-error-policy flag and reports
+// whether degraded GETs should fail rather than miss.
+func parseBackendErrorPolicy(policy string) (bool, error) {
+	switch strings.ToLower(policy) {
+	case "miss", "":
+		return false, nil
+	case "fail":
+		return true, nil
+	default:
+		return false, fmt.Errorf("invalid backend error policy %q: must be miss or fail", policy)
 	}
+}
 
-	return buf.Bytes(), nil
+// bodyReadError is an error reading (or decompressing) a backend body, as
+// opposed to writing it to the local cache.
+type bodyReadError struct {
+	err error
 }
 
-// decompressData decompresses LZ4-compressed data.
-func decompressData(data []byte) ([]byte, error) {
-	reader := lz4.NewReader(bytes.NewReader(data))
+func (e *bodyReadError) Error() string {
+	return e.err.Error()
+}
+
+func (e *bodyReadError) Unwrap() error {
+	return e.err
+}
 
-	var buf bytes.Buffer
-	if _, err := io.Copy(&buf, reader); err != nil {
-		return nil, fmt.Errorf("failed to decompress LZ4 data: %w", err)
+// bodyReader wraps read errors from r in a bodyReadError.
+type bodyReader struct {
+	r io.Reader
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = &bodyReadError{err: err}
 	}
+	return n, err
+}
+
+// drainAfter reads r and, once r is exhausted, reads src to EOF before
+// reporting EOF itself. Decompressors stop reading at the end of the compressed
+// stream, so this makes sure errors that a backend body only reports at its
+// end (such as checksum mismatches) aren't missed. src is drained when r fails
+// too: a corrupt or forged body usually fails to decompress before its end is
+// reached, and the error src reports there says why.
+type drainAfter struct {
+	r   io.Reader
+	src io.Reader
+}
 
-	return buf.Bytes(), nil
+func (d *drainAfter) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	if err != nil {
+		if _, drainErr := io.Copy(io.Discard, d.src); drainErr != nil {
+			return n, drainErr
+		}
+	}
+	return n, err
 }
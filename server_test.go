@@ -1,7 +1,23 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/richardartoul/gobuildcache/pkg/backends"
+	"github.com/richardartoul/gobuildcache/pkg/locking"
 )
 
 func TestFormatBytes(t *testing.T) {
@@ -29,3 +45,819 @@ func TestFormatBytes(t *testing.T) {
 		}
 	}
 }
+
+func TestReadRequestStreamsLargeBody(t *testing.T) {
+	cp, err := NewCacheProg(backends.NewNoop(), locking.NewMemLock(), t.TempDir(), CacheProgOptions{})
+	if err != nil {
+		t.Fatalf("failed to create cache prog: %v", err)
+	}
+	cp.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// Larger than the spool threshold so the body is spilled to disk.
+	body := make([]byte, backends.DefaultSpoolThreshold+12345)
+	rand.New(rand.NewSource(1)).Read(body)
+
+	input := fmt.Sprintf("{\"ID\":1,\"Command\":\"put\",\"ActionID\":\"AQI=\",\"BodySize\":%d}\n\n\"%s\"\n{\"ID\":2,\"Command\":\"close\"}\n",
+		len(body), base64.StdEncoding.EncodeToString(body))
+	// A small buffer forces the body to be decoded across many chunks.
+	cp.reader = bufio.NewReaderSize(strings.NewReader(input), 64)
+
+	req, err := cp.readRequest()
+	if err != nil {
+		t.Fatalf("readRequest failed: %v", err)
+	}
+	got, err := io.ReadAll(req.Body)
+	if err != nil {
+		t.Fatalf("failed to read body: %v", err)
+	}
+	if !bytes.Equal(got, body) {
+		t.Fatal("decoded body does not match")
+	}
+	req.Body.(io.Closer).Close()
+
+	// The next request is read correctly after the body line.
+	req, err = cp.readRequest()
+	if err != nil {
+		t.Fatalf("readRequest failed: %v", err)
+	}
+	if req.Command != CmdClose {
+		t.Fatalf("expected close command, got %q", req.Command)
+	}
+}
+
+func TestReadRequestBodySizeMismatch(t *testing.T) {
+	cp, err := NewCacheProg(backends.NewNoop(), locking.NewMemLock(), t.TempDir(), CacheProgOptions{})
+	if err != nil {
+		t.Fatalf("failed to create cache prog: %v", err)
+	}
+	cp.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	input := "{\"ID\":1,\"Command\":\"put\",\"ActionID\":\"AQI=\",\"BodySize\":10}\n\"" +
+		base64.StdEncoding.EncodeToString([]byte("short")) + "\"\n"
+	cp.reader = bufio.NewReader(strings.NewReader(input))
+
+	if _, err := cp.readRequest(); err == nil {
+		t.Fatal("expected size mismatch error")
+	}
+}
+
+func TestHandlePutGetRoundTrip(t *testing.T) {
+	for _, compression := range []string{"none", "lz4", "zstd", "auto"} {
+		t.Run(fmt.Sprintf("compression=%s", compression), func(t *testing.T) {
+			fs, err := backends.NewFS(t.TempDir())
+			if err != nil {
+				t.Fatalf("failed to create fs backend: %v", err)
+			}
+			writer, err := NewCacheProg(fs, locking.NewMemLock(), t.TempDir(),
+				CacheProgOptions{Compression: compression})
+			if err != nil {
+				t.Fatalf("failed to create cache prog: %v", err)
+			}
+			writer.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+			body := bytes.Repeat([]byte("gobuildcache "), 200000)
+			resp, err := writer.handlePut(&Request{
+				ID:       1,
+				Command:  CmdPut,
+				ActionID: []byte{0x01, 0x02},
+				OutputID: []byte{0x03},
+				Body:     bytes.NewReader(body),
+				BodySize: int64(len(body)),
+			})
+			if err != nil {
+				t.Fatalf("handlePut failed: %v", err)
+			}
+			if got, _ := os.ReadFile(resp.DiskPath); !bytes.Equal(got, body) {
+				t.Fatal("local cache file does not match body")
+			}
+
+			// A second instance with an empty local cache is served from the backend.
+			reader, err := NewCacheProg(fs, locking.NewMemLock(), t.TempDir(),
+				CacheProgOptions{Compression: compression})
+			if err != nil {
+				t.Fatalf("failed to create cache prog: %v", err)
+			}
+			reader.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+			resp, err = reader.handleGet(&Request{ID: 2, Command: CmdGet, ActionID: []byte{0x01, 0x02}})
+			if err != nil || resp.Miss {
+				t.Fatalf("expected backend hit, miss=%v err=%v", resp.Miss, err)
+			}
+			if got, _ := os.ReadFile(resp.DiskPath); !bytes.Equal(got, body) {
+				t.Fatal("backend round trip does not match body")
+			}
+		})
+	}
+}
+
+func TestHandleGetMixedCompression(t *testing.T) {
+	fs, err := backends.NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+
+	// Every instance reads whatever the others wrote, whatever its own setting.
+	var (
+		modes  = []string{"none", "lz4", "zstd"}
+		bodies = make(map[string][]byte)
+	)
+	for i, mode := range modes {
+		writer, err := NewCacheProg(fs, locking.NewMemLock(), t.TempDir(), CacheProgOptions{Compression: mode})
+		if err != nil {
+			t.Fatalf("failed to create cache prog: %v", err)
+		}
+		writer.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+		body := bytes.Repeat([]byte(mode+" output "), 10000)
+		bodies[mode] = body
+		if _, err := writer.handlePut(&Request{
+			ID:       int64(i),
+			Command:  CmdPut,
+			ActionID: []byte(mode),
+			OutputID: []byte{0x03},
+			Body:     bytes.NewReader(body),
+			BodySize: int64(len(body)),
+		}); err != nil {
+			t.Fatalf("handlePut failed: %v", err)
+		}
+
+		_, stored, _, _, encoding, _, err := fs.Get(t.Context(), writer.generateBackendKey([]byte(mode)))
+		if err != nil {
+			t.Fatalf("failed to get stored object: %v", err)
+		}
+		stored.Close()
+		if encoding != mode {
+			t.Fatalf("expected object stored with encoding %q, got %q", mode, encoding)
+		}
+	}
+
+	for _, readerMode := range modes {
+		reader, err := NewCacheProg(fs, locking.NewMemLock(), t.TempDir(), CacheProgOptions{Compression: readerMode})
+		if err != nil {
+			t.Fatalf("failed to create cache prog: %v", err)
+		}
+		reader.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+		for _, writerMode := range modes {
+			resp, err := reader.handleGet(&Request{ID: 1, Command: CmdGet, ActionID: []byte(writerMode)})
+			if err != nil || resp.Miss {
+				t.Fatalf("%s reading %s: expected hit, miss=%v err=%v", readerMode, writerMode, resp.Miss, err)
+			}
+			if got, _ := os.ReadFile(resp.DiskPath); !bytes.Equal(got, bodies[writerMode]) {
+				t.Fatalf("%s reading %s: body does not match", readerMode, writerMode)
+			}
+		}
+	}
+}
+
+func TestHandlePutAutoCompressionSkipsIncompressible(t *testing.T) {
+	fs, err := backends.NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	cp, err := NewCacheProg(fs, locking.NewMemLock(), t.TempDir(), CacheProgOptions{Compression: "auto"})
+	if err != nil {
+		t.Fatalf("failed to create cache prog: %v", err)
+	}
+	cp.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	random := make([]byte, 100000)
+	if _, err := rand.New(rand.NewSource(1)).Read(random); err != nil {
+		t.Fatalf("failed to generate body: %v", err)
+	}
+	compressible := bytes.Repeat([]byte("gobuildcache "), 10000)
+	for i, body := range [][]byte{random, compressible} {
+		if _, err := cp.handlePut(&Request{
+			ID:       int64(i),
+			Command:  CmdPut,
+			ActionID: []byte{byte(i)},
+			OutputID: []byte{0x03},
+			Body:     bytes.NewReader(body),
+			BodySize: int64(len(body)),
+		}); err != nil {
+			t.Fatalf("handlePut failed: %v", err)
+		}
+	}
+
+	if cp.compressionSkipped.Load() != 1 {
+		t.Fatalf("expected 1 PUT stored uncompressed, got %d", cp.compressionSkipped.Load())
+	}
+	if cp.compressionBytesIn.Load() != int64(len(compressible)) {
+		t.Fatalf("expected only the compressible body to be compressed, got %d bytes in", cp.compressionBytesIn.Load())
+	}
+	if want := int64(len(random)) + cp.compressionBytesOut.Load(); cp.backendBytesWritten.Load() != want {
+		t.Fatalf("expected %d backend bytes written, got %d", want, cp.backendBytesWritten.Load())
+	}
+}
+
+func TestHandlePutUncompressedFrameLookalike(t *testing.T) {
+	fs, err := backends.NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+
+	// An output that is itself a zstd frame must come back byte for byte, not
+	// decompressed.
+	var frame bytes.Buffer
+	if err := compressTo(&frame, strings.NewReader("inner"), codecZstd, 0, nil); err != nil {
+		t.Fatalf("failed to compress: %v", err)
+	}
+	writer, err := NewCacheProg(fs, locking.NewMemLock(), t.TempDir(), CacheProgOptions{Compression: "none"})
+	if err != nil {
+		t.Fatalf("failed to create cache prog: %v", err)
+	}
+	writer.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	if _, err := writer.handlePut(&Request{
+		ID:       1,
+		Command:  CmdPut,
+		ActionID: []byte{0x01},
+		OutputID: []byte{0x03},
+		Body:     bytes.NewReader(frame.Bytes()),
+		BodySize: int64(frame.Len()),
+	}); err != nil {
+		t.Fatalf("handlePut failed: %v", err)
+	}
+
+	reader, err := NewCacheProg(fs, locking.NewMemLock(), t.TempDir(), CacheProgOptions{Compression: "none"})
+	if err != nil {
+		t.Fatalf("failed to create cache prog: %v", err)
+	}
+	reader.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	resp, err := reader.handleGet(&Request{ID: 2, Command: CmdGet, ActionID: []byte{0x01}})
+	if err != nil || resp.Miss {
+		t.Fatalf("expected backend hit, miss=%v err=%v", resp.Miss, err)
+	}
+	if got, _ := os.ReadFile(resp.DiskPath); !bytes.Equal(got, frame.Bytes()) {
+		t.Fatal("round trip does not match the original frame")
+	}
+}
+
+func TestHandlePutShortBody(t *testing.T) {
+	cp, err := NewCacheProg(backends.NewNoop(), locking.NewMemLock(), t.TempDir(), CacheProgOptions{})
+	if err != nil {
+		t.Fatalf("failed to create cache prog: %v", err)
+	}
+	cp.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	_, err = cp.handlePut(&Request{
+		ID:       1,
+		Command:  CmdPut,
+		ActionID: []byte{0x01},
+		Body:     strings.NewReader("short"),
+		BodySize: 10,
+	})
+	if err == nil {
+		t.Fatal("expected size mismatch error")
+	}
+	if cp.localCache.check([]byte{0x01}) != nil {
+		t.Fatal("expected no local cache entry for a failed PUT")
+	}
+}
+
+// chunkedBackend serves a fixed object whose body is returned a few bytes at a
+// time, like a network stream.
+type chunkedBackend struct {
+	backends.Noop
+	outputID []byte
+	encoding string
+	body     []byte
+}
+
+func (c *chunkedBackend) Get(ctx context.Context, actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, string, bool, error) {
+	now := time.Now()
+	return c.outputID, io.NopCloser(iotest.HalfReader(bytes.NewReader(c.body))), int64(len(c.body)), &now, c.encoding, false, nil
+}
+
+func TestHandleGetStreamsDecompression(t *testing.T) {
+	expected := bytes.Repeat([]byte("streamed "), 100000)
+	var compressed bytes.Buffer
+	if err := compressTo(&compressed, bytes.NewReader(expected), codecLZ4, 0, nil); err != nil {
+		t.Fatalf("failed to compress: %v", err)
+	}
+
+	cp, err := NewCacheProg(&chunkedBackend{outputID: []byte{0x09}, body: compressed.Bytes()}, locking.NewMemLock(), t.TempDir(),
+		CacheProgOptions{Compression: "lz4"})
+	if err != nil {
+		t.Fatalf("failed to create cache prog: %v", err)
+	}
+	cp.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	resp, err := cp.handleGet(&Request{ID: 1, Command: CmdGet, ActionID: []byte{0x01}})
+	if err != nil || resp.Miss {
+		t.Fatalf("expected backend hit, miss=%v err=%v", resp.Miss, err)
+	}
+	if resp.Size != int64(len(expected)) {
+		t.Fatalf("expected decompressed size %d, got %d", len(expected), resp.Size)
+	}
+	if got, _ := os.ReadFile(resp.DiskPath); !bytes.Equal(got, expected) {
+		t.Fatal("local cache file does not match decompressed body")
+	}
+	if meta := cp.localCache.check([]byte{0x01}); meta == nil || meta.Size != int64(len(expected)) {
+		t.Fatalf("unexpected local cache metadata: %+v", meta)
+	}
+	if cp.decompressionBytesIn.Load() != int64(compressed.Len()) || cp.decompressionBytesOut.Load() != int64(len(expected)) {
+		t.Fatalf("unexpected decompression stats: in=%d out=%d",
+			cp.decompressionBytesIn.Load(), cp.decompressionBytesOut.Load())
+	}
+	if stats, err := cp.latencyTracker.GetStats("get_decompression"); err != nil || stats.Count != 1 {
+		t.Fatalf("expected 1 get_decompression latency, got %+v err=%v", stats, err)
+	}
+}
+
+func TestHandleGetCorruptCompressedBody(t *testing.T) {
+	body := append(bytes.Clone(lz4FrameMagic), "not lz4 at all"...)
+	for _, policy := range []string{"miss", "fail"} {
+		cp, err := NewCacheProg(&chunkedBackend{outputID: []byte{0x09}, body: body}, locking.NewMemLock(), t.TempDir(),
+			CacheProgOptions{Compression: "lz4", BackendErrorPolicy: policy})
+		if err != nil {
+			t.Fatalf("failed to create cache prog: %v", err)
+		}
+		cp.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+		resp, err := cp.handleGet(&Request{ID: 1, Command: CmdGet, ActionID: []byte{0x01}})
+		if policy == "miss" && (err != nil || !resp.Miss) {
+			t.Fatalf("expected miss for corrupt compressed body, miss=%v err=%v", resp.Miss, err)
+		}
+		if policy == "fail" && err == nil {
+			t.Fatal("expected error for corrupt compressed body")
+		}
+		if cp.decodeErrors.Load() != 1 || cp.backendGetErrors.Load() != 0 || cp.localWriteErrors.Load() != 0 {
+			t.Fatalf("%s: expected a single decode error, got backend=%d decode=%d local=%d", policy,
+				cp.backendGetErrors.Load(), cp.decodeErrors.Load(), cp.localWriteErrors.Load())
+		}
+		if cp.localCache.check([]byte{0x01}) != nil {
+			t.Fatal("expected no local cache entry for a corrupt body")
+		}
+	}
+}
+
+func TestHandleGetLocalWriteFailure(t *testing.T) {
+	for _, policy := range []string{"miss", "fail"} {
+		cp, err := NewCacheProg(&chunkedBackend{outputID: []byte{0x09}, encoding: "none", body: []byte("output")}, locking.NewMemLock(), t.TempDir(),
+			CacheProgOptions{BackendErrorPolicy: policy})
+		if err != nil {
+			t.Fatalf("failed to create cache prog: %v", err)
+		}
+		cp.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+		// A file in place of the shard directory makes every write to it fail.
+		shard := filepath.Join(cp.localCache.cacheDir, "01")
+		if err := os.RemoveAll(shard); err != nil {
+			t.Fatalf("failed to remove shard directory: %v", err)
+		}
+		if err := os.WriteFile(shard, nil, 0644); err != nil {
+			t.Fatalf("failed to replace shard directory: %v", err)
+		}
+
+		resp, err := cp.handleGet(&Request{ID: 1, Command: CmdGet, ActionID: []byte{0x01}})
+		if policy == "miss" && (err != nil || !resp.Miss || resp.Err != "") {
+			t.Fatalf("expected clean miss, miss=%v resp.Err=%q err=%v", resp.Miss, resp.Err, err)
+		}
+		if policy == "fail" && (err == nil || resp.Err == "") {
+			t.Fatalf("expected error response, resp.Err=%q err=%v", resp.Err, err)
+		}
+		if cp.localWriteErrors.Load() != 1 || cp.backendGetErrors.Load() != 0 || cp.decodeErrors.Load() != 0 {
+			t.Fatalf("%s: expected a single local write error, got backend=%d decode=%d local=%d", policy,
+				cp.backendGetErrors.Load(), cp.decodeErrors.Load(), cp.localWriteErrors.Load())
+		}
+		if cp.backendCacheHits.Load() != 0 {
+			t.Fatalf("%s: expected no backend hit to be counted, got %d", policy, cp.backendCacheHits.Load())
+		}
+	}
+}
+
+func TestHandleGetBackendErrorUnderFailPolicy(t *testing.T) {
+	cp, err := NewCacheProg(backends.NewError(backends.NewNoop(), 1.0), locking.NewMemLock(), t.TempDir(),
+		CacheProgOptions{BackendErrorPolicy: "fail"})
+	if err != nil {
+		t.Fatalf("failed to create cache prog: %v", err)
+	}
+	cp.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	resp, err := cp.handleGet(&Request{ID: 1, Command: CmdGet, ActionID: []byte{0x01}})
+	if err == nil || resp.Err == "" || !resp.Miss {
+		t.Fatalf("expected error response, miss=%v resp.Err=%q err=%v", resp.Miss, resp.Err, err)
+	}
+	if cp.backendGetErrors.Load() != 1 || cp.decodeErrors.Load() != 0 || cp.localWriteErrors.Load() != 0 {
+		t.Fatalf("expected a single backend GET error, got backend=%d decode=%d local=%d",
+			cp.backendGetErrors.Load(), cp.decodeErrors.Load(), cp.localWriteErrors.Load())
+	}
+}
+
+// timeoutLocker fails to acquire every lock, like an FSLockGroup whose locks
+// are all held by another process.
+type timeoutLocker struct{}
+
+func (timeoutLocker) DoWithLock(key string, fn func() (interface{}, error)) (interface{}, error) {
+	return nil, fmt.Errorf("%w: timeout", locking.ErrLockNotAcquired)
+}
+
+func TestHandleGetLockFailure(t *testing.T) {
+	for _, policy := range []string{"miss", "fail"} {
+		cp, err := NewCacheProg(backends.NewNoop(), timeoutLocker{}, t.TempDir(),
+			CacheProgOptions{BackendErrorPolicy: policy})
+		if err != nil {
+			t.Fatalf("failed to create cache prog: %v", err)
+		}
+		cp.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+		resp, err := cp.handleGet(&Request{ID: 1, Command: CmdGet, ActionID: []byte{0x01}})
+		if policy == "miss" && (err != nil || !resp.Miss || resp.Err != "") {
+			t.Fatalf("expected clean miss, miss=%v resp.Err=%q err=%v", resp.Miss, resp.Err, err)
+		}
+		if policy == "fail" && (err == nil || resp.Err == "") {
+			t.Fatalf("expected error response, resp.Err=%q err=%v", resp.Err, err)
+		}
+		if cp.lockErrors.Load() != 1 || cp.backendGetErrors.Load() != 0 {
+			t.Fatalf("%s: expected a single lock error, got lock=%d backend=%d", policy,
+				cp.lockErrors.Load(), cp.backendGetErrors.Load())
+		}
+	}
+}
+
+func TestHandleGetDecodesByStoredEncoding(t *testing.T) {
+	// A raw output that happens to look like an LZ4 frame is only stored raw
+	// by writers that record the encoding, so it mustn't be decompressed.
+	body := append(bytes.Clone(lz4FrameMagic), "raw output"...)
+	cp, err := NewCacheProg(&chunkedBackend{outputID: []byte{0x09}, encoding: "none", body: body}, locking.NewMemLock(), t.TempDir(),
+		CacheProgOptions{Compression: "lz4"})
+	if err != nil {
+		t.Fatalf("failed to create cache prog: %v", err)
+	}
+	cp.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	resp, err := cp.handleGet(&Request{ID: 1, Command: CmdGet, ActionID: []byte{0x01}})
+	if err != nil || resp.Miss {
+		t.Fatalf("expected backend hit, miss=%v err=%v", resp.Miss, err)
+	}
+	if got, _ := os.ReadFile(resp.DiskPath); !bytes.Equal(got, body) {
+		t.Fatalf("expected raw body, got %q", got)
+	}
+
+	// Encodings from newer versions are misses rather than errors.
+	cp, err = NewCacheProg(&chunkedBackend{outputID: []byte{0x09}, encoding: "brotli", body: body}, locking.NewMemLock(), t.TempDir(),
+		CacheProgOptions{})
+	if err != nil {
+		t.Fatalf("failed to create cache prog: %v", err)
+	}
+	cp.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	resp, err = cp.handleGet(&Request{ID: 2, Command: CmdGet, ActionID: []byte{0x01}})
+	if err != nil || !resp.Miss {
+		t.Fatalf("expected miss for unknown encoding, miss=%v err=%v", resp.Miss, err)
+	}
+	if cp.localCache.check([]byte{0x01}) != nil {
+		t.Fatal("expected no local cache entry for an unknown encoding")
+	}
+}
+
+func TestHandleGetCorruptBackendEntryIsMiss(t *testing.T) {
+	root := t.TempDir()
+	fs, err := backends.NewFS(root)
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	writer, err := NewCacheProg(fs, locking.NewMemLock(), t.TempDir(), CacheProgOptions{})
+	if err != nil {
+		t.Fatalf("failed to create cache prog: %v", err)
+	}
+	writer.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	body := []byte("some build output")
+	if _, err := writer.handlePut(&Request{
+		ID:       1,
+		Command:  CmdPut,
+		ActionID: []byte{0x01, 0x02},
+		OutputID: []byte{0x03},
+		Body:     bytes.NewReader(body),
+		BodySize: int64(len(body)),
+	}); err != nil {
+		t.Fatalf("handlePut failed: %v", err)
+	}
+
+	// Flip the last byte of the stored object.
+	var objectPath string
+	if err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			objectPath = path
+		}
+		return err
+	}); err != nil || objectPath == "" {
+		t.Fatalf("failed to find stored object: %v", err)
+	}
+	data, _ := os.ReadFile(objectPath)
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(objectPath, data, 0644); err != nil {
+		t.Fatalf("failed to corrupt object: %v", err)
+	}
+
+	reader, err := NewCacheProg(fs, locking.NewMemLock(), t.TempDir(), CacheProgOptions{})
+	if err != nil {
+		t.Fatalf("failed to create cache prog: %v", err)
+	}
+	reader.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	resp, err := reader.handleGet(&Request{ID: 2, Command: CmdGet, ActionID: []byte{0x01, 0x02}})
+	if err != nil || !resp.Miss {
+		t.Fatalf("expected miss for corrupt entry, miss=%v err=%v", resp.Miss, err)
+	}
+	if got := reader.corruptBackend.Load(); got != 1 {
+		t.Fatalf("expected 1 corrupt backend entry, got %d", got)
+	}
+	if reader.localCache.check([]byte{0x01, 0x02}) != nil {
+		t.Fatal("expected no local cache entry for a corrupt body")
+	}
+}
+
+func TestHandleGetEncryptedBackend(t *testing.T) {
+	fs, err := backends.NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	keys := []backends.EncryptionKey{{ID: "k1", Key: bytes.Repeat([]byte{1}, 32)}}
+	encrypted, err := backends.NewEncrypt(fs, keys)
+	if err != nil {
+		t.Fatalf("failed to create encrypt backend: %v", err)
+	}
+
+	writer, err := NewCacheProg(encrypted, locking.NewMemLock(), t.TempDir(), CacheProgOptions{Compression: "zstd"})
+	if err != nil {
+		t.Fatalf("failed to create cache prog: %v", err)
+	}
+	writer.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	body := bytes.Repeat([]byte("some build output "), 1000)
+	if _, err := writer.handlePut(&Request{
+		ID:       1,
+		Command:  CmdPut,
+		ActionID: []byte{0x01, 0x02},
+		OutputID: []byte{0x03},
+		Body:     bytes.NewReader(body),
+		BodySize: int64(len(body)),
+	}); err != nil {
+		t.Fatalf("handlePut failed: %v", err)
+	}
+
+	reader, err := NewCacheProg(encrypted, locking.NewMemLock(), t.TempDir(), CacheProgOptions{})
+	if err != nil {
+		t.Fatalf("failed to create cache prog: %v", err)
+	}
+	reader.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	resp, err := reader.handleGet(&Request{ID: 2, Command: CmdGet, ActionID: []byte{0x01, 0x02}})
+	if err != nil || resp.Miss {
+		t.Fatalf("expected backend hit, miss=%v err=%v", resp.Miss, err)
+	}
+	if got, _ := os.ReadFile(resp.DiskPath); !bytes.Equal(got, body) {
+		t.Fatal("encrypted round trip does not match body")
+	}
+
+	// Swap in a body that fails authentication, with a valid checksum.
+	backendKey := writer.generateBackendKey([]byte{0x01, 0x02})
+	outputID, stored, size, _, encoding, _, err := fs.Get(t.Context(), backendKey)
+	if err != nil {
+		t.Fatalf("failed to get stored object: %v", err)
+	}
+	data, _ := io.ReadAll(stored)
+	stored.Close()
+	data[0] ^= 1
+	if err := fs.Put(t.Context(), backendKey, outputID, encoding, bytes.NewReader(data), size); err != nil {
+		t.Fatalf("failed to put: %v", err)
+	}
+
+	reader, err = NewCacheProg(encrypted, locking.NewMemLock(), t.TempDir(), CacheProgOptions{})
+	if err != nil {
+		t.Fatalf("failed to create cache prog: %v", err)
+	}
+	reader.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	resp, err = reader.handleGet(&Request{ID: 3, Command: CmdGet, ActionID: []byte{0x01, 0x02}})
+	if err != nil || !resp.Miss {
+		t.Fatalf("expected miss for a body that fails authentication, miss=%v err=%v", resp.Miss, err)
+	}
+	if got := reader.corruptBackend.Load(); got != 1 {
+		t.Fatalf("expected 1 corrupt backend entry, got %d", got)
+	}
+}
+
+func TestHandleGetSignedBackend(t *testing.T) {
+	fs, err := backends.NewFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create fs backend: %v", err)
+	}
+	keys := []backends.SigningKey{{ID: "s1", Key: bytes.Repeat([]byte{1}, 32)}}
+	signed, err := backends.NewSign(fs, keys)
+	if err != nil {
+		t.Fatalf("failed to create sign backend: %v", err)
+	}
+
+	writer, err := NewCacheProg(signed, locking.NewMemLock(), t.TempDir(), CacheProgOptions{Compression: "zstd"})
+	if err != nil {
+		t.Fatalf("failed to create cache prog: %v", err)
+	}
+	writer.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	body := bytes.Repeat([]byte("some build output "), 1000)
+	if _, err := writer.handlePut(&Request{
+		ID:       1,
+		Command:  CmdPut,
+		ActionID: []byte{0x01, 0x02},
+		OutputID: []byte{0x03},
+		Body:     bytes.NewReader(body),
+		BodySize: int64(len(body)),
+	}); err != nil {
+		t.Fatalf("handlePut failed: %v", err)
+	}
+
+	reader, err := NewCacheProg(signed, locking.NewMemLock(), t.TempDir(), CacheProgOptions{})
+	if err != nil {
+		t.Fatalf("failed to create cache prog: %v", err)
+	}
+	reader.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	resp, err := reader.handleGet(&Request{ID: 2, Command: CmdGet, ActionID: []byte{0x01, 0x02}})
+	if err != nil || resp.Miss {
+		t.Fatalf("expected backend hit, miss=%v err=%v", resp.Miss, err)
+	}
+	if got, _ := os.ReadFile(resp.DiskPath); !bytes.Equal(got, body) {
+		t.Fatal("signed round trip does not match body")
+	}
+
+	// Plant an object written without the key, and one with a swapped body.
+	if err := fs.Put(t.Context(), writer.generateBackendKey([]byte{0x04}), []byte{0x05}, "none", strings.NewReader("evil"), 4); err != nil {
+		t.Fatalf("failed to put: %v", err)
+	}
+	backendKey := writer.generateBackendKey([]byte{0x01, 0x02})
+	outputID, stored, size, _, encoding, _, err := fs.Get(t.Context(), backendKey)
+	if err != nil {
+		t.Fatalf("failed to get stored object: %v", err)
+	}
+	data, _ := io.ReadAll(stored)
+	stored.Close()
+	data[0] ^= 1
+	if err := fs.Put(t.Context(), backendKey, outputID, encoding, bytes.NewReader(data), size); err != nil {
+		t.Fatalf("failed to put: %v", err)
+	}
+
+	reader, err = NewCacheProg(signed, locking.NewMemLock(), t.TempDir(), CacheProgOptions{})
+	if err != nil {
+		t.Fatalf("failed to create cache prog: %v", err)
+	}
+	reader.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	for i, actionID := range [][]byte{{0x04}, {0x01, 0x02}} {
+		resp, err = reader.handleGet(&Request{ID: int64(3 + i), Command: CmdGet, ActionID: actionID})
+		if err != nil || !resp.Miss {
+			t.Fatalf("expected miss for %x, miss=%v err=%v", actionID, resp.Miss, err)
+		}
+	}
+	// Rejects are counted apart from corruption.
+	if got := reader.corruptBackend.Load(); got != 0 {
+		t.Fatalf("expected no corrupt backend entries, got %d", got)
+	}
+	sign, ok := findBackend[*backends.Sign](reader.backend)
+	if !ok {
+		t.Fatal("expected to find the sign wrapper")
+	}
+	if stats := sign.Stats(); stats.Unsigned != 1 || stats.BadSignatures != 1 {
+		t.Fatalf("expected 1 unsigned and 1 badly signed entry, got %+v", stats)
+	}
+}
+
+func TestBackendRetriesAreCounted(t *testing.T) {
+	retry := backends.NewRetry(backends.NewError(backends.NewNoop(), 1.0),
+		backends.RetryOptions{MaxAttempts: 3, BaseDelay: time.Millisecond},
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	cp, err := NewCacheProg(retry, locking.NewMemLock(), t.TempDir(), CacheProgOptions{})
+	if err != nil {
+		t.Fatalf("failed to create cache prog: %v", err)
+	}
+	cp.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	if resp, err := cp.handleGet(&Request{ID: 1, Command: CmdGet, ActionID: []byte{0x01}}); err != nil || !resp.Miss {
+		t.Fatalf("expected miss once retries are exhausted, miss=%v err=%v", resp.Miss, err)
+	}
+	if cp.backendGetErrors.Load() != 1 {
+		t.Fatalf("expected 1 backend GET error, got %d", cp.backendGetErrors.Load())
+	}
+	if got, total := cp.retriedRequests.Load(), cp.totalRetries.Load(); got != 1 || total != 2 {
+		t.Fatalf("expected 1 retried request with 2 retries, got %d with %d", got, total)
+	}
+}
+
+func TestHandleGetOpenCircuitServesMisses(t *testing.T) {
+	breaker := backends.NewCircuitBreaker(backends.NewError(backends.NewNoop(), 1.0),
+		backends.CircuitBreakerOptions{Failures: 2, CoolDown: time.Hour},
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	cp, err := NewCacheProg(breaker, locking.NewMemLock(), t.TempDir(), CacheProgOptions{})
+	if err != nil {
+		t.Fatalf("failed to create cache prog: %v", err)
+	}
+	cp.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	for i := int64(1); i <= 3; i++ {
+		resp, err := cp.handleGet(&Request{ID: i, Command: CmdGet, ActionID: []byte{byte(i)}})
+		if err != nil || !resp.Miss {
+			t.Fatalf("expected miss, miss=%v err=%v", resp.Miss, err)
+		}
+	}
+	// Only the GETs before the circuit opened reached the backend.
+	if got := cp.backendGetErrors.Load(); got != 2 {
+		t.Fatalf("expected 2 backend GET errors, got %d", got)
+	}
+	if stats := breaker.Stats(); stats.Trips != 1 || stats.ShortCircuited != 1 {
+		t.Fatalf("unexpected circuit breaker stats: %+v", stats)
+	}
+}
+
+func TestHedgeDelayFollowsBackendLatency(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	hedge := backends.NewHedge(backends.NewNoop(), backends.HedgeOptions{}, logger)
+	cp, err := NewCacheProg(backends.NewRetry(hedge, backends.RetryOptions{MaxAttempts: 2}, logger), locking.NewMemLock(), t.TempDir(),
+		CacheProgOptions{})
+	if err != nil {
+		t.Fatalf("failed to create cache prog: %v", err)
+	}
+	cp.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	if found, _ := findBackend[*backends.Hedge](cp.backend); found != hedge {
+		t.Fatal("expected to find the hedge wrapper under the retry wrapper")
+	}
+
+	if _, ok := cp.hedgeDelay(); ok {
+		t.Fatal("expected no hedge delay without backend GET latencies")
+	}
+	for range hedgeMinSamples {
+		cp.latencyTracker.Record("get_backend", 10*time.Millisecond)
+	}
+	if delay, ok := cp.hedgeDelay(); !ok || delay < 9*time.Millisecond || delay > 11*time.Millisecond {
+		t.Fatalf("expected a hedge delay of about 10ms, got %v (ok=%v)", delay, ok)
+	}
+}
+
+// stallingBackend serves a body that stalls halfway through until the GET's
+// context is done, like a connection that hangs mid-download.
+type stallingBackend struct {
+	backends.Noop
+}
+
+func (s *stallingBackend) Get(ctx context.Context, actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, string, bool, error) {
+	now := time.Now()
+	body := io.MultiReader(strings.NewReader("partial"), &stalledReader{ctx: ctx})
+	return []byte{0x09}, io.NopCloser(body), 100, &now, "", false, nil
+}
+
+type stalledReader struct {
+	ctx context.Context
+}
+
+func (s *stalledReader) Read([]byte) (int, error) {
+	<-s.ctx.Done()
+	return 0, s.ctx.Err()
+}
+
+func TestHandleGetTimeoutServesMiss(t *testing.T) {
+	cp, err := NewCacheProg(&stallingBackend{}, locking.NewMemLock(), t.TempDir(),
+		CacheProgOptions{GetTimeout: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("failed to create cache prog: %v", err)
+	}
+	cp.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	start := time.Now()
+	resp, err := cp.handleGet(&Request{ID: 1, Command: CmdGet, ActionID: []byte{0x01}})
+	if err != nil || !resp.Miss {
+		t.Fatalf("expected miss once the GET timed out, miss=%v err=%v", resp.Miss, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected the GET to time out, took %v", elapsed)
+	}
+	if cp.decodeErrors.Load() != 1 {
+		t.Fatalf("expected the stalled body to count as a decode error, got %d", cp.decodeErrors.Load())
+	}
+	if cp.localCache.check([]byte{0x01}) != nil {
+		t.Fatal("expected no local cache entry for a timed out GET")
+	}
+}
+
+func TestHandleGetVerifiesLocalHits(t *testing.T) {
+	cp, err := NewCacheProg(backends.NewNoop(), locking.NewMemLock(), t.TempDir(),
+		CacheProgOptions{VerifyLocalHits: true})
+	if err != nil {
+		t.Fatalf("failed to create cache prog: %v", err)
+	}
+	cp.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	body := []byte("some build output")
+	resp, err := cp.handlePut(&Request{
+		ID:       1,
+		Command:  CmdPut,
+		ActionID: []byte{0x01},
+		OutputID: []byte{0x02},
+		Body:     bytes.NewReader(body),
+		BodySize: int64(len(body)),
+	})
+	if err != nil {
+		t.Fatalf("handlePut failed: %v", err)
+	}
+
+	// An intact entry is served.
+	if resp, err := cp.handleGet(&Request{ID: 2, Command: CmdGet, ActionID: []byte{0x01}}); err != nil || resp.Miss {
+		t.Fatalf("expected local hit, miss=%v err=%v", resp.Miss, err)
+	}
+
+	// A bit-flipped entry is quarantined and becomes a miss.
+	if err := os.WriteFile(resp.DiskPath, []byte("some build outpuT"), 0644); err != nil {
+		t.Fatalf("failed to corrupt entry: %v", err)
+	}
+	resp, err = cp.handleGet(&Request{ID: 3, Command: CmdGet, ActionID: []byte{0x01}})
+	if err != nil || !resp.Miss {
+		t.Fatalf("expected miss for corrupt entry, miss=%v err=%v", resp.Miss, err)
+	}
+	if got := cp.localCache.quarantined.Load(); got != 1 {
+		t.Fatalf("expected 1 quarantined entry, got %d", got)
+	}
+	if cp.localCache.check([]byte{0x01}) != nil {
+		t.Fatal("expected corrupt entry to be removed from the local cache")
+	}
+}